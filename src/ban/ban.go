@@ -0,0 +1,151 @@
+package ban
+
+import (
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// BlockLength is the size of the blocks whose senders are remembered
+const BlockLength = 16 * 1024
+
+// List holds the addresses peers can't connect from or be connected to
+type List struct {
+	mu      sync.Mutex
+	entries map[string]time.Time // expiry of each address, zero for never
+	now     func() time.Time
+}
+
+func NewList() *List {
+	return &List{entries: make(map[string]time.Time), now: time.Now}
+}
+
+// Ban bans ip for d, or for good if d is zero
+func (l *List) Ban(ip net.IP, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var expiry time.Time
+	if d > 0 {
+		expiry = l.now().Add(d)
+	}
+	l.entries[ip.String()] = expiry
+}
+
+func (l *List) Unban(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, ip.String())
+}
+
+// Banned reports whether ip is banned, a nil list bans nobody
+func (l *List) Banned(ip net.IP) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expiry, ok := l.entries[ip.String()]
+	if ok && !expiry.IsZero() && !l.now().Before(expiry) {
+		delete(l.entries, ip.String())
+		return false
+	}
+	return ok
+}
+
+// Entries returns the banned addresses with their expiry, zero for never
+func (l *List) Entries() map[string]time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make(map[string]time.Time, len(l.entries))
+	now := l.now()
+	for ip, expiry := range l.entries {
+		if expiry.IsZero() || now.Before(expiry) {
+			entries[ip] = expiry
+		}
+	}
+	return entries
+}
+
+// SmartBan remembers who sent each block of the pieces that failed their
+// hash check. Once a piece passes, the peers whose blocks differ from
+// the good ones are the ones that sent bad data.
+type SmartBan struct {
+	mu     sync.Mutex
+	pieces map[int]map[string][][20]byte // hash of the blocks each address sent
+}
+
+func NewSmartBan() *SmartBan {
+	return &SmartBan{pieces: make(map[int]map[string][][20]byte)}
+}
+
+// Failed records the data of a piece that failed its hash check, block i
+// of which was sent by senders[i]
+func (s *SmartBan) Failed(piece int, data []byte, senders []net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bySender, ok := s.pieces[piece]
+	if !ok {
+		bySender = make(map[string][][20]byte)
+		s.pieces[piece] = bySender
+	}
+	for i, block := range blocks(data) {
+		if i >= len(senders) {
+			break
+		}
+		hashes := bySender[senders[i].String()]
+		for len(hashes) <= i {
+			hashes = append(hashes, [20]byte{})
+		}
+		hashes[i] = sha1.Sum(block)
+		bySender[senders[i].String()] = hashes
+	}
+}
+
+// Sent reports whether ip sent blocks of a failed download of the piece
+func (s *SmartBan) Sent(piece int, ip net.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.pieces[piece][ip.String()]
+	return ok
+}
+
+// Passed takes the data of the piece that passed its hash check and
+// returns the addresses that sent a different block, the piece is then
+// forgotten
+func (s *SmartBan) Passed(piece int, data []byte) []net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bySender, ok := s.pieces[piece]
+	if !ok {
+		return nil
+	}
+	delete(s.pieces, piece)
+	good := blocks(data)
+	var bad []net.IP
+	for sender, hashes := range bySender {
+		for i, hash := range hashes {
+			if hash != [20]byte{} && i < len(good) && hash != sha1.Sum(good[i]) {
+				bad = append(bad, net.ParseIP(sender))
+				break
+			}
+		}
+	}
+	return bad
+}
+
+// Forget drops what was recorded about a piece given up on, its senders
+// can't be told apart anymore
+func (s *SmartBan) Forget(piece int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pieces, piece)
+}
+
+func blocks(data []byte) [][]byte {
+	var split [][]byte
+	for start := 0; start < len(data); start += BlockLength {
+		split = append(split, data[start:min(start+BlockLength, len(data))])
+	}
+	return split
+}
@@ -0,0 +1,63 @@
+package ban
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListExpiry(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewList()
+	l.now = func() time.Time { return now }
+	temporary := net.ParseIP("10.0.0.1")
+	permanent := net.ParseIP("10.0.0.2")
+	l.Ban(temporary, time.Hour)
+	l.Ban(permanent, 0)
+	if !l.Banned(temporary) || !l.Banned(permanent) || l.Banned(net.ParseIP("10.0.0.3")) {
+		t.Fatalf("expected exactly the two addresses to be banned")
+	}
+	now = now.Add(2 * time.Hour)
+	if l.Banned(temporary) {
+		t.Errorf("expected the ban to expire")
+	}
+	if !l.Banned(permanent) || len(l.Entries()) != 1 {
+		t.Errorf("expected the permanent ban to stay")
+	}
+	l.Unban(permanent)
+	if l.Banned(permanent) {
+		t.Errorf("expected the address to be unbanned")
+	}
+	var none *List
+	if none.Banned(permanent) {
+		t.Errorf("expected a nil list to ban nobody")
+	}
+}
+
+func TestSmartBan(t *testing.T) {
+	good := bytes.Repeat([]byte("g"), 3*BlockLength)
+	bad := bytes.Clone(good)
+	bad[BlockLength+10] = 'b'
+	honest := net.ParseIP("10.0.0.1")
+	liar := net.ParseIP("10.0.0.2")
+
+	s := NewSmartBan()
+	// The liar only sent the middle block
+	s.Failed(0, bad, []net.IP{honest, liar, honest})
+	if !s.Sent(0, liar) || !s.Sent(0, honest) || s.Sent(1, liar) {
+		t.Errorf("expected both senders to be recorded for piece 0 only")
+	}
+	banned := s.Passed(0, good)
+	if len(banned) != 1 || !banned[0].Equal(liar) {
+		t.Errorf("expected only the liar to be banned, got %v", banned)
+	}
+	if s.Sent(0, liar) || s.Passed(0, good) != nil {
+		t.Errorf("expected the piece to be forgotten once it passed")
+	}
+	s.Failed(1, bad, []net.IP{honest, liar, honest})
+	s.Forget(1)
+	if s.Sent(1, liar) || s.Passed(1, good) != nil {
+		t.Errorf("expected the piece to be forgotten once given up on")
+	}
+}
@@ -1,28 +1,148 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/samir-adh/bytetorrent/src/log"
-	"github.com/samir-adh/bytetorrent/src/torrentclient"
+	"github.com/samir-adh/bytetorrent/src/rpc"
+	"github.com/samir-adh/bytetorrent/src/session"
+	"github.com/samir-adh/bytetorrent/src/tui"
 	"github.com/ztrue/tracerr"
 )
 
+// stringList collects the values of a flag given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch name := os.Args[1]; name {
+		case "serve":
+			serve(os.Args[2:])
+			return
+		case "daemon":
+			daemon(os.Args[2:])
+			return
+		default:
+			if _, ok := remoteCommands[name]; ok {
+				remote(name, os.Args[2:])
+				return
+			}
+		}
+	}
 	defaultFilepath := "./test-env/torrents/test.torrent"
 	filepath := flag.String("f", defaultFilepath, "Torrent file to download")
-	verbose := flag.Bool("v", false, "Enable verbose output mode")
+	openSession := sessionFlags(flag.CommandLine)
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "Time given to a clean shutdown on SIGINT or SIGTERM")
+	var only stringList
+	flag.Var(&only, "only", "Only download the files matching this glob, can be repeated")
+	fullScreen := flag.Bool("tui", true, "Show the full-screen display when the output is a terminal")
+	stay := flag.Bool("stay", false, "Keep the full-screen display once the downloads complete, until q is pressed")
 	flag.Parse()
-	verboseLevel := log.LowVerbose
-	if *verbose {
-		verboseLevel = log.HighVerbose
-	}
-	logger := log.Logger{Verbose: verboseLevel}
-	client, err := torrentclient.New(*filepath, &logger)
-	if err != nil {
-		tracerr.Print(err)
+	torrentSession, config, logger := openSession()
+	defer torrentSession.Close()
+	// Torrents can also be given as arguments
+	paths := flag.Args()
+	if len(paths) == 0 {
+		paths = []string{*filepath}
+	}
+	for _, path := range paths {
+		torrent, err := torrentSession.AddFile(path, config, false)
+		if err != nil {
+			tracerr.Print(err)
+			os.Exit(1)
+		}
+		if len(only) > 0 {
+			selected, err := torrent.Client.SelectFiles(only)
+			if err != nil {
+				tracerr.Print(err)
+				os.Exit(1)
+			}
+			if selected == 0 {
+				fmt.Fprintf(os.Stderr, "no file of %s matches %s\n", path, only.String())
+				os.Exit(1)
+			}
+		}
+		torrentSession.Resume(torrent.Client.InfoHash)
+	}
+	// Stop cleanly on SIGINT or SIGTERM, keeping what was downloaded
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	done := make(chan struct{})
+	go func() {
+		torrentSession.Wait()
+		close(done)
+	}()
+	// With -stay, the full-screen display stays until the user quits, since
+	// torrents can be paused and resumed from it
+	var finished <-chan struct{} = done
+	var dashboard *tui.TUI
+	if *fullScreen && tui.Supported() {
+		dashboard = tui.New(rpc.NewServer(torrentSession, config), logger)
+		if err := dashboard.Start(); err != nil {
+			logger.Printf(log.LowVerbose, "could not start the full-screen display: %s\n", err)
+			dashboard = nil
+		} else if *stay {
+			finished = nil
+		}
+	}
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	defer stopProgress()
+	var progress sync.WaitGroup
+	if dashboard == nil {
+		progress.Go(func() { showProgress(progressCtx, torrentSession, logger) })
+	}
+	select {
+	case <-finished:
+		dashboard.Stop()
+		stopProgress()
+		progress.Wait()
+	case <-dashboard.Quit():
+		dashboard.Stop()
+		logger.Printf(log.LowVerbose, "shutting down\n")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := torrentSession.Shutdown(shutdownCtx); err != nil {
+			fmt.Fprintf(os.Stderr, "shutdown didn't complete in %s\n", *shutdownTimeout)
+		}
+	case <-ctx.Done():
+		dashboard.Stop()
+		stopProgress()
+		progress.Wait()
+		stopSignals()
+		logger.Printf(log.LowVerbose, "shutting down, interrupt again to exit immediately\n")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := torrentSession.Shutdown(shutdownCtx); err != nil {
+			fmt.Fprintf(os.Stderr, "shutdown didn't complete in %s\n", *shutdownTimeout)
+		}
+		os.Exit(1)
+	}
+	failed := false
+	for _, torrent := range torrentSession.Torrents() {
+		if torrent.State() == session.Failed {
+			tracerr.Print(torrent.Err())
+			failed = true
+		}
+	}
+	if failed {
+		torrentSession.Close()
 		os.Exit(1)
 	}
-	client.Download()
 }
@@ -0,0 +1,225 @@
+package connlimit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"sync"
+)
+
+// Pool bounds the number of open connections. When it is full a new
+// connection can take the slot of the one with the lowest priority.
+type Pool struct {
+	mu    sync.Mutex
+	max   int // no limit when zero
+	slots map[*Slot]struct{}
+	freed chan struct{} // closed when a slot is released
+}
+
+// Slot is held by a connection of a Pool
+type Slot struct {
+	pool     *Pool
+	priority uint32
+	evict    func()
+}
+
+func NewPool(max int) *Pool {
+	return &Pool{max: max, slots: make(map[*Slot]struct{}), freed: make(chan struct{})}
+}
+
+// SetMax changes the size of the pool, connections over the new size are
+// kept until they close.
+func (p *Pool) SetMax(max int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.max = max
+	p.signal()
+}
+
+// Len returns the number of slots in use
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.slots)
+}
+
+// signal wakes up Acquire, p.mu must be held
+func (p *Pool) signal() {
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
+
+func (p *Pool) full() bool {
+	return p.max > 0 && len(p.slots) >= p.max
+}
+
+func (p *Pool) add(priority uint32, evict func()) *Slot {
+	slot := &Slot{pool: p, priority: priority, evict: evict}
+	p.slots[slot] = struct{}{}
+	return slot
+}
+
+// Acquire waits for a free slot, it returns false if quit is closed
+// first. evict is called if a connection of higher priority takes the slot.
+func (p *Pool) Acquire(priority uint32, evict func(), quit <-chan bool) (*Slot, bool) {
+	p.mu.Lock()
+	for p.full() {
+		freed := p.freed
+		p.mu.Unlock()
+		select {
+		case <-freed:
+		case <-quit:
+			return nil, false
+		}
+		p.mu.Lock()
+	}
+	defer p.mu.Unlock()
+	return p.add(priority, evict), true
+}
+
+// TryAcquire takes a free slot or the one of the connection with the
+// lowest priority if it is lower than priority.
+func (p *Pool) TryAcquire(priority uint32, evict func()) (*Slot, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.full() {
+		var lowest *Slot
+		for slot := range p.slots {
+			if slot.evict != nil && (lowest == nil || slot.priority < lowest.priority) {
+				lowest = slot
+			}
+		}
+		if lowest == nil || lowest.priority >= priority {
+			return nil, false
+		}
+		delete(p.slots, lowest)
+		go lowest.evict()
+	}
+	return p.add(priority, evict), true
+}
+
+// Release frees the slot, it can be called more than once
+func (s *Slot) Release() {
+	if s == nil {
+		return
+	}
+	s.pool.mu.Lock()
+	defer s.pool.mu.Unlock()
+	if _, ok := s.pool.slots[s]; ok {
+		delete(s.pool.slots, s)
+		s.pool.signal()
+	}
+}
+
+// IPLimit bounds the number of connections to a same address
+type IPLimit struct {
+	mu     sync.Mutex
+	max    int // no limit when zero
+	counts map[string]int
+}
+
+func NewIPLimit(max int) *IPLimit {
+	return &IPLimit{max: max, counts: make(map[string]int)}
+}
+
+// Acquire counts a connection to ip, it returns false if there are
+// already too many.
+func (l *IPLimit) Acquire(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := ip.String()
+	if l.max > 0 && l.counts[key] >= l.max {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
+
+func (l *IPLimit) Release(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := ip.String()
+	if l.counts[key] <= 1 {
+		delete(l.counts, key)
+		return
+	}
+	l.counts[key]--
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Priority is the BEP 40 canonical priority of the connection between
+// two endpoints, both sides compute the same value and favor the same
+// connections.
+func Priority(selfIP net.IP, selfPort int, peerIP net.IP, peerPort int) uint32 {
+	a, b := selfIP.To4(), peerIP.To4()
+	if a == nil || b == nil {
+		a, b = selfIP.To16(), peerIP.To16()
+	}
+	if a == nil || b == nil {
+		return 0
+	}
+	if a.Equal(b) {
+		ports := make([]byte, 4)
+		first, second := min(selfPort, peerPort), max(selfPort, peerPort)
+		binary.BigEndian.PutUint16(ports[0:2], uint16(first))
+		binary.BigEndian.PutUint16(ports[2:4], uint16(second))
+		return crc32.Checksum(ports, castagnoli)
+	}
+	mask := priorityMask(a, b)
+	maskedA, maskedB := make([]byte, len(a)), make([]byte, len(b))
+	for i := range a {
+		maskedA[i] = a[i] & mask[i]
+		maskedB[i] = b[i] & mask[i]
+	}
+	if bytes.Compare(maskedA, maskedB) > 0 {
+		maskedA, maskedB = maskedB, maskedA
+	}
+	return crc32.Checksum(append(maskedA, maskedB...), castagnoli)
+}
+
+// priorityMask keeps fewer bits of addresses that are far apart
+func priorityMask(a net.IP, b net.IP) []byte {
+	if len(a) == net.IPv4len {
+		switch {
+		case bytes.Equal(a[:3], b[:3]):
+			return []byte{0xff, 0xff, 0xff, 0xff}
+		case bytes.Equal(a[:2], b[:2]):
+			return []byte{0xff, 0xff, 0xff, 0x55}
+		default:
+			return []byte{0xff, 0xff, 0x55, 0x55}
+		}
+	}
+	// The same as IPv4 with /48 and /16 in place of /24 and /16
+	mask := bytes.Repeat([]byte{0x55}, net.IPv6len)
+	keep := 2
+	switch {
+	case bytes.Equal(a[:6], b[:6]):
+		keep = 16
+	case bytes.Equal(a[:2], b[:2]):
+		keep = 6
+	}
+	for i := range keep {
+		mask[i] = 0xff
+	}
+	return mask
+}
+
+// Shared holds the limits shared by every torrent of a session
+type Shared struct {
+	Conns    *Pool
+	HalfOpen *Pool  // dials in progress
+	SelfIP   net.IP // our address, used for peer priorities
+}
+
+// LocalIP returns the address of this host on its default route, nil
+// when it has none. Nothing is sent.
+func LocalIP() net.IP {
+	conn, err := net.Dial("udp", "192.0.2.1:6881")
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
@@ -0,0 +1,98 @@
+package connlimit
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPriority(t *testing.T) {
+	// Examples from BEP 40
+	cases := []struct {
+		a, b     string
+		expected uint32
+	}{
+		{"123.213.32.10", "98.76.54.32", 0xec2d7224},
+		{"123.213.32.10", "123.213.32.234", 0x99568189},
+	}
+	for _, c := range cases {
+		priority := Priority(net.ParseIP(c.a), 0, net.ParseIP(c.b), 0)
+		if priority != c.expected {
+			t.Errorf("priority of %s and %s is %x, expected %x", c.a, c.b, priority, c.expected)
+		}
+		if reverse := Priority(net.ParseIP(c.b), 0, net.ParseIP(c.a), 0); reverse != priority {
+			t.Errorf("priority isn't symmetric for %s and %s", c.a, c.b)
+		}
+	}
+}
+
+func TestPriorityMaskIPv6(t *testing.T) {
+	cases := []struct {
+		a, b string
+		keep int // leading bytes of the mask kept whole
+	}{
+		{"2001:db8:1:2::1", "2001:db8:1:3::1", 16},
+		{"2001:db8:1::1", "2001:db9:1::1", 6},
+		{"2001:db8::1", "2a00:db8::1", 2},
+	}
+	for _, c := range cases {
+		mask := priorityMask(net.ParseIP(c.a), net.ParseIP(c.b))
+		for i, b := range mask {
+			if expected := i < c.keep; (b == 0xff) != expected {
+				t.Errorf("mask of %s and %s is %x, expected %d bytes kept", c.a, c.b, mask, c.keep)
+				break
+			}
+		}
+	}
+}
+
+func TestPoolEviction(t *testing.T) {
+	p := NewPool(2)
+	evicted := make(chan int, 2)
+	low, _ := p.TryAcquire(10, func() { evicted <- 10 })
+	p.TryAcquire(20, func() { evicted <- 20 })
+	if _, ok := p.TryAcquire(5, nil); ok {
+		t.Errorf("a lower priority connection took a slot")
+	}
+	if _, ok := p.TryAcquire(15, nil); !ok {
+		t.Fatalf("a higher priority connection didn't get a slot")
+	}
+	if priority := <-evicted; priority != 10 {
+		t.Errorf("evicted connection of priority %d, expected 10", priority)
+	}
+	// Releasing an evicted slot doesn't free another one
+	low.Release()
+	if p.Len() != 2 {
+		t.Errorf("expected 2 slots in use, got %d", p.Len())
+	}
+}
+
+func TestAcquireWaits(t *testing.T) {
+	p := NewPool(1)
+	slot, _ := p.Acquire(0, nil, nil)
+	acquired := make(chan bool)
+	go func() {
+		_, ok := p.Acquire(0, nil, nil)
+		acquired <- ok
+	}()
+	slot.Release()
+	if !<-acquired {
+		t.Errorf("expected the waiting connection to get the slot")
+	}
+	quit := make(chan bool)
+	close(quit)
+	if _, ok := p.Acquire(0, nil, quit); ok {
+		t.Errorf("expected Acquire to give up when quit is closed")
+	}
+}
+
+func TestIPLimit(t *testing.T) {
+	l := NewIPLimit(1)
+	ip := net.ParseIP("10.0.0.1")
+	if !l.Acquire(ip) || l.Acquire(ip) {
+		t.Errorf("expected a single connection to be allowed")
+	}
+	l.Release(ip)
+	if !l.Acquire(ip) {
+		t.Errorf("expected the released connection to make room")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/rpc"
+	"github.com/samir-adh/bytetorrent/src/transmission"
+	"github.com/samir-adh/bytetorrent/src/web"
+	"github.com/ztrue/tracerr"
+)
+
+// daemon runs a session until it is stopped, torrents are added and
+// controlled through the JSON-RPC API it serves, the RPC of Transmission
+// or the web dashboard
+func daemon(args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: bytetorrent daemon [flags]")
+		flags.PrintDefaults()
+	}
+	openSession := sessionFlags(flags)
+	socket := flags.String("socket", rpc.DefaultSocket(), "Unix socket the API is served on, none when empty")
+	rpcAddr := flags.String("rpc-addr", "", "Also serve the API on this host:port, -rpc-auth is needed unless it is a loopback address")
+	rpcAuth := flags.String("rpc-auth", "", "user:password asked with HTTP Basic authentication on -rpc-addr")
+	dashboard := flags.Bool("web", true, "Serve the web dashboard at / of -rpc-addr")
+	torrentDir := flags.String("torrent-dir", "", "Directory keeping the added torrents across restarts, .torrents in the download directory by default")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 10*time.Second, "Time given to a clean shutdown on SIGINT or SIGTERM")
+	flags.Parse(args)
+	if *socket == "" && *rpcAddr == "" {
+		fmt.Fprintln(os.Stderr, "-socket or -rpc-addr is needed")
+		os.Exit(2)
+	}
+	if *rpcAuth != "" && !strings.Contains(*rpcAuth, ":") {
+		fmt.Fprintln(os.Stderr, "-rpc-auth is given as user:password")
+		os.Exit(2)
+	}
+	// Anyone reaching the address could add torrents and delete files
+	if *rpcAddr != "" && *rpcAuth == "" && !rpc.IsLoopback(*rpcAddr) {
+		fmt.Fprintf(os.Stderr, "-rpc-auth is needed to serve the API on %s, which isn't a loopback address\n", *rpcAddr)
+		os.Exit(2)
+	}
+	torrentSession, config, logger := openSession()
+	defer torrentSession.Close()
+	rpcServer := rpc.NewServer(torrentSession, config)
+	// Without a password, a page of another site could reach a loopback
+	// address through DNS rebinding: requests must name this machine and
+	// torrents stay in the download directory
+	guard := func(handler http.Handler) http.Handler { return handler }
+	if *rpcAuth == "" {
+		rpcServer.DownloadRoot = config.DownloadDir
+		guard = func(handler http.Handler) http.Handler { return rpc.CheckHost(handler, *rpcAddr) }
+	}
+	rpcServer.TorrentDir = *torrentDir
+	if rpcServer.TorrentDir == "" {
+		rpcServer.TorrentDir = filepath.Join(config.DownloadDir, ".torrents")
+	}
+	// The torrents that can't be restored are left in the directory for
+	// the next run
+	if err := rpcServer.Restore(); err != nil {
+		logger.Printf(log.LowVerbose, "%s\n", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.Path, guard(rpcServer))
+	mux.Handle(transmission.Path, guard(transmission.New(rpcServer)))
+	if *dashboard {
+		mux.Handle("/", guard(web.New(rpcServer)))
+	}
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	// The requests end with the daemon, the event streams of the dashboard
+	// would otherwise keep the shutdown waiting
+	var handler http.Handler = mux
+	if *rpcAuth != "" {
+		handler = rpc.RequireAuth(mux, *rpcAuth)
+	}
+	httpServer := &http.Server{Handler: handler, BaseContext: func(net.Listener) context.Context { return ctx }}
+
+	var listeners []net.Listener
+	for _, address := range []string{*socket, *rpcAddr} {
+		if address == "" {
+			continue
+		}
+		listener, err := rpc.Listen(address)
+		if err != nil {
+			tracerr.Print(err)
+			os.Exit(1)
+		}
+		logger.Printf(log.LowVerbose, "serving the API on %s\n", address)
+		if *dashboard && address == *rpcAddr {
+			logger.Printf(log.LowVerbose, "web dashboard at http://%s/\n", address)
+		}
+		listeners = append(listeners, listener)
+	}
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() { errs <- httpServer.Serve(listener) }()
+	}
+
+	select {
+	case err := <-errs:
+		tracerr.Print(err)
+		torrentSession.Close()
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stopSignals()
+	logger.Printf(log.LowVerbose, "shutting down, interrupt again to exit immediately\n")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	// Closing the server also removes the Unix socket
+	if err := httpServer.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Printf(log.LowVerbose, "failed to stop the API: %s\n", err)
+	}
+	if err := torrentSession.Shutdown(shutdownCtx); err != nil {
+		fmt.Fprintf(os.Stderr, "shutdown didn't complete in %s\n", *shutdownTimeout)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,98 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/proxy"
+	"github.com/samir-adh/bytetorrent/src/utp"
+)
+
+// Dialer connects to peers, it tries uTP first and falls back to TCP
+// when the peer doesn't answer over uTP.
+type Dialer struct {
+	Socket     *utp.Socket // nil disables uTP
+	UTPTimeout time.Duration
+	TCPTimeout time.Duration
+	Proxy      *proxy.Proxy // TCP connections go through it when set
+	logger     *log.Logger
+}
+
+// New opens the UDP socket shared by every uTP connection on port,
+// if the port is taken an ephemeral one is used and if no socket can be
+// opened at all peers are only dialed over TCP.
+func New(port int, logger *log.Logger) *Dialer {
+	dialer := &Dialer{
+		UTPTimeout: 3 * time.Second,
+		TCPTimeout: 5 * time.Second,
+		logger:     logger,
+	}
+	socket, err := utp.Listen("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		socket, err = utp.Listen("udp", ":0")
+	}
+	if err != nil {
+		logger.Printf(log.LowVerbose, "uTP disabled, could not open UDP socket: %s\n", err)
+		return dialer
+	}
+	dialer.Socket = socket
+	return dialer
+}
+
+// NewProxied sends every connection through p, uTP goes through a UDP
+// association with SOCKS5 proxies and is disabled with HTTP ones.
+func NewProxied(p *proxy.Proxy, logger *log.Logger) *Dialer {
+	dialer := &Dialer{
+		UTPTimeout: 3 * time.Second,
+		TCPTimeout: 5 * time.Second,
+		Proxy:      p,
+		logger:     logger,
+	}
+	conn, err := p.ListenPacket(context.Background())
+	if err != nil {
+		logger.Printf(log.LowVerbose, "uTP disabled, could not relay UDP through %s: %s\n", p, err)
+		return dialer
+	}
+	dialer.Socket = utp.NewSocket(conn)
+	return dialer
+}
+
+// Dial opens a connection to address, e.g. "10.0.0.1:6881"
+func (d *Dialer) Dial(address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), address)
+}
+
+// DialContext is Dial giving up when ctx is done
+func (d *Dialer) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	if d.Socket != nil {
+		utpCtx, cancel := context.WithTimeout(ctx, d.UTPTimeout)
+		conn, err := d.Socket.DialContext(utpCtx, address)
+		cancel()
+		if err == nil {
+			d.logger.Printf(log.HighVerbose, "connected to %s over uTP\n", address)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		d.logger.Printf(log.HighVerbose, "uTP dial to %s failed, falling back to TCP: %s\n", address, err)
+	}
+	if d.Proxy != nil {
+		tcpCtx, cancel := context.WithTimeout(ctx, d.TCPTimeout)
+		defer cancel()
+		return d.Proxy.DialContext(tcpCtx, "tcp", address)
+	}
+	tcpDialer := net.Dialer{Timeout: d.TCPTimeout}
+	return tcpDialer.DialContext(ctx, "tcp", address)
+}
+
+// Close releases the UDP socket
+func (d *Dialer) Close() error {
+	if d.Socket == nil {
+		return nil
+	}
+	return d.Socket.Close()
+}
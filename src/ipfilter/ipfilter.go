@@ -0,0 +1,253 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Range is an inclusive range of addresses of a same family
+type Range struct {
+	First net.IP
+	Last  net.IP
+}
+
+// emuleAllowed is the lowest eMule access level that isn't blocked
+const emuleAllowed = 128
+
+// Filter blocks the addresses of a set of ranges. The ranges are kept
+// sorted and merged so lookups are a binary search.
+type Filter struct {
+	mu    sync.RWMutex
+	v4    []span
+	v6    []span
+	paths []string // files loaded by LoadFiles, read again by Reload
+}
+
+// span is a range with addresses in their 16 bytes form
+type span struct {
+	first [16]byte
+	last  [16]byte
+}
+
+func New() *Filter {
+	return &Filter{}
+}
+
+// LoadFiles replaces the ranges of the filter with those of the files,
+// each one in the eMule ipfilter.dat, PeerGuardian P2P or CIDR format.
+func (f *Filter) LoadFiles(paths ...string) error {
+	var ranges []Range
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		parsed, err := Parse(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		ranges = append(ranges, parsed...)
+	}
+	f.SetRanges(ranges)
+	f.mu.Lock()
+	f.paths = slices.Clone(paths)
+	f.mu.Unlock()
+	return nil
+}
+
+// Reload reads the files given to LoadFiles again, the current ranges
+// are kept if one of them can't be read
+func (f *Filter) Reload() error {
+	f.mu.RLock()
+	paths := f.paths
+	f.mu.RUnlock()
+	return f.LoadFiles(paths...)
+}
+
+// SetRanges replaces the ranges of the filter
+func (f *Filter) SetRanges(ranges []Range) {
+	var v4, v6 []span
+	for _, r := range ranges {
+		s := span{first: [16]byte(r.First.To16()), last: [16]byte(r.Last.To16())}
+		if r.First.To4() != nil {
+			v4 = append(v4, s)
+		} else {
+			v6 = append(v6, s)
+		}
+	}
+	v4, v6 = merge(v4), merge(v6)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.v4, f.v6 = v4, v6
+}
+
+// Len returns the number of disjoint ranges blocked
+func (f *Filter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.v4) + len(f.v6)
+}
+
+// Blocked reports whether ip is in a range of the filter, a nil filter
+// blocks nothing
+func (f *Filter) Blocked(ip net.IP) bool {
+	if f == nil || ip == nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	spans := f.v6
+	if ip.To4() != nil {
+		spans = f.v4
+	}
+	addr := [16]byte(ip.To16())
+	// The last span starting at or before addr is the only candidate
+	i, found := slices.BinarySearchFunc(spans, addr, func(s span, addr [16]byte) int {
+		return bytes.Compare(s.first[:], addr[:])
+	})
+	if found {
+		return true
+	}
+	return i > 0 && bytes.Compare(addr[:], spans[i-1].last[:]) <= 0
+}
+
+// merge sorts the spans and joins those that overlap or touch
+func merge(spans []span) []span {
+	slices.SortFunc(spans, func(a, b span) int {
+		return bytes.Compare(a.first[:], b.first[:])
+	})
+	var merged []span
+	for _, s := range spans {
+		if n := len(merged); n > 0 && adjacent(merged[n-1].last, s.first) {
+			if bytes.Compare(s.last[:], merged[n-1].last[:]) > 0 {
+				merged[n-1].last = s.last
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// adjacent reports whether next starts at most one address after last
+func adjacent(last [16]byte, next [16]byte) bool {
+	if bytes.Compare(next[:], last[:]) <= 0 {
+		return true
+	}
+	for i := 15; i >= 0; i-- {
+		last[i]++
+		if last[i] != 0 {
+			break
+		}
+	}
+	return last == next
+}
+
+// Parse reads a list of ranges, one per line, in any of these formats:
+//
+//	001.009.096.105 - 001.009.096.105 , 000 , eMule ipfilter.dat
+//	PeerGuardian P2P description:1.2.3.0-1.2.3.255
+//	10.0.0.0/8
+//	2001:db8::1-2001:db8::ff
+//	192.0.2.1
+//
+// Empty lines and lines starting with # or // are skipped. eMule ranges
+// with an access level of 128 or more are allowed, so left out.
+func Parse(r io.Reader) ([]Range, error) {
+	var ranges []Range
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		r, blocked, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+		if blocked {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges, scanner.Err()
+}
+
+func parseLine(line string) (Range, bool, error) {
+	fields := strings.Split(line, ",")
+	if len(fields) >= 2 {
+		// eMule, the description may hold more commas
+		if level, err := strconv.Atoi(strings.TrimSpace(fields[1])); err == nil {
+			r, err := parseRange(fields[0])
+			return r, level < emuleAllowed, err
+		}
+	}
+	// A P2P description may hold a slash too
+	if _, network, err := net.ParseCIDR(line); err == nil {
+		last := make(net.IP, len(network.IP))
+		for i := range network.IP {
+			last[i] = network.IP[i] | ^network.Mask[i]
+		}
+		return Range{First: network.IP, Last: last}, true, nil
+	}
+	if r, err := parseRange(line); err == nil {
+		return r, true, nil
+	}
+	// PeerGuardian, the range follows the description and a colon
+	for i, c := range line {
+		if c != ':' {
+			continue
+		}
+		if r, err := parseRange(line[i+1:]); err == nil {
+			return r, true, nil
+		}
+	}
+	return Range{}, false, fmt.Errorf("invalid range %q", line)
+}
+
+// parseRange parses "first-last" or a single address
+func parseRange(s string) (Range, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		to = from
+	}
+	first, last := parseIP(from), parseIP(to)
+	if first == nil || last == nil {
+		return Range{}, fmt.Errorf("invalid range %q", s)
+	}
+	if (first.To4() == nil) != (last.To4() == nil) || bytes.Compare(first.To16(), last.To16()) > 0 {
+		return Range{}, fmt.Errorf("invalid range %q", s)
+	}
+	return Range{First: first, Last: last}, nil
+}
+
+// parseIP also accepts the zero padded IPv4 addresses of ipfilter.dat
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, octet := range octets {
+		n, err := strconv.ParseUint(octet, 10, 8)
+		if err != nil {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip
+}
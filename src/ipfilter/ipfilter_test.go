@@ -0,0 +1,99 @@
+package ipfilter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const lists = `# eMule
+001.009.096.105 - 001.009.096.110 , 000 , Blocked, with a comma
+010.000.000.000 - 010.255.255.255 , 200 , Allowed
+// PeerGuardian P2P
+Some org, Inc: with a colon:192.0.2.0-192.0.2.255
+AT&T/Bell Labs:12.0.0.0-12.255.255.255
+# CIDR
+198.51.100.0/24
+2001:db8::/32
+fe80::1-fe80::ff
+203.0.113.7
+`
+
+func TestParseFormats(t *testing.T) {
+	ranges, err := Parse(strings.NewReader(lists))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := New()
+	f.SetRanges(ranges)
+	for ip, blocked := range map[string]bool{
+		"1.9.96.105":    true,
+		"1.9.96.110":    true,
+		"1.9.96.111":    false,
+		"12.34.56.78":   true,
+		"10.1.2.3":      false,
+		"192.0.2.128":   true,
+		"192.0.3.0":     false,
+		"198.51.100.42": true,
+		"203.0.113.7":   true,
+		"203.0.113.8":   false,
+		"2001:db8::1":   true,
+		"2001:db9::1":   false,
+		"fe80::80":      true,
+		"fe80::100":     false,
+	} {
+		if f.Blocked(net.ParseIP(ip)) != blocked {
+			t.Errorf("expected %s blocked to be %v", ip, blocked)
+		}
+	}
+	var none *Filter
+	if none.Blocked(net.ParseIP("1.9.96.105")) {
+		t.Errorf("expected a nil filter to block nothing")
+	}
+	if _, err := Parse(strings.NewReader("not an address\n")); err == nil {
+		t.Errorf("expected an invalid line to fail")
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	f := New()
+	f.SetRanges([]Range{
+		{net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.20")},
+		{net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.9")},
+		{net.ParseIP("10.0.0.15"), net.ParseIP("10.0.0.30")},
+		{net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.0")},
+	})
+	if f.Len() != 2 {
+		t.Errorf("expected touching ranges to merge into 2, got %d", f.Len())
+	}
+	if !f.Blocked(net.ParseIP("10.0.0.25")) || f.Blocked(net.ParseIP("10.0.0.31")) {
+		t.Errorf("expected the merged range to end at 10.0.0.30")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("192.0.2.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f := New()
+	if err := f.LoadFiles(path); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Blocked(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("expected the listed address to be blocked")
+	}
+	os.WriteFile(path, []byte("192.0.2.2\n"), 0o644)
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Blocked(net.ParseIP("192.0.2.1")) || !f.Blocked(net.ParseIP("192.0.2.2")) {
+		t.Errorf("expected the reloaded list to replace the previous one")
+	}
+	os.Remove(path)
+	if err := f.Reload(); err == nil || !f.Blocked(net.ParseIP("192.0.2.2")) {
+		t.Errorf("expected a failed reload to keep the previous list")
+	}
+}
@@ -10,41 +10,105 @@ import (
 
 type Logger struct {
 	Verbose       VerboseLevel
+	Plain         bool // Progress prints lines every PlainInterval instead of a bar
 	progressMutex sync.Mutex
-	startTime     time.Time
+	lastPlain     time.Time
 	lastProgress  int
+	barShown      bool // the bar is on the current line of the terminal
+	hideProgress  bool
+}
+
+// PlainInterval is how often Progress prints a line in plain mode
+const PlainInterval = 10 * time.Second
+
+// Transfer is what Progress shows
+type Transfer struct {
+	Completed    int64 // bytes verified
+	Total        int64 // bytes wanted
+	DownloadRate int   // bytes per second
+	UploadRate   int
+	Peers        int
+	Seeds        int
+}
+
+// HideProgress stops Progress and ProgressSimple from drawing, while
+// something else takes the terminal
+func (logger *Logger) HideProgress(hide bool) {
+	logger.progressMutex.Lock()
+	defer logger.progressMutex.Unlock()
+	logger.hideProgress = hide
+}
+
+// clearBar erases the progress bar for a log line to take its place, it
+// is drawn again by the next call to Progress
+func (logger *Logger) clearBar() {
+	logger.progressMutex.Lock()
+	defer logger.progressMutex.Unlock()
+	if logger.barShown {
+		fmt.Print("\r\033[K")
+		logger.barShown = false
+	}
 }
 
 func (logger *Logger) Printf(verboseLevel VerboseLevel, format string, v ...any) {
 	if verboseLevel <= logger.Verbose {
+		logger.clearBar()
 		log.Printf(format, v...)
 	}
 }
 
 func (logger *Logger) Println(verboseLevel VerboseLevel, v ...any) {
 	if verboseLevel <= logger.Verbose {
+		logger.clearBar()
 		log.Println(v...)
 	}
 }
 
 func (logger *Logger) Print(verboseLevel VerboseLevel, v ...any) {
 	if verboseLevel <= logger.Verbose {
+		logger.clearBar()
 		log.Print(v...)
 	}
 }
 
-// Progress displays an enhanced progress bar with colors and statistics
-func (logger *Logger) Progress(progress int, downloaded, total int64) {
-	// if logger.Verbose == HighVerbose {
-	// 	return
-	// }
-
+// Progress displays an enhanced progress bar with colors and statistics,
+// or a plain line every PlainInterval when Plain is set
+func (logger *Logger) Progress(transfer Transfer) {
 	logger.progressMutex.Lock()
 	defer logger.progressMutex.Unlock()
+	if logger.hideProgress {
+		return
+	}
+
+	progress := 100
+	if transfer.Total > 0 {
+		progress = int(transfer.Completed * 100 / transfer.Total)
+	}
+	completed := progress >= 100 && logger.lastProgress < 100
+	defer func() { logger.lastProgress = progress }()
 
-	// Initialize start time on first call
-	if logger.startTime.IsZero() {
-		logger.startTime = time.Now()
+	var etaStr string
+	if left := transfer.Total - transfer.Completed; left > 0 && transfer.DownloadRate > 0 {
+		etaStr = formatDuration(time.Duration(left/int64(transfer.DownloadRate)) * time.Second)
+	}
+	sizeInfo := fmt.Sprintf("%s / %s", formatBytes(float64(transfer.Completed)), formatBytes(float64(transfer.Total)))
+	peersInfo := fmt.Sprintf("%d peers, %d seeds", transfer.Peers, transfer.Seeds)
+
+	if logger.Plain {
+		if !completed && time.Since(logger.lastPlain) < PlainInterval {
+			return
+		}
+		logger.lastPlain = time.Now()
+		line := fmt.Sprintf("%d%% | %s | down %s/s | up %s/s | %s", progress, sizeInfo,
+			formatBytes(float64(transfer.DownloadRate)), formatBytes(float64(transfer.UploadRate)), peersInfo)
+		if etaStr != "" {
+			line += " | ETA: " + etaStr
+		}
+		fmt.Println(line)
+		if completed {
+			fmt.Println("Download complete!")
+		}
+		return
 	}
 
 	// Clear the current line
@@ -52,7 +116,7 @@ func (logger *Logger) Progress(progress int, downloaded, total int64) {
 
 	// Build progress bar with Unicode block characters
 	barWidth := 40
-	filled := int(float64(barWidth) * float64(progress) / 100.0)
+	filled := min(barWidth, barWidth*progress/100)
 	bar := strings.Repeat("█", filled) + strings.Repeat("░", barWidth-filled)
 
 	// Color codes
@@ -64,50 +128,28 @@ func (logger *Logger) Progress(progress int, downloaded, total int64) {
 		colorBold   = "\033[1m"
 	)
 
-	// Calculate speed and ETA
-	elapsed := time.Since(logger.startTime)
-	var speedStr, etaStr string
-
-	if downloaded > 0 && elapsed.Seconds() > 0 {
-		speed := float64(downloaded) / elapsed.Seconds() // bytes per second
-		speedStr = formatBytes(speed) + "/s"
-
-		if progress > 0 {
-			remaining := float64(total-downloaded) / speed
-			etaStr = formatDuration(time.Duration(remaining * float64(time.Second)))
-		}
-	}
-
 	// Choose color based on progress
 	barColor := colorYellow
 	if progress >= 100 {
 		barColor = colorGreen
 	}
 
-	// Format file size info
-	sizeInfo := fmt.Sprintf("%s / %s", formatBytes(float64(downloaded)), formatBytes(float64(total)))
-
 	// Print the progress bar
 	fmt.Print(barColor + colorBold + "[" + bar + "]" + colorReset)
 	fmt.Printf(" %s%d%%%s", colorCyan, progress, colorReset)
-
-	if speedStr != "" {
-		fmt.Printf(" | %s", speedStr)
-	}
-
+	fmt.Printf(" | ↓ %s/s ↑ %s/s", formatBytes(float64(transfer.DownloadRate)), formatBytes(float64(transfer.UploadRate)))
 	if etaStr != "" {
 		fmt.Printf(" | ETA: %s", etaStr)
 	}
-
-	fmt.Printf(" | %s", sizeInfo)
+	fmt.Printf(" | %s | %s", sizeInfo, peersInfo)
+	logger.barShown = true
 
 	// Print newline when complete
-	if progress >= 100 {
+	if completed {
 		fmt.Println()
 		fmt.Printf("%s✓ Download complete!%s\n", colorGreen+colorBold, colorReset)
+		logger.barShown = false
 	}
-
-	logger.lastProgress = progress
 }
 
 // ProgressSimple is a simpler version without speed/ETA (backward compatible)
@@ -118,6 +160,9 @@ func (logger *Logger) ProgressSimple(progress int) {
 
 	logger.progressMutex.Lock()
 	defer logger.progressMutex.Unlock()
+	if logger.hideProgress {
+		return
+	}
 
 	// Clear line
 	fmt.Print("\r\033[K")
@@ -139,6 +184,8 @@ func (logger *Logger) ProgressSimple(progress int) {
 		fmt.Printf("%s[%s] %d%%%s", color, bar, progress, "\033[0m")
 	}
 
+	logger.barShown = progress < 100 && logger.Verbose != HighVerbose
+
 	if progress >= 100 {
 		fmt.Println("\n\033[32m✓ Complete!\033[0m")
 	}
@@ -0,0 +1,70 @@
+package merkle
+
+import "crypto/sha256"
+
+// BlockSize is the size of the data hashed by each leaf of a v2 merkle tree
+const BlockSize = 16 * 1024
+
+// BlockHashes returns the SHA-256 hash of every 16 KiB block of data,
+// the last block may be shorter.
+func BlockHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, 0, (len(data)+BlockSize-1)/BlockSize)
+	for start := 0; start < len(data); start += BlockSize {
+		end := min(start+BlockSize, len(data))
+		hashes = append(hashes, sha256.Sum256(data[start:end]))
+	}
+	return hashes
+}
+
+func hashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// PadHash returns the root of a tree made of leaves zero hashes, which is
+// what stands for the missing parts of a tree past the end of a file.
+func PadHash(leaves int) [32]byte {
+	var hash [32]byte
+	for n := leaves; n > 1; n /= 2 {
+		hash = hashPair(hash, hash)
+	}
+	return hash
+}
+
+// Root computes the root of a tree of count leaves, count being a power
+// of two, the leaves past the given hashes being set to pad.
+func Root(hashes [][32]byte, count int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, max(count, len(hashes)))
+	copy(layer, hashes)
+	for i := len(hashes); i < len(layer); i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		if len(layer)%2 != 0 {
+			layer = append(layer, pad)
+		}
+		for i := range len(layer) / 2 {
+			layer[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layer = layer[:len(layer)/2]
+		pad = hashPair(pad, pad)
+	}
+	return layer[0]
+}
+
+// PieceRoot computes the root of the tree of leaves leaves built over
+// the 16 KiB blocks of data.
+func PieceRoot(data []byte, leaves int) [32]byte {
+	return Root(BlockHashes(data), leaves, [32]byte{})
+}
+
+// NextPowerOfTwo returns the smallest power of two greater or equal to n
+func NextPowerOfTwo(n int) int {
+	power := 1
+	for power < n {
+		power *= 2
+	}
+	return power
+}
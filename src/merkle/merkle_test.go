@@ -0,0 +1,47 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestPieceRoot(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, BlockSize+10)
+	left := sha256.Sum256(data[:BlockSize])
+	right := sha256.Sum256(data[BlockSize:])
+	var zero [32]byte
+
+	expected := hashPair(left, right)
+	if got := PieceRoot(data, 2); got != expected {
+		t.Errorf("got root %x, expected %x", got, expected)
+	}
+
+	// Missing leaves are zero hashes
+	expected = hashPair(expected, hashPair(zero, zero))
+	if got := PieceRoot(data, 4); got != expected {
+		t.Errorf("got padded root %x, expected %x", got, expected)
+	}
+}
+
+func TestRootWithPadHash(t *testing.T) {
+	// Hashing piece roots with pad hashes gives the same root as hashing
+	// all the blocks at once
+	data := bytes.Repeat([]byte{7}, 3*BlockSize)
+	pieceRoots := [][32]byte{
+		PieceRoot(data[:2*BlockSize], 2),
+		PieceRoot(data[2*BlockSize:], 2),
+	}
+	expected := PieceRoot(data, 8)
+	if got := Root(pieceRoots, 4, PadHash(2)); got != expected {
+		t.Errorf("got root %x, expected %x", got, expected)
+	}
+}
+
+func TestNextPowerOfTwo(t *testing.T) {
+	for n, expected := range map[int]int{0: 1, 1: 1, 3: 4, 4: 4, 5: 8} {
+		if got := NextPowerOfTwo(n); got != expected {
+			t.Errorf("NextPowerOfTwo(%d) = %d, expected %d", n, got, expected)
+		}
+	}
+}
@@ -37,23 +37,31 @@ const (
 	MsgCancel messageId = 8
 )
 
+// MaxLength is the longest message read: a piece message with the
+// largest block served, which also fits the bitfield of a million pieces
+const MaxLength = 128*1024 + 13
+
+// Read reads the next message of r, skipping keep-alives
 func Read(r io.Reader) (*Message, error) {
 	// Read message length
 	buf_length := make([]byte, 4)
-	_, err := io.ReadFull(r, buf_length)
-	if err != nil {
-		if err == io.EOF {
-			return nil, err
+	var length uint32
+	for length == 0 {
+		_, err := io.ReadFull(r, buf_length)
+		if err != nil {
+			if err == io.EOF {
+				return nil, err
+			}
+			return nil, tracerr.Wrap(err)
 		}
-		return nil, tracerr.Wrap(err)
+		length = binary.BigEndian.Uint32(buf_length)
 	}
-	length := binary.BigEndian.Uint32(buf_length)
-	if length <= 0 {
+	if length > MaxLength {
 		return nil, tracerr.Errorf("Failed to read message with length %d", length)
 	}
 	// Read the rest of the message
 	buf_message := make([]byte, length)
-	_, err = io.ReadFull(r, buf_message) // the first 4 bytes were already read
+	_, err := io.ReadFull(r, buf_message) // the first 4 bytes were already read
 	if err != nil {
 		if err == io.EOF {
 			return nil, err
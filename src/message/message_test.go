@@ -44,3 +44,23 @@ func TestRead(t *testing.T) {
 	}
 
 }
+
+func TestReadKeepAlive(t *testing.T) {
+	// Two keep-alives before an unchoke
+	input := bytes.NewBuffer([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, byte(MsgUnchoke)})
+	msg, err := Read(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != MsgUnchoke {
+		t.Errorf("expected an unchoke, got %s", msg.Id.String())
+	}
+}
+
+func TestReadTooLong(t *testing.T) {
+	lengthPrefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthPrefix, 1<<31)
+	if _, err := Read(bytes.NewReader(lengthPrefix)); err == nil {
+		t.Errorf("expected a message of 2 GiB to be refused")
+	}
+}
@@ -0,0 +1,52 @@
+package peerconnection
+
+import "strings"
+
+// clients maps the codes of Azureus-style peer ids to client names
+var clients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UM": "µTorrent Mac",
+}
+
+// ClientName returns the client and version a peer id advertises, as
+// "qBittorrent 4.6.2" for "-qB4620-". The digits of the version end at
+// the first other character, like the release letter of Transmission in
+// "-TR406Z-". Ids in another format give an empty string.
+func ClientName(id [20]byte) string {
+	if id[0] != '-' || id[7] != '-' {
+		return ""
+	}
+	code := string(id[1:3])
+	name, ok := clients[code]
+	if !ok {
+		name = code
+	}
+	var digits []string
+	for _, c := range id[3:7] {
+		if c < '0' || c > '9' {
+			break
+		}
+		digits = append(digits, string(c))
+	}
+	// Trailing zeros are dropped, down to a major and minor version
+	for len(digits) > 2 && digits[len(digits)-1] == "0" {
+		digits = digits[:len(digits)-1]
+	}
+	if len(digits) == 0 {
+		return name
+	}
+	if len(digits) == 1 {
+		digits = append(digits, "0")
+	}
+	return name + " " + strings.Join(digits, ".")
+}
@@ -0,0 +1,19 @@
+package peerconnection
+
+import "testing"
+
+func TestClientName(t *testing.T) {
+	for id, expected := range map[string]string{
+		"-qB4620-abcdefghijkl": "qBittorrent 4.6.2",
+		"-TR406Z-abcdefghijkl": "Transmission 4.0.6",
+		"-TR300Z-abcdefghijkl": "Transmission 3.0",
+		"-LT2000-abcdefghijkl": "libtorrent 2.0",
+		"-XX1234-abcdefghijkl": "XX 1.2.3.4",
+		"-DEs---abcdefghijklm": "",
+		"M7-4-3--abcdefghijkl": "",
+	} {
+		if name := ClientName([20]byte([]byte(id))); name != expected {
+			t.Errorf("expected %q for %s, got %q", expected, id, name)
+		}
+	}
+}
@@ -3,10 +3,16 @@ package peerconnection
 import (
 	"encoding/binary"
 	"fmt"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 	"github.com/samir-adh/bytetorrent/src/log"
 	"github.com/samir-adh/bytetorrent/src/message"
 	pc "github.com/samir-adh/bytetorrent/src/piece"
+	"github.com/samir-adh/bytetorrent/src/ratelimit"
+	"github.com/samir-adh/bytetorrent/src/stats"
 	"github.com/samir-adh/bytetorrent/src/tracker"
 	"github.com/ztrue/tracerr"
 )
@@ -20,8 +26,38 @@ type PeerConnection struct {
 	logger          *log.Logger
 	netConn         *net.Conn
 	unchocked		bool
+	DownloadLimit   ratelimit.Group // throttles the received blocks
+	availableMu     sync.Mutex
+	messages        chan *message.Message // read by readLoop, haves aside
+	haves           chan struct{}         // signaled when the peer announces a piece
+	done            chan struct{}         // closed by Close
+	readErr         error
+	Pipeline        int           // outstanding requests, DefaultPipeline when zero
+	SnubTimeout     time.Duration // wait for a block before the peer is snubbed
+	IdleTimeout     time.Duration // wait for a block before the peer is dropped
+	snubbed         atomic.Bool
+	lastBlock       time.Time
+	remoteId        [20]byte     // peer id sent in the handshake
+	choked          atomic.Bool  // the peer chokes us
+	interested      atomic.Bool  // we told the peer we are interested
+	Received        *stats.Meter // counts the blocks received
 }
 
+// Default request settings of a connection
+const (
+	DefaultPipeline    = 5
+	DefaultSnubTimeout = 30 * time.Second
+	DefaultIdleTimeout = 2 * time.Minute
+)
+
+// ErrSnubbed is returned by Download when the peer stopped sending blocks,
+// the next requests are sent one at a time
+var ErrSnubbed = errors.New("peer snubbed us")
+
+// ErrIdle is returned by Download when the peer sent no block for
+// IdleTimeout, or kept us choked that long
+var ErrIdle = errors.New("peer stayed idle")
+
 func New(selfId [20]byte, peer tracker.Peer, infoHash [20]byte, netConn *net.Conn, logger *log.Logger) (*PeerConnection, error) {
 
 	connection := PeerConnection{
@@ -31,6 +67,13 @@ func New(selfId [20]byte, peer tracker.Peer, infoHash [20]byte, netConn *net.Con
 		InfoHash:        infoHash,
 		logger:          logger,
 		netConn:         netConn,
+		messages:        make(chan *message.Message, 16),
+		haves:           make(chan struct{}, 1),
+		done:            make(chan struct{}),
+		SnubTimeout:     DefaultSnubTimeout,
+		IdleTimeout:     DefaultIdleTimeout,
+		lastBlock:       time.Now(),
+		Received:        &stats.Meter{},
 	}
 
 	err := connection.handshakeExchange()
@@ -55,9 +98,123 @@ func New(selfId [20]byte, peer tracker.Peer, infoHash [20]byte, netConn *net.Con
 	if err := connection.receiveUnchoke(); err != nil {
 		return nil, tracerr.Wrap(err)
 	}
+	go connection.readLoop()
 	return &connection, nil
 }
 
+// readLoop reads the messages of the peer until the connection fails or
+// is closed, haves update the available pieces and the other messages
+// are left to Download
+func (p *PeerConnection) readLoop() {
+	defer close(p.messages)
+	for {
+		msg, err := message.Read(*p.netConn)
+		if err != nil {
+			p.readErr = err
+			return
+		}
+		if msg.Id == message.MsgHave {
+			p.receiveHave(msg)
+			continue
+		}
+		select {
+		case p.messages <- msg:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *PeerConnection) receiveHave(msg *message.Message) {
+	if len(msg.Payload) != 4 {
+		return
+	}
+	index := int(binary.BigEndian.Uint32(msg.Payload))
+	p.availableMu.Lock()
+	defer p.availableMu.Unlock()
+	for _, available := range p.AvailablePieces {
+		if available == index {
+			return
+		}
+	}
+	p.AvailablePieces = append(p.AvailablePieces, index)
+	select {
+	case p.haves <- struct{}{}:
+	default:
+	}
+}
+
+// Available returns the number of pieces the peer has
+func (p *PeerConnection) Available() int {
+	p.availableMu.Lock()
+	defer p.availableMu.Unlock()
+	return len(p.AvailablePieces)
+}
+
+// Pieces returns the indexes of the pieces the peer has
+func (p *PeerConnection) Pieces() []int {
+	p.availableMu.Lock()
+	defer p.availableMu.Unlock()
+	return append([]int(nil), p.AvailablePieces...)
+}
+
+// Snubbed reports whether the last Download timed out waiting for a block
+func (p *PeerConnection) Snubbed() bool {
+	return p.snubbed.Load()
+}
+
+// Choked reports whether the peer chokes us
+func (p *PeerConnection) Choked() bool {
+	return p.choked.Load()
+}
+
+// Interested reports whether we told the peer we are interested in its
+// pieces
+func (p *PeerConnection) Interested() bool {
+	return p.interested.Load()
+}
+
+// RemoteId returns the peer id the peer sent in its handshake
+func (p *PeerConnection) RemoteId() [20]byte {
+	return p.remoteId
+}
+
+func (p *PeerConnection) pipeline() int {
+	if p.snubbed.Load() {
+		return 1
+	}
+	if p.Pipeline == 0 {
+		return DefaultPipeline
+	}
+	return p.Pipeline
+}
+
+// Haves is signaled when the peer announces a piece it didn't have
+func (p *PeerConnection) Haves() <-chan struct{} {
+	return p.haves
+}
+
+// SendHave tells the peer we downloaded the piece
+func (p *PeerConnection) SendHave(index int) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	msg := message.Message{
+		Id:      message.MsgHave,
+		Length:  uint32(len(payload) + 1),
+		Payload: payload,
+	}
+	if _, err := (*p.netConn).Write(msg.Serialize()); err != nil {
+		return tracerr.Wrap(err)
+	}
+	return nil
+}
+
+// Close stops reading messages from the peer, the connection itself is
+// closed by whoever opened it
+func (p *PeerConnection) Close() {
+	close(p.done)
+}
+
 func (connection *PeerConnection) handshakeExchange() error {
 	// Send handshake
 	sentHandshake, err := connection.SendHandShake()
@@ -75,6 +232,7 @@ func (connection *PeerConnection) handshakeExchange() error {
 	if err := VerifyHandshake(sentHandshake, receivedHandshake); err != nil {
 		return tracerr.Wrap(err)
 	}
+	connection.remoteId = receivedHandshake.PeerId
 	return nil
 }
 
@@ -100,6 +258,7 @@ func (p *PeerConnection) sendInterested() error {
 	if err != nil {
 		return tracerr.Wrap(err)
 	}
+	p.interested.Store(true)
 	return nil
 }
 
@@ -108,6 +267,13 @@ func (p *PeerConnection) receiveUnchoke() error {
 	if err != nil {
 		return tracerr.Wrap(err)
 	}
+	// A super seeder reveals pieces before unchoking us
+	for msg.Id == message.MsgHave {
+		p.receiveHave(msg)
+		if msg, err = message.Read(*p.netConn); err != nil {
+			return tracerr.Wrap(err)
+		}
+	}
 	if msg.Id != message.MsgUnchoke {
 		return fmt.Errorf("expected unchoke message, got %s", msg.Id.String())
 	}
@@ -195,6 +361,8 @@ func VerifyHandshake(sent *HandShake, received *HandShake) error {
 }
 
 func (p *PeerConnection) CanHandle(pieceIndex int) bool {
+	p.availableMu.Lock()
+	defer p.availableMu.Unlock()
 	for _, index := range p.AvailablePieces {
 		if index == pieceIndex {
 			return true
@@ -209,48 +377,93 @@ type block struct {
 	Data   []byte
 }
 
-func (p *PeerConnection) Download(piece *pc.Piece) (*pc.PieceResult, error) {
-	defaultBlockSize := 16384
-	blocksCount := piece.Length / defaultBlockSize
-	if piece.Length%defaultBlockSize != 0 {
-		blocksCount++
-	}
-	downloadedBlocks := 0
-	pieceBuffer := make([]byte, piece.Length)
-	for downloadedBlocks < blocksCount {
-		offset := downloadedBlocks * defaultBlockSize
-		blockSize := defaultBlockSize
-		if offset+defaultBlockSize > piece.Length {
-			blockSize = piece.Length - offset
+// Download requests the blocks of piece that partial is missing, partial
+// keeps those received even if the download fails. Up to Pipeline
+// requests are sent at once, one if the peer snubbed us. It returns
+// ErrSnubbed if no block arrives for SnubTimeout while unchoked, or
+// ErrIdle if the peer sent nothing or kept us choked for IdleTimeout. The
+// requests left are canceled then.
+func (p *PeerConnection) Download(piece *pc.Piece, partial *pc.Partial) (*pc.PieceResult, error) {
+	var missing []int
+	for i, received := range partial.Received {
+		if !received {
+			missing = append(missing, i)
 		}
-		if err := p.sendBlockRequest(piece, offset, blockSize); err != nil {
-			return nil, tracerr.Wrap(err)
+	}
+	blockSize := func(i int) int {
+		return min(pc.BlockLength, piece.Length-i*pc.BlockLength)
+	}
+	requested := make(map[int]bool)
+	choked := false
+	timer := time.NewTimer(p.SnubTimeout)
+	defer timer.Stop()
+	for len(missing) > 0 || len(requested) > 0 {
+		for !choked && len(missing) > 0 && len(requested) < p.pipeline() {
+			i := missing[0]
+			missing = missing[1:]
+			if err := p.sendBlockRequest(piece, i*pc.BlockLength, blockSize(i)); err != nil {
+				return nil, tracerr.Wrap(err)
+			}
+			requested[i] = true
 		}
-		response, err := message.Read(*p.netConn)
-		if err != nil {
-			return nil, tracerr.Wrap(err)
+		var response *message.Message
+		select {
+		case msg, ok := <-p.messages:
+			if !ok {
+				return nil, tracerr.Wrap(p.readErr)
+			}
+			response = msg
+		case <-timer.C:
+			// The peer would still send the blocks asked, which the next
+			// download of the piece would drop
+			for i := range requested {
+				if err := p.sendBlockCancel(piece, i*pc.BlockLength, blockSize(i)); err != nil {
+					return nil, tracerr.Wrap(err)
+				}
+			}
+			if choked || time.Since(p.lastBlock) >= p.IdleTimeout {
+				return nil, ErrIdle
+			}
+			p.snubbed.Store(true)
+			return nil, ErrSnubbed
 		}
 		switch response.Id {
 		default:
 			p.logger.Printf(log.HighVerbose, "expected message id %d, got %d\n", message.MsgPiece, response.Id)
-			continue
-			// return nil, fmt.Errorf("expected message id %d, got %d", message.MsgPiece, response.Id)
 		case message.MsgPiece :
+			if len(response.Payload) < 8 {
+				return nil, fmt.Errorf("malformed block of %d bytes", len(response.Payload))
+			}
 			block := parseBlockData(response.Payload)
-			copy(pieceBuffer[block.Offset:], block.Data)
-			downloadedBlocks++
-		
+			i := block.Offset / pc.BlockLength
+			if block.Index != piece.Index || block.Offset%pc.BlockLength != 0 || !requested[i] || len(block.Data) != blockSize(i) {
+				p.logger.Printf(log.HighVerbose, "ignoring unrequested block at %d of piece %d\n", block.Offset, block.Index)
+				continue
+			}
+			p.DownloadLimit.Wait(len(block.Data))
+			copy(partial.Data[block.Offset:], block.Data)
+			p.Received.Add(int64(len(block.Data)))
+			partial.Received[i] = true
+			delete(requested, i)
+			p.lastBlock = time.Now()
+			p.snubbed.Store(false)
+			timer.Reset(p.SnubTimeout)
 		case message.MsgChoke:
 			p.logger.Printf(log.HighVerbose, "client go chocked by peer %d, waiting for unchocke message\n",p.Peer.Id)
-			for {
-				response ,err := message.Read(*p.netConn)
-				if err != nil {
+			choked = true
+			p.choked.Store(true)
+			// Being choked isn't being snubbed
+			timer.Reset(p.IdleTimeout)
+		case message.MsgUnchoke:
+			p.logger.Printf(log.HighVerbose, "client go unchoked by peer %d \n", p.Peer.Id)
+			choked = false
+			p.choked.Store(false)
+			timer.Reset(p.SnubTimeout)
+			// Requests are dropped by a choke
+			for i := range requested {
+				if err := p.sendBlockRequest(piece, i*pc.BlockLength, blockSize(i)); err != nil {
 					return nil, tracerr.Wrap(err)
 				}
-				if response.Id == message.MsgUnchoke {
-					p.logger.Printf(log.HighVerbose, "client go unchoked by peer %d \n", p.Peer.Id)
-					break
-				}
 			}
 		}
 	}
@@ -275,7 +488,7 @@ func (p *PeerConnection) Download(piece *pc.Piece) (*pc.PieceResult, error) {
 
 	return &pc.PieceResult{
 		Index:   piece.Index,
-		Payload: pieceBuffer,
+		Payload: partial.Data,
 		State:   pc.Downloaded,
 	}, nil
 
@@ -294,6 +507,23 @@ func parseBlockData(payload []byte) *block {
 
 }
 
+// sendBlockCancel cancels a request sent by sendBlockRequest
+func (p *PeerConnection) sendBlockCancel(piece *pc.Piece, offset int, blockSize int) error {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(piece.Index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(offset))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(blockSize))
+	msg := message.Message{
+		Id:      message.MsgCancel,
+		Length:  uint32(len(payload) + 1),
+		Payload: payload,
+	}
+	if _, err := (*p.netConn).Write(msg.Serialize()); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (p *PeerConnection) sendBlockRequest(piece *pc.Piece, bytesDownloaded int, blockSize int) error {
 	payload := make([]byte, 12)
 	binary.BigEndian.PutUint32(payload[0:4], uint32(piece.Index))
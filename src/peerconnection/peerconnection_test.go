@@ -0,0 +1,97 @@
+package peerconnection
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/message"
+	pc "github.com/samir-adh/bytetorrent/src/piece"
+	"github.com/samir-adh/bytetorrent/src/tracker"
+)
+
+func write(conn net.Conn, msg message.Message) {
+	msg.Length = uint32(len(msg.Payload) + 1)
+	conn.Write(msg.Serialize())
+}
+
+// scriptedPeer connects to a peer having piece 0 which unchokes us, the
+// returned connection plays its side from there
+func scriptedPeer(t *testing.T) (*PeerConnection, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	go func() {
+		handshake := make([]byte, 68)
+		if _, err := io.ReadFull(remote, handshake); err != nil {
+			return
+		}
+		remote.Write(handshake)
+		write(remote, message.Message{Id: message.MsgBitfield, Payload: []byte{0x80}})
+		message.Read(remote)
+		write(remote, message.Message{Id: message.MsgUnchoke})
+	}()
+	p, err := New([20]byte{}, tracker.Peer{}, [20]byte{}, &local, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p, remote
+}
+
+func TestChokedIsNotSnubbed(t *testing.T) {
+	p, remote := scriptedPeer(t)
+	p.SnubTimeout = 50 * time.Millisecond
+	go func() {
+		message.Read(remote)
+		write(remote, message.Message{Id: message.MsgChoke})
+		time.Sleep(200 * time.Millisecond)
+		write(remote, message.Message{Id: message.MsgUnchoke})
+		// The request dropped by the choke is sent again
+		request, err := message.Read(remote)
+		if err != nil {
+			return
+		}
+		write(remote, message.Message{Id: message.MsgPiece, Payload: append(request.Payload[:8], make([]byte, pc.BlockLength)...)})
+	}()
+	piece := &pc.Piece{Index: 0, Length: pc.BlockLength}
+	if _, err := p.Download(piece, pc.NewPartial(piece.Length)); err != nil {
+		t.Fatalf("expected the block after the unchoke, got %v", err)
+	}
+	if p.Snubbed() {
+		t.Errorf("expected a peer choking us not to be snubbed")
+	}
+}
+
+func TestSnubCancelsRequests(t *testing.T) {
+	p, remote := scriptedPeer(t)
+	p.SnubTimeout = 50 * time.Millisecond
+	canceled := make(chan []byte, 1)
+	go func() {
+		message.Read(remote)
+		msg, err := message.Read(remote)
+		if err == nil && msg.Id == message.MsgCancel {
+			canceled <- msg.Payload
+		}
+		close(canceled)
+	}()
+	piece := &pc.Piece{Index: 0, Length: pc.BlockLength}
+	if _, err := p.Download(piece, pc.NewPartial(piece.Length)); !errors.Is(err, ErrSnubbed) {
+		t.Fatalf("expected the peer to snub us, got %v", err)
+	}
+	var payload []byte
+	select {
+	case payload = <-canceled:
+	case <-time.After(time.Second):
+	}
+	if len(payload) != 12 || binary.BigEndian.Uint32(payload[8:]) != pc.BlockLength {
+		t.Errorf("expected the request to be canceled, got %v", payload)
+	}
+}
@@ -0,0 +1,191 @@
+package peerconnection
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/message"
+	"github.com/samir-adh/bytetorrent/src/ratelimit"
+	"github.com/ztrue/tracerr"
+)
+
+// MaxBlockLength is the largest block a peer may request
+const MaxBlockLength = 128 * 1024
+
+// ServeIdleTimeout is how long a peer we serve may send nothing, they
+// send keep-alives every two minutes
+const ServeIdleTimeout = 3 * time.Minute
+
+// Source provides the pieces uploaded to peers
+type Source interface {
+	PieceCount() int
+	Has(piece int) bool
+	ReadBlock(piece int, offset int, length int) ([]byte, error)
+	// PeerInterested is called when the peer becomes interested in the
+	// pieces of the source or stops being interested
+	PeerInterested(interested bool)
+}
+
+// deadlineReader pushes back the read deadline of conn on every read, a
+// peer sending keep-alives stays connected
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r deadlineReader) Read(b []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(b)
+}
+
+// ReadHandShake reads the handshake a peer sends when it connects to us
+func ReadHandShake(conn net.Conn) (*HandShake, error) {
+	buf := make([]byte, 68)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	if buf[0] != 19 || string(buf[1:20]) != "BitTorrent protocol" {
+		return nil, fmt.Errorf("unexpected protocol in handshake")
+	}
+	handshake := UnserializeHandshake(buf)
+	return &handshake, nil
+}
+
+// Serve uploads pieces of source to a peer whose handshake was already
+// exchanged, until the connection fails or is closed. The blocks sent
+// are throttled by limit. With superSeed, the peer is sent an empty
+// bitfield and the pieces it reveals instead of all of them.
+func Serve(conn net.Conn, source Source, limit ratelimit.Group, superSeed *SuperSeed, logger *log.Logger) error {
+	w := &writer{conn: conn}
+	var peer *superPeer
+	if superSeed != nil {
+		empty := make([]byte, (source.PieceCount()+7)/8)
+		if err := w.send(message.Message{Id: message.MsgBitfield, Payload: empty}); err != nil {
+			return err
+		}
+		peer = superSeed.join()
+		defer superSeed.leave(peer)
+		go func() {
+			for piece := range peer.offers {
+				if err := w.send(have(piece)); err != nil {
+					return
+				}
+			}
+		}()
+	} else if err := w.send(message.Message{Id: message.MsgBitfield, Payload: bitfield(source)}); err != nil {
+		return err
+	}
+	interested := false
+	defer func() {
+		if interested {
+			source.PeerInterested(false)
+		}
+	}()
+	reader := deadlineReader{conn: conn, timeout: ServeIdleTimeout}
+	for {
+		msg, err := message.Read(reader)
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch msg.Id {
+		case message.MsgInterested:
+			if !interested {
+				interested = true
+				source.PeerInterested(true)
+			}
+			err = w.send(message.Message{Id: message.MsgUnchoke})
+		case message.MsgNotInterested:
+			if interested {
+				interested = false
+				source.PeerInterested(false)
+			}
+			err = w.send(message.Message{Id: message.MsgChoke})
+		case message.MsgHave:
+			if peer != nil && len(msg.Payload) == 4 {
+				superSeed.have(peer, int(binary.BigEndian.Uint32(msg.Payload)))
+			}
+		case message.MsgBitfield:
+			if peer != nil {
+				superSeed.bitfield(peer, msg.Payload)
+			}
+		case message.MsgRequest:
+			if peer != nil && len(msg.Payload) == 12 && !superSeed.allowed(peer, int(binary.BigEndian.Uint32(msg.Payload))) {
+				logger.Printf(log.HighVerbose, "ignoring request of a hidden piece from %s\n", conn.RemoteAddr())
+				continue
+			}
+			err = serveRequest(w, source, limit, msg.Payload)
+		default:
+			logger.Printf(log.HighVerbose, "ignoring %s message from %s\n", msg.Id.String(), conn.RemoteAddr())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func serveRequest(w *writer, source Source, limit ratelimit.Group, payload []byte) error {
+	if len(payload) != 12 {
+		return fmt.Errorf("malformed request of %d bytes", len(payload))
+	}
+	index := int(binary.BigEndian.Uint32(payload[0:4]))
+	offset := int(binary.BigEndian.Uint32(payload[4:8]))
+	length := int(binary.BigEndian.Uint32(payload[8:12]))
+	if length > MaxBlockLength {
+		return fmt.Errorf("requested block of %d bytes is too large", length)
+	}
+	if index >= source.PieceCount() || !source.Has(index) {
+		return fmt.Errorf("requested piece %d we don't have", index)
+	}
+	data, err := source.ReadBlock(index, offset, length)
+	if err != nil {
+		return err
+	}
+	limit.Wait(len(data))
+	block := make([]byte, 8+len(data))
+	copy(block, payload[0:8])
+	copy(block[8:], data)
+	return w.send(message.Message{Id: message.MsgPiece, Payload: block})
+}
+
+func bitfield(source Source) []byte {
+	field := make([]byte, (source.PieceCount()+7)/8)
+	for i := range source.PieceCount() {
+		if source.Has(i) {
+			field[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return field
+}
+
+func have(piece int) message.Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(piece))
+	return message.Message{Id: message.MsgHave, Payload: payload}
+}
+
+// writer serializes the messages Serve and the super seed offers write
+// to a peer
+type writer struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// send writes msg, its length is derived from the payload
+func (w *writer) send(msg message.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	msg.Length = uint32(len(msg.Payload) + 1)
+	if _, err := w.conn.Write(msg.Serialize()); err != nil {
+		return tracerr.Wrap(err)
+	}
+	return nil
+}
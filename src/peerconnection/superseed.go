@@ -0,0 +1,127 @@
+package peerconnection
+
+import "sync"
+
+// SuperSeed hides the pieces of a seeder and reveals them to each peer
+// one at a time, rarest first, as described by BEP 16. A peer is shown a
+// new piece once the last one it was shown reached another peer. It is
+// shared by the connections of a torrent.
+type SuperSeed struct {
+	mu        sync.Mutex
+	source    Source
+	available []int // connected peers that have each piece
+	revealed  []int // times each piece was revealed
+	peers     map[*superPeer]struct{}
+}
+
+// superPeer is the state of a peer connected to a super seeder
+type superPeer struct {
+	has      []bool
+	pending  int          // revealed piece not yet seen at another peer, -1 if none
+	revealed map[int]bool // pieces the peer may request
+	offers   chan int     // pieces to announce with a have
+}
+
+func NewSuperSeed(source Source) *SuperSeed {
+	return &SuperSeed{
+		source:    source,
+		available: make([]int, source.PieceCount()),
+		revealed:  make([]int, source.PieceCount()),
+		peers:     make(map[*superPeer]struct{}),
+	}
+}
+
+// join registers a peer and reveals its first piece
+func (s *SuperSeed) join() *superPeer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer := &superPeer{
+		has:      make([]bool, len(s.available)),
+		pending:  -1,
+		revealed: make(map[int]bool),
+		// A piece is revealed at most once to a peer, sends never block
+		offers: make(chan int, len(s.available)),
+	}
+	s.peers[peer] = struct{}{}
+	s.reveal(peer)
+	return peer
+}
+
+// leave forgets a disconnected peer and closes its offers
+func (s *SuperSeed) leave(peer *superPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, peer)
+	for i, has := range peer.has {
+		if has {
+			s.available[i]--
+		}
+	}
+	close(peer.offers)
+}
+
+// bitfield records the pieces a peer announced when it connected
+func (s *SuperSeed) bitfield(peer *superPeer, field []byte) {
+	for i := range peer.has {
+		if i/8 < len(field) && field[i/8]&(1<<(7-i%8)) != 0 {
+			s.have(peer, i)
+		}
+	}
+}
+
+// have records that a peer got a piece, which frees the peers that were
+// waiting for the piece to spread
+func (s *SuperSeed) have(peer *superPeer, piece int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if piece < 0 || piece >= len(peer.has) || peer.has[piece] {
+		return
+	}
+	peer.has[piece] = true
+	s.available[piece]++
+	for other := range s.peers {
+		if other != peer && other.pending == piece {
+			other.pending = -1
+			s.reveal(other)
+		}
+	}
+	if peer.pending != piece {
+		return
+	}
+	// Nobody else can get the piece from it, don't wait for them
+	for other := range s.peers {
+		if other != peer && !other.has[piece] {
+			return
+		}
+	}
+	peer.pending = -1
+	s.reveal(peer)
+}
+
+// allowed reports whether the peer may request the piece
+func (s *SuperSeed) allowed(peer *superPeer, piece int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return peer.revealed[piece]
+}
+
+// reveal offers the peer the piece the fewest peers have, s.mu must be
+// held
+func (s *SuperSeed) reveal(peer *superPeer) {
+	best := -1
+	for i := range s.available {
+		if peer.has[i] || peer.revealed[i] || !s.source.Has(i) {
+			continue
+		}
+		if best < 0 || s.available[i]+s.revealed[i] < s.available[best]+s.revealed[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return
+	}
+	s.revealed[best]++
+	peer.revealed[best] = true
+	peer.pending = best
+	peer.offers <- best
+}
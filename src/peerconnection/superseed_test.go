@@ -0,0 +1,55 @@
+package peerconnection
+
+import "testing"
+
+type fullSource int
+
+func (s fullSource) PieceCount() int                                     { return int(s) }
+func (s fullSource) Has(piece int) bool                                  { return true }
+func (s fullSource) ReadBlock(piece, offset, length int) ([]byte, error) { return nil, nil }
+func (s fullSource) PeerInterested(interested bool)                      {}
+
+// offers returns the pieces revealed to the peer so far
+func offers(peer *superPeer) []int {
+	var pieces []int
+	for {
+		select {
+		case piece := <-peer.offers:
+			pieces = append(pieces, piece)
+		default:
+			return pieces
+		}
+	}
+}
+
+func TestSuperSeed(t *testing.T) {
+	s := NewSuperSeed(fullSource(4))
+	a := s.join()
+	b := s.join()
+	if got := offers(a); len(got) != 1 || got[0] != 0 {
+		t.Fatalf("expected first peer to be shown piece 0, got %v", got)
+	}
+	if got := offers(b); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("expected second peer to be shown piece 1, got %v", got)
+	}
+	if !s.allowed(b, 1) || s.allowed(b, 0) {
+		t.Errorf("expected second peer to only request piece 1")
+	}
+
+	// The piece hasn't reached another peer yet
+	s.have(a, 0)
+	if got := offers(a); len(got) != 0 {
+		t.Errorf("expected no new piece before piece 0 spreads, got %v", got)
+	}
+	s.have(b, 0)
+	if got := offers(a); len(got) != 1 || got[0] != 2 {
+		t.Errorf("expected the rarest piece 2 once piece 0 spread, got %v", got)
+	}
+
+	// Alone, a peer is shown the next piece as soon as it has its own
+	s.leave(a)
+	s.have(b, 1)
+	if got := offers(b); len(got) != 1 || got[0] != 3 {
+		t.Errorf("expected the last peer to be shown the unrevealed piece 3, got %v", got)
+	}
+}
@@ -0,0 +1,249 @@
+package picker
+
+import "sync"
+
+type Priority int
+
+const (
+	// Skip pieces are not downloaded
+	Skip Priority = iota
+	Low
+	Normal
+	High
+)
+
+func (p Priority) String() string {
+	switch p {
+	case Skip:
+		return "skip"
+	case Low:
+		return "low"
+	case Normal:
+		return "normal"
+	case High:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// ParsePriority is the inverse of Priority.String
+func ParsePriority(s string) (Priority, bool) {
+	for _, priority := range []Priority{Skip, Low, Normal, High} {
+		if priority.String() == s {
+			return priority, true
+		}
+	}
+	return Normal, false
+}
+
+type pieceState int
+
+const (
+	wanted  pieceState = iota
+	pending            // being downloaded
+	done
+)
+
+// Picker decides which piece each worker downloads next, pieces with
+// a higher priority go first and skipped pieces are never handed out.
+//
+// In sequential mode pieces are taken in order from the playhead, and
+// the readahead pieces after it go before any other. Urgent pieces, the
+// ones a reader is blocked on, go before everything else.
+type Picker struct {
+	mu         sync.Mutex
+	priorities []Priority
+	states     []pieceState
+	urgent     []int // number of readers waiting on each piece
+	sequential bool
+	playhead   int
+	readahead  int
+	changed    chan struct{}
+}
+
+// New returns a picker for pieceCount pieces of normal priority
+func New(pieceCount int) *Picker {
+	priorities := make([]Priority, pieceCount)
+	for i := range priorities {
+		priorities[i] = Normal
+	}
+	return &Picker{
+		priorities: priorities,
+		states:     make([]pieceState, pieceCount),
+		urgent:     make([]int, pieceCount),
+		changed:    make(chan struct{}),
+	}
+}
+
+// signal wakes up the workers waiting on Changed, p.mu must be held
+func (p *Picker) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Changed returns a channel closed the next time a piece becomes
+// available or is completed.
+func (p *Picker) Changed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.changed
+}
+
+func (p *Picker) SetPriority(piece int, priority Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.priorities[piece] = priority
+	p.signal()
+}
+
+func (p *Picker) Priority(piece int) Priority {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.priorities[piece]
+}
+
+// SetSequential switches sequential mode on or off, readahead is the
+// number of pieces after the playhead that are fetched first.
+func (p *Picker) SetSequential(sequential bool, readahead int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sequential = sequential
+	p.readahead = max(readahead, 1)
+	p.signal()
+}
+
+// SetPlayhead moves the position sequential mode downloads from
+func (p *Picker) SetPlayhead(piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.playhead = min(max(piece, 0), len(p.states)-1)
+	p.signal()
+}
+
+// Urge puts the piece ahead of every other one until Release is called,
+// even if it is skipped.
+func (p *Picker) Urge(piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.urgent[piece]++
+	p.signal()
+}
+
+// Release undoes a call to Urge
+func (p *Picker) Release(piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.urgent[piece] > 0 {
+		p.urgent[piece]--
+	}
+}
+
+// isWanted reports whether the piece should be downloaded, p.mu must be held
+func (p *Picker) isWanted(piece int) bool {
+	return p.priorities[piece] != Skip || p.urgent[piece] > 0
+}
+
+// rank orders the pieces, the lowest rank is picked first. p.mu must be held.
+func (p *Picker) rank(piece int) int {
+	count := len(p.states)
+	// Pieces are ordered by index within a priority class
+	order := piece
+	if p.sequential {
+		// Pieces behind the playhead go last
+		order = (piece - p.playhead + count) % count
+	}
+	class := int(High - p.priorities[piece])
+	if p.sequential && order < p.readahead {
+		class = -1
+	}
+	if p.urgent[piece] > 0 {
+		class = -2
+	}
+	return class*count + order
+}
+
+// Pick reserves the first piece left for which has returns true, the
+// second value is false when there is none.
+func (p *Picker) Pick(has func(piece int) bool) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best, bestRank := -1, 0
+	for i, state := range p.states {
+		if state != wanted || !p.isWanted(i) {
+			continue
+		}
+		rank := p.rank(i)
+		if best >= 0 && rank >= bestRank {
+			continue
+		}
+		if has(i) {
+			best, bestRank = i, rank
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	p.states[best] = pending
+	return best, true
+}
+
+// Return makes a picked piece available again after a failed download
+func (p *Picker) Return(piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.states[piece] == pending {
+		p.states[piece] = wanted
+		p.signal()
+	}
+}
+
+// ReturnPending makes every picked piece available again
+func (p *Picker) ReturnPending() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, state := range p.states {
+		if state == pending {
+			p.states[i] = wanted
+		}
+	}
+	p.signal()
+}
+
+// Done records that the piece was downloaded and verified
+func (p *Picker) Done(piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.states[piece] = done
+	p.signal()
+}
+
+// IsDone reports whether the piece was downloaded
+func (p *Picker) IsDone(piece int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.states[piece] == done
+}
+
+// Progress returns the number of downloaded and wanted pieces, skipped
+// pieces that were downloaded anyway are counted in both.
+func (p *Picker) Progress() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	completed, wantedCount := 0, 0
+	for i, state := range p.states {
+		if state == done {
+			completed++
+			wantedCount++
+		} else if p.isWanted(i) {
+			wantedCount++
+		}
+	}
+	return completed, wantedCount
+}
+
+// Complete reports whether every piece that isn't skipped is downloaded
+func (p *Picker) Complete() bool {
+	completed, wantedCount := p.Progress()
+	return completed == wantedCount
+}
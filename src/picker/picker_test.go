@@ -0,0 +1,73 @@
+package picker
+
+import "testing"
+
+func all(int) bool { return true }
+
+func TestPickByPriority(t *testing.T) {
+	p := New(4)
+	p.SetPriority(0, Skip)
+	p.SetPriority(2, High)
+	p.SetPriority(3, Low)
+
+	for _, expected := range []int{2, 1, 3} {
+		piece, ok := p.Pick(all)
+		if !ok || piece != expected {
+			t.Fatalf("picked %d (%v), expected %d", piece, ok, expected)
+		}
+	}
+	if piece, ok := p.Pick(all); ok {
+		t.Errorf("picked skipped piece %d", piece)
+	}
+}
+
+func TestPickOnlyAvailablePieces(t *testing.T) {
+	p := New(3)
+	piece, ok := p.Pick(func(index int) bool { return index == 2 })
+	if !ok || piece != 2 {
+		t.Fatalf("picked %d (%v), expected 2", piece, ok)
+	}
+	if _, ok := p.Pick(func(index int) bool { return index == 2 }); ok {
+		t.Errorf("piece 2 was picked twice")
+	}
+}
+
+func TestReturnAndComplete(t *testing.T) {
+	p := New(2)
+	p.SetPriority(1, Skip)
+	changed := p.Changed()
+	piece, _ := p.Pick(all)
+	p.Return(piece)
+	select {
+	case <-changed:
+	default:
+		t.Errorf("expected returning a piece to signal a change")
+	}
+	piece, ok := p.Pick(all)
+	if !ok || piece != 0 {
+		t.Fatalf("expected returned piece to be picked again")
+	}
+	if p.Complete() {
+		t.Errorf("download shouldn't be complete yet")
+	}
+	p.Done(piece)
+	if !p.Complete() {
+		t.Errorf("download should be complete once every wanted piece is done")
+	}
+}
+
+func TestSequential(t *testing.T) {
+	p := New(6)
+	p.SetPriority(5, High)
+	p.SetSequential(true, 2)
+	p.SetPlayhead(2)
+	p.Urge(0)
+
+	// Urgent piece, readahead window, then by priority from the playhead
+	for _, expected := range []int{0, 2, 3, 5, 4, 1} {
+		piece, ok := p.Pick(all)
+		if !ok || piece != expected {
+			t.Fatalf("picked %d (%v), expected %d", piece, ok, expected)
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package piece
 
+import (
+	"crypto/sha1"
+
+	"github.com/samir-adh/bytetorrent/src/merkle"
+)
+
 type PieceState int
 
 const (
@@ -11,8 +17,44 @@ const (
 
 type Piece struct {
 	Index  int
-	Hash   [20]byte
+	Hash   [20]byte // SHA-1 hash, zero for pure v2 torrents
 	Length int
+	HashV2 *HashV2 // set for v2 and hybrid torrents
+}
+
+// HashV2 is the merkle root a piece of a v2 torrent is verified against
+type HashV2 struct {
+	Root   [32]byte // piece layer hash, or pieces root of a file fitting in one piece
+	Leaves int      // number of 16 KiB leaves of the tree
+	Length int      // bytes of the piece belonging to the file, padding excluded
+}
+
+// BlockLength is the size of the blocks pieces are requested in, the
+// size of the merkle leaves
+const BlockLength = merkle.BlockSize
+
+// Partial holds the blocks of a piece received so far, they can be kept
+// when a download fails to only request the others from the next peer
+type Partial struct {
+	Data     []byte
+	Received []bool // whether each block was received
+}
+
+func NewPartial(length int) *Partial {
+	return &Partial{
+		Data:     make([]byte, length),
+		Received: make([]bool, (length+BlockLength-1)/BlockLength),
+	}
+}
+
+// Any reports whether a block was received
+func (p *Partial) Any() bool {
+	for _, received := range p.Received {
+		if received {
+			return true
+		}
+	}
+	return false
 }
 
 type PieceResult struct {
@@ -20,3 +62,19 @@ type PieceResult struct {
 	Payload []byte
 	State   PieceState
 }
+
+// Verify checks the downloaded payload against the hashes of the piece
+func (p *Piece) Verify(payload []byte) bool {
+	if len(payload) != p.Length {
+		return false
+	}
+	if p.HashV2 != nil {
+		if merkle.PieceRoot(payload[:p.HashV2.Length], p.HashV2.Leaves) != p.HashV2.Root {
+			return false
+		}
+		if p.Hash == [20]byte{} {
+			return true
+		}
+	}
+	return sha1.Sum(payload) == p.Hash
+}
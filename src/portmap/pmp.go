@@ -0,0 +1,230 @@
+package portmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ztrue/tracerr"
+)
+
+// PMPPort is the port PCP and NAT-PMP servers listen on
+const PMPPort = "5351"
+
+const (
+	pmpTries       = 4
+	defaultTimeout = 250 * time.Millisecond
+
+	pcpVersion    = 2
+	pcpOpMap      = 1
+	pcpResponse   = 0x80
+	pcpMapLength  = 60
+	pcpUnsupp     = 1 // UNSUPP_VERSION
+	natpmpVersion = 0
+	natpmpOpAddr  = 0
+	natpmpOpUDP   = 1
+	natpmpOpTCP   = 2
+)
+
+var errUnsupportedVersion = errors.New("gateway doesn't speak PCP")
+
+// PMP maps ports with PCP (RFC 6887), falling back to NAT-PMP (RFC 6886)
+// for routers that only speak the older protocol
+type PMP struct {
+	Addr    string        // host:port of the gateway
+	Timeout time.Duration // wait for the first answer, doubled on each retry, 250ms when zero
+
+	mu         sync.Mutex
+	natpmp     bool   // the gateway answered PCP requests with NAT-PMP
+	externalIP net.IP // as reported by NAT-PMP
+}
+
+func NewPMP(addr string) *PMP {
+	return &PMP{Addr: addr}
+}
+
+func (p *PMP) String() string {
+	return "PCP/NAT-PMP gateway " + p.Addr
+}
+
+func (p *PMP) AddMapping(ctx context.Context, mapping Mapping) (Mapping, error) {
+	p.mu.Lock()
+	natpmp := p.natpmp
+	p.mu.Unlock()
+	if !natpmp {
+		granted, err := p.pcpMap(ctx, mapping)
+		if !errors.Is(err, errUnsupportedVersion) {
+			return granted, err
+		}
+		p.mu.Lock()
+		p.natpmp = true
+		p.mu.Unlock()
+	}
+	return p.natpmpMap(ctx, mapping)
+}
+
+// DeleteMapping requests a lifetime of zero for the mapping
+func (p *PMP) DeleteMapping(ctx context.Context, mapping Mapping) error {
+	mapping.Lifetime = 0
+	p.mu.Lock()
+	natpmp := p.natpmp
+	p.mu.Unlock()
+	if natpmp {
+		mapping.External = 0
+		_, err := p.natpmpMap(ctx, mapping)
+		return err
+	}
+	_, err := p.pcpMap(ctx, mapping)
+	return err
+}
+
+func (p *PMP) pcpMap(ctx context.Context, mapping Mapping) (Mapping, error) {
+	if mapping.nonce == [12]byte{} {
+		rand.Read(mapping.nonce[:])
+	}
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return Mapping{}, err
+	}
+	defer conn.Close()
+	protocol := byte(6)
+	if mapping.Protocol == UDP {
+		protocol = 17
+	}
+	request := make([]byte, pcpMapLength)
+	request[0] = pcpVersion
+	request[1] = pcpOpMap
+	binary.BigEndian.PutUint32(request[4:8], uint32(mapping.Lifetime/time.Second))
+	copy(request[8:24], conn.LocalAddr().(*net.UDPAddr).IP.To16())
+	copy(request[24:36], mapping.nonce[:])
+	request[36] = protocol
+	binary.BigEndian.PutUint16(request[40:42], uint16(mapping.Internal))
+	binary.BigEndian.PutUint16(request[42:44], uint16(mapping.External))
+	copy(request[44:60], net.IPv4zero.To16())
+	response, err := p.exchange(ctx, conn, request, func(response []byte) bool {
+		if len(response) >= 4 && response[0] == natpmpVersion {
+			return true
+		}
+		return len(response) >= pcpMapLength && response[1] == pcpResponse|pcpOpMap &&
+			bytes.Equal(response[24:36], mapping.nonce[:])
+	})
+	if err != nil {
+		return Mapping{}, err
+	}
+	if response[0] == natpmpVersion || response[3] == pcpUnsupp {
+		return Mapping{}, errUnsupportedVersion
+	}
+	if response[3] != 0 {
+		return Mapping{}, fmt.Errorf("PCP gateway %s refused the mapping: result %d", p.Addr, response[3])
+	}
+	mapping.Lifetime = time.Duration(binary.BigEndian.Uint32(response[4:8])) * time.Second
+	mapping.External = int(binary.BigEndian.Uint16(response[42:44]))
+	mapping.ExternalIP = net.IP(bytes.Clone(response[44:60]))
+	if ip4 := mapping.ExternalIP.To4(); ip4 != nil {
+		mapping.ExternalIP = ip4
+	}
+	return mapping, nil
+}
+
+func (p *PMP) natpmpMap(ctx context.Context, mapping Mapping) (Mapping, error) {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return Mapping{}, err
+	}
+	defer conn.Close()
+	op := byte(natpmpOpTCP)
+	if mapping.Protocol == UDP {
+		op = natpmpOpUDP
+	}
+	request := make([]byte, 12)
+	request[1] = op
+	binary.BigEndian.PutUint16(request[4:6], uint16(mapping.Internal))
+	binary.BigEndian.PutUint16(request[6:8], uint16(mapping.External))
+	binary.BigEndian.PutUint32(request[8:12], uint32(mapping.Lifetime/time.Second))
+	response, err := p.exchange(ctx, conn, request, func(response []byte) bool {
+		return len(response) >= 16 && response[1] == pcpResponse|op &&
+			binary.BigEndian.Uint16(response[8:10]) == uint16(mapping.Internal)
+	})
+	if err != nil {
+		return Mapping{}, err
+	}
+	if result := binary.BigEndian.Uint16(response[2:4]); result != 0 {
+		return Mapping{}, fmt.Errorf("NAT-PMP gateway %s refused the mapping: result %d", p.Addr, result)
+	}
+	mapping.External = int(binary.BigEndian.Uint16(response[10:12]))
+	mapping.Lifetime = time.Duration(binary.BigEndian.Uint32(response[12:16])) * time.Second
+	if mapping.Lifetime == 0 {
+		// Deleted
+		return mapping, nil
+	}
+	// NAT-PMP reports the external address separately
+	p.mu.Lock()
+	externalIP := p.externalIP
+	p.mu.Unlock()
+	if externalIP == nil {
+		response, err := p.exchange(ctx, conn, []byte{natpmpVersion, natpmpOpAddr}, func(response []byte) bool {
+			return len(response) >= 12 && response[1] == pcpResponse|natpmpOpAddr
+		})
+		if err != nil {
+			return Mapping{}, err
+		}
+		externalIP = net.IP(bytes.Clone(response[8:12]))
+		p.mu.Lock()
+		p.externalIP = externalIP
+		p.mu.Unlock()
+	}
+	mapping.ExternalIP = externalIP
+	return mapping, nil
+}
+
+func (p *PMP) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", p.Addr)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	return conn, nil
+}
+
+// exchange sends request until the gateway answers with a response
+// accepted by match, waiting twice as long after each try
+func (p *PMP) exchange(ctx context.Context, conn net.Conn, request []byte, match func([]byte) bool) ([]byte, error) {
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+	wait := p.Timeout
+	if wait == 0 {
+		wait = defaultTimeout
+	}
+	buffer := make([]byte, 1100)
+	for try := 0; try < pmpTries; try++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, tracerr.Wrap(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+		for {
+			n, err := conn.Read(buffer)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				// Nothing listens on the gateway
+				return nil, tracerr.Wrap(err)
+			}
+			if match(buffer[:n]) {
+				return bytes.Clone(buffer[:n]), nil
+			}
+		}
+		wait *= 2
+	}
+	return nil, fmt.Errorf("gateway %s didn't answer", p.Addr)
+}
@@ -0,0 +1,289 @@
+package portmap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/log"
+)
+
+const (
+	TCP = "TCP"
+	UDP = "UDP"
+)
+
+// Mapping is a port forwarded by a gateway to this host
+type Mapping struct {
+	Protocol   string // TCP or UDP
+	Internal   int    // port on this host
+	External   int    // port on the gateway, a suggestion when requesting
+	ExternalIP net.IP
+	Lifetime   time.Duration // zero for a mapping that doesn't expire
+	nonce      [12]byte      // identifies a PCP mapping
+}
+
+// Gateway is a router that can forward ports, over UPnP IGD or
+// PCP/NAT-PMP
+type Gateway interface {
+	// AddMapping creates or renews a mapping, the returned one is what the
+	// gateway granted
+	AddMapping(ctx context.Context, mapping Mapping) (Mapping, error)
+	DeleteMapping(ctx context.Context, mapping Mapping) error
+}
+
+// ErrNoGateway is returned when no gateway on the network maps ports
+var ErrNoGateway = errors.New("no gateway mapping ports found")
+
+const (
+	leaseTime     = time.Hour
+	retryInterval = 5 * time.Minute
+	deleteTimeout = 2 * time.Second
+)
+
+// Mapper keeps the TCP and UDP ports of the session mapped on the
+// gateway, renews the leases and removes the mappings when closed.
+type Mapper struct {
+	Gateways []Gateway // tried in order, discovered on the network when nil
+
+	port     int
+	logger   *log.Logger
+	mu       sync.Mutex
+	gateway  Gateway // the gateway that accepted the mappings
+	mappings []Mapping
+	mapped   chan struct{} // closed once the ports are first mapped
+	tried    chan struct{} // closed once the first attempt to map them ended
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	started  bool
+	once     sync.Once
+}
+
+func New(port int, logger *log.Logger) *Mapper {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Mapper{
+		port:   port,
+		logger: logger,
+		mapped: make(chan struct{}),
+		tried:  make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// Start maps the ports in the background
+func (m *Mapper) Start() {
+	m.mu.Lock()
+	m.started = true
+	m.mu.Unlock()
+	go m.run()
+}
+
+// Mapped is closed once the ports are first mapped
+func (m *Mapper) Mapped() <-chan struct{} {
+	return m.mapped
+}
+
+// Wait waits up to timeout for the first attempt to map the ports to
+// end, then returns External. A nil mapper returns right away.
+func (m *Mapper) Wait(timeout time.Duration) (net.IP, int) {
+	if m == nil {
+		return nil, 0
+	}
+	select {
+	case <-m.tried:
+	case <-time.After(timeout):
+	}
+	return m.External()
+}
+
+// External returns the address peers reach us at, nil and 0 while the
+// TCP port isn't mapped. A nil mapper has no external address.
+func (m *Mapper) External() (net.IP, int) {
+	if m == nil {
+		return nil, 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mapping := range m.mappings {
+		if mapping.Protocol == TCP {
+			return mapping.ExternalIP, mapping.External
+		}
+	}
+	return nil, 0
+}
+
+// Close stops renewing the leases and removes the mappings
+func (m *Mapper) Close() {
+	if m == nil {
+		return
+	}
+	m.once.Do(func() {
+		m.cancel()
+		m.mu.Lock()
+		started := m.started
+		m.mu.Unlock()
+		if started {
+			<-m.done
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
+		defer cancel()
+		for _, mapping := range m.mappings {
+			if err := m.gateway.DeleteMapping(ctx, mapping); err != nil {
+				m.logger.Printf(log.HighVerbose, "could not remove %s port mapping %d: %s\n", mapping.Protocol, mapping.External, err)
+			}
+		}
+		m.mappings = nil
+	})
+}
+
+func (m *Mapper) run() {
+	defer close(m.done)
+	tried := sync.OnceFunc(func() { close(m.tried) })
+	defer tried()
+	for {
+		wait := retryInterval
+		if err := m.update(); err != nil {
+			m.logger.Printf(log.HighVerbose, "port mapping failed: %s\n", err)
+		} else {
+			wait = m.renewal()
+		}
+		tried()
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// update renews the mappings, or looks for a gateway to map the ports
+// on when there are none
+func (m *Mapper) update() error {
+	m.mu.Lock()
+	gateway, mappings := m.gateway, m.mappings
+	m.mu.Unlock()
+	if gateway != nil {
+		renewed, err := mapPorts(m.ctx, gateway, mappings)
+		if err == nil {
+			m.set(gateway, renewed)
+			return nil
+		}
+		// The gateway may have been replaced, look for one again
+		m.set(nil, nil)
+		return err
+	}
+	requested := []Mapping{
+		{Protocol: TCP, Internal: m.port, External: m.port, Lifetime: leaseTime},
+		{Protocol: UDP, Internal: m.port, External: m.port, Lifetime: leaseTime},
+	}
+	gateways := m.Gateways
+	if gateways == nil {
+		if ip, err := DefaultGateway(); err == nil {
+			gateways = []Gateway{NewPMP(net.JoinHostPort(ip.String(), PMPPort))}
+		}
+	}
+	err := ErrNoGateway
+	for _, gateway := range gateways {
+		if err = m.tryGateway(gateway, requested); err == nil {
+			return nil
+		}
+	}
+	if m.Gateways != nil {
+		return err
+	}
+	// UPnP gateways take a while to answer, they are only looked for when
+	// the router doesn't speak PCP or NAT-PMP
+	upnp, err := DiscoverUPnP(m.ctx, SSDPAddr)
+	if err != nil {
+		return err
+	}
+	return m.tryGateway(upnp, requested)
+}
+
+func (m *Mapper) tryGateway(gateway Gateway, requested []Mapping) error {
+	mapped, err := mapPorts(m.ctx, gateway, requested)
+	if err != nil {
+		return err
+	}
+	m.set(gateway, mapped)
+	ip, port := m.External()
+	m.logger.Printf(log.LowVerbose, "mapped port %d to %s:%d\n", m.port, ip, port)
+	return nil
+}
+
+func (m *Mapper) set(gateway Gateway, mappings []Mapping) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gateway, m.mappings = gateway, mappings
+	if mappings != nil {
+		select {
+		case <-m.mapped:
+		default:
+			close(m.mapped)
+		}
+	}
+}
+
+// renewal returns when the leases should be renewed, half way through
+// the shortest one
+func (m *Mapper) renewal() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wait := leaseTime
+	for _, mapping := range m.mappings {
+		if mapping.Lifetime > 0 && mapping.Lifetime < wait {
+			wait = mapping.Lifetime
+		}
+	}
+	return wait / 2
+}
+
+func mapPorts(ctx context.Context, gateway Gateway, requested []Mapping) ([]Mapping, error) {
+	mapped := make([]Mapping, 0, len(requested))
+	for _, mapping := range requested {
+		granted, err := gateway.AddMapping(ctx, mapping)
+		if err != nil {
+			return nil, err
+		}
+		mapped = append(mapped, granted)
+	}
+	return mapped, nil
+}
+
+// DefaultGateway returns the router of the default IPv4 route, it is read
+// from /proc/net/route so only found on Linux
+func DefaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Iface Destination Gateway ..., addresses in little endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := hex.DecodeString(fields[2])
+		if err != nil || len(gateway) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gateway))
+		return ip, nil
+	}
+	return nil, ErrNoGateway
+}
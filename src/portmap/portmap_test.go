@@ -0,0 +1,238 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/log"
+)
+
+var externalIP = net.IPv4(203, 0, 113, 1).To4()
+
+// mockPMP is a gateway answering PCP, or only NAT-PMP when natpmp is set.
+// It records the lifetime last requested for each protocol.
+type mockPMP struct {
+	conn      net.PacketConn
+	natpmp    bool
+	mu        sync.Mutex
+	lifetimes map[byte]uint32
+}
+
+func newMockPMP(t *testing.T, natpmp bool) *mockPMP {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	m := &mockPMP{conn: conn, natpmp: natpmp, lifetimes: make(map[byte]uint32)}
+	go m.serve()
+	return m
+}
+
+func (m *mockPMP) serve() {
+	buffer := make([]byte, 1100)
+	for {
+		n, from, err := m.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		request := buffer[:n]
+		var response []byte
+		switch {
+		case request[0] == pcpVersion && !m.natpmp:
+			response = make([]byte, pcpMapLength)
+			copy(response, request)
+			response[0] = pcpVersion
+			response[1] = pcpResponse | pcpOpMap
+			copy(response[44:60], externalIP.To16())
+			// External ports are shifted by 1000
+			binary.BigEndian.PutUint16(response[42:44], binary.BigEndian.Uint16(request[40:42])+1000)
+			m.record(request[36], binary.BigEndian.Uint32(request[4:8]))
+		case request[0] != natpmpVersion:
+			response = []byte{natpmpVersion, pcpResponse | request[1], 0, 1, 0, 0, 0, 0}
+		case request[1] == natpmpOpAddr:
+			response = append([]byte{natpmpVersion, pcpResponse, 0, 0, 0, 0, 0, 0}, externalIP...)
+		default:
+			response = make([]byte, 16)
+			response[1] = pcpResponse | request[1]
+			copy(response[8:10], request[4:6])
+			binary.BigEndian.PutUint16(response[10:12], binary.BigEndian.Uint16(request[4:6])+1000)
+			copy(response[12:16], request[8:12])
+			m.record(request[1], binary.BigEndian.Uint32(request[8:12]))
+		}
+		m.conn.WriteTo(response, from)
+	}
+}
+
+func (m *mockPMP) record(protocol byte, lifetime uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lifetimes[protocol] = lifetime
+}
+
+func (m *mockPMP) lifetime(protocol byte) (uint32, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lifetime, ok := m.lifetimes[protocol]
+	return lifetime, ok
+}
+
+func TestMapperPCP(t *testing.T) {
+	gateway := newMockPMP(t, false)
+	mapper := New(6881, &log.Logger{Verbose: log.LowVerbose})
+	mapper.Gateways = []Gateway{NewPMP(gateway.conn.LocalAddr().String())}
+	mapper.Start()
+	select {
+	case <-mapper.Mapped():
+	case <-time.After(5 * time.Second):
+		t.Fatal("ports weren't mapped")
+	}
+	ip, port := mapper.External()
+	if !ip.Equal(externalIP) || port != 7881 {
+		t.Errorf("expected to be reachable at %s:7881, got %s:%d", externalIP, ip, port)
+	}
+	for _, protocol := range []byte{6, 17} {
+		if lifetime, _ := gateway.lifetime(protocol); lifetime != uint32(leaseTime/time.Second) {
+			t.Errorf("expected protocol %d to be mapped for an hour, got %ds", protocol, lifetime)
+		}
+	}
+	mapper.Close()
+	for _, protocol := range []byte{6, 17} {
+		if lifetime, _ := gateway.lifetime(protocol); lifetime != 0 {
+			t.Errorf("expected protocol %d to be unmapped on close", protocol)
+		}
+	}
+	if ip, _ := mapper.External(); ip != nil {
+		t.Errorf("expected no external address once closed")
+	}
+}
+
+func TestNATPMPFallback(t *testing.T) {
+	gateway := newMockPMP(t, true)
+	pmp := NewPMP(gateway.conn.LocalAddr().String())
+	mapping, err := pmp.AddMapping(context.Background(), Mapping{Protocol: TCP, Internal: 6881, External: 6881, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pmp.natpmp || !mapping.ExternalIP.Equal(externalIP) || mapping.External != 7881 || mapping.Lifetime != time.Hour {
+		t.Errorf("unexpected NAT-PMP mapping %+v", mapping)
+	}
+	if err := pmp.DeleteMapping(context.Background(), mapping); err != nil {
+		t.Fatal(err)
+	}
+	if lifetime, ok := gateway.lifetime(natpmpOpTCP); !ok || lifetime != 0 {
+		t.Errorf("expected the mapping to be deleted")
+	}
+}
+
+const igdDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+func TestUPnP(t *testing.T) {
+	var mu sync.Mutex
+	var actions []string
+	igd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rootDesc.xml" {
+			io.WriteString(w, igdDescription)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		action := r.Header.Get("SOAPAction")
+		mu.Lock()
+		actions = append(actions, action)
+		mu.Unlock()
+		switch {
+		case strings.HasSuffix(action, "#AddPortMapping\"") && soapValue(body, "NewLeaseDuration") != "0":
+			// The gateway only supports permanent leases
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `<s:Envelope><s:Body><s:Fault><detail><UPnPError>`+
+				`<errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription>`+
+				`</UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+		case strings.HasSuffix(action, "#GetExternalIPAddress\""):
+			io.WriteString(w, `<s:Envelope><s:Body><u:GetExternalIPAddressResponse>`+
+				`<NewExternalIPAddress>203.0.113.1</NewExternalIPAddress>`+
+				`</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		}
+	}))
+	defer igd.Close()
+
+	ssdp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ssdp.Close()
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, from, err := ssdp.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(string(buffer[:n]), "M-SEARCH") {
+				fmt.Fprintf(ssdpWriter{ssdp, from}, "HTTP/1.1 200 OK\r\nLOCATION: %s/rootDesc.xml\r\n\r\n", igd.URL)
+			}
+		}
+	}()
+
+	gateway, err := DiscoverUPnP(context.Background(), ssdp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gateway.ControlURL != igd.URL+"/ctl/IPConn" || !gateway.LocalIP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("unexpected gateway %+v", gateway)
+	}
+	mapping, err := gateway.AddMapping(context.Background(), Mapping{Protocol: TCP, Internal: 6881, External: 6881, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.Lifetime != 0 || !mapping.ExternalIP.Equal(externalIP) {
+		t.Errorf("expected a permanent mapping at %s, got %+v", externalIP, mapping)
+	}
+	if err := gateway.DeleteMapping(context.Background(), mapping); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(actions) != 4 || !strings.HasSuffix(actions[3], "#DeletePortMapping\"") {
+		t.Errorf("unexpected actions %v", actions)
+	}
+}
+
+type ssdpWriter struct {
+	conn net.PacketConn
+	to   net.Addr
+}
+
+func (w ssdpWriter) Write(b []byte) (int, error) {
+	return w.conn.WriteTo(b, w.to)
+}
@@ -0,0 +1,284 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ztrue/tracerr"
+)
+
+// SSDPAddr is the multicast address UPnP devices are discovered on
+const SSDPAddr = "239.255.255.250:1900"
+
+const (
+	ssdpWait    = 2 * time.Second
+	description = "bytetorrent"
+
+	// UPnP errors of AddPortMapping
+	errOnlyPermanentLeases = 725
+)
+
+// igdServices are the services able to map ports, the preferred first
+var igdServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnP maps ports on an Internet Gateway Device with SOAP requests
+type UPnP struct {
+	ControlURL  string
+	ServiceType string
+	LocalIP     net.IP // our address on the network of the gateway
+	Client      *http.Client
+}
+
+// SOAPError is an error returned by a UPnP action
+type SOAPError struct {
+	Action      string
+	Code        int
+	Description string
+}
+
+func (e *SOAPError) Error() string {
+	return fmt.Sprintf("UPnP %s failed: %d %s", e.Action, e.Code, e.Description)
+}
+
+// DiscoverUPnP searches ssdpAddr for an Internet Gateway Device and
+// returns the first one able to map ports
+func DiscoverUPnP(ctx context.Context, ssdpAddr string) (*UPnP, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	defer conn.Close()
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + SSDPAddr + "\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), addr); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+	conn.SetReadDeadline(time.Now().Add(ssdpWait))
+	seen := make(map[string]bool)
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, ErrNoGateway
+		}
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := response.Header.Get("Location")
+		if location == "" || seen[location] {
+			continue
+		}
+		seen[location] = true
+		if gateway, err := fetchDescription(ctx, location); err == nil {
+			return gateway, nil
+		}
+	}
+}
+
+// deviceDescription is the part of a UPnP device description listing
+// the services of the device and of its embedded devices
+type deviceDescription struct {
+	URLBase string `xml:"URLBase"`
+	Device  device `xml:"device"`
+}
+
+type device struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []device `xml:"deviceList>device"`
+}
+
+// find returns the control URL of the service of type serviceType
+func (d *device) find(serviceType string) (string, bool) {
+	for _, service := range d.Services {
+		if service.ServiceType == serviceType {
+			return service.ControlURL, true
+		}
+	}
+	for i := range d.Devices {
+		if controlURL, ok := d.Devices[i].find(serviceType); ok {
+			return controlURL, true
+		}
+	}
+	return "", false
+}
+
+func fetchDescription(ctx context.Context, location string) (*UPnP, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	client := &http.Client{Timeout: ssdpWait}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	defer response.Body.Close()
+	var root deviceDescription
+	if err := xml.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, tracerr.Wrap(err)
+		}
+	}
+	for _, serviceType := range igdServices {
+		controlURL, ok := root.Device.find(serviceType)
+		if !ok {
+			continue
+		}
+		control, err := base.Parse(strings.TrimSpace(controlURL))
+		if err != nil {
+			return nil, tracerr.Wrap(err)
+		}
+		// The address the gateway reaches us at is the one we'd reach it from
+		conn, err := net.Dial("udp", control.Host)
+		if err != nil {
+			return nil, tracerr.Wrap(err)
+		}
+		localIP := conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+		return &UPnP{
+			ControlURL:  control.String(),
+			ServiceType: serviceType,
+			LocalIP:     localIP,
+			Client:      client,
+		}, nil
+	}
+	return nil, fmt.Errorf("%s has no port mapping service", location)
+}
+
+func (u *UPnP) String() string {
+	return "UPnP gateway " + u.ControlURL
+}
+
+func (u *UPnP) AddMapping(ctx context.Context, mapping Mapping) (Mapping, error) {
+	add := func(lease time.Duration) error {
+		_, err := u.call(ctx, "AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(mapping.External)},
+			{"NewProtocol", mapping.Protocol},
+			{"NewInternalPort", strconv.Itoa(mapping.Internal)},
+			{"NewInternalClient", u.LocalIP.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", description},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		})
+		return err
+	}
+	err := add(mapping.Lifetime)
+	if soapErr, ok := err.(*SOAPError); ok && soapErr.Code == errOnlyPermanentLeases {
+		mapping.Lifetime = 0
+		err = add(0)
+	}
+	if err != nil {
+		return Mapping{}, err
+	}
+	response, err := u.call(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return Mapping{}, err
+	}
+	mapping.ExternalIP = net.ParseIP(soapValue(response, "NewExternalIPAddress"))
+	return mapping, nil
+}
+
+func (u *UPnP) DeleteMapping(ctx context.Context, mapping Mapping) error {
+	_, err := u.call(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(mapping.External)},
+		{"NewProtocol", mapping.Protocol},
+	})
+	return err
+}
+
+// call sends a SOAP action with its arguments in order, it returns the
+// body of the response
+func (u *UPnP) call(ctx context.Context, action string, args [][2]string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.ServiceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, u.ControlURL, &body)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", `"`+u.ServiceType+"#"+action+`"`)
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		code, _ := strconv.Atoi(soapValue(content, "errorCode"))
+		return nil, &SOAPError{Action: action, Code: code, Description: soapValue(content, "errorDescription")}
+	}
+	return content, nil
+}
+
+// soapValue returns the text of the first element named name
+func soapValue(content []byte, name string) string {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == name {
+			var value string
+			if decoder.DecodeElement(&value, &start) != nil {
+				return ""
+			}
+			return strings.TrimSpace(value)
+		}
+	}
+}
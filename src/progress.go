@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/session"
+)
+
+// progressInterval is how often the progress is drawn
+const progressInterval = time.Second
+
+// showProgress draws the transfer of the torrents of s until ctx is done,
+// and a last time then
+func showProgress(ctx context.Context, s *session.Session, logger *log.Logger) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Progress(transfer(s))
+			return
+		case <-ticker.C:
+			logger.Progress(transfer(s))
+		}
+	}
+}
+
+// transfer sums the transfer of the torrents of s
+func transfer(s *session.Session) log.Transfer {
+	var total log.Transfer
+	for _, torrent := range s.Torrents() {
+		stats := torrent.Client.Stats()
+		total.Completed += stats.Completed
+		total.Total += stats.Wanted
+		total.DownloadRate += stats.DownloadRate
+		total.UploadRate += stats.UploadRate
+		total.Peers += stats.Peers
+		total.Seeds += stats.Seeds
+	}
+	return total
+}
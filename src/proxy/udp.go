@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ztrue/tracerr"
+)
+
+// ListenPacket returns a packet connection whose datagrams are relayed by
+// the proxy with a SOCKS5 UDP ASSOCIATE. Only SOCKS5 proxies relay UDP.
+func (p *Proxy) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if p.Kind != SOCKS5 {
+		return nil, ErrNoUDP
+	}
+	dialer := net.Dialer{Timeout: p.timeout()}
+	control, err := dialer.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	local, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		control.Close()
+		return nil, tracerr.Wrap(err)
+	}
+	control.SetDeadline(time.Now().Add(p.timeout()))
+	// The proxy doesn't know the address we'll send from behind a NAT, so
+	// the zero address lets it accept any
+	relay, err := p.connectSOCKS(control, cmdAssociate, "0.0.0.0:0")
+	if err != nil {
+		control.Close()
+		local.Close()
+		return nil, err
+	}
+	control.SetDeadline(time.Time{})
+	if relay.IP.IsUnspecified() {
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	conn := &packetConn{UDPConn: local, control: control, relay: relay}
+	// The association ends with the control connection
+	go func() {
+		buffer := make([]byte, 1)
+		control.Read(buffer)
+		local.Close()
+	}()
+	return conn, nil
+}
+
+// packetConn wraps and unwraps the datagrams relayed by a SOCKS5 proxy
+type packetConn struct {
+	*net.UDPConn
+	control net.Conn
+	relay   *net.UDPAddr
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	datagram, err := appendAddress([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	datagram = append(datagram, b...)
+	if _, err := c.UDPConn.WriteTo(datagram, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buffer := make([]byte, len(b)+262)
+	for {
+		n, from, err := c.UDPConn.ReadFrom(buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+		if udp, ok := from.(*net.UDPAddr); !ok || !udp.IP.Equal(c.relay.IP) {
+			continue
+		}
+		// Fragments aren't supported and are dropped, as RFC 1928 allows
+		if n < 4 || buffer[2] != 0 {
+			continue
+		}
+		reader := bytes.NewReader(buffer[3:n])
+		source, err := readAddress(reader)
+		if err != nil {
+			continue
+		}
+		return copy(b, buffer[n-reader.Len():n]), source, nil
+	}
+}
+
+func (c *packetConn) Close() error {
+	c.control.Close()
+	return c.UDPConn.Close()
+}
+
+func (c *packetConn) String() string {
+	return fmt.Sprintf("udp relay %s", c.relay)
+}
@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket refilled at rate bytes per second, holding
+// at most one second worth of tokens. A nil Limiter or a rate of zero
+// doesn't limit anything.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func New(rate int) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), now: time.Now}
+}
+
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the rate, it applies to the bytes not waited for yet
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	l.rate = rate
+	l.tokens = min(l.tokens, float64(rate))
+}
+
+// refill adds the tokens earned since the last call, l.mu must be held
+func (l *Limiter) refill() {
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), float64(l.rate))
+	}
+	l.last = now
+}
+
+// reserve takes n tokens and returns how long to wait before using them,
+// the bucket goes in debt for transfers larger than it.
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill()
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Wait blocks until n bytes can be transferred
+func (l *Limiter) Wait(n int) {
+	time.Sleep(l.reserve(n))
+}
+
+// Group chains limiters, e.g. those of the session, the torrent and the
+// peer, a transfer goes at the pace of the slowest.
+type Group []*Limiter
+
+func (g Group) Wait(n int) {
+	var delay time.Duration
+	for _, l := range g {
+		delay = max(delay, l.reserve(n))
+	}
+	time.Sleep(delay)
+}
+
+// With returns a group that also waits on l
+func (g Group) With(l *Limiter) Group {
+	return append(g[:len(g):len(g)], l)
+}
+
+// Schedule switches to alternate rates between Start and End, given as
+// durations since midnight, on Days or every day when Days is empty.
+// End may be before Start to span midnight.
+type Schedule struct {
+	Start    time.Duration
+	End      time.Duration
+	Days     []time.Weekday
+	Download int
+	Upload   int
+}
+
+// ParseClock parses a time of day such as "08:30"
+func ParseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active reports whether the alternate rates apply at t
+func (s *Schedule) Active(t time.Time) bool {
+	if s == nil {
+		return false
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	clock := t.Sub(midnight)
+	day := t.Weekday()
+	if s.End < s.Start && clock < s.End {
+		// Past midnight, the period started the day before
+		day = (day + 6) % 7
+	}
+	if len(s.Days) > 0 {
+		found := false
+		for _, d := range s.Days {
+			found = found || d == day
+		}
+		if !found {
+			return false
+		}
+	}
+	if s.Start <= s.End {
+		return clock >= s.Start && clock < s.End
+	}
+	return clock >= s.Start || clock < s.End
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := New(1000)
+	l.now = func() time.Time { return now }
+
+	if delay := l.reserve(1000); delay != 0 {
+		t.Errorf("expected a full bucket, waited %s", delay)
+	}
+	if delay := l.reserve(500); delay != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, waited %s", delay)
+	}
+	now = now.Add(time.Second)
+	if delay := l.reserve(500); delay != 0 {
+		t.Errorf("expected the bucket to be refilled, waited %s", delay)
+	}
+	l.SetRate(0)
+	if delay := l.reserve(1 << 30); delay != 0 {
+		t.Errorf("expected no limit, waited %s", delay)
+	}
+	var unlimited *Limiter
+	if delay := unlimited.reserve(1 << 30); delay != 0 {
+		t.Errorf("expected nil limiter not to limit, waited %s", delay)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	start, _ := ParseClock("22:00")
+	end, _ := ParseClock("06:30")
+	s := &Schedule{Start: start, End: end, Days: []time.Weekday{time.Friday}}
+	// 2025-01-03 is a Friday
+	cases := map[string]bool{
+		"2025-01-03 21:59": false,
+		"2025-01-03 22:00": true,
+		"2025-01-04 06:29": true, // Friday night
+		"2025-01-04 06:30": false,
+		"2025-01-04 23:00": false,
+	}
+	for clock, expected := range cases {
+		at, _ := time.Parse("2006-01-02 15:04", clock)
+		if s.Active(at) != expected {
+			t.Errorf("expected schedule active at %s to be %v", clock, expected)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/bits"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/rpc"
+)
+
+// remoteCommand defines its own flags on flags, the returned function
+// runs it once they are parsed
+type remoteCommand struct {
+	usage string
+	flags func(flags *flag.FlagSet) func(ctx context.Context, client *rpc.Client, args []string) error
+}
+
+// remoteCommands are the commands controlling a running daemon
+var remoteCommands = map[string]remoteCommand{
+	"add":    {"[-paused] [-dir directory] <torrent file, URL or magnet>...", addFlags},
+	"ls":     {"", listFlags},
+	"info":   {"<info hash>", infoFlags},
+	"pause":  {"<info hash>...", actionFlags((*rpc.Client).Pause)},
+	"resume": {"<info hash>...", actionFlags((*rpc.Client).Resume)},
+	"rm":     {"<info hash>...", actionFlags((*rpc.Client).Remove)},
+	"limits": {"[-download-rate KiB/s] [-upload-rate KiB/s] [info hash]", limitsFlags},
+}
+
+// remote runs the command name against the daemon given by -socket or
+// -rpc-addr
+func remote(name string, args []string) {
+	command := remoteCommands[name]
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: bytetorrent %s [flags] %s\n", name, command.usage)
+		flags.PrintDefaults()
+	}
+	socket := flags.String("socket", rpc.DefaultSocket(), "Unix socket of the daemon")
+	rpcAddr := flags.String("rpc-addr", "", "host:port of the daemon, used instead of the socket")
+	auth := flags.String("rpc-auth", "", "user:password asked by the daemon on -rpc-addr")
+	timeout := flags.Duration("timeout", time.Minute, "Time given to the daemon to answer")
+	run := command.flags(flags)
+	flags.Parse(args)
+	address := *socket
+	if *rpcAddr != "" {
+		address = *rpcAddr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	client := rpc.Dial(address)
+	client.Auth = *auth
+	if err := run(ctx, client, flags.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func addFlags(flags *flag.FlagSet) func(context.Context, *rpc.Client, []string) error {
+	paused := flags.Bool("paused", false, "Add the torrents without starting them")
+	dir := flags.String("dir", "", "Directory where the daemon saves the downloads, its own by default")
+	return func(ctx context.Context, client *rpc.Client, args []string) error {
+		if len(args) == 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		for _, arg := range args {
+			params := rpc.AddParams{Paused: *paused, DownloadDir: *dir}
+			if strings.Contains(arg, "://") || strings.HasPrefix(arg, "magnet:") {
+				params.URL = arg
+			} else {
+				// The daemon may run on another host, or as another user
+				data, err := os.ReadFile(arg)
+				if err != nil {
+					return err
+				}
+				params.Data = data
+			}
+			status, err := client.Add(ctx, params)
+			if err != nil {
+				return fmt.Errorf("adding %s: %w", arg, err)
+			}
+			fmt.Printf("%s %s\n", status.InfoHash, status.Name)
+		}
+		return nil
+	}
+}
+
+func listFlags(flags *flag.FlagSet) func(context.Context, *rpc.Client, []string) error {
+	return func(ctx context.Context, client *rpc.Client, args []string) error {
+		statuses, err := client.List(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "HASH\tSTATE\tDONE\tSIZE\tPEERS\tDOWN\tUP\tNAME")
+		for _, st := range statuses {
+			state := st.State
+			if st.Error != "" {
+				state += ": " + st.Error
+			}
+			fmt.Fprintf(w, "%s\t%s\t%.1f%%\t%s\t%d\t%s\t%s\t%s\n", st.InfoHash[:8], state, st.Progress*100,
+				size(st.Size), st.Peers, size(st.Downloaded), size(st.Uploaded), st.Name)
+		}
+		return w.Flush()
+	}
+}
+
+func infoFlags(flags *flag.FlagSet) func(context.Context, *rpc.Client, []string) error {
+	return func(ctx context.Context, client *rpc.Client, args []string) error {
+		if len(args) != 1 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		d, err := client.Get(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Name:      %s\n", d.Name)
+		fmt.Printf("Hash:      %s\n", d.InfoHash)
+		fmt.Printf("State:     %s\n", d.State)
+		if d.Error != "" {
+			fmt.Printf("Error:     %s\n", d.Error)
+		}
+		fmt.Printf("Progress:  %.1f%% of %s\n", d.Progress*100, size(d.Size))
+		fmt.Printf("Pieces:    %d/%d of %s\n", verified(d.Pieces), d.PieceCount, size(int64(d.PieceLength)))
+		fmt.Printf("Transfer:  %s down, %s up\n", size(d.Downloaded), size(d.Uploaded))
+		fmt.Printf("Limits:    %s down, %s up, %s down and %s up for each peer\n",
+			rate(d.DownloadRate), rate(d.UploadRate), rate(d.PeerDownloadRate), rate(d.PeerUploadRate))
+		for _, tracker := range d.Trackers {
+			fmt.Printf("Tracker:   %s\n", tracker)
+		}
+		fmt.Println("Files:")
+		for _, file := range d.Files {
+			fmt.Printf("  %10s  %s\n", size(int64(file.Length)), file.Path)
+		}
+		fmt.Printf("Peers:     %d\n", len(d.PeerList))
+		for _, peer := range d.PeerList {
+			flags := ""
+			if peer.Inbound {
+				flags += " inbound"
+			}
+			if peer.Snubbed {
+				flags += " snubbed"
+			}
+			fmt.Printf("  %-21s %d pieces%s\n", peer.Address, peer.Pieces, flags)
+		}
+		// A row of the map for each 64 pieces, # for the verified ones
+		fmt.Println("Piece map:")
+		for start := 0; start < d.PieceCount; start += 64 {
+			var row strings.Builder
+			for i := start; i < min(start+64, d.PieceCount); i++ {
+				if i/8 < len(d.Pieces) && d.Pieces[i/8]&(1<<(7-i%8)) != 0 {
+					row.WriteByte('#')
+				} else {
+					row.WriteByte('.')
+				}
+			}
+			fmt.Printf("  %s\n", row.String())
+		}
+		return nil
+	}
+}
+
+// actionFlags is the command calling action on each torrent given
+func actionFlags(action func(*rpc.Client, context.Context, string) (rpc.TorrentStatus, error)) func(*flag.FlagSet) func(context.Context, *rpc.Client, []string) error {
+	return func(flags *flag.FlagSet) func(context.Context, *rpc.Client, []string) error {
+		return func(ctx context.Context, client *rpc.Client, args []string) error {
+			if len(args) == 0 {
+				flags.Usage()
+				os.Exit(2)
+			}
+			for _, infoHash := range args {
+				status, err := action(client, ctx, infoHash)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s %s %s\n", status.InfoHash[:8], status.State, status.Name)
+			}
+			return nil
+		}
+	}
+}
+
+func limitsFlags(flags *flag.FlagSet) func(context.Context, *rpc.Client, []string) error {
+	var params rpc.LimitsParams
+	// Only the flags given are sent, the others are left unchanged
+	kib := func(name string, usage string, field **int) {
+		flags.Func(name, usage, func(s string) error {
+			var v int
+			if _, err := fmt.Sscan(s, &v); err != nil {
+				return err
+			}
+			v *= 1024
+			*field = &v
+			return nil
+		})
+	}
+	kib("download-rate", "Download limit in KiB/s, 0 for none", &params.DownloadRate)
+	kib("upload-rate", "Upload limit in KiB/s, 0 for none", &params.UploadRate)
+	kib("peer-download-rate", "Download limit of each peer of the torrent in KiB/s", &params.PeerDownloadRate)
+	kib("peer-upload-rate", "Upload limit of each peer of the torrent in KiB/s", &params.PeerUploadRate)
+	return func(ctx context.Context, client *rpc.Client, args []string) error {
+		if len(args) > 1 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		if len(args) == 1 {
+			params.InfoHash = args[0]
+		}
+		if err := client.SetLimits(ctx, params); err != nil {
+			return err
+		}
+		if params.InfoHash != "" {
+			d, err := client.Get(ctx, params.InfoHash)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: %s down, %s up, %s down and %s up for each peer\n", d.Name,
+				rate(d.DownloadRate), rate(d.UploadRate), rate(d.PeerDownloadRate), rate(d.PeerUploadRate))
+			return nil
+		}
+		st, err := client.Session(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("session of %d torrents on port %d: %s down, %s up\n", st.Torrents, st.Port,
+			rate(st.DownloadRate), rate(st.UploadRate))
+		if st.AltSpeed {
+			fmt.Println("the alternate limits apply at the moment")
+		}
+		return nil
+	}
+}
+
+// verified counts the pieces set in a bitfield
+func verified(bitfield []byte) int {
+	count := 0
+	for _, b := range bitfield {
+		count += bits.OnesCount8(b)
+	}
+	return count
+}
+
+func size(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func rate(n int) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return size(int64(n)) + "/s"
+}
@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IsLoopback reports whether the host of address, a host:port, only
+// accepts connections from this machine
+func IsLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// RequireAuth answers requests without the user and password given in
+// auth, as "user:password", with 401 Unauthorized before passing them to
+// handler. Requests on a Unix socket, which only the user can connect to,
+// aren't asked for them.
+func RequireAuth(handler http.Handler, auth string) http.Handler {
+	wantUser, wantPassword, _ := strings.Cut(auth, ":")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(wantPassword)) == 1
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="bytetorrent", charset="UTF-8"`)
+			http.Error(w, "authentication needed", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// CheckHost answers requests whose Host header isn't localhost, a
+// loopback address or address with 403 Forbidden before passing them to
+// handler. A page of another site reaching a loopback address through
+// DNS rebinding still sends its own host name. Requests on a Unix socket
+// aren't checked.
+func CheckHost(handler http.Handler, address string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if !allowedHost(r.Host, address) {
+			http.Error(w, "unknown host "+r.Host, http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost reports whether host, with or without a port, names this
+// machine or the host of address
+func allowedHost(host string, address string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	configured, _, err := net.SplitHostPort(address)
+	return err == nil && configured != "" && strings.EqualFold(host, configured)
+}
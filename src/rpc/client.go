@@ -0,0 +1,176 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Path is where the daemon serves JSON-RPC requests
+const Path = "/rpc"
+
+// DefaultSocket returns the Unix socket the daemon listens on by default,
+// in $XDG_RUNTIME_DIR or else the temporary directory
+func DefaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "bytetorrent.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("bytetorrent-%d.sock", os.Getuid()))
+}
+
+// isSocket reports whether address is the path of a Unix socket rather
+// than a host:port
+func isSocket(address string) bool {
+	return strings.Contains(address, "/") || !strings.Contains(address, ":")
+}
+
+// Listen opens the listener of the daemon at address, a host:port or the
+// path of a Unix socket only the user can connect to. A socket left by a
+// daemon that didn't exit cleanly is replaced.
+func Listen(address string) (net.Listener, error) {
+	if !isSocket(address) {
+		return net.Listen("tcp", address)
+	}
+	if conn, err := net.Dial("unix", address); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon already listens on %s", address)
+	}
+	os.Remove(address)
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(address, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Client sends JSON-RPC requests to a daemon
+type Client struct {
+	URL  string
+	HTTP *http.Client
+	Auth string // user:password sent with HTTP Basic authentication, when set
+	id   atomic.Int64
+}
+
+// Dial returns a client of the daemon at address, a host:port or the
+// path of a Unix socket
+func Dial(address string) *Client {
+	if isSocket(address) {
+		socket := address
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &Client{URL: "http://unix" + Path, HTTP: &http.Client{Transport: transport}}
+	}
+	return &Client{URL: "http://" + address + Path, HTTP: http.DefaultClient}
+}
+
+// Call sends the request of method with params and decodes its result
+// into result, errors of the method are returned as *Error
+func (c *Client) Call(ctx context.Context, method string, params any, result any) error {
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(request{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  encoded,
+		ID:      json.RawMessage(fmt.Sprint(c.id.Add(1))),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Auth != "" {
+		user, password, _ := strings.Cut(c.Auth, ":")
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("daemon answered %s", resp.Status)
+	}
+	var decoded struct {
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return err
+	}
+	if decoded.Error != nil {
+		return decoded.Error
+	}
+	if result == nil || len(decoded.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(decoded.Result, result)
+}
+
+func (c *Client) Add(ctx context.Context, params AddParams) (TorrentStatus, error) {
+	var status TorrentStatus
+	err := c.Call(ctx, "add", params, &status)
+	return status, err
+}
+
+func (c *Client) List(ctx context.Context) ([]TorrentStatus, error) {
+	var statuses []TorrentStatus
+	err := c.Call(ctx, "list", nil, &statuses)
+	return statuses, err
+}
+
+func (c *Client) Get(ctx context.Context, infoHash string) (TorrentDetails, error) {
+	var details TorrentDetails
+	err := c.Call(ctx, "get", TorrentParams{InfoHash: infoHash}, &details)
+	return details, err
+}
+
+func (c *Client) Pause(ctx context.Context, infoHash string) (TorrentStatus, error) {
+	var status TorrentStatus
+	err := c.Call(ctx, "pause", TorrentParams{InfoHash: infoHash}, &status)
+	return status, err
+}
+
+func (c *Client) Resume(ctx context.Context, infoHash string) (TorrentStatus, error) {
+	var status TorrentStatus
+	err := c.Call(ctx, "resume", TorrentParams{InfoHash: infoHash}, &status)
+	return status, err
+}
+
+func (c *Client) Remove(ctx context.Context, infoHash string) (TorrentStatus, error) {
+	var status TorrentStatus
+	err := c.Call(ctx, "remove", TorrentParams{InfoHash: infoHash}, &status)
+	return status, err
+}
+
+// SetLimits changes the rates of the session, or of a torrent when
+// params.InfoHash is set
+func (c *Client) SetLimits(ctx context.Context, params LimitsParams) error {
+	return c.Call(ctx, "limits", params, nil)
+}
+
+func (c *Client) Session(ctx context.Context) (SessionStatus, error) {
+	var status SessionStatus
+	err := c.Call(ctx, "session", nil, &status)
+	return status, err
+}
@@ -0,0 +1,644 @@
+package rpc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/samir-adh/bytetorrent/src/session"
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+)
+
+// Error codes of JSON-RPC 2.0, and the one of failed methods
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeFailed         = -32000
+)
+
+// Error is the error member of a JSON-RPC response
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrMagnet is returned when adding a magnet link, the metadata exchange
+// of BEP 9 needed to get the info dictionary from peers isn't supported
+var ErrMagnet = errors.New("magnet links aren't supported, add the .torrent file instead")
+
+const maxTorrentSize = 16 << 20
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  any             `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// AddParams gives the torrent to add as one of Path, URL or Data
+type AddParams struct {
+	Path        string `json:"path,omitempty"` // .torrent file on the daemon's host
+	URL         string `json:"url,omitempty"`  // http(s) URL of a .torrent file
+	Data        []byte `json:"data,omitempty"` // content of a .torrent file, base64 in JSON
+	Paused      bool   `json:"paused,omitempty"`
+	DownloadDir string `json:"download_dir,omitempty"` // the daemon's when empty
+}
+
+// TorrentParams selects a torrent by its info hash, or a unique prefix of
+// it
+type TorrentParams struct {
+	InfoHash string `json:"info_hash"`
+}
+
+// LimitsParams changes the rates in bytes per second, of the session or
+// of a torrent when InfoHash is set. Nil rates are left unchanged, zero
+// means unlimited.
+type LimitsParams struct {
+	InfoHash         string `json:"info_hash,omitempty"`
+	DownloadRate     *int   `json:"download_rate,omitempty"`
+	UploadRate       *int   `json:"upload_rate,omitempty"`
+	PeerDownloadRate *int   `json:"peer_download_rate,omitempty"`
+	PeerUploadRate   *int   `json:"peer_upload_rate,omitempty"`
+}
+
+type TorrentStatus struct {
+	InfoHash   string  `json:"info_hash"`
+	Name       string  `json:"name"`
+	State      string  `json:"state"`
+	Error      string  `json:"error,omitempty"`
+	Size       int64   `json:"size"`
+	Completed  int64   `json:"completed"` // bytes of verified pieces
+	Progress   float64 `json:"progress"`  // from 0 to 1
+	Downloaded int64   `json:"downloaded"`
+	Uploaded   int64   `json:"uploaded"`
+	Peers      int     `json:"peers"`
+	Seeds      int     `json:"seeds"`  // connected peers having every piece
+	Wasted     int64   `json:"wasted"` // bytes failing their hash check
+	// Transfer rates in bytes per second, averaged over the last seconds
+	DownloadSpeed int   `json:"download_speed"`
+	UploadSpeed   int   `json:"upload_speed"`
+	ETA           int64 `json:"eta"` // seconds until complete, -1 when unknown
+}
+
+type TorrentDetails struct {
+	TorrentStatus
+	Trackers    []string `json:"trackers"`
+	Files       []File   `json:"files"`
+	PeerList    []Peer   `json:"peer_list"`
+	PieceLength int      `json:"piece_length"`
+	PieceCount  int      `json:"piece_count"`
+	Pieces      []byte   `json:"pieces"` // bitfield of the verified pieces, base64 in JSON
+	// Number of connected peers having each piece
+	Availability []int `json:"availability"`
+	// Rates of the torrent, zero means unlimited
+	DownloadRate     int `json:"download_rate"`
+	UploadRate       int `json:"upload_rate"`
+	PeerDownloadRate int `json:"peer_download_rate"`
+	PeerUploadRate   int `json:"peer_upload_rate"`
+}
+
+type File struct {
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+}
+
+type Peer struct {
+	Address    string `json:"address"`
+	Client     string `json:"client"`
+	Inbound    bool   `json:"inbound"`
+	Pieces     int    `json:"pieces"`
+	Snubbed    bool   `json:"snubbed"`
+	Choked     bool   `json:"choked"`
+	Interested bool   `json:"interested"`
+	// Whether we choke the peer and told it we are interested
+	AmChoking    bool  `json:"am_choking"`
+	AmInterested bool  `json:"am_interested"`
+	Downloaded   int64 `json:"downloaded"`
+	Uploaded     int64 `json:"uploaded"`
+	// Transfer rates in bytes per second
+	DownloadRate int `json:"download_rate"`
+	UploadRate   int `json:"upload_rate"`
+}
+
+type SessionStatus struct {
+	PeerID       string `json:"peer_id"`
+	Port         int    `json:"port"`
+	DownloadRate int    `json:"download_rate"`
+	UploadRate   int    `json:"upload_rate"`
+	AltSpeed     bool   `json:"alt_speed"`
+	Torrents     int    `json:"torrents"`
+}
+
+// Server answers JSON-RPC 2.0 requests controlling a session
+type Server struct {
+	Session    *session.Session
+	Config     torrentclient.Config // of the added torrents
+	HTTPClient *http.Client         // fetches the torrents added by URL
+	TorrentDir string               // keeps the added torrents for Restore, when set
+	// DownloadRoot holds the download directories of added torrents, any
+	// directory is accepted when empty
+	DownloadRoot string
+	methods      map[string]func(ctx context.Context, params json.RawMessage) (any, error)
+}
+
+func NewServer(s *session.Session, config torrentclient.Config) *Server {
+	server := &Server{
+		Session:    s,
+		Config:     config,
+		HTTPClient: http.DefaultClient,
+	}
+	server.methods = map[string]func(context.Context, json.RawMessage) (any, error){
+		"add":     server.add,
+		"list":    server.list,
+		"get":     server.get,
+		"pause":   server.pause,
+		"resume":  server.resume,
+		"remove":  server.remove,
+		"limits":  server.limits,
+		"session": server.session,
+	}
+	return server
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requests are POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Browsers only post JSON to another site after a CORS preflight,
+	// which other sites don't pass
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "JSON-RPC requests are application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var req request
+	if err := json.NewDecoder(io.LimitReader(r.Body, 2*maxTorrentSize)).Decode(&req); err != nil {
+		json.NewEncoder(w).Encode(response{JSONRPC: "2.0", Error: &Error{CodeParseError, err.Error()}})
+		return
+	}
+	resp := response{JSONRPC: "2.0", ID: req.ID}
+	if method, ok := s.methods[req.Method]; req.JSONRPC != "2.0" {
+		resp.Error = &Error{CodeInvalidRequest, "jsonrpc must be 2.0"}
+	} else if !ok {
+		resp.Error = &Error{CodeMethodNotFound, fmt.Sprintf("unknown method %q", req.Method)}
+	} else if result, err := method(r.Context(), req.Params); err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{CodeFailed, err.Error()}
+		}
+		resp.Error = rpcErr
+	} else {
+		resp.Result = result
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func decode(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &Error{CodeInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+// Find returns the torrent whose info hash starts with prefix
+func (s *Server) Find(prefix string) (*session.Torrent, error) {
+	prefix = strings.ToLower(prefix)
+	if prefix == "" {
+		return nil, &Error{CodeInvalidParams, "missing info_hash"}
+	}
+	var found *session.Torrent
+	for _, t := range s.Session.Torrents() {
+		if strings.HasPrefix(hex.EncodeToString(t.Client.InfoHash[:]), prefix) {
+			if found != nil {
+				return nil, fmt.Errorf("info hash %s is ambiguous", prefix)
+			}
+			found = t
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("unknown torrent %s", prefix)
+	}
+	return found, nil
+}
+
+func (s *Server) add(ctx context.Context, params json.RawMessage) (any, error) {
+	var p AddParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	t, err := s.Add(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return s.Status(t), nil
+}
+
+// Add adds the torrent given by p and keeps it in TorrentDir. A torrent
+// already added is returned along with session.ErrDuplicate.
+func (s *Server) Add(ctx context.Context, p AddParams) (*session.Torrent, error) {
+	if err := s.CheckDownloadDir(p.DownloadDir); err != nil {
+		return nil, err
+	}
+	data := p.Data
+	switch {
+	case strings.HasPrefix(p.URL, "magnet:"):
+		return nil, ErrMagnet
+	case p.URL != "":
+		var err error
+		if data, err = s.fetch(ctx, p.URL); err != nil {
+			return nil, err
+		}
+	case p.Path != "":
+		var err error
+		if data, err = os.ReadFile(p.Path); err != nil {
+			return nil, err
+		}
+	case len(data) == 0:
+		return nil, &Error{CodeInvalidParams, "one of path, url or data is needed"}
+	}
+	tor, err := torrentfile.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := s.Session.Get(tor.InfoHash); ok {
+		return t, fmt.Errorf("%w: %x", session.ErrDuplicate, tor.InfoHash)
+	}
+	config := s.Config
+	if p.DownloadDir != "" {
+		config.DownloadDir = p.DownloadDir
+	}
+	t, err := s.Session.Add(tor, config, !p.Paused)
+	if err != nil {
+		return nil, err
+	}
+	if s.TorrentDir != "" {
+		state := torrentState{Paused: p.Paused, DownloadDir: p.DownloadDir}
+		if err := s.save(tor.InfoHash, data, state); err != nil {
+			s.Session.Remove(tor.InfoHash)
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// CheckDownloadDir refuses a download directory outside DownloadRoot
+func (s *Server) CheckDownloadDir(dir string) error {
+	if s.DownloadRoot == "" || dir == "" {
+		return nil
+	}
+	root, err := filepath.Abs(s.DownloadRoot)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(root, abs); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return &Error{CodeInvalidParams, fmt.Sprintf("download directory %s isn't within %s", dir, s.DownloadRoot)}
+	}
+	return nil
+}
+
+// torrentState is kept next to a torrent in TorrentDir, for Restore
+type torrentState struct {
+	Paused      bool   `json:"paused"`
+	DownloadDir string `json:"download_dir,omitempty"`
+}
+
+func (s *Server) torrentPath(infoHash [20]byte) string {
+	return filepath.Join(s.TorrentDir, hex.EncodeToString(infoHash[:])+".torrent")
+}
+
+func (s *Server) statePath(infoHash [20]byte) string {
+	return filepath.Join(s.TorrentDir, hex.EncodeToString(infoHash[:])+".json")
+}
+
+func (s *Server) save(infoHash [20]byte, data []byte, state torrentState) error {
+	if err := os.MkdirAll(s.TorrentDir, 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.torrentPath(infoHash), data, 0o644); err != nil {
+		return err
+	}
+	return s.saveState(infoHash, state)
+}
+
+func (s *Server) saveState(infoHash [20]byte, state torrentState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.statePath(infoHash), data, 0o644)
+}
+
+// loadState reads the state kept for a torrent, a torrent kept without
+// one is started in the default download directory
+func (s *Server) loadState(infoHash [20]byte) (torrentState, error) {
+	var state torrentState
+	data, err := os.ReadFile(s.statePath(infoHash))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(data, &state)
+}
+
+// setPaused keeps whether the torrent is paused for Restore
+func (s *Server) setPaused(infoHash [20]byte, paused bool) error {
+	if s.TorrentDir == "" {
+		return nil
+	}
+	state, err := s.loadState(infoHash)
+	if err != nil {
+		return err
+	}
+	state.Paused = paused
+	return s.saveState(infoHash, state)
+}
+
+// Restore adds the torrents kept in TorrentDir by a previous run, paused
+// or started from their resume data as they were left. A torrent that
+// fails to be added is skipped, the errors of all of them are returned.
+func (s *Server) Restore() error {
+	if s.TorrentDir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(s.TorrentDir, "*.torrent"))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, path := range paths {
+		if err := s.restore(path); err != nil {
+			errs = append(errs, fmt.Errorf("restoring %s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) restore(path string) error {
+	tor, err := torrentfile.OpenTorrentFile(path)
+	if err != nil {
+		return err
+	}
+	state, err := s.loadState(tor.InfoHash)
+	if err != nil {
+		return err
+	}
+	config := s.Config
+	if state.DownloadDir != "" {
+		config.DownloadDir = state.DownloadDir
+	}
+	_, err = s.Session.Add(tor, config, !state.Paused)
+	return err
+}
+
+// Pause pauses the torrent and keeps it paused across restarts
+func (s *Server) Pause(infoHash [20]byte) error {
+	if err := s.Session.Pause(infoHash); err != nil {
+		return err
+	}
+	return s.setPaused(infoHash, true)
+}
+
+// Resume resumes the torrent and keeps it started across restarts
+func (s *Server) Resume(infoHash [20]byte) error {
+	if err := s.Session.Resume(infoHash); err != nil {
+		return err
+	}
+	return s.setPaused(infoHash, false)
+}
+
+func (s *Server) fetch(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxTorrentSize))
+}
+
+func (s *Server) list(ctx context.Context, params json.RawMessage) (any, error) {
+	torrents := s.Session.Torrents()
+	statuses := make([]TorrentStatus, 0, len(torrents))
+	for _, t := range torrents {
+		statuses = append(statuses, s.Status(t))
+	}
+	return statuses, nil
+}
+
+func (s *Server) get(ctx context.Context, params json.RawMessage) (any, error) {
+	var p TorrentParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	t, err := s.Find(p.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	return s.Details(t), nil
+}
+
+// Details returns the status of t along with its files, peers and pieces
+func (s *Server) Details(t *session.Torrent) TorrentDetails {
+	client := t.Client
+	details := TorrentDetails{
+		TorrentStatus: s.Status(t),
+		PieceLength:   client.PieceLength,
+		PieceCount:    len(client.Pieces),
+		Pieces:        client.Bitfield(),
+		Availability:  client.Availability(),
+		DownloadRate:  client.Limits.Download.Rate(),
+		UploadRate:    client.Limits.Upload.Rate(),
+		Files:         []File{},
+		PeerList:      []Peer{},
+		Trackers:      []string{},
+	}
+	details.PeerDownloadRate, details.PeerUploadRate = client.Limits.PeerRates()
+	if client.Torrent.Announce != "" {
+		details.Trackers = append(details.Trackers, client.Torrent.Announce)
+	}
+	for _, file := range client.Torrent.Files {
+		if !file.Padding {
+			details.Files = append(details.Files, File{Path: strings.Join(file.Path, "/"), Length: file.Length})
+		}
+	}
+	for _, peer := range client.ConnectedPeers() {
+		details.PeerList = append(details.PeerList, Peer(peer))
+	}
+	return details
+}
+
+func (s *Server) pause(ctx context.Context, params json.RawMessage) (any, error) {
+	return s.apply(params, s.Pause)
+}
+
+func (s *Server) resume(ctx context.Context, params json.RawMessage) (any, error) {
+	return s.apply(params, s.Resume)
+}
+
+func (s *Server) remove(ctx context.Context, params json.RawMessage) (any, error) {
+	return s.apply(params, func(infoHash [20]byte) error {
+		return s.Remove(infoHash, false)
+	})
+}
+
+// Remove removes the torrent from the session and from TorrentDir, its
+// downloaded files are also deleted when deleteData is set
+func (s *Server) Remove(infoHash [20]byte, deleteData bool) error {
+	t, ok := s.Session.Get(infoHash)
+	if !ok {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+	if err := s.Session.Remove(infoHash); err != nil {
+		return err
+	}
+	if s.TorrentDir != "" {
+		os.Remove(s.torrentPath(infoHash))
+		os.Remove(s.statePath(infoHash))
+	}
+	if deleteData {
+		return t.Client.RemoveData()
+	}
+	return nil
+}
+
+// apply calls action with the torrent of params, it returns its status
+func (s *Server) apply(params json.RawMessage, action func([20]byte) error) (any, error) {
+	var p TorrentParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	t, err := s.Find(p.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := action(t.Client.InfoHash); err != nil {
+		return nil, err
+	}
+	return s.Status(t), nil
+}
+
+func (s *Server) limits(ctx context.Context, params json.RawMessage) (any, error) {
+	var p LimitsParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	if p.InfoHash == "" {
+		if p.PeerDownloadRate != nil || p.PeerUploadRate != nil {
+			return nil, &Error{CodeInvalidParams, "peer rates are set for a torrent"}
+		}
+		download, upload := s.Session.Rates()
+		s.Session.SetRates(value(p.DownloadRate, download), value(p.UploadRate, upload))
+		return s.session(ctx, nil)
+	}
+	t, err := s.Find(p.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	limits := t.Client.Limits
+	limits.Download.SetRate(value(p.DownloadRate, limits.Download.Rate()))
+	limits.Upload.SetRate(value(p.UploadRate, limits.Upload.Rate()))
+	peerDownload, peerUpload := limits.PeerRates()
+	limits.SetPeerRates(value(p.PeerDownloadRate, peerDownload), value(p.PeerUploadRate, peerUpload))
+	return s.Details(t), nil
+}
+
+func value(v *int, current int) int {
+	if v == nil {
+		return current
+	}
+	return *v
+}
+
+func (s *Server) session(ctx context.Context, params json.RawMessage) (any, error) {
+	return s.SessionStatus(), nil
+}
+
+// SessionStatus returns the settings and the number of torrents of the
+// session
+func (s *Server) SessionStatus() SessionStatus {
+	download, upload := s.Session.Rates()
+	return SessionStatus{
+		PeerID:       hex.EncodeToString(s.Session.PeerId[:]),
+		Port:         s.Session.Port,
+		DownloadRate: download,
+		UploadRate:   upload,
+		AltSpeed:     s.Session.AltSpeedActive(),
+		Torrents:     len(s.Session.Torrents()),
+	}
+}
+
+// Status returns the state and transfer of t
+func (s *Server) Status(t *session.Torrent) TorrentStatus {
+	client := t.Client
+	stats := client.Stats()
+	st := TorrentStatus{
+		InfoHash:      hex.EncodeToString(client.InfoHash[:]),
+		Name:          client.Torrent.Name,
+		State:         t.State().String(),
+		Size:          int64(client.Torrent.Length),
+		Completed:     client.Completed(),
+		Downloaded:    stats.Downloaded,
+		Uploaded:      stats.Uploaded,
+		Peers:         stats.Peers,
+		Seeds:         stats.Seeds,
+		Wasted:        stats.Wasted,
+		DownloadSpeed: stats.DownloadRate,
+		UploadSpeed:   stats.UploadRate,
+	}
+	if err := t.Err(); err != nil {
+		st.Error = err.Error()
+	}
+	if st.Size > 0 {
+		st.Progress = float64(st.Completed) / float64(st.Size)
+	}
+	// Skipped files aren't waited for
+	st.ETA = -1
+	if left := stats.Wanted - stats.Completed; left > 0 && st.DownloadSpeed > 0 {
+		st.ETA = left / int64(st.DownloadSpeed)
+	}
+	return st
+}
+
+// Speeds returns the transfer rates of t in bytes per second, averaged
+// over stats.Window
+func (s *Server) Speeds(t *session.Torrent) (int, int) {
+	st := t.Client.Stats()
+	return st.DownloadRate, st.UploadRate
+}
@@ -0,0 +1,318 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/session"
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+)
+
+// torrentData is a .torrent file of data announced to a tracker giving
+// no peer, its downloads can't progress
+func torrentData(t *testing.T, data []byte, pieceLength int) []byte {
+	t.Helper()
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bencode.Marshal(w, map[string]any{"interval": 60, "peers": ""})
+	}))
+	t.Cleanup(tracker.Close)
+	var pieces []byte
+	for start := 0; start < len(data); start += pieceLength {
+		hash := sha1.Sum(data[start:min(start+pieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	var buffer bytes.Buffer
+	err := bencode.Marshal(&buffer, map[string]any{
+		"announce": tracker.URL,
+		"info": map[string]any{
+			"name":         "data.bin",
+			"length":       len(data),
+			"piece length": pieceLength,
+			"pieces":       string(pieces),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func newServer(t *testing.T) (*Server, *Client) {
+	t.Helper()
+	s, err := session.New(session.Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	dir := t.TempDir()
+	server := NewServer(s, torrentclient.Config{DownloadDir: dir, ResumeDir: filepath.Join(dir, ".resume")})
+	server.TorrentDir = filepath.Join(dir, ".torrents")
+	mux := http.NewServeMux()
+	mux.Handle(Path, server)
+	httpServer := httptest.NewServer(mux)
+	t.Cleanup(httpServer.Close)
+	return server, Dial(httpServer.Listener.Addr().String())
+}
+
+func TestControlTorrent(t *testing.T) {
+	server, client := newServer(t)
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("bytetorrent"), 100)
+	added, err := client.Add(ctx, AddParams{Data: torrentData(t, data, 256), Paused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Name != "data.bin" || added.State != "paused" || added.Size != int64(len(data)) {
+		t.Errorf("unexpected status %+v", added)
+	}
+	if _, err := os.Stat(filepath.Join(server.TorrentDir, added.InfoHash+".torrent")); err != nil {
+		t.Errorf("expected the torrent to be kept: %s", err)
+	}
+
+	statuses, err := client.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].InfoHash != added.InfoHash {
+		t.Fatalf("unexpected list %+v", statuses)
+	}
+
+	// Torrents are found by a prefix of their info hash
+	prefix := added.InfoHash[:8]
+	resumed, err := client.Resume(ctx, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.State != "downloading" {
+		t.Errorf("expected torrent to be downloading, got %s", resumed.State)
+	}
+	paused, err := client.Pause(ctx, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paused.State != "paused" {
+		t.Errorf("expected torrent to be paused, got %s", paused.State)
+	}
+
+	download, upload := 100<<10, 0
+	if err := client.SetLimits(ctx, LimitsParams{InfoHash: prefix, DownloadRate: &download, PeerUploadRate: &upload}); err != nil {
+		t.Fatal(err)
+	}
+	details, err := client.Get(ctx, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.DownloadRate != download || details.UploadRate != 0 {
+		t.Errorf("unexpected rates %d and %d", details.DownloadRate, details.UploadRate)
+	}
+	if details.PieceCount != 5 || len(details.Pieces) != 1 || details.Pieces[0] != 0 {
+		t.Errorf("expected 5 missing pieces, got %d and %v", details.PieceCount, details.Pieces)
+	}
+	if len(details.Files) != 1 || details.Files[0].Length != len(data) {
+		t.Errorf("unexpected files %+v", details.Files)
+	}
+
+	if err := client.SetLimits(ctx, LimitsParams{DownloadRate: &download}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := client.Session(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.DownloadRate != download || st.Torrents != 1 {
+		t.Errorf("unexpected session %+v", st)
+	}
+
+	if _, err := client.Remove(ctx, prefix); err != nil {
+		t.Fatal(err)
+	}
+	if statuses, _ := client.List(ctx); len(statuses) != 0 {
+		t.Errorf("expected torrent to be removed, got %+v", statuses)
+	}
+	if _, err := os.Stat(filepath.Join(server.TorrentDir, added.InfoHash+".torrent")); !os.IsNotExist(err) {
+		t.Errorf("expected the kept torrent to be deleted")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	server, client := newServer(t)
+	ctx := context.Background()
+	downloadDir := t.TempDir()
+	paused, err := client.Add(ctx, AddParams{Data: torrentData(t, []byte("restored"), 256), Paused: true, DownloadDir: downloadDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, err := client.Add(ctx, AddParams{Data: torrentData(t, []byte("started"), 256), Paused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Resume(ctx, started.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	// A torrent that can't be added doesn't keep the others from being restored
+	if err := os.WriteFile(filepath.Join(server.TorrentDir, "broken.torrent"), []byte("broken"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := session.New(session.Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	restarted := NewServer(s, server.Config)
+	restarted.TorrentDir = server.TorrentDir
+	if err := restarted.Restore(); err == nil || !strings.Contains(err.Error(), "broken.torrent") {
+		t.Errorf("expected the broken torrent to fail, got %v", err)
+	}
+	if torrents := s.Torrents(); len(torrents) != 2 {
+		t.Fatalf("expected 2 torrents to be restored, got %d", len(torrents))
+	}
+	for _, torrent := range s.Torrents() {
+		status := restarted.Status(torrent)
+		switch status.InfoHash {
+		case paused.InfoHash:
+			if status.State != "paused" {
+				t.Errorf("expected the paused torrent to stay paused, got %s", status.State)
+			}
+			if dir := torrent.Client.Config.DownloadDir; dir != downloadDir {
+				t.Errorf("expected the download directory %s, got %s", downloadDir, dir)
+			}
+		case started.InfoHash:
+			if status.State == "paused" {
+				t.Errorf("expected the resumed torrent to start")
+			}
+		default:
+			t.Errorf("unexpected torrent %s", status.Name)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, client := newServer(t)
+	ctx := context.Background()
+	var rpcErr *Error
+	if _, err := client.Add(ctx, AddParams{URL: "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"}); err == nil || err.Error() != ErrMagnet.Error() {
+		t.Errorf("expected magnet links to be refused, got %v", err)
+	}
+	if _, err := client.Add(ctx, AddParams{}); !errors.As(err, &rpcErr) || rpcErr.Code != CodeInvalidParams {
+		t.Errorf("expected invalid params, got %v", err)
+	}
+	if _, err := client.Get(ctx, "ffff"); !errors.As(err, &rpcErr) || rpcErr.Code != CodeFailed {
+		t.Errorf("expected unknown torrent, got %v", err)
+	}
+	if err := client.Call(ctx, "reboot", nil, nil); !errors.As(err, &rpcErr) || rpcErr.Code != CodeMethodNotFound {
+		t.Errorf("expected unknown method, got %v", err)
+	}
+	// Such a request can be sent by a form of another site
+	resp, err := client.HTTP.Post(client.URL, "text/plain", strings.NewReader(`{"jsonrpc":"2.0","method":"list","id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected requests other than JSON to be refused, got %s", resp.Status)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	server, _ := newServer(t)
+	handler := RequireAuth(server, "user:secret")
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+	ctx := context.Background()
+	client := Dial(httpServer.Listener.Addr().String())
+	if _, err := client.List(ctx); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected a request without password to be refused, got %v", err)
+	}
+	client.Auth = "user:wrong"
+	if _, err := client.List(ctx); err == nil {
+		t.Errorf("expected a wrong password to be refused")
+	}
+	client.Auth = "user:secret"
+	if _, err := client.List(ctx); err != nil {
+		t.Errorf("expected the password to be accepted, got %v", err)
+	}
+
+	// The socket is only open to the user
+	socket := filepath.Join(t.TempDir(), "rpc.sock")
+	listener, err := Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, handler)
+	defer listener.Close()
+	if _, err := Dial(socket).List(ctx); err != nil {
+		t.Errorf("expected requests on the socket to need no password, got %v", err)
+	}
+
+	for address, loopback := range map[string]bool{
+		"127.0.0.1:9091": true,
+		"[::1]:9091":     true,
+		"localhost:9091": true,
+		":9091":          false,
+		"0.0.0.0:9091":   false,
+		"192.0.2.1:9091": false,
+	} {
+		if IsLoopback(address) != loopback {
+			t.Errorf("expected IsLoopback(%q) to be %t", address, loopback)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	server, _ := newServer(t)
+	httpServer := httptest.NewServer(CheckHost(server, "192.0.2.1:9091"))
+	defer httpServer.Close()
+	for host, allowed := range map[string]bool{
+		httpServer.Listener.Addr().String(): true,
+		"localhost:9091":                    true,
+		"[::1]:9091":                        true,
+		"192.0.2.1:9091":                    true,
+		"attacker.example:9091":             false,
+		"attacker.example":                  false,
+	} {
+		req, err := http.NewRequest(http.MethodPost, httpServer.URL+Path, strings.NewReader(`{"jsonrpc":"2.0","method":"list","id":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if (resp.StatusCode == http.StatusOK) != allowed {
+			t.Errorf("unexpected %s for the host %s", resp.Status, host)
+		}
+	}
+}
+
+func TestDownloadRoot(t *testing.T) {
+	server, client := newServer(t)
+	server.DownloadRoot = server.Config.DownloadDir
+	ctx := context.Background()
+	var rpcErr *Error
+	outside := AddParams{Data: torrentData(t, []byte("outside"), 256), Paused: true, DownloadDir: t.TempDir()}
+	if _, err := client.Add(ctx, outside); !errors.As(err, &rpcErr) || rpcErr.Code != CodeInvalidParams {
+		t.Errorf("expected a directory outside the root to be refused, got %v", err)
+	}
+	outside.DownloadDir = filepath.Join(server.DownloadRoot, "..", "elsewhere")
+	if _, err := client.Add(ctx, outside); err == nil {
+		t.Errorf("expected a directory escaping the root to be refused")
+	}
+	inside := AddParams{Data: torrentData(t, []byte("inside"), 256), Paused: true, DownloadDir: filepath.Join(server.DownloadRoot, "movies")}
+	if _, err := client.Add(ctx, inside); err != nil {
+		t.Errorf("expected a directory within the root to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/server"
+	"github.com/samir-adh/bytetorrent/src/session"
+	"github.com/samir-adh/bytetorrent/src/term"
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+	"github.com/ztrue/tracerr"
+)
+
+// serve downloads the torrents given as arguments and exposes their
+// files over HTTP while they download.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: bytetorrent serve [flags] <torrent file>...")
+		flags.PrintDefaults()
+	}
+	addr := flags.String("addr", "127.0.0.1:8080", "Address the HTTP server listens on")
+	verbose := flags.Bool("v", false, "Enable verbose output mode")
+	downloadDir := flags.String("o", "./downloads", "Directory where downloads are saved")
+	port := flags.Int("port", 6881, "Port peers connect to, over TCP and uTP")
+	readahead := flags.Int("readahead", 8<<20, "Bytes fetched first after the playhead")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	verboseLevel := log.LowVerbose
+	if *verbose {
+		verboseLevel = log.HighVerbose
+	}
+	logger := log.Logger{Verbose: verboseLevel, Plain: !term.IsTerminal(os.Stdout.Fd())}
+	config := torrentclient.Config{
+		ResumeDir:   filepath.Join(*downloadDir, ".resume"),
+		DownloadDir: *downloadDir,
+		PartSuffix:  true,
+		Sequential:  true,
+		Readahead:   *readahead,
+	}
+	torrentSession, err := session.New(session.Config{Port: *port}, &logger)
+	if err != nil {
+		tracerr.Print(err)
+		os.Exit(1)
+	}
+	defer torrentSession.Close()
+	handler := server.New()
+	for _, path := range flags.Args() {
+		torrent, err := torrentSession.AddFile(path, config, true)
+		if err != nil {
+			tracerr.Print(err)
+			os.Exit(1)
+		}
+		client := torrent.Client
+		handler.Add(client)
+		for i, file := range client.Torrent.Files {
+			if !file.Padding {
+				logger.Printf(log.LowVerbose, "serving http://%s%s\n", *addr, server.URL(client, i))
+			}
+		}
+	}
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	go showProgress(ctx, torrentSession, &logger)
+	httpServer := &http.Server{Addr: *addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+		torrentSession.Shutdown(shutdownCtx)
+	}()
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		tracerr.Print(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+)
+
+// Server exposes the files of its torrents over HTTP at
+// /<info hash>/<file path>, with Range support. Bytes are served as soon
+// as the pieces covering them are verified and the requested pieces are
+// downloaded first.
+type Server struct {
+	mu       sync.Mutex
+	clients  map[string]*torrentclient.TorrentClient
+	order    []string
+	modified time.Time
+}
+
+func New() *Server {
+	return &Server{
+		clients:  make(map[string]*torrentclient.TorrentClient),
+		modified: time.Now(),
+	}
+}
+
+// Add makes the files of the client's torrent available
+func (s *Server) Add(client *torrentclient.TorrentClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hex.EncodeToString(client.InfoHash[:])
+	if _, ok := s.clients[key]; !ok {
+		s.order = append(s.order, key)
+	}
+	s.clients[key] = client
+}
+
+// URL returns the path a file of the client is served at
+func URL(client *torrentclient.TorrentClient, index int) string {
+	escaped := make([]string, 0, len(client.Torrent.Files[index].Path))
+	for _, part := range client.Torrent.Files[index].Path {
+		escaped = append(escaped, url.PathEscape(part))
+	}
+	return "/" + hex.EncodeToString(client.InfoHash[:]) + "/" + strings.Join(escaped, "/")
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == "/" {
+		s.serveIndex(w)
+		return
+	}
+	key, filePath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	s.mu.Lock()
+	client, ok := s.clients[key]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	index := findFile(client, filePath)
+	if index < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	reader, err := client.NewReader(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Stop waiting for pieces when the client goes away
+	reader.SetContext(r.Context())
+	// Keep ServeContent from sniffing, it would wait for the first piece
+	contentType := mime.TypeByExtension(path.Ext(filePath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, path.Base(filePath), s.modified, reader)
+}
+
+func findFile(client *torrentclient.TorrentClient, filePath string) int {
+	for i, file := range client.Torrent.Files {
+		if !file.Padding && strings.Join(file.Path, "/") == filePath {
+			return i
+		}
+	}
+	return -1
+}
+
+// serveIndex lists the files of every torrent with their progress
+func (s *Server) serveIndex(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<!DOCTYPE html>\n<title>bytetorrent</title>")
+	for _, key := range s.order {
+		client := s.clients[key]
+		completed, wanted := client.Picker.Progress()
+		fmt.Fprintf(w, "<h2>%s (%d/%d pieces)</h2>\n<ul>\n", html.EscapeString(client.FileName), completed, wanted)
+		for i, file := range client.Torrent.Files {
+			if file.Padding {
+				continue
+			}
+			fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> %d bytes</li>\n",
+				html.EscapeString(URL(client, i)), html.EscapeString(strings.Join(file.Path, "/")), file.Length)
+		}
+		fmt.Fprintln(w, "</ul>")
+	}
+}
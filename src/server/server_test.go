@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/storage"
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+)
+
+func TestServeRange(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abc"), 10000)
+	// The web seed stands in for the swarm
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := data[:40000]
+		if strings.HasSuffix(r.URL.Path, ".mkv") {
+			file = data[40000:]
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(file))
+	}))
+	defer seed.Close()
+
+	tor := &torrentfile.TorrentFile{
+		Name:        "movie dir",
+		PieceLength: 16384,
+		Length:      len(data),
+		MultiFile:   true,
+		Files: []torrentfile.File{
+			{Path: []string{"a.txt"}, Length: 40000},
+			{Path: []string{"sub", "b c.mkv"}, Length: len(data) - 40000, Offset: 40000},
+		},
+		UrlList: []string{seed.URL + "/"},
+	}
+	for start := 0; start < len(data); start += tor.PieceLength {
+		tor.PiecesHash = append(tor.PiecesHash, sha1.Sum(data[start:min(start+tor.PieceLength, len(data))]))
+	}
+	client, err := torrentclient.NewFromTorrent(tor, torrentclient.Config{Sequential: true}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Storage = storage.NewMemory(tor)
+	s := New()
+	s.Add(client)
+	server := httptest.NewServer(s)
+	defer server.Close()
+	go client.Download()
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+URL(client, 1), nil)
+	request.Header.Set("Range", "bytes=100-199")
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusPartialContent {
+		t.Fatalf("unexpected status %s", response.Status)
+	}
+	if !bytes.Equal(body, data[40100:40200]) {
+		t.Errorf("served %q, expected %q", body, data[40100:40200])
+	}
+
+	index, err := server.Client().Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Body.Close()
+	listing, _ := io.ReadAll(index.Body)
+	if !strings.Contains(string(listing), URL(client, 1)) {
+		t.Errorf("index doesn't link to the file: %s", listing)
+	}
+}
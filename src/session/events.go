@@ -0,0 +1,72 @@
+package session
+
+type EventKind int
+
+const (
+	TorrentAdded EventKind = iota
+	TorrentRemoved
+	StateChanged
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case TorrentAdded:
+		return "added"
+	case TorrentRemoved:
+		return "removed"
+	case StateChanged:
+		return "state"
+	default:
+		return "unknown"
+	}
+}
+
+// Event tells subscribers a torrent was added, removed or changed state
+type Event struct {
+	Kind     EventKind
+	InfoHash [20]byte
+	State    State // the new state
+}
+
+// eventBuffer is the number of events a subscriber may fall behind by
+// before the next ones are dropped
+const eventBuffer = 64
+
+// Subscribe returns a channel receiving the events of the session until
+// the returned function is called. Events are dropped while the channel
+// is full, subscribers should reread the torrents rather than rely on
+// every event.
+func (s *Session) Subscribe() (<-chan Event, func()) {
+	events := make(chan Event, eventBuffer)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan Event]struct{})
+	}
+	s.subscribers[events] = struct{}{}
+	return events, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subscribers, events)
+	}
+}
+
+// publish sends event to the subscribers, s.mu must be held
+func (s *Session) publish(event Event) {
+	for events := range s.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// setState changes the state of t and tells the subscribers, s.mu must
+// be held
+func (s *Session) setState(t *Torrent, state State) {
+	if t.state == state {
+		return
+	}
+	t.state = state
+	s.publish(Event{Kind: StateChanged, InfoHash: t.Client.InfoHash, State: state})
+}
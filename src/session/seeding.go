@@ -0,0 +1,117 @@
+package session
+
+import (
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/log"
+)
+
+// SeedGoals tell when a completed torrent stops seeding, as soon as one
+// of the goals set is reached. A torrent without any goal seeds as long
+// as the session runs but doesn't keep Wait blocked.
+type SeedGoals struct {
+	Ratio    float64       // bytes uploaded over the torrent size, zero disables it
+	Time     time.Duration // time spent seeding, zero disables it
+	IdleTime time.Duration // time without a peer interested in the pieces, zero disables it
+	Infinite bool          // seed until paused, the other goals are ignored
+}
+
+// set reports whether the torrent seeds until a goal is reached or
+// forever, rather than until the session closes
+func (g SeedGoals) set() bool {
+	return g.Infinite || g.Ratio > 0 || g.Time > 0 || g.IdleTime > 0
+}
+
+// seedCheckInterval is how often seeding torrents are checked against
+// their goals
+const seedCheckInterval = 10 * time.Second
+
+// SetSeedGoals replaces the goals of the torrents that don't have their own
+func (s *Session) SetSeedGoals(goals SeedGoals) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.Seed = goals
+	s.changed.Broadcast()
+}
+
+// SeedGoals returns the goals of the torrents that don't have their own
+func (s *Session) SeedGoals() SeedGoals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config.Seed
+}
+
+// SetSeedGoals replaces the goals of the torrent, nil restores the
+// session's
+func (t *Torrent) SetSeedGoals(goals *SeedGoals) {
+	t.session.mu.Lock()
+	defer t.session.mu.Unlock()
+	t.seedGoals = goals
+	t.session.changed.Broadcast()
+}
+
+// goals returns the seed goals that apply to t, s.mu must be held
+func (s *Session) goals(t *Torrent) SeedGoals {
+	if t.seedGoals != nil {
+		return *t.seedGoals
+	}
+	return s.config.Seed
+}
+
+// reached returns the goal of g that t reached at now, or an empty
+// string if it should keep seeding
+func (g SeedGoals) reached(t *Torrent, now time.Time) string {
+	if g.Infinite {
+		return ""
+	}
+	size := t.Client.Torrent.Length
+	if g.Ratio > 0 && size > 0 && float64(t.Client.Uploaded())/float64(size) >= g.Ratio {
+		return "ratio"
+	}
+	if g.Time > 0 && now.Sub(t.seedingSince) >= g.Time {
+		return "seed time"
+	}
+	if g.IdleTime > 0 {
+		since, idle := t.Client.Idle()
+		if since.Before(t.seedingSince) {
+			since = t.seedingSince
+		}
+		if idle && now.Sub(since) >= g.IdleTime {
+			return "idle time"
+		}
+	}
+	return ""
+}
+
+// checkSeeding stops seeding the torrents that reached their goals
+func (s *Session) checkSeeding(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.torrents {
+		if t.state != Seeding {
+			continue
+		}
+		goal := s.goals(t).reached(t, now)
+		if goal == "" {
+			continue
+		}
+		s.logger.Printf(log.LowVerbose, "%s reached its %s goal, stopped seeding\n", t.Client.FileName, goal)
+		s.setState(t, Finished)
+		s.announceStopped(t)
+		s.disconnect(t)
+		s.changed.Broadcast()
+	}
+}
+
+func (s *Session) seedLoop() {
+	ticker := time.NewTicker(seedCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.checkSeeding(now)
+		case <-s.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,570 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/ban"
+	"github.com/samir-adh/bytetorrent/src/connlimit"
+	"github.com/samir-adh/bytetorrent/src/dialer"
+	"github.com/samir-adh/bytetorrent/src/ipfilter"
+	"github.com/samir-adh/bytetorrent/src/log"
+	pr "github.com/samir-adh/bytetorrent/src/peerconnection"
+	"github.com/samir-adh/bytetorrent/src/portmap"
+	"github.com/samir-adh/bytetorrent/src/proxy"
+	"github.com/samir-adh/bytetorrent/src/ratelimit"
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+	tr "github.com/samir-adh/bytetorrent/src/tracker"
+	"github.com/ztrue/tracerr"
+)
+
+// Config holds the settings shared by every torrent of a session
+type Config struct {
+	Port         int // TCP and uTP listen port, picked by the system when zero
+	MaxActive    int // torrents downloading at once, no limit when zero
+	DownloadRate int // payload bytes per second for all torrents, zero means unlimited
+	UploadRate   int
+	AltSpeed     *ratelimit.Schedule // rates used at some times of the day
+
+	MaxConnections int // connections of all torrents, 200 when zero
+	MaxHalfOpen    int // dials in progress, 16 when zero
+
+	Seed SeedGoals // when completed torrents stop seeding
+
+	Proxy *proxy.Proxy // outgoing connections of all torrents go through it when set
+
+	PortMapping bool // forward the listen port on the router with UPnP or PCP/NAT-PMP
+}
+
+const (
+	defaultMaxConnections = 200
+	defaultMaxHalfOpen    = 16
+)
+
+// ErrDuplicate is returned when adding a torrent the session already has
+var ErrDuplicate = errors.New("torrent already added")
+
+// handshakeTimeout bounds the time an inbound peer has to say which
+// torrent it wants
+const handshakeTimeout = 10 * time.Second
+
+// Session owns the listen sockets and the peer ID used by all of its
+// torrents, it queues their downloads and routes inbound connections to
+// them by info hash.
+type Session struct {
+	PeerId          [20]byte
+	Port            int
+	Dialer          *dialer.Dialer
+	DownloadLimiter *ratelimit.Limiter
+	UploadLimiter   *ratelimit.Limiter
+	Connections     *connlimit.Shared
+	Bans            *ban.List
+	Filter          *ipfilter.Filter // blocks addresses of all torrents, see ipfilter.Filter.Reload
+	PortMap         *portmap.Mapper  // nil unless Config.PortMapping is set
+	config          Config
+	logger          *log.Logger
+	listener        net.Listener
+
+	mu          sync.Mutex
+	changed     *sync.Cond // signaled when a torrent changes state
+	torrents    map[[20]byte]*Torrent
+	order       [][20]byte // queue order
+	closed      bool
+	altSpeed    bool                    // the alternate rates are in use
+	conns       map[net.Conn]*Torrent   // inbound connections, nil until the handshake
+	subscribers map[chan Event]struct{} // see Subscribe
+	quit        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+}
+
+// New opens the listen sockets of the session
+func New(config Config, logger *log.Logger) (*Session, error) {
+	peerId, err := tr.RandomPeerId()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	if config.MaxConnections == 0 {
+		config.MaxConnections = defaultMaxConnections
+	}
+	if config.MaxHalfOpen == 0 {
+		config.MaxHalfOpen = defaultMaxHalfOpen
+	}
+	s := &Session{
+		PeerId:          peerId,
+		Port:            port,
+		Dialer:          newDialer(config.Proxy, port, logger),
+		DownloadLimiter: ratelimit.New(config.DownloadRate),
+		UploadLimiter:   ratelimit.New(config.UploadRate),
+		Connections: &connlimit.Shared{
+			Conns:    connlimit.NewPool(config.MaxConnections),
+			HalfOpen: connlimit.NewPool(config.MaxHalfOpen),
+			SelfIP:   connlimit.LocalIP(),
+		},
+		Bans:     ban.NewList(),
+		Filter:   ipfilter.New(),
+		config:   config,
+		logger:   logger,
+		listener: listener,
+		torrents: make(map[[20]byte]*Torrent),
+		conns:    make(map[net.Conn]*Torrent),
+		quit:     make(chan struct{}),
+	}
+	if config.PortMapping {
+		s.PortMap = portmap.New(port, logger)
+		s.PortMap.Start()
+	}
+	s.changed = sync.NewCond(&s.mu)
+	s.applySchedule(time.Now())
+	s.wg.Go(s.scheduleLoop)
+	s.wg.Go(s.seedLoop)
+	s.wg.Go(func() { s.acceptLoop(listener) })
+	if s.Dialer.Socket != nil {
+		s.wg.Go(func() { s.acceptLoop(s.Dialer.Socket) })
+	}
+	return s, nil
+}
+
+func newDialer(p *proxy.Proxy, port int, logger *log.Logger) *dialer.Dialer {
+	if p != nil {
+		return dialer.NewProxied(p, logger)
+	}
+	return dialer.New(port, logger)
+}
+
+// AddFile adds the torrent described by the file at path
+func (s *Session) AddFile(path string, config torrentclient.Config, start bool) (*Torrent, error) {
+	tor, err := torrentfile.OpenTorrentFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.Add(tor, config, start)
+}
+
+// Add queues the download of tor, it is added paused unless start is
+// true. The peer ID, port, dialer, shared limits, ban list and IP filter
+// of config are replaced by the session's.
+func (s *Session) Add(tor *torrentfile.TorrentFile, config torrentclient.Config, start bool) (*Torrent, error) {
+	s.mu.Lock()
+	if _, ok := s.torrents[tor.InfoHash]; ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: %x", ErrDuplicate, tor.InfoHash)
+	}
+	s.mu.Unlock()
+	config.PeerId = s.PeerId
+	config.Port = s.Port
+	config.Dialer = s.Dialer
+	config.SessionDownload = s.DownloadLimiter
+	config.SessionUpload = s.UploadLimiter
+	config.Connections = s.Connections
+	config.Bans = s.Bans
+	config.Filter = s.Filter
+	config.Proxy = s.config.Proxy
+	config.PortMap = s.PortMap
+	client, err := torrentclient.NewFromTorrent(tor, config, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	t := &Torrent{Client: client, session: s, state: Paused}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("session is closed")
+	}
+	if _, ok := s.torrents[tor.InfoHash]; ok {
+		return nil, fmt.Errorf("%w: %x", ErrDuplicate, tor.InfoHash)
+	}
+	s.torrents[tor.InfoHash] = t
+	s.order = append(s.order, tor.InfoHash)
+	s.publish(Event{Kind: TorrentAdded, InfoHash: tor.InfoHash, State: t.state})
+	if start {
+		s.setState(t, Queued)
+		s.schedule()
+	}
+	return t, nil
+}
+
+// Get returns the torrent with the info hash
+func (s *Session) Get(infoHash [20]byte) (*Torrent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[infoHash]
+	return t, ok
+}
+
+// Torrents returns the torrents in queue order
+func (s *Session) Torrents() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	torrents := make([]*Torrent, 0, len(s.order))
+	for _, hash := range s.order {
+		torrents = append(torrents, s.torrents[hash])
+	}
+	return torrents
+}
+
+// Pause stops the download of the torrent, it no longer accepts peers
+func (s *Session) Pause(infoHash [20]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+	switch t.state {
+	case Downloading:
+		t.Client.Stop()
+	case Queued, Seeding, Finished, Failed:
+	default:
+		return nil
+	}
+	s.announceStopped(t)
+	s.setState(t, Paused)
+	s.disconnect(t)
+	s.changed.Broadcast()
+	return nil
+}
+
+// Resume queues a paused, failed or finished torrent again
+func (s *Session) Resume(infoHash [20]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+	if t.state != Paused && t.state != Failed && t.state != Finished {
+		return nil
+	}
+	if t.running {
+		// Wait for the paused download to return, it requeues the torrent
+		t.resume = true
+		return nil
+	}
+	s.setState(t, Queued)
+	t.err = nil
+	s.schedule()
+	return nil
+}
+
+// Remove stops the torrent and forgets it, downloaded files are kept
+func (s *Session) Remove(infoHash [20]byte) error {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+	delete(s.torrents, infoHash)
+	for i, hash := range s.order {
+		if hash == infoHash {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	t.state = Removed
+	s.publish(Event{Kind: TorrentRemoved, InfoHash: infoHash, State: Removed})
+	t.Client.Stop()
+	s.disconnect(t)
+	for t.running {
+		s.changed.Wait()
+	}
+	s.schedule()
+	s.changed.Broadcast()
+	t.Client.AnnounceStopped()
+	s.mu.Unlock()
+	return t.Client.Close()
+}
+
+// schedule starts queued torrents while there are free slots, s.mu must
+// be held
+func (s *Session) schedule() {
+	active := 0
+	for _, t := range s.torrents {
+		if t.state == Downloading {
+			active++
+		}
+	}
+	for _, hash := range s.order {
+		t := s.torrents[hash]
+		if t.state != Queued || t.running {
+			continue
+		}
+		if s.config.MaxActive > 0 && active >= s.config.MaxActive {
+			break
+		}
+		active++
+		s.start(t)
+	}
+	s.changed.Broadcast()
+}
+
+// start runs the download of t in the background, s.mu must be held
+func (s *Session) start(t *Torrent) {
+	s.setState(t, Downloading)
+	t.running = true
+	s.wg.Go(func() {
+		err := t.Client.Download()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		t.running = false
+		switch {
+		case err == nil:
+			// A torrent completed while being paused is still complete
+			if t.state == Downloading || t.state == Paused {
+				s.setState(t, Seeding)
+				t.seedingSince = time.Now()
+			}
+			if s.closed {
+				s.announceStopped(t)
+			}
+		case t.state == Paused && t.resume:
+			s.setState(t, Queued)
+		case t.state == Paused || t.state == Removed:
+		case errors.Is(err, torrentclient.ErrStopped):
+			// Stopped by a pause that was resumed before the download started
+			s.setState(t, Queued)
+		default:
+			s.logger.Printf(log.LowVerbose, "download of %s failed: %s\n", t.Client.FileName, err)
+			s.setState(t, Failed)
+			t.err = err
+		}
+		t.resume = false
+		s.schedule()
+	})
+}
+
+// Wait blocks until no torrent is queued or downloading, nor seeding
+// towards a goal
+func (s *Session) Wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.busy() {
+		s.changed.Wait()
+	}
+}
+
+func (s *Session) busy() bool {
+	for _, t := range s.torrents {
+		if t.state == Queued || t.state == Downloading || t.running {
+			return true
+		}
+		if t.state == Seeding && s.goals(t).set() {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops every torrent and the listen sockets
+func (s *Session) Close() error {
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown stops every torrent, which writes the pieces downloaded so
+// far, saves the resume data and tells the tracker, then closes the
+// sockets. It returns ctx.Err() if ctx is done before all of it is.
+func (s *Session) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		close(s.quit)
+	}
+	s.closed = true
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		if t.state == Downloading || t.state == Queued {
+			s.setState(t, Paused)
+		}
+		if t.running {
+			t.Client.Stop()
+		} else {
+			s.announceStopped(t)
+		}
+		torrents = append(torrents, t)
+	}
+	// Peers we upload to would keep the connections open
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	// The uTP socket is also a listener, closing it ends the uTP
+	// connections of the stopping downloads early
+	s.listener.Close()
+	s.Dialer.Close()
+	s.PortMap.Close()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		// Closing the torrents also waits for their stopped events
+		s.closeOnce.Do(func() {
+			for _, t := range torrents {
+				t.Client.Close()
+			}
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// SetRates changes the session rates used outside of the alternate
+// speed schedule
+func (s *Session) SetRates(download int, upload int) {
+	s.mu.Lock()
+	s.config.DownloadRate = download
+	s.config.UploadRate = upload
+	s.mu.Unlock()
+	s.applySchedule(time.Now())
+}
+
+// Rates returns the session rates used outside of the alternate speed
+// schedule
+func (s *Session) Rates() (download int, upload int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config.DownloadRate, s.config.UploadRate
+}
+
+// SetAltSpeed replaces the alternate speed schedule, nil disables it
+func (s *Session) SetAltSpeed(schedule *ratelimit.Schedule) {
+	s.mu.Lock()
+	s.config.AltSpeed = schedule
+	s.mu.Unlock()
+	s.applySchedule(time.Now())
+}
+
+// AltSpeedActive reports whether the alternate rates are in use
+func (s *Session) AltSpeedActive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.altSpeed
+}
+
+// applySchedule sets the session rates for the time of day now
+func (s *Session) applySchedule(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	download, upload := s.config.DownloadRate, s.config.UploadRate
+	s.altSpeed = s.config.AltSpeed.Active(now)
+	if s.altSpeed {
+		download, upload = s.config.AltSpeed.Download, s.config.AltSpeed.Upload
+	}
+	if s.DownloadLimiter.Rate() != download {
+		s.DownloadLimiter.SetRate(download)
+	}
+	if s.UploadLimiter.Rate() != upload {
+		s.UploadLimiter.SetRate(upload)
+	}
+}
+
+func (s *Session) scheduleLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.applySchedule(now)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Session) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Printf(log.LowVerbose, "stopped accepting peers: %s\n", err)
+			}
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = nil
+		s.mu.Unlock()
+		s.wg.Go(func() {
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			if err := s.handleConn(conn); err != nil {
+				s.logger.Printf(log.HighVerbose, "connection from %s: %s\n", conn.RemoteAddr(), err)
+			}
+		})
+	}
+}
+
+// handleConn hands an inbound connection to the torrent it asks for
+func (s *Session) handleConn(conn net.Conn) error {
+	// Over TCP or uTP
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		ip := net.ParseIP(host)
+		if s.Bans.Banned(ip) {
+			return torrentclient.ErrBanned
+		}
+		if s.Filter.Blocked(ip) {
+			return torrentclient.ErrFiltered
+		}
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	handshake, err := pr.ReadHandShake(conn)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	t, ok := s.torrents[handshake.InfoHash]
+	accepting := ok && (t.state == Downloading || t.state == Seeding)
+	closed := s.closed
+	if accepting && !closed {
+		s.conns[conn] = t
+	}
+	s.mu.Unlock()
+	if !accepting || closed {
+		return fmt.Errorf("no active torrent with info hash %x", handshake.InfoHash)
+	}
+	reply := pr.HandShake{Protocol: "BitTorrent protocol", InfoHash: handshake.InfoHash, PeerId: s.PeerId}
+	if _, err := conn.Write(reply.Serialize()); err != nil {
+		return tracerr.Wrap(err)
+	}
+	// Serve pushes back the read deadline as messages come
+	conn.SetDeadline(time.Time{})
+	return t.Client.ServePeer(conn, handshake.PeerId)
+}
+
+// announceStopped tells the tracker t stopped, unless its download runs
+// and tells it when it returns. s.mu must be held.
+func (s *Session) announceStopped(t *Torrent) {
+	if !t.running {
+		t.Client.AnnounceStopped()
+	}
+}
+
+// disconnect closes the inbound connections of t, s.mu must be held
+func (s *Session) disconnect(t *Torrent) {
+	for conn, torrent := range s.conns {
+		if torrent == t {
+			conn.Close()
+		}
+	}
+}
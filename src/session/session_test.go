@@ -0,0 +1,359 @@
+package session
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/ratelimit"
+	"github.com/samir-adh/bytetorrent/src/storage"
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+)
+
+// tracker answers every announce with a single peer on localhost
+func tracker(port *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := []byte{127, 0, 0, 1, 0, 0}
+		binary.BigEndian.PutUint16(peer[4:], uint16(*port))
+		bencode.Marshal(w, map[string]any{"interval": 60, "peers": string(peer)})
+	}))
+}
+
+func generateTorrent(data []byte, pieceLength int, announce string) *torrentfile.TorrentFile {
+	tor := &torrentfile.TorrentFile{
+		Announce:    announce,
+		Name:        "data.bin",
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Files:       []torrentfile.File{{Path: []string{"data.bin"}, Length: len(data)}},
+	}
+	tor.InfoHash = sha1.Sum(data)
+	for start := 0; start < len(data); start += pieceLength {
+		tor.PiecesHash = append(tor.PiecesHash, sha1.Sum(data[start:min(start+pieceLength, len(data))]))
+	}
+	return tor
+}
+
+// seed adds tor to s with all of data already stored
+func seed(t *testing.T, s *Session, tor *torrentfile.TorrentFile, data []byte, config torrentclient.Config) {
+	t.Helper()
+	torrent, err := s.Add(tor, config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := storage.NewMemory(tor)
+	for i := range tor.PiecesHash {
+		start := i * tor.PieceLength
+		memory.WriteAt(data[start:min(start+tor.PieceLength, len(data))], i, 0)
+		torrent.Client.Picker.Done(i)
+	}
+	torrent.Client.Storage = memory
+	s.Resume(tor.InfoHash)
+	s.Wait()
+	if torrent.State() != Seeding {
+		t.Fatalf("expected seeder to be seeding, got %s", torrent.State())
+	}
+}
+
+func TestDownloadFromSession(t *testing.T) {
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	seeder, err := New(Config{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	server := tracker(&seeder.Port)
+	defer server.Close()
+
+	first := bytes.Repeat([]byte("first torrent "), 5000)
+	second := bytes.Repeat([]byte("second torrent "), 3000)
+	torrents := []*torrentfile.TorrentFile{
+		generateTorrent(first, 16384, server.URL),
+		generateTorrent(second, 16384, server.URL),
+	}
+	seed(t, seeder, torrents[0], first, torrentclient.Config{})
+	seed(t, seeder, torrents[1], second, torrentclient.Config{})
+
+	leecher, err := New(Config{MaxActive: 1}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	var memories []*storage.MemoryStorage
+	for _, tor := range torrents {
+		torrent, err := leecher.Add(tor, torrentclient.Config{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memory := storage.NewMemory(tor)
+		torrent.Client.Storage = memory
+		memories = append(memories, memory)
+	}
+	if _, err := leecher.Add(torrents[0], torrentclient.Config{}, false); err == nil {
+		t.Errorf("expected adding a torrent twice to fail")
+	}
+	for _, tor := range torrents {
+		leecher.Resume(tor.InfoHash)
+	}
+	done := make(chan struct{})
+	go func() {
+		leecher.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("downloads didn't complete")
+	}
+	for i, torrent := range leecher.Torrents() {
+		if torrent.State() != Seeding {
+			t.Errorf("torrent %d is %s: %v", i, torrent.State(), torrent.Err())
+		}
+	}
+	if !bytes.Equal(memories[0].Bytes(), first) || !bytes.Equal(memories[1].Bytes(), second) {
+		t.Errorf("downloaded data differs from the seeded data")
+	}
+	// Each torrent was uploaded once
+	seeder.SetSeedGoals(SeedGoals{Ratio: 1})
+	seeder.checkSeeding(time.Now())
+	for i, torrent := range seeder.Torrents() {
+		if torrent.State() != Finished {
+			t.Errorf("expected seeded torrent %d to reach its ratio, got %s", i, torrent.State())
+		}
+	}
+}
+
+func TestPauseAndRemove(t *testing.T) {
+	s, err := New(Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Nothing listens on the announced port, the download can't progress
+	port := 1
+	server := tracker(&port)
+	defer server.Close()
+	tor := generateTorrent(bytes.Repeat([]byte("x"), 1000), 256, server.URL)
+	torrent, err := s.Add(tor, torrentclient.Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.Client.Storage = storage.NewMemory(tor)
+	s.Resume(tor.InfoHash)
+	if torrent.State() != Downloading {
+		t.Errorf("expected torrent to be downloading, got %s", torrent.State())
+	}
+	if err := s.Pause(tor.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	if torrent.State() != Paused {
+		t.Errorf("expected torrent to be paused, got %s", torrent.State())
+	}
+	if err := s.Remove(tor.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(tor.InfoHash); ok || len(s.Torrents()) != 0 {
+		t.Errorf("expected torrent to be removed")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s, err := New(Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	events, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+	port := 1
+	server := tracker(&port)
+	defer server.Close()
+	tor := generateTorrent(bytes.Repeat([]byte("x"), 1000), 256, server.URL)
+	torrent, err := s.Add(tor, torrentclient.Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.Client.Storage = storage.NewMemory(tor)
+	s.Resume(tor.InfoHash)
+	s.Pause(tor.InfoHash)
+	s.Remove(tor.InfoHash)
+	expected := []Event{
+		{TorrentAdded, tor.InfoHash, Paused},
+		{StateChanged, tor.InfoHash, Queued},
+		{StateChanged, tor.InfoHash, Downloading},
+		{StateChanged, tor.InfoHash, Paused},
+		{TorrentRemoved, tor.InfoHash, Removed},
+	}
+	for _, want := range expected {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("expected %s event of state %s, got %s of %s", want.Kind, want.State, got.Kind, got.State)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("missing %s event of state %s", want.Kind, want.State)
+		}
+	}
+}
+
+func TestAltSpeedSchedule(t *testing.T) {
+	start, _ := ratelimit.ParseClock("09:00")
+	end, _ := ratelimit.ParseClock("18:00")
+	s, err := New(Config{
+		DownloadRate: 1000,
+		AltSpeed:     &ratelimit.Schedule{Start: start, End: end, Download: 100, Upload: 50},
+	}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.applySchedule(time.Date(2025, 1, 6, 10, 0, 0, 0, time.Local))
+	if !s.AltSpeedActive() || s.DownloadLimiter.Rate() != 100 || s.UploadLimiter.Rate() != 50 {
+		t.Errorf("expected alternate rates during business hours")
+	}
+	s.applySchedule(time.Date(2025, 1, 6, 20, 0, 0, 0, time.Local))
+	if s.AltSpeedActive() || s.DownloadLimiter.Rate() != 1000 || s.UploadLimiter.Rate() != 0 {
+		t.Errorf("expected normal rates in the evening")
+	}
+}
+
+func TestSeedGoals(t *testing.T) {
+	s, err := New(Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	server := tracker(&s.Port)
+	defer server.Close()
+	first := generateTorrent(bytes.Repeat([]byte("a"), 1000), 256, server.URL)
+	second := generateTorrent(bytes.Repeat([]byte("b"), 1000), 256, server.URL)
+	seed(t, s, first, bytes.Repeat([]byte("a"), 1000), torrentclient.Config{})
+	seed(t, s, second, bytes.Repeat([]byte("b"), 1000), torrentclient.Config{})
+	a, _ := s.Get(first.InfoHash)
+	b, _ := s.Get(second.InfoHash)
+
+	s.SetSeedGoals(SeedGoals{Time: time.Hour})
+	b.SetSeedGoals(&SeedGoals{Infinite: true})
+	now := time.Now()
+	s.checkSeeding(now)
+	if a.State() != Seeding || b.State() != Seeding {
+		t.Fatalf("expected both torrents to seed, got %s and %s", a.State(), b.State())
+	}
+	s.checkSeeding(now.Add(2 * time.Hour))
+	if a.State() != Finished {
+		t.Errorf("expected seed time to be reached, got %s", a.State())
+	}
+	if b.State() != Seeding {
+		t.Errorf("expected infinite seed to go on, got %s", b.State())
+	}
+	s.mu.Lock()
+	busy := s.busy()
+	s.mu.Unlock()
+	if !busy {
+		t.Errorf("expected Wait to block on an infinite seed")
+	}
+
+	b.SetSeedGoals(&SeedGoals{IdleTime: time.Minute})
+	b.Client.PeerInterested(true)
+	s.checkSeeding(now.Add(2 * time.Hour))
+	if b.State() != Seeding {
+		t.Errorf("expected torrent with an interested peer to seed, got %s", b.State())
+	}
+	b.Client.PeerInterested(false)
+	s.checkSeeding(time.Now().Add(2 * time.Minute))
+	if b.State() != Finished {
+		t.Errorf("expected idle time to be reached, got %s", b.State())
+	}
+
+	s.SetSeedGoals(SeedGoals{})
+	s.Resume(first.InfoHash)
+	s.Wait()
+	if a.State() != Seeding {
+		t.Errorf("expected resumed torrent to seed again, got %s", a.State())
+	}
+}
+
+func TestTrackerEvents(t *testing.T) {
+	s, err := New(Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var mu sync.Mutex
+	var events []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if event := r.URL.Query().Get("event"); event != "" {
+			mu.Lock()
+			events = append(events, event)
+			mu.Unlock()
+		}
+		bencode.Marshal(w, map[string]any{"interval": 60, "peers": ""})
+	}))
+	defer server.Close()
+	data := bytes.Repeat([]byte("a"), 1000)
+	tor := generateTorrent(data, 256, server.URL)
+	seed(t, s, tor, data, torrentclient.Config{})
+
+	// Stopped by its goal, resumed, then seeding at shutdown
+	s.SetSeedGoals(SeedGoals{Time: time.Hour})
+	s.checkSeeding(time.Now().Add(2 * time.Hour))
+	s.SetSeedGoals(SeedGoals{})
+	s.Resume(tor.InfoHash)
+	s.Wait()
+	s.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(events) != "[started stopped started stopped]" {
+		t.Errorf("unexpected tracker events %v", events)
+	}
+}
+
+func TestSuperSeeding(t *testing.T) {
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	seeder, err := New(Config{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	server := tracker(&seeder.Port)
+	defer server.Close()
+	data := bytes.Repeat([]byte("super seeded "), 4000)
+	tor := generateTorrent(data, 8192, server.URL)
+	seed(t, seeder, tor, data, torrentclient.Config{SuperSeed: true})
+
+	leecher, err := New(Config{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	torrent, err := leecher.Add(tor, torrentclient.Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := storage.NewMemory(tor)
+	torrent.Client.Storage = memory
+	leecher.Resume(tor.InfoHash)
+	done := make(chan struct{})
+	go func() {
+		leecher.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("download from the super seeder didn't complete")
+	}
+	if torrent.State() != Seeding || !bytes.Equal(memory.Bytes(), data) {
+		t.Errorf("expected the data of the super seeder, torrent is %s: %v", torrent.State(), torrent.Err())
+	}
+}
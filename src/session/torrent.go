@@ -0,0 +1,67 @@
+package session
+
+import (
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+)
+
+type State int
+
+const (
+	Paused State = iota
+	Queued
+	Downloading
+	Seeding
+	Finished // seeded until a goal was reached
+	Failed
+	Removed
+)
+
+func (s State) String() string {
+	switch s {
+	case Paused:
+		return "paused"
+	case Queued:
+		return "queued"
+	case Downloading:
+		return "downloading"
+	case Seeding:
+		return "seeding"
+	case Finished:
+		return "finished"
+	case Failed:
+		return "failed"
+	case Removed:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// Torrent is a torrent managed by a Session, its fields are guarded by
+// the session lock.
+type Torrent struct {
+	Client  *torrentclient.TorrentClient
+	session *Session
+	state   State
+	err     error
+	running bool // Download hasn't returned yet
+	resume  bool // queue again once the running Download returns
+
+	seedGoals    *SeedGoals // the session's when nil
+	seedingSince time.Time
+}
+
+func (t *Torrent) State() State {
+	t.session.mu.Lock()
+	defer t.session.mu.Unlock()
+	return t.state
+}
+
+// Err returns the error the download failed with
+func (t *Torrent) Err() error {
+	t.session.mu.Lock()
+	defer t.session.mu.Unlock()
+	return t.err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/ipfilter"
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/proxy"
+	"github.com/samir-adh/bytetorrent/src/ratelimit"
+	"github.com/samir-adh/bytetorrent/src/session"
+	"github.com/samir-adh/bytetorrent/src/term"
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+	"github.com/ztrue/tracerr"
+)
+
+// sessionFlags defines the flags of the commands running a session, the
+// returned function opens the session once they are parsed. It exits on
+// invalid settings.
+func sessionFlags(flags *flag.FlagSet) func() (*session.Session, torrentclient.Config, *log.Logger) {
+	verbose := flags.Bool("v", false, "Enable verbose output mode")
+	downloadDir := "./downloads"
+	flags.StringVar(&downloadDir, "o", downloadDir, "Directory where downloads are saved")
+	flags.StringVar(&downloadDir, "dir", downloadDir, "Same as -o")
+	incompleteDir := flags.String("incomplete-dir", "", "Directory holding downloads until they complete")
+	partSuffix := flags.Bool("part", true, "Append .part to files until the download completes")
+	sequential := flags.Bool("sequential", false, "Download pieces in order, for streaming")
+	readahead := flags.Int("readahead", 8<<20, "Bytes fetched first after the playhead in sequential mode")
+	port := flags.Int("port", 6881, "Port peers connect to, over TCP and uTP")
+	maxActive := flags.Int("max-active", 0, "Number of torrents downloading at once, no limit when 0")
+	downloadRate := flags.Int("download-rate", 0, "Download limit in KiB/s for all torrents, 0 for none")
+	uploadRate := flags.Int("upload-rate", 0, "Upload limit in KiB/s for all torrents, 0 for none")
+	peerDownloadRate := flags.Int("peer-download-rate", 0, "Download limit in KiB/s for each peer, 0 for none")
+	peerUploadRate := flags.Int("peer-upload-rate", 0, "Upload limit in KiB/s for each peer, 0 for none")
+	altSpeed := flags.String("alt-speed", "", "Time of day the alternate limits apply, e.g. 09:00-18:00")
+	altDownloadRate := flags.Int("alt-download-rate", 0, "Alternate download limit in KiB/s")
+	altUploadRate := flags.Int("alt-upload-rate", 0, "Alternate upload limit in KiB/s")
+	maxConnections := flags.Int("max-connections", 200, "Connections of all torrents")
+	maxTorrentConnections := flags.Int("max-torrent-connections", 50, "Connections of each torrent")
+	maxHalfOpen := flags.Int("max-half-open", 16, "Connection attempts in progress")
+	maxPerIP := flags.Int("max-per-ip", 4, "Connections to a same address for each torrent, 0 for no limit")
+	banTime := flags.Duration("ban-time", 24*time.Hour, "How long peers that sent bad data are banned")
+	maxPieceAttempts := flags.Int("max-piece-attempts", 5, "Peers a piece may fail from before the download gives up")
+	pipeline := flags.Int("pipeline", 5, "Block requests sent to a peer at once")
+	snubTimeout := flags.Duration("snub-timeout", 30*time.Second, "Wait for a block before asking other peers for the piece")
+	idleTimeout := flags.Duration("idle-timeout", 2*time.Minute, "Wait for a block before disconnecting a peer")
+	resumeDir := flags.String("resume-dir", "", "Directory of the resume data, .resume in the download directory by default")
+	seedRatio := flags.Float64("seed-ratio", 0, "Stop seeding once this many times the torrent size was uploaded")
+	seedTime := flags.Duration("seed-time", 0, "Stop seeding after this long")
+	seedIdle := flags.Duration("seed-idle", 0, "Stop seeding after this long without an interested peer")
+	superSeed := flags.Bool("super-seed", false, "Reveal pieces one at a time to peers when seeding from scratch (BEP 16)")
+	seedForever := flags.Bool("seed-forever", false, "Seed until interrupted, ignoring the other seeding goals")
+	portMap := flags.Bool("port-map", true, "Forward the listen port on the router with UPnP or PCP/NAT-PMP")
+	proxyURL := flags.String("proxy", "", "Reach peers, trackers and web seeds through socks5://[user:pass@]host:port or http://host:port")
+	var ipFilters stringList
+	flags.Var(&ipFilters, "ip-filter", "Block the addresses of an ipfilter.dat, P2P or CIDR list, can be repeated")
+	return func() (*session.Session, torrentclient.Config, *log.Logger) {
+		verboseLevel := log.LowVerbose
+		if *verbose {
+			verboseLevel = log.HighVerbose
+		}
+		logger := log.Logger{Verbose: verboseLevel, Plain: !term.IsTerminal(os.Stdout.Fd())}
+		if *resumeDir == "" {
+			*resumeDir = filepath.Join(downloadDir, ".resume")
+		}
+		config := torrentclient.Config{
+			ResumeDir:     *resumeDir,
+			DownloadDir:   downloadDir,
+			IncompleteDir: *incompleteDir,
+			PartSuffix:    *partSuffix,
+			Sequential:    *sequential,
+			Readahead:     *readahead,
+			SuperSeed:     *superSeed,
+
+			PeerDownloadRate: *peerDownloadRate * 1024,
+			PeerUploadRate:   *peerUploadRate * 1024,
+
+			MaxConnections: *maxTorrentConnections,
+			MaxPerIP:       *maxPerIP,
+			BanTime:        *banTime,
+
+			MaxPieceAttempts: *maxPieceAttempts,
+
+			Pipeline:    *pipeline,
+			SnubTimeout: *snubTimeout,
+			IdleTimeout: *idleTimeout,
+		}
+		sessionConfig := session.Config{
+			Port:         *port,
+			MaxActive:    *maxActive,
+			DownloadRate: *downloadRate * 1024,
+			UploadRate:   *uploadRate * 1024,
+
+			MaxConnections: *maxConnections,
+			MaxHalfOpen:    *maxHalfOpen,
+
+			PortMapping: *portMap,
+
+			Seed: session.SeedGoals{
+				Ratio:    *seedRatio,
+				Time:     *seedTime,
+				IdleTime: *seedIdle,
+				Infinite: *seedForever,
+			},
+		}
+		if *proxyURL != "" {
+			p, err := proxy.Parse(*proxyURL)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			sessionConfig.Proxy = p
+		}
+		if *altSpeed != "" {
+			schedule, err := parseSchedule(*altSpeed)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			schedule.Download = *altDownloadRate * 1024
+			schedule.Upload = *altUploadRate * 1024
+			sessionConfig.AltSpeed = schedule
+		}
+		torrentSession, err := session.New(sessionConfig, &logger)
+		if err != nil {
+			tracerr.Print(err)
+			os.Exit(1)
+		}
+		if len(ipFilters) > 0 {
+			if err := torrentSession.Filter.LoadFiles(ipFilters...); err != nil {
+				tracerr.Print(err)
+				os.Exit(1)
+			}
+			go reloadFilter(torrentSession.Filter, &logger)
+		}
+		return torrentSession, config, &logger
+	}
+}
+
+// reloadFilter reads the IP filter lists again on each SIGHUP
+func reloadFilter(filter *ipfilter.Filter, logger *log.Logger) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := filter.Reload(); err != nil {
+			logger.Printf(log.LowVerbose, "failed to reload the IP filter: %s\n", err)
+			continue
+		}
+		logger.Printf(log.LowVerbose, "reloaded the IP filter, %d ranges\n", filter.Len())
+	}
+}
+
+// parseSchedule parses a period of the day such as "09:00-18:00"
+func parseSchedule(s string) (*ratelimit.Schedule, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid period %q, expected HH:MM-HH:MM", s)
+	}
+	start, err := ratelimit.ParseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := ratelimit.ParseClock(to)
+	if err != nil {
+		return nil, err
+	}
+	return &ratelimit.Schedule{Start: start, End: end}, nil
+}
@@ -0,0 +1,83 @@
+// Package stats measures transfers: the bytes sent or received and their
+// rate, as a moving average.
+package stats
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Window is the time over which rates are averaged, older transfers
+// weigh less and less
+const Window = 5 * time.Second
+
+// sampleInterval is the shortest time a rate is measured over, shorter
+// ones would follow every burst of blocks
+const sampleInterval = 500 * time.Millisecond
+
+// Meter counts bytes and averages their rate. The zero value is ready to
+// use, a meter made with Child also counts in its parent.
+type Meter struct {
+	mu      sync.Mutex
+	parent  *Meter
+	total   int64
+	pending int64     // bytes since last
+	last    time.Time // when rate was last updated
+	rate    float64   // bytes per second
+	now     func() time.Time
+}
+
+// Child returns a meter adding what it counts to m
+func (m *Meter) Child() *Meter {
+	return &Meter{parent: m, now: m.now}
+}
+
+// Add counts n bytes
+func (m *Meter) Add(n int64) {
+	for ; m != nil; m = m.parent {
+		m.mu.Lock()
+		m.update()
+		m.total += n
+		m.pending += n
+		m.mu.Unlock()
+	}
+}
+
+// Total returns the bytes counted
+func (m *Meter) Total() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+// Rate returns the average rate in bytes per second
+func (m *Meter) Rate() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.update()
+	return int(m.rate)
+}
+
+// update folds the bytes counted since the last update into the rate,
+// m.mu must be held. The rate moves towards the rate of the new sample by
+// how much of Window elapsed.
+func (m *Meter) update() {
+	now := time.Now()
+	if m.now != nil {
+		now = m.now()
+	}
+	if m.last.IsZero() {
+		m.last = now
+		return
+	}
+	elapsed := now.Sub(m.last)
+	if elapsed < sampleInterval {
+		return
+	}
+	sample := float64(m.pending) / elapsed.Seconds()
+	weight := 1 - math.Exp(-elapsed.Seconds()/Window.Seconds())
+	m.rate += weight * (sample - m.rate)
+	m.pending = 0
+	m.last = now
+}
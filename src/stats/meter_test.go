@@ -0,0 +1,36 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeter(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	parent := &Meter{now: func() time.Time { return clock }}
+	m := parent.Child()
+	m.Add(0)
+	// A steady 1000 bytes per second
+	for range 60 {
+		clock = clock.Add(time.Second)
+		m.Add(1000)
+	}
+	if rate := m.Rate(); rate < 990 || rate > 1000 {
+		t.Errorf("expected a rate close to 1000, got %d", rate)
+	}
+	if total := parent.Total(); total != 60000 {
+		t.Errorf("expected the parent to count 60000 bytes, got %d", total)
+	}
+	if rate := parent.Rate(); rate < 990 || rate > 1000 {
+		t.Errorf("expected the parent rate close to 1000, got %d", rate)
+	}
+	// The rate falls once nothing comes
+	clock = clock.Add(Window)
+	if rate := m.Rate(); rate > 600 {
+		t.Errorf("expected the rate to fall after a window without transfer, got %d", rate)
+	}
+	clock = clock.Add(10 * Window)
+	if rate := m.Rate(); rate != 0 {
+		t.Errorf("expected no rate after a long pause, got %d", rate)
+	}
+}
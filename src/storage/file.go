@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+	"github.com/ztrue/tracerr"
+)
+
+// FileStorage stores each file of the torrent in its own file on disk,
+// files are created the first time they are written to.
+type FileStorage struct {
+	mu         sync.Mutex
+	dir        string
+	partSuffix string
+	torrent    *torrentfile.TorrentFile
+	files      []*os.File
+	skipped    []bool
+}
+
+// FileOptions changes how FileStorage names its files
+type FileOptions struct {
+	// PartSuffix is appended to every file name until Finish is called
+	PartSuffix string
+}
+
+func NewFile(dir string, torrent *torrentfile.TorrentFile) (*FileStorage, error) {
+	return NewFileWithOptions(dir, torrent, FileOptions{})
+}
+
+func NewFileWithOptions(dir string, torrent *torrentfile.TorrentFile, options FileOptions) (*FileStorage, error) {
+	// Validate every path before touching the disk
+	for _, file := range torrent.Files {
+		if _, err := FilePath(dir, torrent, file); err != nil {
+			return nil, err
+		}
+	}
+	s := &FileStorage{
+		dir:        dir,
+		partSuffix: options.PartSuffix,
+		torrent:    torrent,
+		files:      make([]*os.File, len(torrent.Files)),
+		skipped:    make([]bool, len(torrent.Files)),
+	}
+	// Empty files are never written to, create them right away
+	for i, file := range torrent.Files {
+		if file.Length == 0 && !file.Padding {
+			if _, err := s.open(i, true); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// open returns the handle of the file at index, creating it if needed
+func (s *FileStorage) open(index int, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files[index] != nil {
+		return s.files[index], nil
+	}
+	file := s.torrent.Files[index]
+	path, err := s.path(s.dir, file)
+	if err != nil {
+		return nil, err
+	}
+	path += s.partSuffix
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, tracerr.Wrap(err)
+		}
+	}
+	handle, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	if err := handle.Truncate(int64(file.Length)); err != nil {
+		handle.Close()
+		return nil, tracerr.Wrap(err)
+	}
+	s.files[index] = handle
+	return handle, nil
+}
+
+func (s *FileStorage) ReadAt(p []byte, piece int, offset int) (int, error) {
+	ranges, err := span(s.torrent, piece, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+	read := 0
+	for _, fileRange := range ranges {
+		buf := p[read : read+fileRange.Length]
+		if s.torrent.Files[fileRange.Index].Padding {
+			clear(buf)
+		} else {
+			handle, err := s.open(fileRange.Index, false)
+			if err != nil {
+				return read, err
+			}
+			if _, err := handle.ReadAt(buf, int64(fileRange.Start)); err != nil {
+				return read, tracerr.Wrap(err)
+			}
+		}
+		read += fileRange.Length
+	}
+	return read, nil
+}
+
+func (s *FileStorage) WriteAt(p []byte, piece int, offset int) (int, error) {
+	ranges, err := span(s.torrent, piece, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+	// A piece shared with a wanted file is kept whole, to be read back
+	wanted := s.wanted(piece)
+	written := 0
+	for _, fileRange := range ranges {
+		if !s.torrent.Files[fileRange.Index].Padding && wanted {
+			handle, err := s.open(fileRange.Index, true)
+			if err != nil {
+				return written, err
+			}
+			if _, err := handle.WriteAt(p[written:written+fileRange.Length], int64(fileRange.Start)); err != nil {
+				return written, tracerr.Wrap(err)
+			}
+		}
+		written += fileRange.Length
+	}
+	return written, nil
+}
+
+// SkipFile stops writing to the file at index. The pieces it shares with
+// wanted files are still written in full, so that they can be verified
+// and uploaded, which allocates the file.
+func (s *FileStorage) SkipFile(index int, skip bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped[index] = skip
+}
+
+// wanted reports whether piece overlaps a file that isn't skipped
+func (s *FileStorage) wanted(piece int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fileRange := range s.torrent.PieceFileRanges(piece) {
+		if !s.torrent.Files[fileRange.Index].Padding && !s.skipped[fileRange.Index] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *FileStorage) MarkComplete(piece int) error {
+	return nil
+}
+
+// Finish drops the part suffix of the files and moves them to dir,
+// reads keep working from the new location.
+func (s *FileStorage) Finish(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.closeFiles(); err != nil {
+		return err
+	}
+	for _, file := range s.torrent.Files {
+		if file.Padding {
+			continue
+		}
+		from, err := s.path(s.dir, file)
+		if err != nil {
+			return err
+		}
+		to, err := s.path(dir, file)
+		if err != nil {
+			return err
+		}
+		from += s.partSuffix
+		if _, err := os.Stat(from); errors.Is(err, os.ErrNotExist) {
+			// Never written to
+			continue
+		}
+		if err := Move(from, to); err != nil {
+			return err
+		}
+	}
+	if s.torrent.MultiFile && filepath.Clean(dir) != filepath.Clean(s.dir) {
+		removeEmptyDirs(filepath.Join(s.dir, s.torrent.Name))
+	}
+	s.dir = dir
+	s.partSuffix = ""
+	return nil
+}
+
+func (s *FileStorage) path(dir string, file torrentfile.File) (string, error) {
+	return FilePath(dir, s.torrent, file)
+}
+
+// Move renames a file, copying it when source and destination are on
+// different devices. Missing parent directories are created.
+func Move(from string, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return tracerr.Wrap(err)
+	}
+	err := os.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return tracerr.Wrap(err)
+	}
+	if err := copyFile(from, to); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return tracerr.Wrap(os.Remove(from))
+}
+
+func copyFile(from string, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	destination, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	if _, err := io.Copy(destination, source); err != nil {
+		destination.Close()
+		return tracerr.Wrap(err)
+	}
+	return tracerr.Wrap(destination.Close())
+}
+
+// RemoveFiles deletes the files of torrent stored under dir with suffix
+// appended to their names, files that don't exist are ignored
+func RemoveFiles(dir string, torrent *torrentfile.TorrentFile, suffix string) error {
+	for _, file := range torrent.Files {
+		if file.Padding {
+			continue
+		}
+		path, err := FilePath(dir, torrent, file)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return tracerr.Wrap(err)
+		}
+	}
+	if torrent.MultiFile {
+		removeEmptyDirs(filepath.Join(dir, torrent.Name))
+	}
+	return nil
+}
+
+// removeEmptyDirs removes dir and its subdirectories if they hold no files
+func removeEmptyDirs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			removeEmptyDirs(filepath.Join(dir, entry.Name()))
+		}
+	}
+	os.Remove(dir)
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeFiles()
+}
+
+func (s *FileStorage) closeFiles() error {
+	var firstErr error
+	for i, handle := range s.files {
+		if handle == nil {
+			continue
+		}
+		if err := handle.Close(); err != nil && firstErr == nil {
+			firstErr = tracerr.Wrap(err)
+		}
+		s.files[i] = nil
+	}
+	return firstErr
+}
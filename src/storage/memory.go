@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+)
+
+// MemoryStorage keeps the whole torrent in memory, which is handy for
+// tests and for piping the data somewhere else.
+type MemoryStorage struct {
+	mu        sync.RWMutex
+	torrent   *torrentfile.TorrentFile
+	data      []byte
+	completed []bool
+}
+
+func NewMemory(torrent *torrentfile.TorrentFile) *MemoryStorage {
+	return &MemoryStorage{
+		torrent:   torrent,
+		data:      make([]byte, torrent.Length),
+		completed: make([]bool, torrent.PieceCount()),
+	}
+}
+
+func (s *MemoryStorage) ReadAt(p []byte, piece int, offset int) (int, error) {
+	if _, err := span(s.torrent, piece, offset, len(p)); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	start := piece*s.torrent.PieceLength + offset
+	return copy(p, s.data[start:start+len(p)]), nil
+}
+
+func (s *MemoryStorage) WriteAt(p []byte, piece int, offset int) (int, error) {
+	if _, err := span(s.torrent, piece, offset, len(p)); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := piece*s.torrent.PieceLength + offset
+	return copy(s.data[start:start+len(p)], p), nil
+}
+
+func (s *MemoryStorage) MarkComplete(piece int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed[piece] = true
+	return nil
+}
+
+// Completed reports whether piece was marked as complete
+func (s *MemoryStorage) Completed(piece int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.completed[piece]
+}
+
+// Bytes returns the data of the torrent, files are laid out back to back
+// as in the torrent data.
+func (s *MemoryStorage) Bytes() []byte {
+	return s.data
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+)
+
+// MmapStorage is only available on unix systems
+type MmapStorage struct {
+	FileStorage
+}
+
+func NewMmap(dir string, torrent *torrentfile.TorrentFile) (*MmapStorage, error) {
+	return nil, fmt.Errorf("mmap storage is not supported on this platform")
+}
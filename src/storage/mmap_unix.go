@@ -0,0 +1,124 @@
+//go:build unix
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+	"github.com/ztrue/tracerr"
+)
+
+// MmapStorage maps every file of the torrent in memory, the kernel takes
+// care of writing the pages back to disk.
+type MmapStorage struct {
+	mu      sync.RWMutex
+	torrent *torrentfile.TorrentFile
+	maps    [][]byte
+}
+
+func NewMmap(dir string, torrent *torrentfile.TorrentFile) (*MmapStorage, error) {
+	s := &MmapStorage{
+		torrent: torrent,
+		maps:    make([][]byte, len(torrent.Files)),
+	}
+	for i, file := range torrent.Files {
+		if file.Padding {
+			continue
+		}
+		data, err := mapFile(dir, torrent, file)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.maps[i] = data
+	}
+	return s, nil
+}
+
+func mapFile(dir string, torrent *torrentfile.TorrentFile, file torrentfile.File) ([]byte, error) {
+	path, err := FilePath(dir, torrent, file)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	handle, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	// The mapping stays valid once the file is closed
+	defer handle.Close()
+	if err := handle.Truncate(int64(file.Length)); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	if file.Length == 0 {
+		return nil, nil
+	}
+	data, err := syscall.Mmap(int(handle.Fd()), 0, file.Length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	return data, nil
+}
+
+func (s *MmapStorage) ReadAt(p []byte, piece int, offset int) (int, error) {
+	ranges, err := span(s.torrent, piece, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	read := 0
+	for _, fileRange := range ranges {
+		buf := p[read : read+fileRange.Length]
+		if data := s.maps[fileRange.Index]; data != nil {
+			copy(buf, data[fileRange.Start:])
+		} else {
+			clear(buf)
+		}
+		read += fileRange.Length
+	}
+	return read, nil
+}
+
+func (s *MmapStorage) WriteAt(p []byte, piece int, offset int) (int, error) {
+	ranges, err := span(s.torrent, piece, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	written := 0
+	for _, fileRange := range ranges {
+		if data := s.maps[fileRange.Index]; data != nil {
+			copy(data[fileRange.Start:fileRange.Start+fileRange.Length], p[written:])
+		}
+		written += fileRange.Length
+	}
+	return written, nil
+}
+
+func (s *MmapStorage) MarkComplete(piece int) error {
+	return nil
+}
+
+func (s *MmapStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for i, data := range s.maps {
+		if data == nil {
+			continue
+		}
+		if err := syscall.Munmap(data); err != nil && firstErr == nil {
+			firstErr = tracerr.Wrap(err)
+		}
+		s.maps[i] = nil
+	}
+	return firstErr
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+)
+
+// Storage holds the data of a torrent, addressed by piece
+type Storage interface {
+	// ReadAt reads len(p) bytes of piece starting at offset
+	ReadAt(p []byte, piece int, offset int) (int, error)
+	// WriteAt writes p in piece starting at offset
+	WriteAt(p []byte, piece int, offset int) (int, error)
+	// MarkComplete is called once the piece has been verified
+	MarkComplete(piece int) error
+	Close() error
+}
+
+// FileSkipper is implemented by the storages that can leave out the
+// files that aren't wanted.
+type FileSkipper interface {
+	SkipFile(index int, skip bool)
+}
+
+// span returns the file ranges covered by n bytes of piece at offset
+func span(tor *torrentfile.TorrentFile, piece int, offset int, n int) ([]torrentfile.FileRange, error) {
+	if piece < 0 || piece >= tor.PieceCount() {
+		return nil, fmt.Errorf("piece %d out of range", piece)
+	}
+	if offset < 0 || offset+n > tor.GetPieceLength(piece) {
+		return nil, fmt.Errorf("range [%d, %d) out of piece %d of length %d", offset, offset+n, piece, tor.GetPieceLength(piece))
+	}
+	start := piece*tor.PieceLength + offset
+	return tor.FileRanges(start, start+n), nil
+}
+
+// FilePath returns where file is stored under dir, path components that
+// would escape the torrent directory are rejected.
+func FilePath(dir string, tor *torrentfile.TorrentFile, file torrentfile.File) (string, error) {
+	components := file.Path
+	if tor.MultiFile {
+		components = append([]string{tor.Name}, file.Path...)
+	}
+	path := dir
+	for _, component := range components {
+		if component == "" || component == "." || component == ".." || filepath.Base(component) != component {
+			return "", fmt.Errorf("invalid path component %q in torrent %s", component, tor.Name)
+		}
+		path = filepath.Join(path, component)
+	}
+	return path, nil
+}
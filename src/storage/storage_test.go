@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+)
+
+// generateTorrent returns a multi-file torrent of 3 pieces of 8 bytes
+// whose second file is a pad file.
+func generateTorrent() *torrentfile.TorrentFile {
+	return &torrentfile.TorrentFile{
+		Name:        "test",
+		PieceLength: 8,
+		Length:      20,
+		MultiFile:   true,
+		PiecesHash:  make([][20]byte, 3),
+		Files: []torrentfile.File{
+			{Path: []string{"a.txt"}, Length: 5, Offset: 0},
+			{Path: []string{".pad", "3"}, Length: 3, Offset: 5, Padding: true},
+			{Path: []string{"dir", "b.txt"}, Length: 12, Offset: 8},
+		},
+	}
+}
+
+func writeAll(t *testing.T, s Storage, data []byte) {
+	t.Helper()
+	for piece := range 3 {
+		start := piece * 8
+		end := min(start+8, len(data))
+		if _, err := s.WriteAt(data[start:end], piece, 0); err != nil {
+			t.Fatalf("failed to write piece %d: %s", piece, err)
+		}
+		if err := s.MarkComplete(piece); err != nil {
+			t.Fatalf("failed to complete piece %d: %s", piece, err)
+		}
+	}
+}
+
+func checkRead(t *testing.T, s Storage, expected []byte) {
+	t.Helper()
+	buf := make([]byte, 6)
+	if _, err := s.ReadAt(buf, 0, 2); err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	if !bytes.Equal(buf, expected[2:8]) {
+		t.Errorf("read %q, expected %q", buf, expected[2:8])
+	}
+	if _, err := s.ReadAt(make([]byte, 5), 2, 0); err == nil {
+		t.Errorf("expected error when reading past the last piece")
+	}
+}
+
+// The pad file reads back as zeros whatever was written to it
+var written = []byte("abcdeXXXfghijklmnopq")
+var expected = []byte("abcde\x00\x00\x00fghijklmnopq")
+
+func checkFiles(t *testing.T, dir string) {
+	t.Helper()
+	a, _ := os.ReadFile(filepath.Join(dir, "test", "a.txt"))
+	b, _ := os.ReadFile(filepath.Join(dir, "test", "dir", "b.txt"))
+	if string(a) != "abcde" || string(b) != "fghijklmnopq" {
+		t.Errorf("unexpected file contents %q and %q", a, b)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test", ".pad")); err == nil {
+		t.Errorf("pad file shouldn't be stored")
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := NewMemory(generateTorrent())
+	writeAll(t, s, expected)
+	checkRead(t, s, expected)
+	if !s.Completed(1) {
+		t.Errorf("expected piece 1 to be complete")
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(dir, generateTorrent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, s, written)
+	checkRead(t, s, expected)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir)
+}
+
+func TestMmapStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewMmap(dir, generateTorrent())
+	if err != nil {
+		t.Skipf("mmap storage unavailable: %s", err)
+	}
+	writeAll(t, s, written)
+	checkRead(t, s, expected)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir)
+}
+
+func TestFilePathEscape(t *testing.T) {
+	tor := generateTorrent()
+	tor.Files[2].Path = []string{"..", "..", "etc", "passwd"}
+	if _, err := NewFile(t.TempDir(), tor); err == nil {
+		t.Errorf("expected paths escaping the download directory to be rejected")
+	}
+}
+
+func TestFinish(t *testing.T) {
+	incomplete := t.TempDir()
+	complete := filepath.Join(t.TempDir(), "nested", "complete")
+	s, err := NewFileWithOptions(incomplete, generateTorrent(), FileOptions{PartSuffix: ".part"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, s, written)
+	if _, err := os.Stat(filepath.Join(incomplete, "test", "a.txt.part")); err != nil {
+		t.Errorf("expected in-progress file to have the part suffix: %s", err)
+	}
+	if err := s.Finish(complete); err != nil {
+		t.Fatalf("failed to finish: %s", err)
+	}
+	checkFiles(t, complete)
+	if _, err := os.Stat(filepath.Join(incomplete, "test")); err == nil {
+		t.Errorf("expected the incomplete directory to be cleaned up")
+	}
+	// Data is still readable from the new location
+	checkRead(t, s, expected)
+	s.Close()
+}
+
+func TestSkipFile(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(dir, generateTorrent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SkipFile(0, true)
+	writeAll(t, s, written)
+	s.Close()
+	if _, err := os.Stat(filepath.Join(dir, "test", "a.txt")); err == nil {
+		t.Errorf("skipped file shouldn't be allocated")
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, "test", "dir", "b.txt"))
+	if string(b) != "fghijklmnopq" {
+		t.Errorf("unexpected file contents %q", b)
+	}
+}
+
+func TestSkipFileSharedPiece(t *testing.T) {
+	dir := t.TempDir()
+	tor := generateTorrent()
+	// a.txt now shares the first piece with b.txt
+	tor.Files = []torrentfile.File{
+		{Path: []string{"a.txt"}, Length: 5, Offset: 0},
+		{Path: []string{"dir", "b.txt"}, Length: 15, Offset: 5},
+	}
+	s, err := NewFile(dir, tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SkipFile(0, true)
+	writeAll(t, s, written)
+	buf := make([]byte, 8)
+	if _, err := s.ReadAt(buf, 0, 0); err != nil || !bytes.Equal(buf, written[:8]) {
+		t.Errorf("expected the shared piece to be read back, got %q and %v", buf, err)
+	}
+}
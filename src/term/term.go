@@ -0,0 +1,13 @@
+// Package term puts terminals in raw mode and reads their size, for the
+// full-screen display of the command line.
+package term
+
+import "errors"
+
+// ErrUnsupported is returned on systems where terminals can't be set up
+var ErrUnsupported = errors.New("terminal control isn't supported on this system")
+
+// State is the mode of a terminal, restored by Restore
+type State struct {
+	state state
+}
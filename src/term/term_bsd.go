@@ -0,0 +1,11 @@
+//go:build darwin || dragonfly || freebsd || netbsd
+
+package term
+
+import "syscall"
+
+// The requests reading and setting the mode of a terminal
+const (
+	getTermios = syscall.TIOCGETA
+	setTermios = syscall.TIOCSETA
+)
@@ -0,0 +1,9 @@
+package term
+
+import "syscall"
+
+// The requests reading and setting the mode of a terminal
+const (
+	getTermios = syscall.TCGETS
+	setTermios = syscall.TCSETS
+)
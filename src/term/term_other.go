@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd
+
+package term
+
+type state struct{}
+
+// IsTerminal reports whether fd is a terminal, always false here
+func IsTerminal(fd uintptr) bool {
+	return false
+}
+
+func MakeRaw(fd uintptr) (*State, error) {
+	return nil, ErrUnsupported
+}
+
+func Restore(fd uintptr, state *State) error {
+	return ErrUnsupported
+}
+
+func Size(fd uintptr) (width, height int, err error) {
+	return 0, 0, ErrUnsupported
+}
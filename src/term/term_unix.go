@@ -0,0 +1,63 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd
+
+package term
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/ztrue/tracerr"
+)
+
+type state = syscall.Termios
+
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// IsTerminal reports whether fd is a terminal
+func IsTerminal(fd uintptr) bool {
+	var termios syscall.Termios
+	return ioctl(fd, getTermios, unsafe.Pointer(&termios)) == nil
+}
+
+// MakeRaw turns off the echo and line editing of the terminal fd, keys
+// are read as soon as they are pressed. Signals like Ctrl-C are still
+// raised. It returns the previous state.
+func MakeRaw(fd uintptr) (*State, error) {
+	var old State
+	if err := ioctl(fd, getTermios, unsafe.Pointer(&old.state)); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	raw := old.state
+	raw.Iflag &^= syscall.IXON | syscall.ICRNL | syscall.INLCR | syscall.IGNCR
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.IEXTEN
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, setTermios, unsafe.Pointer(&raw)); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	return &old, nil
+}
+
+// Restore puts the terminal fd back in state
+func Restore(fd uintptr, state *State) error {
+	if err := ioctl(fd, setTermios, unsafe.Pointer(&state.state)); err != nil {
+		return tracerr.Wrap(err)
+	}
+	return nil
+}
+
+// Size returns the columns and rows of the terminal fd
+func Size(fd uintptr) (width, height int, err error) {
+	var size struct {
+		rows, columns, x, y uint16
+	}
+	if err := ioctl(fd, syscall.TIOCGWINSZ, unsafe.Pointer(&size)); err != nil {
+		return 0, 0, tracerr.Wrap(err)
+	}
+	return int(size.columns), int(size.rows), nil
+}
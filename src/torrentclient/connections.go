@@ -0,0 +1,190 @@
+package torrentclient
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/samir-adh/bytetorrent/src/connlimit"
+	"github.com/samir-adh/bytetorrent/src/log"
+	pc "github.com/samir-adh/bytetorrent/src/piece"
+	tr "github.com/samir-adh/bytetorrent/src/tracker"
+)
+
+const (
+	defaultMaxConnections = 50
+	defaultMaxHalfOpen    = 8
+)
+
+// ErrTooManyConnections is returned by ServeConn when there is no slot
+// left for the peer.
+var ErrTooManyConnections = errors.New("too many connections")
+
+// ErrBanned is returned by ServeConn for a peer on the ban list
+var ErrBanned = errors.New("peer is banned")
+
+// ErrFiltered is returned by ServeConn for a peer blocked by the IP filter
+var ErrFiltered = errors.New("peer address is filtered")
+
+// evictable lets a connection of higher priority close the one of a
+// worker to take its slot.
+type evictable struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	evicted bool
+}
+
+// set registers the connection, it returns false if the slot was
+// already taken.
+func (e *evictable) set(conn net.Conn) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.conn = conn
+	return !e.evicted
+}
+
+func (e *evictable) evict() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.evicted = true
+	if e.conn != nil {
+		e.conn.Close()
+	}
+}
+
+func newConnectionLimits(config Config) (*connlimit.Shared, *connlimit.Pool, *connlimit.IPLimit) {
+	shared := config.Connections
+	if shared == nil {
+		shared = &connlimit.Shared{
+			Conns:    connlimit.NewPool(0),
+			HalfOpen: connlimit.NewPool(defaultMaxHalfOpen),
+			SelfIP:   connlimit.LocalIP(),
+		}
+	}
+	maxConnections := config.MaxConnections
+	if maxConnections == 0 {
+		maxConnections = defaultMaxConnections
+	}
+	return shared, connlimit.NewPool(maxConnections), connlimit.NewIPLimit(config.MaxPerIP)
+}
+
+// priority ranks the connection to a peer, from the address the peers see
+// once the port is mapped
+func (client *TorrentClient) priority(ip net.IP, port int) uint32 {
+	selfIP, selfPort := client.Config.PortMap.External()
+	if selfIP == nil {
+		selfIP, selfPort = client.Connections.SelfIP, client.Port
+	}
+	if selfIP == nil {
+		selfIP = net.IPv4zero
+	}
+	return connlimit.Priority(selfIP, selfPort, ip, port)
+}
+
+func peerPort(peer tr.Peer) int {
+	return int(peer.Port[0])<<8 + int(peer.Port[1])
+}
+
+// connectPeers starts a worker for each peer, the peers of highest
+// priority first, as long as the connection limits allow.
+func (client *TorrentClient) connectPeers(
+	ctx context.Context,
+	peers []tr.Peer,
+	wg *sync.WaitGroup,
+	resultsQueue chan pc.PieceResult,
+	quit chan bool,
+) {
+	priorities := make(map[int]uint32, len(peers))
+	for _, peer := range peers {
+		priorities[peer.Id] = client.priority(net.IP(peer.IpAdress[:]), peerPort(peer))
+	}
+	slices.SortStableFunc(peers, func(a, b tr.Peer) int {
+		return cmp.Compare(priorities[b.Id], priorities[a.Id])
+	})
+	for i, peer := range peers {
+		ip := net.IP(peer.IpAdress[:])
+		if client.Bans.Banned(ip) || client.Filter.Blocked(ip) || !client.perIP.Acquire(ip) {
+			client.pendingPeers.Add(-1)
+			client.signalUnactivePeer()
+			continue
+		}
+		slot := &evictable{}
+		torrentSlot, ok := client.conns.Acquire(priorities[peer.Id], slot.evict, quit)
+		if ok {
+			var sessionSlot *connlimit.Slot
+			sessionSlot, ok = client.Connections.Conns.Acquire(priorities[peer.Id], slot.evict, quit)
+			if ok {
+				wg.Go(func() {
+					defer client.perIP.Release(ip)
+					defer torrentSlot.Release()
+					defer sessionSlot.Release()
+					client.worker(ctx, peer, slot, resultsQueue, quit)
+				})
+				continue
+			}
+			torrentSlot.Release()
+		}
+		// quit was closed, the remaining peers are never used
+		client.perIP.Release(ip)
+		for range peers[i:] {
+			client.pendingPeers.Add(-1)
+			client.signalUnactivePeer()
+		}
+		return
+	}
+}
+
+// acquireInbound takes the slots of a peer that connected to us, taking
+// those of lower priority peers if needed. The returned function releases them.
+func (client *TorrentClient) acquireInbound(conn net.Conn) (func(), error) {
+	host, portString, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	port, _ := strconv.Atoi(portString)
+	if client.Bans.Banned(ip) {
+		return nil, ErrBanned
+	}
+	if client.Filter.Blocked(ip) {
+		return nil, ErrFiltered
+	}
+	if !client.perIP.Acquire(ip) {
+		return nil, ErrTooManyConnections
+	}
+	priority := client.priority(ip, port)
+	evict := func() { conn.Close() }
+	torrentSlot, ok := client.conns.TryAcquire(priority, evict)
+	if !ok {
+		client.perIP.Release(ip)
+		return nil, ErrTooManyConnections
+	}
+	sessionSlot, ok := client.Connections.Conns.TryAcquire(priority, evict)
+	if !ok {
+		torrentSlot.Release()
+		client.perIP.Release(ip)
+		return nil, ErrTooManyConnections
+	}
+	return func() {
+		sessionSlot.Release()
+		torrentSlot.Release()
+		client.perIP.Release(ip)
+	}, nil
+}
+
+// banSenders bans the peers that sent bad blocks of a piece that then
+// passed its hash check
+func (client *TorrentClient) banSenders(result pc.PieceResult) {
+	banTime := client.Config.BanTime
+	if banTime == 0 {
+		banTime = defaultBanTime
+	}
+	for _, ip := range client.smartBan.Passed(result.Index, result.Payload) {
+		client.Logger.Printf(log.LowVerbose, "banning %s for sending bad data of piece %d\n", ip, result.Index)
+		client.Bans.Ban(ip, banTime)
+	}
+}
@@ -0,0 +1,120 @@
+package torrentclient
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/samir-adh/bytetorrent/src/picker"
+	"github.com/samir-adh/bytetorrent/src/storage"
+)
+
+// SetFilePriority changes the priority of the file at index, pieces
+// shared by several files get the highest priority among them.
+func (client *TorrentClient) SetFilePriority(index int, priority picker.Priority) error {
+	client.prioritiesMu.Lock()
+	defer client.prioritiesMu.Unlock()
+	if index < 0 || index >= len(client.filePriorities) {
+		return fmt.Errorf("file %d out of range", index)
+	}
+	client.filePriorities[index] = priority
+	client.updatePiecePriorities()
+	return nil
+}
+
+// FilePriorities returns a copy of the priority of every file
+func (client *TorrentClient) FilePriorities() []picker.Priority {
+	client.prioritiesMu.Lock()
+	defer client.prioritiesMu.Unlock()
+	return slices.Clone(client.filePriorities)
+}
+
+// SelectFiles skips every file whose path matches none of the glob
+// patterns and returns the number of selected files. A pattern without a
+// slash is also matched against the file name alone.
+func (client *TorrentClient) SelectFiles(patterns []string) (int, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return 0, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	client.prioritiesMu.Lock()
+	defer client.prioritiesMu.Unlock()
+	selected := 0
+	for i, file := range client.Torrent.Files {
+		if file.Padding {
+			continue
+		}
+		if matchFile(patterns, strings.Join(file.Path, "/")) {
+			selected++
+			if client.filePriorities[i] == picker.Skip {
+				client.filePriorities[i] = picker.Normal
+			}
+		} else {
+			client.filePriorities[i] = picker.Skip
+		}
+	}
+	client.updatePiecePriorities()
+	return selected, nil
+}
+
+func matchFile(patterns []string, filePath string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, filePath); ok {
+			return true
+		}
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(filePath)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// updatePiecePriorities derives the priority of every piece from the
+// files it covers so a piece shared with a wanted file is downloaded.
+// prioritiesMu must be held.
+func (client *TorrentClient) updatePiecePriorities() {
+	for i := range client.Pieces {
+		priority := picker.Skip
+		for _, fileRange := range client.Torrent.PieceFileRanges(i) {
+			if client.Torrent.Files[fileRange.Index].Padding {
+				continue
+			}
+			priority = max(priority, client.filePriorities[fileRange.Index])
+		}
+		client.Picker.SetPriority(i, priority)
+	}
+	client.applyFileSkips()
+}
+
+// applyFileSkips keeps the storage from allocating skipped files,
+// prioritiesMu must be held
+func (client *TorrentClient) applyFileSkips() {
+	skipper, ok := client.Storage.(storage.FileSkipper)
+	if !ok {
+		return
+	}
+	for i, priority := range client.filePriorities {
+		skipper.SkipFile(i, priority == picker.Skip)
+	}
+}
+
+// RemoveData deletes the downloaded files, complete or not, the torrent
+// must not be downloading
+func (client *TorrentClient) RemoveData() error {
+	dirs := []string{client.downloadDir()}
+	if client.Config.IncompleteDir != "" {
+		dirs = append(dirs, client.Config.IncompleteDir)
+	}
+	for _, dir := range dirs {
+		for _, suffix := range []string{"", partSuffix} {
+			if err := storage.RemoveFiles(dir, client.Torrent, suffix); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
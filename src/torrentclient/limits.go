@@ -0,0 +1,77 @@
+package torrentclient
+
+import (
+	"sync"
+
+	"github.com/samir-adh/bytetorrent/src/ratelimit"
+)
+
+// Limits throttles the payload of a torrent, the limiters of the
+// session, if any, are shared by every torrent.
+type Limits struct {
+	SessionDownload *ratelimit.Limiter
+	SessionUpload   *ratelimit.Limiter
+	Download        *ratelimit.Limiter
+	Upload          *ratelimit.Limiter
+
+	mu           sync.Mutex
+	peerDownload int
+	peerUpload   int
+	peers        map[*peerLimits]struct{}
+}
+
+type peerLimits struct {
+	download *ratelimit.Limiter
+	upload   *ratelimit.Limiter
+}
+
+func newLimits(config Config) *Limits {
+	return &Limits{
+		SessionDownload: config.SessionDownload,
+		SessionUpload:   config.SessionUpload,
+		Download:        ratelimit.New(config.DownloadRate),
+		Upload:          ratelimit.New(config.UploadRate),
+		peerDownload:    config.PeerDownloadRate,
+		peerUpload:      config.PeerUploadRate,
+		peers:           make(map[*peerLimits]struct{}),
+	}
+}
+
+// SetPeerRates changes the limits of every peer, connected or not
+func (l *Limits) SetPeerRates(download int, upload int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peerDownload = download
+	l.peerUpload = upload
+	for peer := range l.peers {
+		peer.download.SetRate(download)
+		peer.upload.SetRate(upload)
+	}
+}
+
+// PeerRates returns the download and upload limits of each peer
+func (l *Limits) PeerRates() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.peerDownload, l.peerUpload
+}
+
+// forPeer returns the download and upload limiters of a new connection,
+// release must be called once it is closed.
+func (l *Limits) forPeer() (ratelimit.Group, ratelimit.Group, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	peer := &peerLimits{
+		download: ratelimit.New(l.peerDownload),
+		upload:   ratelimit.New(l.peerUpload),
+	}
+	l.peers[peer] = struct{}{}
+	release := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.peers, peer)
+	}
+	download := ratelimit.Group{l.SessionDownload, l.Download, peer.download}
+	upload := ratelimit.Group{l.SessionUpload, l.Upload, peer.upload}
+	return download, upload, release
+}
@@ -0,0 +1,107 @@
+package torrentclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+)
+
+// Reader reads a file of the torrent while it downloads, reads block
+// until the pieces they cover are verified.
+type Reader struct {
+	client *TorrentClient
+	file   torrentfile.File
+	offset int64
+	ctx    context.Context
+}
+
+// NewReader returns a reader over the file at index
+func (client *TorrentClient) NewReader(index int) (*Reader, error) {
+	if index < 0 || index >= len(client.Torrent.Files) {
+		return nil, fmt.Errorf("file %d out of range", index)
+	}
+	return &Reader{client: client, file: client.Torrent.Files[index], ctx: context.Background()}, nil
+}
+
+// SetContext makes reads give up waiting for pieces once ctx is done
+func (r *Reader) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// Size returns the length of the file
+func (r *Reader) Size() int64 {
+	return int64(r.file.Length)
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= int64(r.file.Length) {
+		return 0, io.EOF
+	}
+	start := r.file.Offset + int(r.offset)
+	piece := start / r.client.PieceLength
+	pieceOffset := start - piece*r.client.PieceLength
+	// Only read up to the end of the piece
+	n := min(len(p), r.file.Length-int(r.offset), r.client.Pieces[piece].Length-pieceOffset)
+	if err := r.client.waitPiece(r.ctx, piece); err != nil {
+		return 0, err
+	}
+	store := r.client.storage()
+	if store == nil {
+		return 0, fmt.Errorf("storage of %s isn't open", r.client.FileName)
+	}
+	read, err := store.ReadAt(p[:n], piece, pieceOffset)
+	r.offset += int64(read)
+	return read, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += int64(r.file.Length)
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.offset = offset
+	if offset < int64(r.file.Length) {
+		// Start fetching from the new position right away
+		r.client.Picker.SetPlayhead((r.file.Offset + int(offset)) / r.client.PieceLength)
+	}
+	return offset, nil
+}
+
+// waitPiece moves the playhead to the piece and blocks until it is
+// downloaded, the piece goes before any other in the meantime. It
+// returns ErrStopped if Download returns first.
+func (client *TorrentClient) waitPiece(ctx context.Context, piece int) error {
+	client.Picker.SetPlayhead(piece)
+	if client.Picker.IsDone(piece) {
+		return nil
+	}
+	client.Picker.Urge(piece)
+	defer client.Picker.Release(piece)
+	for {
+		stopped := client.stoppedChan()
+		changed := client.Picker.Changed()
+		if client.Picker.IsDone(piece) {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stopped:
+			if client.Picker.IsDone(piece) {
+				return nil
+			}
+			return ErrStopped
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package torrentclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/samir-adh/bytetorrent/src/log"
+	tr "github.com/samir-adh/bytetorrent/src/tracker"
+	"github.com/ztrue/tracerr"
+)
+
+// announceTimeout bounds the time spent telling the tracker we stop
+const announceTimeout = 5 * time.Second
+
+// defaultAnnounceInterval is the time between two announces when the
+// tracker doesn't give one
+const defaultAnnounceInterval = 30 * time.Minute
+
+// portMapWait bounds the time the first announce waits for the port to be
+// mapped
+const portMapWait = time.Second
+
+// resumeInterval is the number of pieces written between two saves of
+// the resume data
+const resumeInterval = 16
+
+// resumeData records the verified pieces so a download restarted after
+// a shutdown doesn't fetch them again
+type resumeData struct {
+	InfoHash string `bencode:"info hash"`
+	Pieces   string `bencode:"pieces"` // bitfield
+}
+
+func (client *TorrentClient) resumePath() string {
+	return filepath.Join(client.Config.ResumeDir, hex.EncodeToString(client.InfoHash[:])+".resume")
+}
+
+// saveResumeData writes the resume data if Config.ResumeDir is set
+func (client *TorrentClient) saveResumeData() {
+	if client.Config.ResumeDir == "" {
+		return
+	}
+	if err := client.writeResumeData(); err != nil {
+		client.Logger.Printf(log.LowVerbose, "failed to save resume data: %s\n", err)
+	}
+}
+
+func (client *TorrentClient) writeResumeData() error {
+	bitfield := make([]byte, (len(client.Pieces)+7)/8)
+	for i := range client.Pieces {
+		if client.Picker.IsDone(i) {
+			bitfield[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	data := resumeData{InfoHash: string(client.InfoHash[:]), Pieces: string(bitfield)}
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, data); err != nil {
+		return tracerr.Wrap(err)
+	}
+	if err := os.MkdirAll(client.Config.ResumeDir, 0o755); err != nil {
+		return tracerr.Wrap(err)
+	}
+	// Write then rename so a crash never leaves a truncated file
+	path := client.resumePath()
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0o644); err != nil {
+		return tracerr.Wrap(err)
+	}
+	return tracerr.Wrap(os.Rename(path+".tmp", path))
+}
+
+// loadResumeData marks the pieces of the resume data as done, each one
+// is checked against its hash first.
+func (client *TorrentClient) loadResumeData() {
+	if client.Config.ResumeDir == "" {
+		return
+	}
+	file, err := os.Open(client.resumePath())
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	var data resumeData
+	if err := bencode.Unmarshal(file, &data); err != nil || data.InfoHash != string(client.InfoHash[:]) {
+		client.Logger.Printf(log.LowVerbose, "ignoring invalid resume data of %s\n", client.FileName)
+		return
+	}
+	restored := 0
+	for i, piece := range client.Pieces {
+		if i/8 >= len(data.Pieces) || data.Pieces[i/8]&(1<<(7-i%8)) == 0 {
+			continue
+		}
+		payload := make([]byte, piece.Length)
+		if _, err := client.Storage.ReadAt(payload, i, 0); err != nil || !piece.Verify(payload) {
+			continue
+		}
+		client.DownloadedPieces[i] = true
+		client.Picker.Done(i)
+		restored++
+	}
+	client.Logger.Printf(log.LowVerbose, "resumed %d pieces of %s\n", restored, client.FileName)
+}
+
+func (client *TorrentClient) removeResumeData() {
+	if client.Config.ResumeDir != "" {
+		os.Remove(client.resumePath())
+	}
+}
+
+// Uploaded returns the number of payload bytes sent to peers
+func (client *TorrentClient) Uploaded() int64 {
+	return client.uploaded.Total()
+}
+
+// Downloaded returns the number of verified payload bytes received
+func (client *TorrentClient) Downloaded() int64 {
+	return client.downloaded.Load()
+}
+
+// left returns the number of bytes of the pieces not downloaded yet
+func (client *TorrentClient) left() int64 {
+	var left int64
+	for i, piece := range client.Pieces {
+		if !client.Picker.IsDone(i) {
+			left += int64(piece.Length)
+		}
+	}
+	return left
+}
+
+// peers returns the peers given by the last announce
+func (client *TorrentClient) peers() []tr.Peer {
+	client.trackerMu.Lock()
+	defer client.trackerMu.Unlock()
+	return slices.Clone(client.Peers)
+}
+
+// announceStarted tells the tracker the torrent started, or announces it
+// again for fresh peers when it was told already and didn't stop since.
+// The torrent is then announced every interval until it stops.
+func (client *TorrentClient) announceStarted(ctx context.Context) error {
+	if client.Torrent.Announce == "" {
+		return nil
+	}
+	// A stopped event still being sent goes first
+	client.announcing.Wait()
+	client.trackerMu.Lock()
+	started := client.started
+	var stop chan struct{}
+	if !started {
+		client.started = true
+		stop = make(chan struct{})
+		client.reannounceStop = stop
+	}
+	client.trackerMu.Unlock()
+	if started {
+		return client.announce(ctx, tr.EventNone)
+	}
+	// The first announce gives the port a moment to be mapped, the
+	// tracker is told the mapped address later otherwise
+	if _, port := client.Config.PortMap.Wait(portMapWait); port == 0 && client.Config.PortMap != nil {
+		client.mapWatch.Do(func() { go client.announceWhenMapped() })
+	}
+	if err := client.announce(ctx, tr.EventStarted); err != nil {
+		client.trackerMu.Lock()
+		if client.reannounceStop == stop {
+			client.started = false
+			client.reannounceStop = nil
+		}
+		client.trackerMu.Unlock()
+		return err
+	}
+	client.reannouncing.Go(func() { client.reannounce(stop) })
+	return nil
+}
+
+// reannounce announces the torrent every interval the tracker asks for,
+// until stop is closed by AnnounceStopped or the client is closed
+func (client *TorrentClient) reannounce(stop chan struct{}) {
+	for {
+		client.trackerMu.Lock()
+		interval := client.interval
+		client.trackerMu.Unlock()
+		if interval <= 0 {
+			interval = defaultAnnounceInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		case <-client.closed:
+			timer.Stop()
+			return
+		}
+		client.trackerMu.Lock()
+		started := client.started && client.reannounceStop == stop
+		client.trackerMu.Unlock()
+		if !started {
+			return
+		}
+		client.announce(context.Background(), tr.EventNone)
+	}
+}
+
+// AnnounceStopped tells the tracker in the background that the torrent
+// stopped, once after it was told it started. The next Download sends
+// started again and Close waits for it to be sent.
+func (client *TorrentClient) AnnounceStopped() {
+	client.trackerMu.Lock()
+	defer client.trackerMu.Unlock()
+	if !client.started {
+		return
+	}
+	client.started = false
+	if client.reannounceStop != nil {
+		close(client.reannounceStop)
+		client.reannounceStop = nil
+	}
+	client.announcing.Go(func() { client.announce(context.Background(), tr.EventStopped) })
+}
+
+// announceWhenMapped tells the tracker the address of a port mapped after
+// the first announce, unless the torrent stopped
+func (client *TorrentClient) announceWhenMapped() {
+	select {
+	case <-client.Config.PortMap.Mapped():
+	case <-client.closed:
+		return
+	}
+	client.trackerMu.Lock()
+	started := client.started
+	client.trackerMu.Unlock()
+	if started {
+		client.announce(context.Background(), tr.EventNone)
+	}
+}
+
+// announce sends an event to the tracker, even if ctx is already done.
+// The peers it answers replace those of the last announce.
+func (client *TorrentClient) announce(ctx context.Context, event string) error {
+	if client.Torrent.Announce == "" {
+		return nil
+	}
+	ip, port := client.Config.PortMap.External()
+	if port == 0 {
+		port = client.Port
+	}
+	stats := tr.AnnounceStats{
+		Event:      event,
+		Uploaded:   client.Uploaded(),
+		Downloaded: client.Downloaded(),
+		Left:       client.left(),
+		IP:         ip,
+	}
+	url, err := tr.BuildAnnounceRequest(client.Torrent, client.SelfId, port, stats)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), announceTimeout)
+	defer cancel()
+	var response tr.TrackerResponse
+	if event == tr.EventStopped {
+		err = tr.SendEvent(ctx, url, client.httpClient)
+	} else {
+		client.Logger.Printf(log.HighVerbose, "tracker request: %s\n", url)
+		response, err = tr.Announce(ctx, url, client.httpClient)
+	}
+	if err != nil {
+		client.Logger.Printf(log.HighVerbose, "failed to announce %s to tracker: %s\n", client.FileName, err)
+	}
+	client.trackerMu.Lock()
+	defer client.trackerMu.Unlock()
+	client.tracker.Time = time.Now()
+	client.tracker.Event = event
+	client.tracker.Err = err
+	if err == nil && event != tr.EventStopped {
+		client.Logger.Printf(log.HighVerbose, "found %d peers\n", len(response.Peers))
+		client.Peers = response.Peers
+		client.tracker.Peers = len(response.Peers)
+		client.interval = time.Duration(response.Interval) * time.Second
+	}
+	return err
+}
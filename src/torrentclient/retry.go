@@ -0,0 +1,137 @@
+package torrentclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+
+	pc "github.com/samir-adh/bytetorrent/src/piece"
+)
+
+const defaultMaxPieceAttempts = 5
+
+// ErrPieceFailed is returned by Download when a piece failed to download
+// from too many peers.
+var ErrPieceFailed = errors.New("piece failed from too many peers")
+
+// retries counts the failed downloads of each piece and keeps the blocks
+// received before a download failed, for the next peer to complete.
+type retries struct {
+	mu      sync.Mutex
+	max     int                         // distinct peers a piece may fail from
+	failed  map[int]map[string]struct{} // peers each piece failed from
+	partial map[int]*partialPiece
+	err     error // set once a piece failed from max peers
+}
+
+// partialPiece is the blocks of a piece with the address each came from
+type partialPiece struct {
+	blocks  *pc.Partial
+	senders []net.IP
+}
+
+func newRetries(max int) *retries {
+	if max == 0 {
+		max = defaultMaxPieceAttempts
+	}
+	return &retries{
+		max:     max,
+		failed:  make(map[int]map[string]struct{}),
+		partial: make(map[int]*partialPiece),
+	}
+}
+
+// reset forgets the failures of a previous run, the blocks are kept
+func (r *retries) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed = make(map[int]map[string]struct{})
+	r.err = nil
+}
+
+// take returns the blocks of piece received so far, the caller owns them
+// until it keeps them again
+func (r *retries) take(piece *pc.Piece) *partialPiece {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if partial, ok := r.partial[piece.Index]; ok {
+		delete(r.partial, piece.Index)
+		return partial
+	}
+	blocks := pc.NewPartial(piece.Length)
+	return &partialPiece{blocks: blocks, senders: make([]net.IP, len(blocks.Received))}
+}
+
+// keep stores the blocks of a piece whose download failed
+func (r *retries) keep(index int, partial *partialPiece) {
+	if !partial.blocks.Any() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.partial[index] = partial
+}
+
+// fail records that the piece failed from peer, it returns an error once
+// the piece failed from too many distinct peers
+func (r *retries) fail(index int, peer net.IP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	peers, ok := r.failed[index]
+	if !ok {
+		peers = make(map[string]struct{})
+		r.failed[index] = peers
+	}
+	peers[peer.String()] = struct{}{}
+	if len(peers) < r.max {
+		return nil
+	}
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: piece %d failed from %d peers", ErrPieceFailed, index, len(peers))
+	}
+	return r.err
+}
+
+// giveUp records that no peer is left to send the piece, it returns the
+// error of the download
+func (r *retries) giveUp(index int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: piece %d failed and no other peer can send it", ErrPieceFailed, index)
+	}
+	return r.err
+}
+
+// failedPieces returns the pieces that failed from at least one peer
+func (r *retries) failedPieces() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pieces := make([]int, 0, len(r.failed))
+	for index := range r.failed {
+		pieces = append(pieces, index)
+	}
+	return pieces
+}
+
+// Err returns the error of the piece that failed too many times
+func (r *retries) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// received records ip as the sender of the blocks received since before
+func (p *partialPiece) received(before []bool, ip net.IP) {
+	for i, received := range p.blocks.Received {
+		if received && !before[i] {
+			p.senders[i] = ip
+		}
+	}
+}
+
+func (p *partialPiece) snapshot() []bool {
+	return slices.Clone(p.blocks.Received)
+}
@@ -0,0 +1,224 @@
+package torrentclient
+
+import (
+	"sync/atomic"
+	"time"
+
+	pr "github.com/samir-adh/bytetorrent/src/peerconnection"
+	"github.com/samir-adh/bytetorrent/src/picker"
+	"github.com/samir-adh/bytetorrent/src/stats"
+)
+
+// PeerInfo describes a peer connected to the torrent
+type PeerInfo struct {
+	Address    string
+	Client     string // client name from the peer id, empty if unknown
+	Inbound    bool   // the peer connected to us
+	Pieces     int    // pieces the peer has, unknown for inbound peers
+	Snubbed    bool
+	Choked     bool // the peer chokes us
+	Interested bool // the peer is interested in our pieces
+	// AmChoking is set while we choke the peer and AmInterested when we
+	// told it we are interested in its pieces
+	AmChoking    bool
+	AmInterested bool
+	Downloaded   int64 // bytes of the blocks received from the peer
+	Uploaded     int64 // bytes of the blocks sent to the peer
+	// Transfer rates in bytes per second, averaged over stats.Window
+	DownloadRate int
+	UploadRate   int
+}
+
+// Flags describes the peer as Transmission does: D when downloading from
+// it, d when it chokes us, U when uploading to it, I when it connected to
+// us and S when snubbed
+func (info PeerInfo) Flags() string {
+	flags := ""
+	if !info.Inbound {
+		if info.Choked {
+			flags += "d"
+		} else {
+			flags += "D"
+		}
+	}
+	if info.Interested {
+		flags += "U"
+	}
+	if info.Inbound {
+		flags += "I"
+	}
+	if info.Snubbed {
+		flags += "S"
+	}
+	return flags
+}
+
+// connectedPeer is an entry of the connected peers, conn is nil for
+// inbound peers
+type connectedPeer struct {
+	address    string
+	inbound    bool
+	id         [20]byte
+	conn       *pr.PeerConnection
+	interested atomic.Bool
+	unchoked   atomic.Bool  // we unchoked the peer, outbound peers never are
+	uploaded   *stats.Meter // nil for outbound peers
+}
+
+// addPeer records a connected peer until the returned function is called
+func (client *TorrentClient) addPeer(peer *connectedPeer) func() {
+	client.peersMu.Lock()
+	defer client.peersMu.Unlock()
+	if client.connected == nil {
+		client.connected = make(map[*connectedPeer]struct{})
+	}
+	client.connected[peer] = struct{}{}
+	return func() {
+		client.peersMu.Lock()
+		defer client.peersMu.Unlock()
+		delete(client.connected, peer)
+	}
+}
+
+// ConnectedPeers returns the peers connected to the torrent
+func (client *TorrentClient) ConnectedPeers() []PeerInfo {
+	client.peersMu.Lock()
+	defer client.peersMu.Unlock()
+	peers := make([]PeerInfo, 0, len(client.connected))
+	for peer := range client.connected {
+		info := PeerInfo{
+			Address:    peer.address,
+			Client:     pr.ClientName(peer.id),
+			Inbound:    peer.inbound,
+			Interested: peer.interested.Load(),
+			AmChoking:  !peer.unchoked.Load(),
+		}
+		if peer.uploaded != nil {
+			info.Uploaded = peer.uploaded.Total()
+			info.UploadRate = peer.uploaded.Rate()
+		}
+		if peer.conn != nil {
+			info.Client = pr.ClientName(peer.conn.RemoteId())
+			info.Pieces = peer.conn.Available()
+			info.Snubbed = peer.conn.Snubbed()
+			info.Choked = peer.conn.Choked()
+			info.AmInterested = peer.conn.Interested()
+			info.Downloaded = peer.conn.Received.Total()
+			info.DownloadRate = peer.conn.Received.Rate()
+		}
+		peers = append(peers, info)
+	}
+	return peers
+}
+
+// Stats is the transfer of a torrent
+type Stats struct {
+	Downloaded int64 // verified payload
+	Received   int64 // blocks from peers and web seeds, wasted ones included
+	Uploaded   int64
+	Wasted     int64 // failed their hash check
+	// Transfer rates in bytes per second, averaged over stats.Window
+	DownloadRate int
+	UploadRate   int
+	Peers        int   // connected
+	Seeds        int   // connected peers having every piece
+	Completed    int64 // bytes of the wanted pieces verified
+	Wanted       int64 // bytes of the wanted pieces
+}
+
+// Stats returns the transfer of the torrent
+func (client *TorrentClient) Stats() Stats {
+	st := Stats{
+		Downloaded:   client.downloaded.Load(),
+		Received:     client.received.Total(),
+		Uploaded:     client.uploaded.Total(),
+		Wasted:       client.wasted.Load(),
+		DownloadRate: client.received.Rate(),
+		UploadRate:   client.uploaded.Rate(),
+	}
+	// As in Picker.Progress, skipped pieces downloaded anyway count
+	for i, piece := range client.Pieces {
+		if client.Picker.IsDone(i) {
+			st.Completed += int64(piece.Length)
+			st.Wanted += int64(piece.Length)
+		} else if client.Picker.Priority(i) != picker.Skip {
+			st.Wanted += int64(piece.Length)
+		}
+	}
+	client.peersMu.Lock()
+	defer client.peersMu.Unlock()
+	for peer := range client.connected {
+		st.Peers++
+		if peer.conn != nil && peer.conn.Available() == len(client.Pieces) {
+			st.Seeds++
+		}
+	}
+	return st
+}
+
+// TrackerStatus is the outcome of the last announce to the tracker
+type TrackerStatus struct {
+	URL   string
+	Time  time.Time // of the last announce, zero if none was sent
+	Event string    // of the last announce, empty for the ones sent every interval
+	Peers int       // given by the last announce answering peers
+	Err   error
+}
+
+// Tracker returns the outcome of the last announce, with an empty URL if
+// the torrent has no tracker
+func (client *TorrentClient) Tracker() TrackerStatus {
+	client.trackerMu.Lock()
+	defer client.trackerMu.Unlock()
+	return client.tracker
+}
+
+// Completed returns the bytes of the verified pieces
+func (client *TorrentClient) Completed() int64 {
+	return int64(client.Torrent.Length) - client.left()
+}
+
+// Bitfield returns the verified pieces, the first one in the high bit of
+// the first byte
+func (client *TorrentClient) Bitfield() []byte {
+	bitfield := make([]byte, (len(client.Pieces)+7)/8)
+	for i := range client.Pieces {
+		if client.Picker.IsDone(i) {
+			bitfield[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return bitfield
+}
+
+// FilesCompleted returns the bytes of each file in verified pieces
+func (client *TorrentClient) FilesCompleted() []int64 {
+	completed := make([]int64, len(client.Torrent.Files))
+	for i := range client.Pieces {
+		if !client.Picker.IsDone(i) {
+			continue
+		}
+		for _, fileRange := range client.Torrent.PieceFileRanges(i) {
+			completed[fileRange.Index] += int64(fileRange.Length)
+		}
+	}
+	return completed
+}
+
+// Availability returns the number of connected peers having each piece,
+// inbound peers aren't counted since their pieces aren't tracked
+func (client *TorrentClient) Availability() []int {
+	availability := make([]int, len(client.Pieces))
+	client.peersMu.Lock()
+	defer client.peersMu.Unlock()
+	for peer := range client.connected {
+		if peer.conn == nil {
+			continue
+		}
+		for _, index := range peer.conn.Pieces() {
+			if index >= 0 && index < len(availability) {
+				availability[index]++
+			}
+		}
+	}
+	return availability
+}
@@ -1,19 +1,32 @@
 package torrentclient
 
 import (
-	"crypto/sha1"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/samir-adh/bytetorrent/src/ban"
+	"github.com/samir-adh/bytetorrent/src/connlimit"
+	"github.com/samir-adh/bytetorrent/src/dialer"
+	"github.com/samir-adh/bytetorrent/src/ipfilter"
 	"github.com/samir-adh/bytetorrent/src/log"
 	pr "github.com/samir-adh/bytetorrent/src/peerconnection"
+	"github.com/samir-adh/bytetorrent/src/picker"
+	"github.com/samir-adh/bytetorrent/src/portmap"
+	"github.com/samir-adh/bytetorrent/src/proxy"
 	pc "github.com/samir-adh/bytetorrent/src/piece"
+	"github.com/samir-adh/bytetorrent/src/ratelimit"
+	"github.com/samir-adh/bytetorrent/src/stats"
+	"github.com/samir-adh/bytetorrent/src/storage"
 	"github.com/samir-adh/bytetorrent/src/torrentfile"
 	tr "github.com/samir-adh/bytetorrent/src/tracker"
+	"github.com/samir-adh/bytetorrent/src/webseed"
 	"github.com/ztrue/tracerr"
 )
 
@@ -21,7 +34,7 @@ type TorrentClient struct {
 	InfoHash         [20]byte
 	SelfId           [20]byte
 	Port             int
-	Peers            []tr.Peer
+	Peers            []tr.Peer // given by the last announce, guarded by trackerMu
 	ActivePeers      int
 	ActivePeersMu    *sync.Mutex
 	Pieces           []pc.Piece
@@ -29,110 +42,450 @@ type TorrentClient struct {
 	FileName         string
 	Logger           *log.Logger
 	DownloadedPieces []bool
+	Dialer           *dialer.Dialer
+	WebSeeds         []*webseed.WebSeed
+	Torrent          *torrentfile.TorrentFile
+	Storage          storage.Storage // defaults to files laid out as described by Config
+	Config           Config
+	Picker           *picker.Picker
+	Limits           *Limits
+	Connections      *connlimit.Shared
+	Bans             *ban.List
+	Filter           *ipfilter.Filter
+	prioritiesMu     sync.Mutex
+	filePriorities   []picker.Priority // see FilePriorities, guarded by prioritiesMu
+	smartBan         *ban.SmartBan
+	retries          *retries
+	conns            *connlimit.Pool // connections of this torrent
+	perIP            *connlimit.IPLimit
+	fileStorage      *storage.FileStorage // set when Download opened the storage itself
+	ownsDialer       bool
+	httpClient       *http.Client // for trackers and web seeds
+	uploaded         stats.Meter
+	downloaded       atomic.Int64 // verified payload
+	received         stats.Meter  // blocks from peers and web seeds
+	wasted           atomic.Int64 // failed their hash check
+	interestMu       sync.Mutex
+	interestedPeers  int       // inbound peers interested in our pieces
+	idleSince        time.Time // when the last interested peer left
+	superSeed        *pr.SuperSeed
+	webSeedsRunning  atomic.Int32 // web seed workers of the running download
+	pendingPeers     atomic.Int32 // peers of the tracker not connected yet
+	peersMu          sync.Mutex
+	connected        map[*connectedPeer]struct{} // see ConnectedPeers
+	trackerMu        sync.Mutex
+	tracker          TrackerStatus  // see Tracker
+	started          bool           // the tracker was told the torrent started
+	interval         time.Duration  // asked by the tracker between two announces
+	reannounceStop   chan struct{}  // closed when the torrent stops, see reannounce
+	reannouncing     sync.WaitGroup
+	mapWatch         sync.Once // starts announceWhenMapped
+	closed           chan struct{}  // closed by Close
+	closeOnce        sync.Once
+	announcing       sync.WaitGroup // stopped events being sent
+	runMu            sync.Mutex
+	stop             chan struct{} // closed by Stop
+	stopped          chan struct{} // closed when Download returns
 }
 
-func New(filepath string, logger *log.Logger) (*TorrentClient, error) {
+// Config describes where downloads are stored and what they share with
+// other torrents of a session
+type Config struct {
+	DownloadDir   string // where completed downloads end up
+	IncompleteDir string // where downloads are kept until complete, DownloadDir when empty
+	PartSuffix    bool   // append ".part" to files until the download completes
+	ResumeDir     string // where the verified pieces are recorded, not recorded when empty
+	Sequential    bool   // download pieces in order, for streaming
+	Readahead     int    // bytes after the playhead fetched first in sequential mode
+	SuperSeed     bool   // once complete, reveal pieces one at a time to peers (BEP 16)
+
+	PeerId [20]byte        // random when zero
+	Port   int             // announced listen port, 6881 when zero
+	Dialer *dialer.Dialer // shared dialer, one is opened on Port when nil
+	Proxy  *proxy.Proxy   // peers, trackers and web seeds are reached through it when set
+
+	PortMap *portmap.Mapper // its external address and port are announced once mapped
+
+	// Payload limits in bytes per second, zero means unlimited
+	DownloadRate     int
+	UploadRate       int
+	PeerDownloadRate int
+	PeerUploadRate   int
+	SessionDownload  *ratelimit.Limiter // shared with the other torrents
+	SessionUpload    *ratelimit.Limiter
+
+	MaxConnections int               // connections of this torrent, 50 when zero
+	MaxPerIP       int               // connections to a same address, no limit when zero
+	Connections    *connlimit.Shared // limits shared with the other torrents
+
+	Bans    *ban.List        // shared ban list, the torrent has its own when nil
+	Filter  *ipfilter.Filter // addresses never connected to, nothing is filtered when nil
+	BanTime time.Duration    // how long peers that sent bad data are banned, 24h when zero
+
+	MaxPieceAttempts int // distinct peers a piece may fail from before giving up, 5 when zero
+
+	Pipeline    int           // requests sent to a peer at once, 5 when zero
+	SnubTimeout time.Duration // wait for a block before asking other peers, 30s when zero
+	IdleTimeout time.Duration // wait for a block before disconnecting, 2m when zero
+}
+
+// ErrStopped is returned by Download when Stop interrupts it
+var ErrStopped = errors.New("download stopped")
+
+const partSuffix = ".part"
+
+const defaultBanTime = 24 * time.Hour
+
+// maxWebSeedFailures is the number of consecutive failures after which
+// a web seed is abandoned
+const maxWebSeedFailures = 5
+
+func New(filepath string, config Config, logger *log.Logger) (*TorrentClient, error) {
 	tor, err := torrentfile.OpenTorrentFile(filepath)
 	if err != nil {
 		return nil, err
 	}
-	self_id, err := tr.RandomPeerId()
-	if err != nil {
-		return nil, err
+	return NewFromTorrent(tor, config, logger)
+}
+
+func NewFromTorrent(tor *torrentfile.TorrentFile, config Config, logger *log.Logger) (*TorrentClient, error) {
+	self_id := config.PeerId
+	if self_id == [20]byte{} {
+		var err error
+		self_id, err = tr.RandomPeerId()
+		if err != nil {
+			return nil, err
+		}
 	}
 	port := 6881
-	trackerRequest, err := tr.BuildTrackerRequest(tor, self_id, port)
-	if err != nil {
-		return nil, err
+	if config.Port != 0 {
+		port = config.Port
 	}
-
 	httpClient := http.DefaultClient
-	logger.Printf(log.HighVerbose, "tracker request: %s\n", trackerRequest)
-	peers, err := tr.FindPeers(trackerRequest, httpClient)
-	logger.Printf(log.HighVerbose, "found %d peers\n", len(peers))
-
-	if err != nil {
-		return nil, err
+	if config.Proxy != nil {
+		httpClient = config.Proxy.HTTPClient()
 	}
-	pieces := make([]pc.Piece, len(tor.PiecesHash))
-	for i := range len(tor.PiecesHash) {
+	webSeeds := webseed.FromTorrent(tor, httpClient)
+	pieces := make([]pc.Piece, tor.PieceCount())
+	for i := range pieces {
 		pieces[i] = pc.Piece{
 			Index:  i,
-			Hash:   tor.PiecesHash[i],
 			Length: tor.GetPieceLength(i),
 		}
+		if i < len(tor.PiecesHash) {
+			pieces[i].Hash = tor.PiecesHash[i]
+		}
+		if i < len(tor.PiecesHashV2) && tor.PiecesHashV2[i].Leaves > 0 {
+			pieces[i].HashV2 = &tor.PiecesHashV2[i]
+		}
+	}
+	filePriorities := make([]picker.Priority, len(tor.Files))
+	for i := range filePriorities {
+		filePriorities[i] = picker.Normal
 	}
-	downloaded := make([]bool, len(tor.PiecesHash))
+	downloaded := make([]bool, len(pieces))
 	for i := range downloaded {
 		downloaded[i] = false
 	}
+	piecePicker := picker.New(len(pieces))
+	if config.Sequential {
+		piecePicker.SetSequential(true, (config.Readahead+tor.PieceLength-1)/tor.PieceLength)
+	}
+	peerDialer := config.Dialer
+	if peerDialer == nil && config.Proxy != nil {
+		peerDialer = dialer.NewProxied(config.Proxy, logger)
+	} else if peerDialer == nil {
+		peerDialer = dialer.New(port, logger)
+	}
+	connections, conns, perIP := newConnectionLimits(config)
+	bans := config.Bans
+	if bans == nil {
+		bans = ban.NewList()
+	}
 	logger.Printf(log.LowVerbose, "Downloading %s", tor.Name)
-	return &TorrentClient{
+	client := &TorrentClient{
 		InfoHash:         tor.InfoHash,
 		SelfId:           self_id,
 		Port:             port,
-		Peers:            peers,
 		Pieces:           pieces,
 		FileName:         tor.Name,
 		Logger:           logger,
 		PieceLength:      tor.PieceLength,
 		DownloadedPieces: downloaded,
-		ActivePeers:      len(peers),
+		ActivePeers:      len(webSeeds),
 		ActivePeersMu: &sync.Mutex{},
-	}, nil
+		Dialer:           peerDialer,
+		WebSeeds:         webSeeds,
+		Torrent:          tor,
+		Config:           config,
+		Picker:           piecePicker,
+		filePriorities:   filePriorities,
+		Limits:           newLimits(config),
+		Connections:      connections,
+		Bans:             bans,
+		Filter:           config.Filter,
+		smartBan:         ban.NewSmartBan(),
+		retries:          newRetries(config.MaxPieceAttempts),
+		conns:            conns,
+		perIP:            perIP,
+		ownsDialer:       config.Dialer == nil,
+		httpClient:       httpClient,
+		stopped:          make(chan struct{}),
+		closed:           make(chan struct{}),
+	}
+	client.tracker = TrackerStatus{URL: tor.Announce}
+	if config.SuperSeed {
+		client.superSeed = pr.NewSuperSeed(client)
+	}
+	return client, nil
 }
 
+// Download fetches the wanted pieces, it can be called again after it
+// returned to resume an interrupted download.
 func (client *TorrentClient) Download() error {
-	// Create file to store the downloaded data
-	file, err := os.Create(fmt.Sprintf("./downloads/%s", client.FileName))
-	if err != nil {
-		return err
+	return client.DownloadContext(context.Background())
+}
+
+// DownloadContext is Download returning ctx.Err() once ctx is done. The
+// pieces downloaded so far are written and the resume data saved first.
+func (client *TorrentClient) DownloadContext(ctx context.Context) error {
+	stop := client.startRun()
+	defer client.endRun()
+	if client.Storage == nil {
+		fileStorage, err := client.openFileStorage()
+		if err != nil {
+			return err
+		}
+		client.runMu.Lock()
+		client.Storage = fileStorage
+		client.fileStorage = fileStorage
+		client.runMu.Unlock()
+		client.loadResumeData()
 	}
-	fileSize := 0
-	for _, piece := range client.Pieces {
-		fileSize += piece.Length
+	defer client.Storage.Close()
+	if client.ownsDialer {
+		defer client.Dialer.Close()
 	}
-	err = file.Truncate(int64(fileSize))
-	client.Logger.Printf(log.HighVerbose, "created file of size %d bytes", fileSize)
-	if err != nil {
-		return err
+	client.prioritiesMu.Lock()
+	client.applyFileSkips()
+	client.prioritiesMu.Unlock()
+	// Only a download completing now is announced completed
+	alreadyComplete := client.Picker.Complete()
+	if err := client.announceStarted(ctx); err != nil && !alreadyComplete && len(client.peers()) == 0 {
+		// Web seeds are enough to download the torrent
+		if len(client.WebSeeds) == 0 {
+			return err
+		}
+		client.Logger.Printf(log.LowVerbose, "could not get peers from tracker, using web seeds only: %s\n", err)
+	}
+	if !alreadyComplete {
+		client.workerPool(
+			ctx,
+			client.Storage,
+			stop,
+		)
+	}
+	if !client.Picker.Complete() {
+		client.saveResumeData()
+		client.AnnounceStopped()
+		client.announcing.Wait()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case <-stop:
+			return ErrStopped
+		default:
+		}
+		if err := client.retries.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("download of %s stopped before completion", client.FileName)
+	}
+	if client.fileStorage != nil {
+		if err := client.fileStorage.Finish(client.downloadDir()); err != nil {
+			return err
+		}
+		client.removeResumeData()
+		client.Logger.Printf(log.LowVerbose, "saved %s in %s\n", client.FileName, client.downloadDir())
+	}
+	if !alreadyComplete {
+		client.announce(ctx, tr.EventCompleted)
 	}
-	defer file.Close()
-	client.workerPool(
-		file,
-	)
 	return nil
 }
 
-func (client *TorrentClient) workerPool(file *os.File) {
-	piecesQueue := make(chan pc.Piece, len(client.Pieces))
+// Stop makes the running Download return ErrStopped, or the next one if
+// none is running.
+func (client *TorrentClient) Stop() {
+	client.runMu.Lock()
+	defer client.runMu.Unlock()
+	if client.stop == nil {
+		client.stop = make(chan struct{})
+	}
+	select {
+	case <-client.stop:
+	default:
+		close(client.stop)
+	}
+}
+
+// Close releases the storage once the client is no longer used, after
+// the tracker is sent the stopped event
+func (client *TorrentClient) Close() error {
+	client.closeOnce.Do(func() { close(client.closed) })
+	client.announcing.Wait()
+	client.reannouncing.Wait()
+	store := client.storage()
+	if client.ownsDialer {
+		client.Dialer.Close()
+	}
+	if store == nil {
+		return nil
+	}
+	return store.Close()
+}
+
+// startRun returns the channel Stop closes
+func (client *TorrentClient) startRun() chan struct{} {
+	client.runMu.Lock()
+	defer client.runMu.Unlock()
+	if client.stop == nil {
+		client.stop = make(chan struct{})
+	}
+	select {
+	case <-client.stopped:
+		client.stopped = make(chan struct{})
+	default:
+	}
+	return client.stop
+}
+
+func (client *TorrentClient) endRun() {
+	client.runMu.Lock()
+	defer client.runMu.Unlock()
+	// A stop only interrupts one run
+	select {
+	case <-client.stop:
+		client.stop = nil
+	default:
+	}
+	close(client.stopped)
+}
+
+// stoppedChan returns a channel closed when the current Download returns
+func (client *TorrentClient) stoppedChan() chan struct{} {
+	client.runMu.Lock()
+	defer client.runMu.Unlock()
+	return client.stopped
+}
+
+func (client *TorrentClient) downloadDir() string {
+	if client.Config.DownloadDir == "" {
+		return "."
+	}
+	return client.Config.DownloadDir
+}
+
+// openFileStorage stores the torrent in the incomplete directory if
+// there is one, Download moves it to the download directory when done.
+func (client *TorrentClient) openFileStorage() (*storage.FileStorage, error) {
+	dir := client.downloadDir()
+	if client.Config.IncompleteDir != "" {
+		dir = client.Config.IncompleteDir
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	options := storage.FileOptions{}
+	if client.Config.PartSuffix {
+		options.PartSuffix = partSuffix
+	}
+	return storage.NewFileWithOptions(dir, client.Torrent, options)
+}
+
+// workerPool downloads pieces until they are all done, the workers fail,
+// stop is closed or ctx is done.
+func (client *TorrentClient) workerPool(ctx context.Context, store storage.Storage, stop chan struct{}) {
 	resultsQueue := make(chan pc.PieceResult, len(client.Pieces))
+	client.retries.reset()
 	quit := make(chan bool)
+	closeQuit := sync.OnceFunc(func() { close(quit) })
+	// Canceled with quit to interrupt dials and reads in progress
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	peers := client.peers()
+	client.ActivePeersMu.Lock()
+	client.ActivePeers = len(peers) + len(client.WebSeeds)
+	client.ActivePeersMu.Unlock()
+	client.pendingPeers.Store(int32(len(peers)))
+	client.webSeedsRunning.Store(int32(len(client.WebSeeds)))
 	wg := sync.WaitGroup{}
-	for _, piece := range client.Pieces {
-		piecesQueue <- piece
-	}
-	for _, peer := range client.Peers {
+	wg.Go(func() {
+		client.connectPeers(
+			ctx,
+			peers,
+			&wg,
+			resultsQueue,
+			quit,
+		)
+	})
+	for _, seed := range client.WebSeeds {
 		wg.Go(func() {
-			client.worker(
-				peer,
-				piecesQueue,
+			client.webSeedWorker(
+				ctx,
+				seed,
 				resultsQueue,
 				quit,
 			)
 		})
 	}
 
-	wg.Go(func() {
-		client.collectPieces(
-			file,
-			resultsQueue,
-			quit,
-		)
-	})
-	wg.Wait()
-	close(piecesQueue)
-	close(resultsQueue)
+	go func() {
+		select {
+		case <-stop:
+			closeQuit()
+		case <-ctx.Done():
+			closeQuit()
+		case <-quit:
+		}
+		cancel()
+	}()
+	// The collector returns once every worker is gone
+	go func() {
+		wg.Wait()
+		close(resultsQueue)
+	}()
+	client.collectPieces(
+		store,
+		resultsQueue,
+		closeQuit,
+	)
+	// Pieces picked by workers that stopped before downloading them
+	client.Picker.ReturnPending()
+}
+
+// nextPiece waits until the picker hands out a piece for which has returns
+// true, trying again when more is signaled. The second value is false if
+// quit was closed in the meantime.
+func (client *TorrentClient) nextPiece(has func(int) bool, more <-chan struct{}, quit chan bool) (pc.Piece, bool) {
+	for {
+		select {
+		case <-quit:
+			return pc.Piece{}, false
+		default:
+		}
+		changed := client.Picker.Changed()
+		if index, ok := client.Picker.Pick(has); ok {
+			return client.Pieces[index], true
+		}
+		select {
+		case <-changed:
+		case <-more:
+		case <-quit:
+			return pc.Piece{}, false
+		}
+	}
 }
 
 func (client *TorrentClient) signalUnactivePeer() {
@@ -143,18 +496,32 @@ func (client *TorrentClient) signalUnactivePeer() {
 }
 
 func (client *TorrentClient) worker(
+	ctx context.Context,
 	peer tr.Peer,
-	pieceQueue chan pc.Piece,
+	slot *evictable,
 	resultsQueue chan pc.PieceResult,
 	quit chan bool,
 ) {
-	netConn, err := net.DialTimeout(
-		"tcp",
-		peer.AddressToStr(),
-		5*time.Second,
-	)
+	// Runs once the peer is gone
+	defer client.checkFailedPieces(resultsQueue, quit)
+	notPending := sync.OnceFunc(func() { client.pendingPeers.Add(-1) })
+	defer notPending()
+	halfOpen, ok := client.Connections.HalfOpen.Acquire(0, nil, quit)
+	if !ok {
+		client.signalUnactivePeer()
+		return
+	}
+	defer halfOpen.Release()
+	netConn, err := client.Dialer.DialContext(ctx, peer.AddressToStr())
 	if err != nil {
 		client.Logger.Print(log.HighVerbose, err.Error())
+		client.signalUnactivePeer()
+		return
+	}
+	if !slot.set(netConn) {
+		// A peer of higher priority took the slot
+		netConn.Close()
+		client.signalUnactivePeer()
 		return
 	}
 	defer func() {
@@ -162,110 +529,295 @@ func (client *TorrentClient) worker(
 			client.Logger.Print(log.LowVerbose, err.Error())
 		}
 	}() // Close the connection when the function finishes
+	// Unblock the handshake and reads when the download stops
+	stopReads := context.AfterFunc(ctx, func() { netConn.SetDeadline(time.Unix(1, 0)) })
+	defer stopReads()
 	peerConnection, err := pr.New(client.SelfId, peer, client.InfoHash, &netConn, client.Logger)
+	halfOpen.Release()
 	if err != nil {
 		client.Logger.Printf(log.LowVerbose, "could not connect to peer %s", (&peer).String())
 		client.signalUnactivePeer()
 		return
 	}
+	defer peerConnection.Close()
+	peerConnection.Received = client.received.Child()
+	defer client.addPeer(&connectedPeer{address: peer.AddressToStr(), conn: peerConnection})()
+	notPending()
+	downloadLimit, _, releaseLimits := client.Limits.forPeer()
+	defer releaseLimits()
+	peerConnection.DownloadLimit = downloadLimit
+	peerConnection.Pipeline = client.Config.Pipeline
+	if client.Config.SnubTimeout > 0 {
+		peerConnection.SnubTimeout = client.Config.SnubTimeout
+	}
+	if client.Config.IdleTimeout > 0 {
+		peerConnection.IdleTimeout = client.Config.IdleTimeout
+	}
 
+	ip := net.IP(peer.IpAdress[:])
+	// Pieces that failed their hash check with blocks of this peer are
+	// downloaded from another one, and so are the pieces it was too slow
+	// to send while another source can send them
+	timedOut := make(map[int]bool)
+	has := func(index int) bool {
+		if !peerConnection.CanHandle(index) || client.smartBan.Sent(index, ip) {
+			return false
+		}
+		return !timedOut[index] || !client.sourceConnected(index, peerConnection)
+	}
 	for {
-		select {
-		case piece := <-pieceQueue:
-			result := client.downloadPiece(&piece, pieceQueue, peerConnection, &netConn)
-			// check if piece is missing from peer
-			switch result.State {
-			case pc.Downloaded:
-				resultsQueue <- *result
-			case pc.Missing:
-				pieceQueue <- piece
-			default:
-				client.Logger.Printf(log.HighVerbose, "error downloading piece %d from peer %d with state %d\n", piece.Index, peer.Id, result.State)
-				// close(quit)
-				return
-			}
-		case <-quit:
+		if client.Bans.Banned(ip) {
+			client.Logger.Printf(log.HighVerbose, "disconnecting banned peer %s\n", ip)
+			client.signalUnactivePeer()
+			return
+		}
+		piece, ok := client.nextPiece(has, peerConnection.Haves(), quit)
+		if !ok {
 			client.Logger.Printf(log.HighVerbose, "stopping connection to peer %d\n", peer.Id)
 			client.signalUnactivePeer()
 			return
 		}
+		partial := client.retries.take(&piece)
+		result, err := client.downloadPiece(&piece, partial, peerConnection, ip)
+		switch {
+		case errors.Is(err, pr.ErrSnubbed):
+			client.Logger.Printf(log.HighVerbose, "peer %s snubbed us, piece %d goes to other peers\n", ip, piece.Index)
+			timedOut[piece.Index] = true
+			client.retries.keep(piece.Index, partial)
+			client.Picker.Return(piece.Index)
+			continue
+		case errors.Is(err, pr.ErrIdle):
+			client.Logger.Printf(log.HighVerbose, "disconnecting idle peer %s\n", ip)
+			client.retries.keep(piece.Index, partial)
+			client.Picker.Return(piece.Index)
+			client.signalUnactivePeer()
+			return
+		}
+		// check if piece is missing from peer
+		switch result.State {
+		case pc.Downloaded:
+			resultsQueue <- *result
+			if err := peerConnection.SendHave(piece.Index); err != nil {
+				client.Logger.Print(log.HighVerbose, err.Error())
+			}
+		case pc.Missing:
+			client.retries.keep(piece.Index, partial)
+			client.Picker.Return(piece.Index)
+		case pc.HashError:
+			client.Logger.Printf(log.LowVerbose, "piece %d from %s failed its hash check\n", piece.Index, ip)
+			client.wasted.Add(int64(piece.Length))
+			// The blocks can't be trusted, the piece starts over
+			client.smartBan.Failed(piece.Index, result.Payload, partial.senders)
+			client.failPiece(piece.Index, ip, resultsQueue)
+		default:
+			client.Logger.Printf(log.HighVerbose, "error downloading piece %d from peer %d with state %d\n", piece.Index, peer.Id, result.State)
+			client.retries.keep(piece.Index, partial)
+			client.failPiece(piece.Index, ip, resultsQueue)
+			client.signalUnactivePeer()
+			return
+		}
+	}
+}
+
+// failPiece hands the piece to the next peer, or stops the download once
+// it failed from too many peers or no other peer can send it
+func (client *TorrentClient) failPiece(index int, ip net.IP, resultsQueue chan pc.PieceResult) {
+	client.Picker.Return(index)
+	err := client.retries.fail(index, ip)
+	if err == nil && !client.sourceLeft(index) {
+		err = client.retries.giveUp(index)
+	}
+	if err != nil {
+		client.Logger.Printf(log.LowVerbose, "%s, giving up\n", err)
+		client.smartBan.Forget(index)
+		resultsQueue <- pc.PieceResult{Index: index, State: pc.Failed}
+	}
+}
+
+// checkFailedPieces stops the download when no peer is left to send a
+// piece that failed, unless quit is closed
+func (client *TorrentClient) checkFailedPieces(resultsQueue chan pc.PieceResult, quit chan bool) {
+	select {
+	case <-quit:
+		return
+	default:
+	}
+	for _, index := range client.retries.failedPieces() {
+		if client.Picker.IsDone(index) || client.sourceLeft(index) {
+			continue
+		}
+		err := client.retries.giveUp(index)
+		client.Logger.Printf(log.LowVerbose, "%s, giving up\n", err)
+		client.smartBan.Forget(index)
+		resultsQueue <- pc.PieceResult{Index: index, State: pc.Failed}
+		return
 	}
 }
 
-func (client *TorrentClient) downloadPiece(piece *pc.Piece, pieceQueue chan pc.Piece, peerConnection *pr.PeerConnection, netConn *net.Conn) *pc.PieceResult {
+// sourceConnected reports whether a web seed or a connected peer other
+// than except that unchoked us can send the piece now
+func (client *TorrentClient) sourceConnected(index int, except *pr.PeerConnection) bool {
+	if client.webSeedsRunning.Load() > 0 {
+		return true
+	}
+	client.peersMu.Lock()
+	defer client.peersMu.Unlock()
+	for peer := range client.connected {
+		if peer.inbound || peer.conn == except || peer.conn.Choked() {
+			continue
+		}
+		if peer.conn.CanHandle(index) && !client.smartBan.Sent(index, net.IP(peer.conn.Peer.IpAdress[:])) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Check that the peer has the piece
-	if !peerConnection.CanHandle(piece.Index) {
-		pieceQueue <- *piece
+// sourceLeft reports whether the piece can still be downloaded: from a
+// web seed, a connected peer having it that sent none of its failed
+// downloads, or a peer not connected yet
+func (client *TorrentClient) sourceLeft(index int) bool {
+	if client.webSeedsRunning.Load() > 0 || client.pendingPeers.Load() > 0 {
+		return true
 	}
+	client.peersMu.Lock()
+	defer client.peersMu.Unlock()
+	for peer := range client.connected {
+		if peer.inbound {
+			continue
+		}
+		if peer.conn.CanHandle(index) && !client.smartBan.Sent(index, net.IP(peer.conn.Peer.IpAdress[:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (client *TorrentClient) downloadPiece(piece *pc.Piece, partial *partialPiece, peerConnection *pr.PeerConnection, ip net.IP) (*pc.PieceResult, error) {
 
 	// Try to download the piece
 	client.Logger.Printf(log.HighVerbose, "downloading piece %d from peer %d\n", piece.Index, peerConnection.Peer.Id)
-	pieceResult, err := peerConnection.Download(piece)
-	client.Logger.Printf(log.HighVerbose, "downloaded piece %d from peer %d\n", piece.Index, peerConnection.Peer.Id)
+	before := partial.snapshot()
+	pieceResult, err := peerConnection.Download(piece, partial.blocks)
+	partial.received(before, ip)
 	if err != nil {
+		client.Logger.Printf(log.HighVerbose, "failed to download piece %d from peer %d: %s\n", piece.Index, peerConnection.Peer.Id, err)
 		return &pc.PieceResult{
 			Index:   piece.Index,
 			Payload: nil,
 			State:   pc.Failed,
-		}
+		}, err
 	}
 
+	client.Logger.Printf(log.HighVerbose, "downloaded piece %d from peer %d\n", piece.Index, peerConnection.Peer.Id)
 	// Check integrity
-	hash := sha1.Sum(pieceResult.Payload)
-	if hash != piece.Hash {
-		err = tracerr.Errorf("hash of downloaded piece %d doesn't match expected hash\n", piece.Index)
+	if !piece.Verify(pieceResult.Payload) {
 		return &pc.PieceResult{
 			Index:   piece.Index,
-			Payload: nil,
-			State:   pc.Failed,
-		}
+			Payload: pieceResult.Payload, // kept to find who sent bad blocks
+			State:   pc.HashError,
+		}, nil
 	}
-	return pieceResult
+	return pieceResult, nil
 
 }
 
-func (client *TorrentClient) collectPieces(file *os.File, resultsQueue chan pc.PieceResult, quit chan bool) {
-	for result := range resultsQueue {
-		if client.ActivePeers == 0 {
-			close(quit)
+// webSeedWorker downloads pieces from an HTTP seed, taking them from the
+// same picker as the peer workers.
+func (client *TorrentClient) webSeedWorker(
+	ctx context.Context,
+	seed *webseed.WebSeed,
+	resultsQueue chan pc.PieceResult,
+	quit chan bool,
+) {
+	defer client.webSeedsRunning.Add(-1)
+	failures := 0
+	hasAll := func(int) bool { return true }
+	for {
+		piece, ok := client.nextPiece(hasAll, nil, quit)
+		if !ok {
+			client.Logger.Printf(log.HighVerbose, "stopping web seed %s\n", seed)
+			client.signalUnactivePeer()
+			return
+		}
+		result, err := seed.DownloadContext(ctx, &piece)
+		if err == nil {
+			ratelimit.Group{client.Limits.SessionDownload, client.Limits.Download}.Wait(len(result.Payload))
+			client.received.Add(int64(len(result.Payload)))
+		}
+		if err == nil && !piece.Verify(result.Payload) {
+			client.wasted.Add(int64(len(result.Payload)))
+			err = tracerr.Errorf("hash of piece %d from web seed doesn't match expected hash", piece.Index)
+		}
+		if err == nil {
+			failures = 0
+			resultsQueue <- *result
+			continue
+		}
+		client.Picker.Return(piece.Index)
+		client.Logger.Printf(log.HighVerbose, "web seed %s failed to send piece %d: %s\n", seed, piece.Index, err)
+		var delay time.Duration
+		var busy *webseed.BusyError
+		if errors.As(err, &busy) {
+			// A busy seed is still a working one
+			delay = busy.RetryAfter
+		} else {
+			failures++
+			if failures >= maxWebSeedFailures {
+				client.Logger.Printf(log.LowVerbose, "giving up on web seed %s\n", seed)
+				client.signalUnactivePeer()
+				return
+			}
+			delay = time.Duration(failures) * time.Second
+		}
+		select {
+		case <-time.After(delay):
+		case <-quit:
+			client.signalUnactivePeer()
+			return
 		}
+	}
+}
+
+// collectPieces writes the downloaded pieces until resultsQueue is
+// closed, closeQuit stops the workers.
+func (client *TorrentClient) collectPieces(store storage.Storage, resultsQueue chan pc.PieceResult, closeQuit func()) {
+	for result := range resultsQueue {
 		if result.State != pc.Downloaded {
 			client.Logger.Printf(log.LowVerbose,
 				"failed to download piece %d data in state %d, aborting torrent.\n",
 				result.Index, result.State)
-			close(quit)
-			return
+			closeQuit()
+			continue
 		}
 		client.Logger.Printf(log.HighVerbose, "writing data of piece %d/%d \n", result.Index, len(client.Pieces))
 		// time.Sleep(time.Duration(rand.Intn(1e3)) * time.Microsecond) // Simulate download time
 		// startTime := time.Now()
-		pieceDefaultSize := client.PieceLength
-		bytesWritten, err := file.WriteAt(result.Payload, int64(result.Index*pieceDefaultSize))
+		bytesWritten, err := store.WriteAt(result.Payload, result.Index, 0)
+		if err == nil {
+			err = store.MarkComplete(result.Index)
+		}
 		// ellapsedTime := time.Since(startTime)
 		// wp.logger.Printf("writing piece data took %dms\n", ellapsedTime.Milliseconds())
 		if err != nil || bytesWritten != len(result.Payload) {
 			client.Logger.Printf(log.LowVerbose, "failed to write piece data, aborting torrent : %s\n", err)
-			close(quit)
-			return
+			client.Picker.Return(result.Index)
+			closeQuit()
+			continue
 		}
 		// client.completedMu.Lock()
 		client.DownloadedPieces[result.Index] = true
-		downloadIsCompleted := true
-		completedCount := 0
-		for _, pieceIsCompleted := range client.DownloadedPieces {
-			downloadIsCompleted = downloadIsCompleted && pieceIsCompleted
-			if pieceIsCompleted {
-				completedCount += 1
-			}
-		}
+		client.Picker.Done(result.Index)
+		client.banSenders(result)
+		client.downloaded.Add(int64(len(result.Payload)))
+		// Skipped pieces don't count
+		completedCount, wantedCount := client.Picker.Progress()
+		downloadIsCompleted := completedCount == wantedCount
 		// client.completedMu.Unlock()
-		percentageComplete := completedCount * 100 / len(client.DownloadedPieces)
-		// wp.logger.Printf(log.LowVerbose,"download %d %% complete", percentageComplete)
-		client.Logger.ProgressSimple(percentageComplete)
 		if downloadIsCompleted {
-			close(quit)
-			return
+			closeQuit()
+		} else if completedCount%resumeInterval == 0 {
+			client.saveResumeData()
 		}
 	}
 
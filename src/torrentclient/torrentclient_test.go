@@ -0,0 +1,936 @@
+package torrentclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/ipfilter"
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/message"
+	pr "github.com/samir-adh/bytetorrent/src/peerconnection"
+	"github.com/samir-adh/bytetorrent/src/picker"
+	pc "github.com/samir-adh/bytetorrent/src/piece"
+	"github.com/samir-adh/bytetorrent/src/portmap"
+	"github.com/samir-adh/bytetorrent/src/proxy"
+	"github.com/samir-adh/bytetorrent/src/ratelimit"
+	"github.com/samir-adh/bytetorrent/src/storage"
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+	tr "github.com/samir-adh/bytetorrent/src/tracker"
+)
+
+// generateTorrent returns a single file torrent of data with no tracker
+// and a web seed at seedUrl.
+func generateTorrent(data []byte, pieceLength int, seedUrl string) *torrentfile.TorrentFile {
+	tor := &torrentfile.TorrentFile{
+		Name:        "data.bin",
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Files:       []torrentfile.File{{Path: []string{"data.bin"}, Length: len(data)}},
+		UrlList:     []string{seedUrl},
+	}
+	for start := 0; start < len(data); start += pieceLength {
+		tor.PiecesHash = append(tor.PiecesHash, sha1.Sum(data[start:min(start+pieceLength, len(data))]))
+	}
+	return tor
+}
+
+var testTime = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestDownloadToMemory(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", testTime, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	tor := generateTorrent(data, 16384, server.URL)
+	client, err := NewFromTorrent(tor, Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	memory := storage.NewMemory(tor)
+	client.Storage = memory
+	if err := client.Download(); err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	if !bytes.Equal(memory.Bytes(), data) {
+		t.Errorf("downloaded data differs from the seeded data")
+	}
+	stats := client.Stats()
+	if stats.Downloaded != int64(len(data)) || stats.Received != int64(len(data)) || stats.Completed != stats.Wanted || stats.Wasted != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	tor := generateTorrent(data, 16, "http://localhost")
+	tor.MultiFile = true
+	tor.Files = []torrentfile.File{
+		{Path: []string{"a.txt"}, Length: 40, Offset: 0},
+		{Path: []string{"sub", "b.mkv"}, Length: 60, Offset: 40},
+	}
+	client, err := NewFromTorrent(tor, Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	selected, err := client.SelectFiles([]string{"*.mkv"})
+	if err != nil || selected != 1 {
+		t.Fatalf("expected one selected file, got %d (%v)", selected, err)
+	}
+	// Piece 2 covers bytes 32 to 48 and is shared by both files
+	for index, expected := range []picker.Priority{picker.Skip, picker.Skip, picker.Normal, picker.Normal} {
+		if priority := client.Picker.Priority(index); priority != expected {
+			t.Errorf("piece %d has priority %s, expected %s", index, priority, expected)
+		}
+	}
+	client.SetFilePriority(0, picker.High)
+	if priority := client.Picker.Priority(2); priority != picker.High {
+		t.Errorf("shared piece has priority %s, expected %s", priority, picker.High)
+	}
+	priorities := client.FilePriorities()
+	priorities[1] = picker.Skip
+	if priorities := client.FilePriorities(); priorities[0] != picker.High || priorities[1] != picker.Normal {
+		t.Errorf("unexpected file priorities %v", priorities)
+	}
+}
+
+func TestReader(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", testTime, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	tor := generateTorrent(data, 16384, server.URL)
+	client, err := NewFromTorrent(tor, Config{Sequential: true, Readahead: 32768}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	client.Storage = storage.NewMemory(tor)
+	reader, err := client.NewReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- client.Download() }()
+
+	if _, err := reader.Seek(-100, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(tail, data[len(data)-100:]) {
+		t.Fatalf("failed to read the end of the file: %v", err)
+	}
+	reader.Seek(0, io.SeekStart)
+	all, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(all, data) {
+		t.Errorf("read data differs from the seeded data: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("download failed: %s", err)
+	}
+}
+
+func TestReaderWithoutStorage(t *testing.T) {
+	tor := generateTorrent(bytes.Repeat([]byte("0123456789"), 100), 256, "http://localhost")
+	client, err := NewFromTorrent(tor, Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	client.Picker.Done(0)
+	reader, err := client.NewReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Read(make([]byte, 10)); err == nil {
+		t.Errorf("expected reading before the storage is open to fail")
+	}
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 4000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", testTime, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	tor := generateTorrent(data, 4096, server.URL)
+	client, err := NewFromTorrent(tor, Config{DownloadRate: 20000}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	client.Storage = storage.NewMemory(tor)
+	start := time.Now()
+	if err := client.Download(); err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	// The first second worth of bytes goes through right away
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("downloaded %d bytes at 20kB/s in %s", len(data), elapsed)
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T, listener net.Listener) (net.Conn, net.Conn) {
+	t.Helper()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, accepted
+}
+
+func TestInboundPerIPLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	tor := generateTorrent(data, 256, "http://localhost")
+	client, err := NewFromTorrent(tor, Config{MaxPerIP: 1}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	first, firstServed := tcpPair(t, listener)
+	defer first.Close()
+	served := make(chan error, 1)
+	go func() { served <- client.ServeConn(firstServed) }()
+	// The bitfield is sent once the connection got its slot
+	if _, err := message.Read(first); err != nil {
+		t.Fatal(err)
+	}
+
+	second, secondServed := tcpPair(t, listener)
+	defer second.Close()
+	if err := client.ServeConn(secondServed); !errors.Is(err, ErrTooManyConnections) {
+		t.Errorf("expected second connection from the same address to be refused, got %v", err)
+	}
+	first.Close()
+	<-served
+}
+
+func TestInboundPeerStates(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	tor := generateTorrent(data, 256, "http://localhost")
+	client, err := NewFromTorrent(tor, Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, served := tcpPair(t, listener)
+	defer conn.Close()
+	go client.ServeConn(served)
+	if _, err := message.Read(conn); err != nil {
+		t.Fatal(err)
+	}
+	if peers := client.ConnectedPeers(); len(peers) != 1 || !peers[0].AmChoking || peers[0].AmInterested {
+		t.Fatalf("expected the new peer to be choked, got %+v", peers)
+	}
+	interested := message.Message{Id: message.MsgInterested, Length: 1}
+	conn.Write(interested.Serialize())
+	if msg, err := message.Read(conn); err != nil || msg.Id != message.MsgUnchoke {
+		t.Fatalf("expected an unchoke, got %v (%v)", msg, err)
+	}
+	if peers := client.ConnectedPeers(); len(peers) != 1 || peers[0].AmChoking || !peers[0].Interested {
+		t.Errorf("expected the interested peer to be unchoked, got %+v", peers)
+	}
+}
+
+func TestResumeData(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	tor := generateTorrent(data, 1024, "http://localhost")
+	config := Config{DownloadDir: t.TempDir(), ResumeDir: t.TempDir()}
+	client, err := NewFromTorrent(tor, config, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := client.openFileStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Storage = store
+	for _, index := range []int{0, 3} {
+		store.WriteAt(data[index*1024:(index+1)*1024], index, 0)
+		client.Picker.Done(index)
+	}
+	// Claimed but never written, its hash won't match
+	client.Picker.Done(5)
+	client.saveResumeData()
+	store.Close()
+
+	resumed, err := NewFromTorrent(tor, config, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed.Storage, _ = resumed.openFileStorage()
+	defer resumed.Storage.Close()
+	resumed.loadResumeData()
+	for index := range resumed.Pieces {
+		expected := index == 0 || index == 3
+		if resumed.Picker.IsDone(index) != expected {
+			t.Errorf("expected piece %d done to be %v after resuming", index, expected)
+		}
+	}
+}
+
+func TestDownloadContextCanceled(t *testing.T) {
+	events := make(chan string, 2)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if event := r.URL.Query().Get("event"); event != "" {
+			events <- event
+		}
+		// A single peer nothing listens on
+		w.Write([]byte("d8:intervali60e5:peers6:\x7f\x00\x00\x01\x00\x01e"))
+	}))
+	defer tracker.Close()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	tor := generateTorrent(data, 1024, "")
+	tor.UrlList = nil
+	tor.Announce = tracker.URL
+	client, err := NewFromTorrent(tor, Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Storage = storage.NewMemory(tor)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := client.DownloadContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to stop the download, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("download took %s to stop", elapsed)
+	}
+	for _, expected := range []string{"started", "stopped"} {
+		select {
+		case event := <-events:
+			if event != expected {
+				t.Errorf("expected %s event, got %s", expected, event)
+			}
+		default:
+			t.Errorf("tracker wasn't sent the %s event", expected)
+		}
+	}
+}
+
+// poisonedSource claims every piece and sends garbage
+type poisonedSource int
+
+func (s poisonedSource) PieceCount() int    { return int(s) }
+func (s poisonedSource) Has(piece int) bool { return true }
+func (s poisonedSource) ReadBlock(piece, offset, length int) ([]byte, error) {
+	return bytes.Repeat([]byte("x"), length), nil
+}
+func (s poisonedSource) PeerInterested(interested bool) {}
+
+// fakePeer starts a peer uploading source, and sets the announce URL of
+// tor to a tracker returning it
+func fakePeer(t *testing.T, tor *torrentfile.TorrentFile, source pr.Source, logger *log.Logger) *httptest.Server {
+	t.Helper()
+	return fakePeerConn(t, tor, source, logger, func(conn net.Conn) net.Conn { return conn })
+}
+
+// fakePeerConn is fakePeer serving through the connection returned by wrap
+func fakePeerConn(t *testing.T, tor *torrentfile.TorrentFile, source pr.Source, logger *log.Logger, wrap func(net.Conn) net.Conn) *httptest.Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handshake, err := pr.ReadHandShake(conn)
+				if err != nil {
+					return
+				}
+				conn.Write(handshake.Serialize())
+				pr.Serve(wrap(conn), source, ratelimit.Group{}, nil, logger)
+			}()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := string([]byte{127, 0, 0, 1, byte(port >> 8), byte(port)})
+		w.Write([]byte("d8:intervali60e5:peers6:" + peer + "e"))
+	}))
+	tor.Announce = tracker.URL
+	return tracker
+}
+
+func TestSmartBan(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	// The web seed is slow enough for the peer to send bad pieces first
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		http.ServeContent(w, r, "data.bin", testTime, bytes.NewReader(data))
+	}))
+	defer seed.Close()
+	tor := generateTorrent(data, 1024, seed.URL)
+	tracker := fakePeer(t, tor, poisonedSource(len(tor.PiecesHash)), logger)
+	defer tracker.Close()
+
+	client, err := NewFromTorrent(tor, Config{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing answers over uTP
+	client.Dialer.UTPTimeout = time.Millisecond
+	memory := storage.NewMemory(tor)
+	client.Storage = memory
+	if err := client.Download(); err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	if !bytes.Equal(memory.Bytes(), data) {
+		t.Errorf("downloaded data differs from the seeded data")
+	}
+	if !client.Bans.Banned(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("expected the peer that sent bad pieces to be banned")
+	}
+	if stats := client.Stats(); stats.Wasted == 0 || stats.Received < stats.Downloaded+stats.Wasted {
+		t.Errorf("expected the bad pieces to be counted as wasted, got %+v", stats)
+	}
+}
+
+func TestGiveUpOnFailedPiece(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	tor := generateTorrent(data, 1024, "")
+	tor.UrlList = nil
+	tracker := fakePeer(t, tor, poisonedSource(len(tor.PiecesHash)), logger)
+	defer tracker.Close()
+
+	client, err := NewFromTorrent(tor, Config{MaxPieceAttempts: 1}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Dialer.UTPTimeout = time.Millisecond
+	client.Storage = storage.NewMemory(tor)
+	done := make(chan error, 1)
+	go func() { done <- client.Download() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrPieceFailed) {
+			t.Errorf("expected the download to give up on the bad piece, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		client.Stop()
+		t.Fatal("download kept trying the bad piece")
+	}
+	for index := range tor.PiecesHash {
+		if client.smartBan.Sent(index, net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("expected piece %d to be forgotten once given up on", index)
+		}
+	}
+}
+
+func TestGiveUpWithoutOtherPeer(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	tor := generateTorrent(data, 1024, "")
+	tor.UrlList = nil
+	tracker := fakePeer(t, tor, poisonedSource(len(tor.PiecesHash)), logger)
+	defer tracker.Close()
+
+	// The only peer sent bad data, no other can be tried
+	client, err := NewFromTorrent(tor, Config{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Dialer.UTPTimeout = time.Millisecond
+	client.Storage = storage.NewMemory(tor)
+	done := make(chan error, 1)
+	go func() { done <- client.Download() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrPieceFailed) {
+			t.Errorf("expected the download to give up on the bad piece, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		client.Stop()
+		t.Fatal("download waited for a peer to send the bad piece")
+	}
+}
+
+func TestRetriesKeepBlocks(t *testing.T) {
+	r := newRetries(2)
+	piece := &pc.Piece{Index: 3, Length: 3 * pc.BlockLength}
+	first := net.IPv4(10, 0, 0, 1)
+	partial := r.take(piece)
+	before := partial.snapshot()
+	partial.blocks.Received[0] = true
+	partial.received(before, first)
+	r.keep(piece.Index, partial)
+
+	resumed := r.take(piece)
+	if !resumed.blocks.Received[0] || resumed.blocks.Received[1] || !resumed.senders[0].Equal(first) {
+		t.Errorf("expected the first block from %s to be kept", first)
+	}
+	if r.take(piece).blocks.Any() {
+		t.Errorf("expected the kept blocks to be handed out once")
+	}
+
+	// Failures from a same peer count once
+	if r.fail(piece.Index, first) != nil || r.fail(piece.Index, first) != nil {
+		t.Errorf("expected to retry a piece that failed from one peer")
+	}
+	if err := r.fail(piece.Index, net.IPv4(10, 0, 0, 2)); !errors.Is(err, ErrPieceFailed) {
+		t.Errorf("expected to give up after two peers, got %v", err)
+	}
+	r.reset()
+	if r.Err() != nil {
+		t.Errorf("expected a new run to retry the piece")
+	}
+}
+
+// stalledSource claims every piece and never sends any
+type stalledSource chan struct{}
+
+func (s stalledSource) PieceCount() int    { return 10 }
+func (s stalledSource) Has(piece int) bool { return true }
+func (s stalledSource) ReadBlock(piece, offset, length int) ([]byte, error) {
+	<-s
+	return nil, io.EOF
+}
+func (s stalledSource) PeerInterested(interested bool) {}
+
+func TestSnubbedPeer(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		http.ServeContent(w, r, "data.bin", testTime, bytes.NewReader(data))
+	}))
+	defer seed.Close()
+	tor := generateTorrent(data, 1024, seed.URL)
+	stalled := make(stalledSource)
+	defer close(stalled)
+	tracker := fakePeer(t, tor, stalled, logger)
+	defer tracker.Close()
+
+	config := Config{SnubTimeout: 100 * time.Millisecond, IdleTimeout: 300 * time.Millisecond}
+	client, err := NewFromTorrent(tor, config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Dialer.UTPTimeout = time.Millisecond
+	memory := storage.NewMemory(tor)
+	client.Storage = memory
+	done := make(chan error, 1)
+	go func() { done <- client.Download() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		client.Stop()
+		t.Fatal("the piece requested from the stalled peer was never sent by another")
+	}
+	if !bytes.Equal(memory.Bytes(), data) {
+		t.Errorf("downloaded data differs from the seeded data")
+	}
+}
+
+// slowSource sends piece 3 after a delay the first time it is asked for
+type slowSource struct {
+	dataSource
+	delay sync.Once
+}
+
+func (s *slowSource) ReadBlock(piece, offset, length int) ([]byte, error) {
+	if piece == 3 {
+		s.delay.Do(func() { time.Sleep(300 * time.Millisecond) })
+	}
+	return s.dataSource.ReadBlock(piece, offset, length)
+}
+
+func TestSnubbedOnlyPeer(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1024)
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	tor := generateTorrent(data, 1024, "")
+	tor.UrlList = nil
+	tracker := fakePeer(t, tor, &slowSource{dataSource: dataSource{data, 1024}}, logger)
+	defer tracker.Close()
+
+	client, err := NewFromTorrent(tor, Config{SnubTimeout: 100 * time.Millisecond}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Dialer.UTPTimeout = time.Millisecond
+	memory := storage.NewMemory(tor)
+	client.Storage = memory
+	done := make(chan error, 1)
+	go func() { done <- client.Download() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		client.Stop()
+		t.Fatal("the piece the only peer was slow to send was never asked again")
+	}
+	if !bytes.Equal(memory.Bytes(), data) {
+		t.Errorf("downloaded data differs from the seeded data")
+	}
+}
+
+// keepAliveConn sends a keep-alive before every block
+type keepAliveConn struct {
+	net.Conn
+}
+
+func (c keepAliveConn) Write(b []byte) (int, error) {
+	if len(b) > 4 && b[4] == byte(message.MsgPiece) {
+		if _, err := c.Conn.Write([]byte{0, 0, 0, 0}); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+func TestKeepAlive(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	tor := generateTorrent(data, 1024, "")
+	tor.UrlList = nil
+	tracker := fakePeerConn(t, tor, dataSource{data, 1024}, logger, func(conn net.Conn) net.Conn { return keepAliveConn{conn} })
+	defer tracker.Close()
+
+	client, err := NewFromTorrent(tor, Config{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Dialer.UTPTimeout = time.Millisecond
+	memory := storage.NewMemory(tor)
+	client.Storage = memory
+	done := make(chan error, 1)
+	go func() { done <- client.Download() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		client.Stop()
+		t.Fatal("the keep-alives of the only peer stopped the download")
+	}
+	if !bytes.Equal(memory.Bytes(), data) {
+		t.Errorf("downloaded data differs from the seeded data")
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", testTime, bytes.NewReader(data))
+	}))
+	defer seed.Close()
+	tor := generateTorrent(data, 1024, seed.URL)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed := make(chan struct{}, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			dialed <- struct{}{}
+			conn.Close()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := string([]byte{127, 0, 0, 1, byte(port >> 8), byte(port)})
+		w.Write([]byte("d8:intervali60e5:peers6:" + peer + "e"))
+	}))
+	defer tracker.Close()
+	tor.Announce = tracker.URL
+
+	filter := ipfilter.New()
+	filter.SetRanges([]ipfilter.Range{{First: net.IPv4(127, 0, 0, 0), Last: net.IPv4(127, 255, 255, 255)}})
+	client, err := NewFromTorrent(tor, Config{Filter: filter}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Dialer.UTPTimeout = time.Millisecond
+	client.Storage = storage.NewMemory(tor)
+	if err := client.Download(); err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	select {
+	case <-dialed:
+		t.Errorf("expected the filtered peer not to be dialed")
+	default:
+	}
+
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	inbound, served := tcpPair(t, other)
+	defer inbound.Close()
+	if err := client.ServeConn(served); !errors.Is(err, ErrFiltered) {
+		t.Errorf("expected a filtered peer to be refused, got %v", err)
+	}
+}
+
+// dataSource uploads data in pieces of pieceLength
+type dataSource struct {
+	data        []byte
+	pieceLength int
+}
+
+func (s dataSource) PieceCount() int    { return (len(s.data) + s.pieceLength - 1) / s.pieceLength }
+func (s dataSource) Has(piece int) bool { return true }
+func (s dataSource) ReadBlock(piece, offset, length int) ([]byte, error) {
+	start := piece*s.pieceLength + offset
+	return s.data[start : start+length], nil
+}
+func (s dataSource) PeerInterested(interested bool) {}
+
+func TestProxy(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	tor := generateTorrent(data, 1024, "")
+	tor.UrlList = nil
+	tracker := fakePeer(t, tor, dataSource{data, 1024}, logger)
+	defer tracker.Close()
+
+	// A stand-in HTTP proxy forwarding announces and tunneling CONNECT
+	var announces, tunnels atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			announces.Add(1)
+			r.RequestURI = ""
+			response, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer response.Body.Close()
+			io.Copy(w, response.Body)
+			return
+		}
+		tunnels.Add(1)
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		w.WriteHeader(http.StatusOK)
+		conn, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go io.Copy(upstream, buffered)
+		io.Copy(conn, upstream)
+	}))
+	defer server.Close()
+	p, err := proxy.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewFromTorrent(tor, Config{Proxy: p}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Dialer.Socket != nil {
+		t.Errorf("expected uTP to be disabled behind an HTTP proxy")
+	}
+	client.Storage = storage.NewMemory(tor)
+	if err := client.Download(); err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	if announces.Load() == 0 || tunnels.Load() == 0 {
+		t.Errorf("expected the announce and the peer connection to go through the proxy, got %d and %d",
+			announces.Load(), tunnels.Load())
+	}
+}
+
+// fixedGateway maps every port to 7881 on 203.0.113.1
+type fixedGateway struct{}
+
+func (fixedGateway) AddMapping(ctx context.Context, mapping portmap.Mapping) (portmap.Mapping, error) {
+	mapping.External = 7881
+	mapping.ExternalIP = net.IPv4(203, 0, 113, 1)
+	return mapping, nil
+}
+func (fixedGateway) DeleteMapping(ctx context.Context, mapping portmap.Mapping) error { return nil }
+
+func TestAnnounceMappedPort(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", testTime, bytes.NewReader(data))
+	}))
+	defer seed.Close()
+	tor := generateTorrent(data, 1024, seed.URL)
+	announced := make(chan string, 4)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announced <- r.URL.Query().Get("ip") + ":" + r.URL.Query().Get("port")
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	tor.Announce = tracker.URL
+
+	mapper := portmap.New(6881, logger)
+	mapper.Gateways = []portmap.Gateway{fixedGateway{}}
+	mapper.Start()
+	defer mapper.Close()
+	client, err := NewFromTorrent(tor, Config{PortMap: mapper}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.announceStarted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if address := <-announced; address != "203.0.113.1:7881" {
+		t.Errorf("expected the mapped address to be announced, got %s", address)
+	}
+}
+
+// slowGateway maps ports like fixedGateway once release is closed
+type slowGateway struct {
+	fixedGateway
+	release chan struct{}
+}
+
+func (g slowGateway) AddMapping(ctx context.Context, mapping portmap.Mapping) (portmap.Mapping, error) {
+	select {
+	case <-g.release:
+	case <-ctx.Done():
+		return mapping, ctx.Err()
+	}
+	return g.fixedGateway.AddMapping(ctx, mapping)
+}
+
+func TestAnnounceLateMapping(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	tor := generateTorrent(data, 1024, "")
+	announced := make(chan string, 4)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announced <- r.URL.Query().Get("ip") + ":" + r.URL.Query().Get("port")
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	tor.Announce = tracker.URL
+
+	release := make(chan struct{})
+	mapper := portmap.New(6881, logger)
+	mapper.Gateways = []portmap.Gateway{slowGateway{release: release}}
+	mapper.Start()
+	defer mapper.Close()
+	client, err := NewFromTorrent(tor, Config{PortMap: mapper}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.announceStarted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if address := <-announced; address != ":6881" {
+		t.Errorf("expected the local port to be announced first, got %s", address)
+	}
+	close(release)
+	select {
+	case address := <-announced:
+		if address != "203.0.113.1:7881" {
+			t.Errorf("expected the mapped address to be announced, got %s", address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mapped address wasn't announced")
+	}
+}
+
+func TestReannounce(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	tor := generateTorrent(data, 1024, "")
+	events := make(chan string, 8)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		w.Write([]byte("d8:intervali1e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	tor.Announce = tracker.URL
+
+	client, err := NewFromTorrent(tor, Config{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	select {
+	case event := <-events:
+		t.Fatalf("expected nothing to be announced before the torrent starts, got %q", event)
+	default:
+	}
+	if err := client.announceStarted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event != tr.EventStarted {
+		t.Errorf("expected started first, got %q", event)
+	}
+	select {
+	case event := <-events:
+		if event != tr.EventNone {
+			t.Errorf("expected a regular announce, got %q", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the torrent wasn't announced again after the interval")
+	}
+	// A resumed torrent asks for fresh peers
+	if err := client.announceStarted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event != tr.EventNone {
+		t.Errorf("expected a regular announce on resume, got %q", event)
+	}
+	client.AnnounceStopped()
+	client.announcing.Wait()
+	if event := <-events; event != tr.EventStopped {
+		t.Errorf("expected stopped, got %q", event)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	select {
+	case event := <-events:
+		t.Errorf("expected no announce once stopped, got %q", event)
+	default:
+	}
+}
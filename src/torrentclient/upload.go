@@ -0,0 +1,131 @@
+package torrentclient
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	pr "github.com/samir-adh/bytetorrent/src/peerconnection"
+	"github.com/samir-adh/bytetorrent/src/storage"
+)
+
+// ServeConn uploads the downloaded pieces to a peer that connected to us,
+// once the handshakes were exchanged. It returns when the connection
+// closes, or ErrTooManyConnections if the peer can't get a slot.
+func (client *TorrentClient) ServeConn(conn net.Conn) error {
+	return client.ServePeer(conn, [20]byte{})
+}
+
+// ServePeer is ServeConn for a peer that sent peerId in its handshake
+func (client *TorrentClient) ServePeer(conn net.Conn, peerId [20]byte) error {
+	release, err := client.acquireInbound(conn)
+	if err != nil {
+		return err
+	}
+	defer release()
+	peer := &connectedPeer{address: conn.RemoteAddr().String(), inbound: true, id: peerId, uploaded: client.uploaded.Child()}
+	defer client.addPeer(peer)()
+	_, uploadLimit, releaseLimits := client.Limits.forPeer()
+	defer releaseLimits()
+	// Super seeding is meant for the initial seeder only
+	var superSeed *pr.SuperSeed
+	if client.superSeed != nil && client.hasAll() {
+		superSeed = client.superSeed
+	}
+	return pr.Serve(conn, &inboundSource{client, peer}, uploadLimit, superSeed, client.Logger)
+}
+
+// inboundSource is the torrent served to an inbound peer, keeping track
+// of what the peer gets
+type inboundSource struct {
+	*TorrentClient
+	peer *connectedPeer
+}
+
+func (source *inboundSource) ReadBlock(piece int, offset int, length int) ([]byte, error) {
+	block, err := source.readBlock(piece, offset, length)
+	if err == nil {
+		source.peer.uploaded.Add(int64(length))
+	}
+	return block, err
+}
+
+// PeerInterested also follows the choke state, Serve unchokes the peers
+// interested and only them
+func (source *inboundSource) PeerInterested(interested bool) {
+	source.peer.interested.Store(interested)
+	source.peer.unchoked.Store(interested)
+	source.TorrentClient.PeerInterested(interested)
+}
+
+func (client *TorrentClient) PieceCount() int {
+	return len(client.Pieces)
+}
+
+// Has reports whether the piece was downloaded and verified
+func (client *TorrentClient) Has(piece int) bool {
+	return client.Picker.IsDone(piece)
+}
+
+func (client *TorrentClient) ReadBlock(piece int, offset int, length int) ([]byte, error) {
+	block, err := client.readBlock(piece, offset, length)
+	if err == nil {
+		client.uploaded.Add(int64(length))
+	}
+	return block, err
+}
+
+// readBlock is ReadBlock without counting the block as uploaded
+func (client *TorrentClient) readBlock(piece int, offset int, length int) ([]byte, error) {
+	if offset < 0 || length <= 0 || offset+length > client.Pieces[piece].Length {
+		return nil, fmt.Errorf("block at %d of %d bytes is out of piece %d", offset, length, piece)
+	}
+	store := client.storage()
+	if store == nil {
+		return nil, fmt.Errorf("storage of %s isn't open", client.FileName)
+	}
+	block := make([]byte, length)
+	if _, err := store.ReadAt(block, piece, offset); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// hasAll reports whether every piece, wanted or not, was downloaded
+func (client *TorrentClient) hasAll() bool {
+	for i := range client.Pieces {
+		if !client.Picker.IsDone(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// PeerInterested counts the inbound peers interested in our pieces
+func (client *TorrentClient) PeerInterested(interested bool) {
+	client.interestMu.Lock()
+	defer client.interestMu.Unlock()
+	if interested {
+		client.interestedPeers++
+		return
+	}
+	client.interestedPeers--
+	if client.interestedPeers == 0 {
+		client.idleSince = time.Now()
+	}
+}
+
+// Idle reports whether no peer is interested in our pieces, and since
+// when. The time is zero if no peer ever was.
+func (client *TorrentClient) Idle() (since time.Time, idle bool) {
+	client.interestMu.Lock()
+	defer client.interestMu.Unlock()
+	return client.idleSince, client.interestedPeers == 0
+}
+
+// storage returns the storage Download writes to, nil before it starts
+func (client *TorrentClient) storage() storage.Storage {
+	client.runMu.Lock()
+	defer client.runMu.Unlock()
+	return client.Storage
+}
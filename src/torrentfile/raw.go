@@ -0,0 +1,82 @@
+package torrentfile
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// rawInfo returns the bencoded info dictionary of a .torrent file
+// exactly as it appears in data.
+func rawInfo(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("torrent file is not a dictionary")
+	}
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		key, valueStart, err := readString(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		valueEnd, err := skipValue(data, valueStart)
+		if err != nil {
+			return nil, err
+		}
+		if key == "info" {
+			return data[valueStart:valueEnd], nil
+		}
+		pos = valueEnd
+	}
+	return nil, fmt.Errorf("no info dictionary found")
+}
+
+// readString decodes the byte string starting at pos and returns it
+// along with the position following it.
+func readString(data []byte, pos int) (string, int, error) {
+	colon := bytes.IndexByte(data[pos:], ':')
+	if colon < 0 {
+		return "", 0, fmt.Errorf("invalid string at offset %d", pos)
+	}
+	length, err := strconv.Atoi(string(data[pos : pos+colon]))
+	if err != nil || length < 0 {
+		return "", 0, fmt.Errorf("invalid string length at offset %d", pos)
+	}
+	start := pos + colon + 1
+	if start+length > len(data) {
+		return "", 0, fmt.Errorf("truncated string at offset %d", pos)
+	}
+	return string(data[start : start+length]), start + length, nil
+}
+
+// skipValue returns the position following the value starting at pos
+func skipValue(data []byte, pos int) (int, error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated integer at offset %d", pos)
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			var err error
+			pos, err = skipValue(data, pos)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if pos >= len(data) {
+			return 0, fmt.Errorf("unterminated list or dictionary")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		_, end, err := readString(data, pos)
+		return end, err
+	default:
+		return 0, fmt.Errorf("invalid bencode value at offset %d", pos)
+	}
+}
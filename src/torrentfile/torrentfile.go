@@ -3,19 +3,30 @@ package torrentfile
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/jackpal/bencode-go"
+	pc "github.com/samir-adh/bytetorrent/src/piece"
 	"github.com/ztrue/tracerr"
 )
 
 type BencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length"`
+	Name        string        `bencode:"name"`
+	Files       []BencodeFile `bencode:"files,omitempty"`
+	MetaVersion int           `bencode:"meta version,omitempty"`
+}
+
+type BencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Attr   string   `bencode:"attr,omitempty"`
 }
 
 type BencodeTorrent struct {
@@ -34,12 +45,36 @@ func Open(r io.Reader) (*BencodeTorrent, error) {
 }
 
 type TorrentFile struct {
-	Announce    string     // the URL of the tracker
-	InfoHash    [20]byte   // sha1 hash of the torrent file
-	PiecesHash  [][20]byte // a hash list, i.e., a concatenation of each piece's SHA-1 hash.
-	PieceLength int        // number of bytes per piece. This is commonly 2^8 KiB = 256 KiB = 262,144 B.
-	Length      int        // size of the file in bytes
-	Name        string     // suggested filename where the file is to be saved.
+	Announce     string      // the URL of the tracker
+	InfoHash     [20]byte    // sha1 hash of the torrent file, the truncated v2 hash for pure v2 torrents
+	InfoHashV2   [32]byte    // sha256 hash of the info dictionary of v2 and hybrid torrents
+	MetaVersion  int         // 2 for v2 and hybrid torrents, 1 otherwise
+	PiecesHash   [][20]byte  // a hash list, i.e., a concatenation of each piece's SHA-1 hash.
+	PiecesHashV2 []pc.HashV2 // merkle roots of the pieces of v2 and hybrid torrents
+	PieceLength  int         // number of bytes per piece. This is commonly 2^8 KiB = 256 KiB = 262,144 B.
+	Length       int         // size of the file in bytes, the sum of all files for multi-file torrents
+	Name         string      // suggested filename where the file is to be saved.
+	MultiFile    bool        // whether the files are stored in a directory called Name
+	Files        []File      // files of the torrent, a single one named Name for single-file torrents
+	UrlList      []string    // web seeds serving the files (BEP 19)
+	HttpSeeds    []string    // web seeds serving pieces (BEP 17)
+}
+
+// File is a file of the torrent, the torrent data being the
+// concatenation of all its files.
+type File struct {
+	Path       []string // path components relative to the torrent directory
+	Length     int
+	Offset     int      // position of the first byte of the file in the torrent data
+	Padding    bool     // pad files align the files of hybrid torrents on pieces and aren't stored
+	PiecesRoot [32]byte // root of the merkle tree of the file in v2 torrents
+}
+
+// FileRange is the part of a file covered by a span of the torrent data
+type FileRange struct {
+	Index  int // index of the file in Files
+	Start  int // offset of the first byte in the file
+	Length int
 }
 
 // Computes the info hash of the torrent
@@ -72,10 +107,8 @@ func (bto BencodeTorrent) ToTorrentFile() (TorrentFile, error) {
 	var tor TorrentFile
 	if bto.Announce != "" {
 		tor.Announce = bto.Announce
-	} else if len(bto.AnnounceList) > 0 {
+	} else if len(bto.AnnounceList) > 0 && len(bto.AnnounceList[0]) > 0 {
 		tor.Announce = bto.AnnounceList[0][0]
-	} else {
-		return tor, fmt.Errorf("no announce or announce-list found")
 	}
 	var err error
 	tor.InfoHash, err = bto.InfoHash()
@@ -87,19 +120,40 @@ func (bto BencodeTorrent) ToTorrentFile() (TorrentFile, error) {
 		return tor, tracerr.Wrap(err)
 	}
 	tor.PieceLength = bto.Info.PieceLength
-	tor.Length = bto.Info.Length
 	tor.Name = bto.Info.Name
+	if len(bto.Info.Files) == 0 {
+		tor.Length = bto.Info.Length
+		tor.Files = []File{{Path: []string{bto.Info.Name}, Length: bto.Info.Length}}
+		return tor, nil
+	}
+	tor.MultiFile = true
+	for _, file := range bto.Info.Files {
+		if len(file.Path) == 0 {
+			return tor, fmt.Errorf("file with an empty path in %s", bto.Info.Name)
+		}
+		tor.Files = append(tor.Files, File{
+			Path:    file.Path,
+			Length:  file.Length,
+			Offset:  tor.Length,
+			Padding: strings.Contains(file.Attr, "p"),
+		})
+		tor.Length += file.Length
+	}
 	return tor, nil
 }
 
 func OpenTorrentFile(filepath string) (*TorrentFile, error) {
-	file, err := os.Open(filepath)
+	data, err := os.ReadFile(filepath)
 	if err != nil {
 		return nil, tracerr.Wrap(err)
 	}
-	defer file.Close()
+	return Parse(data)
+}
+
+// Parse decodes the content of a .torrent file
+func Parse(data []byte) (*TorrentFile, error) {
 	var bt BencodeTorrent
-	err = bencode.Unmarshal(file, &bt)
+	err := bencode.Unmarshal(bytes.NewReader(data), &bt)
 	if err != nil {
 		return nil, tracerr.Wrap(err)
 	}
@@ -107,9 +161,62 @@ func OpenTorrentFile(filepath string) (*TorrentFile, error) {
 	if err != nil {
 		return nil, tracerr.Wrap(err)
 	}
+	// Hash the info dictionary as it appears in the file, re-encoding
+	// BencodeInfo would drop the keys we don't decode
+	info, err := rawInfo(data)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	tf.InfoHash = sha1.Sum(info)
+	tf.MetaVersion = 1
+
+	// url-list is either a single string or a list of strings, which the
+	// struct decoder can't express
+	meta, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	dict, ok := meta.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("torrent file is not a dictionary")
+	}
+	tf.UrlList = stringList(dict["url-list"])
+	tf.HttpSeeds = stringList(dict["httpseeds"])
+	switch bt.Info.MetaVersion {
+	case 0, 1:
+	case 2:
+		tf.MetaVersion = 2
+		tf.InfoHashV2 = sha256.Sum256(info)
+		if err := tf.parseV2(dict); err != nil {
+			return nil, tracerr.Wrap(err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported meta version %d", bt.Info.MetaVersion)
+	}
+	if tf.Announce == "" && len(tf.UrlList) == 0 && len(tf.HttpSeeds) == 0 {
+		return nil, fmt.Errorf("no announce, announce-list or web seed found")
+	}
 	return &tf, nil
 }
 
+// stringList returns the non empty strings of a bencoded string or list
+func stringList(value any) []string {
+	var list []string
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			list = append(list, v)
+		}
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
 func (tf *TorrentFile) getPieceBounds(index int) (int, int) {
 	start := tf.PieceLength * index
 	end := start + tf.PieceLength
@@ -121,6 +228,38 @@ func (tf *TorrentFile) getPieceBounds(index int) (int, int) {
 }
 
 func (tf *TorrentFile) GetPieceLength(index int) int {
+	// Pieces of pure v2 torrents stop at the end of their file
+	if len(tf.PiecesHash) == 0 && index < len(tf.PiecesHashV2) {
+		return tf.PiecesHashV2[index].Length
+	}
 	start, end := tf.getPieceBounds(index)
 	return end - start
 }
+
+// FileRanges maps the bytes [start, end) of the torrent data onto its files
+func (tf *TorrentFile) FileRanges(start, end int) []FileRange {
+	var ranges []FileRange
+	for i, file := range tf.Files {
+		fileEnd := file.Offset + file.Length
+		if fileEnd <= start || file.Length == 0 {
+			continue
+		}
+		if file.Offset >= end {
+			break
+		}
+		from := max(start, file.Offset)
+		to := min(end, fileEnd)
+		ranges = append(ranges, FileRange{
+			Index:  i,
+			Start:  from - file.Offset,
+			Length: to - from,
+		})
+	}
+	return ranges
+}
+
+// PieceFileRanges returns the file ranges covered by the piece at index
+func (tf *TorrentFile) PieceFileRanges(index int) []FileRange {
+	start, end := tf.getPieceBounds(index)
+	return tf.FileRanges(start, end)
+}
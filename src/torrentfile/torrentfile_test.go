@@ -1,8 +1,15 @@
 package torrentfile
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"fmt"
+	"strings"
 	"testing"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/samir-adh/bytetorrent/src/merkle"
+	pc "github.com/samir-adh/bytetorrent/src/piece"
 )
 
 var testBencodeTorrent = BencodeTorrent{
@@ -61,3 +68,146 @@ func assertEqual(t *testing.T, got, want string) {
 		t.Errorf("got: %s, expected: %s", got, want)
 	}
 }
+
+func TestParseMultiFile(t *testing.T) {
+	info := "d5:filesld6:lengthi3e4:pathl5:a.txteed6:lengthi5e4:pathl3:dir5:b.txteee" +
+		"4:name4:test12:piece lengthi4e6:pieces40:0123456789012345678901234567890123456789" +
+		"7:privatei1ee"
+	data := "d8:url-list19:http://example.com/4:info" + info + "e"
+	tf, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("failed to parse torrent: %s", err)
+	}
+	assertEqual(t, fmt.Sprintf("%x", tf.InfoHash), fmt.Sprintf("%x", sha1.Sum([]byte(info))))
+	if !tf.MultiFile || len(tf.Files) != 2 || tf.Length != 8 {
+		t.Fatalf("expected 2 files totalling 8 bytes, got %+v", tf.Files)
+	}
+	assertEqual(t, strings.Join(tf.Files[1].Path, "/"), "dir/b.txt")
+	if tf.Files[1].Offset != 3 {
+		t.Errorf("expected second file at offset 3, got %d", tf.Files[1].Offset)
+	}
+	if len(tf.UrlList) != 1 {
+		t.Fatalf("expected one web seed, got %v", tf.UrlList)
+	}
+	assertEqual(t, tf.UrlList[0], "http://example.com/")
+
+	ranges := tf.PieceFileRanges(0)
+	expected := []FileRange{{Index: 0, Start: 0, Length: 3}, {Index: 1, Start: 0, Length: 1}}
+	if len(ranges) != len(expected) {
+		t.Fatalf("got ranges %+v, expected %+v", ranges, expected)
+	}
+	for i := range ranges {
+		if ranges[i] != expected[i] {
+			t.Errorf("got range %+v, expected %+v", ranges[i], expected[i])
+		}
+	}
+}
+
+// generateV2Torrent bencodes a torrent with a two pieces file and a small
+// one, adding a v1 file list with a pad file when hybrid is set.
+func generateV2Torrent(t *testing.T, hybrid bool) ([]byte, []byte, []byte) {
+	t.Helper()
+	pieceLength := 2 * merkle.BlockSize
+	big := bytes.Repeat([]byte("big"), 15000)
+	small := []byte("small file")
+
+	blocks := merkle.BlockHashes(big)
+	firstPiece := merkle.Root(blocks[:2], 2, [32]byte{})
+	secondPiece := merkle.Root(blocks[2:], 2, [32]byte{})
+	bigRoot := merkle.Root([][32]byte{firstPiece, secondPiece}, 2, merkle.PadHash(2))
+	smallRoot := merkle.PieceRoot(small, 1)
+
+	info := map[string]any{
+		"name":         "v2",
+		"piece length": pieceLength,
+		"meta version": 2,
+		"file tree": map[string]any{
+			"big.bin":   map[string]any{"": map[string]any{"length": len(big), "pieces root": string(bigRoot[:])}},
+			"small.txt": map[string]any{"": map[string]any{"length": len(small), "pieces root": string(smallRoot[:])}},
+		},
+	}
+	if hybrid {
+		padding := 2*pieceLength - len(big)
+		data := append(append(bytes.Clone(big), make([]byte, padding)...), small...)
+		var pieces []byte
+		for start := 0; start < len(data); start += pieceLength {
+			hash := sha1.Sum(data[start:min(start+pieceLength, len(data))])
+			pieces = append(pieces, hash[:]...)
+		}
+		info["pieces"] = string(pieces)
+		info["files"] = []any{
+			map[string]any{"length": len(big), "path": []any{"big.bin"}},
+			map[string]any{"length": padding, "path": []any{".pad", fmt.Sprint(padding)}, "attr": "p"},
+			map[string]any{"length": len(small), "path": []any{"small.txt"}},
+		}
+	}
+	torrent := map[string]any{
+		"announce": "http://tracker",
+		"info":     info,
+		"piece layers": map[string]any{
+			string(bigRoot[:]): string(firstPiece[:]) + string(secondPiece[:]),
+		},
+	}
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, torrent); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), big, small
+}
+
+func checkPiece(t *testing.T, tf *TorrentFile, index int, data []byte) {
+	t.Helper()
+	piece := pc.Piece{Index: index, Length: tf.GetPieceLength(index), HashV2: &tf.PiecesHashV2[index]}
+	if index < len(tf.PiecesHash) {
+		piece.Hash = tf.PiecesHash[index]
+	}
+	if !piece.Verify(data) {
+		t.Errorf("piece %d failed verification", index)
+	}
+	corrupted := bytes.Clone(data)
+	corrupted[0]++
+	if piece.Verify(corrupted) {
+		t.Errorf("corrupted piece %d passed verification", index)
+	}
+}
+
+func TestParseV2(t *testing.T) {
+	data, big, small := generateV2Torrent(t, false)
+	tf, err := Parse(data)
+	if err != nil {
+		t.Fatalf("failed to parse v2 torrent: %s", err)
+	}
+	if tf.MetaVersion != 2 || tf.IsHybrid() {
+		t.Errorf("expected a pure v2 torrent")
+	}
+	if !bytes.Equal(tf.InfoHash[:], tf.InfoHashV2[:20]) {
+		t.Errorf("expected the truncated v2 info hash, got %x", tf.InfoHash)
+	}
+	if tf.PieceCount() != 3 {
+		t.Fatalf("expected 3 pieces, got %d", tf.PieceCount())
+	}
+	if tf.Files[1].Offset != 2*tf.PieceLength {
+		t.Errorf("expected small file aligned on piece 2, got offset %d", tf.Files[1].Offset)
+	}
+	checkPiece(t, tf, 0, big[:tf.PieceLength])
+	checkPiece(t, tf, 1, big[tf.PieceLength:])
+	checkPiece(t, tf, 2, small)
+}
+
+func TestParseHybrid(t *testing.T) {
+	data, big, small := generateV2Torrent(t, true)
+	tf, err := Parse(data)
+	if err != nil {
+		t.Fatalf("failed to parse hybrid torrent: %s", err)
+	}
+	if !tf.IsHybrid() {
+		t.Errorf("expected a hybrid torrent")
+	}
+	if !tf.Files[1].Padding {
+		t.Errorf("expected the second file to be padding")
+	}
+	padded := append(bytes.Clone(big[tf.PieceLength:]), make([]byte, 2*tf.PieceLength-len(big))...)
+	checkPiece(t, tf, 0, big[:tf.PieceLength])
+	checkPiece(t, tf, 1, padded)
+	checkPiece(t, tf, 2, small)
+}
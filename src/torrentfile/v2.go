@@ -0,0 +1,180 @@
+package torrentfile
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/samir-adh/bytetorrent/src/merkle"
+	pc "github.com/samir-adh/bytetorrent/src/piece"
+)
+
+// PieceCount returns the number of pieces of the torrent
+func (tf *TorrentFile) PieceCount() int {
+	if len(tf.PiecesHash) > 0 {
+		return len(tf.PiecesHash)
+	}
+	return len(tf.PiecesHashV2)
+}
+
+// IsHybrid reports whether the torrent can be downloaded by v1 and v2 clients
+func (tf *TorrentFile) IsHybrid() bool {
+	return tf.MetaVersion == 2 && len(tf.PiecesHash) > 0
+}
+
+// parseV2 reads the file tree and piece layers of a v2 or hybrid torrent
+// (BEP 52). Hybrid torrents keep the layout of their v1 file list, whose
+// pad files align every file on a piece boundary like v2 does.
+func (tf *TorrentFile) parseV2(meta map[string]any) error {
+	info, _ := meta["info"].(map[string]any)
+	tree, ok := info["file tree"].(map[string]any)
+	if !ok {
+		return fmt.Errorf("v2 torrent without a file tree")
+	}
+	if tf.PieceLength < merkle.BlockSize || tf.PieceLength&(tf.PieceLength-1) != 0 {
+		return fmt.Errorf("invalid v2 piece length %d", tf.PieceLength)
+	}
+	var files []File
+	if err := walkFileTree(tree, nil, &files); err != nil {
+		return err
+	}
+
+	if len(tf.PiecesHash) > 0 {
+		if err := tf.matchV1Files(files); err != nil {
+			return err
+		}
+	} else {
+		tf.layoutV2Files(files)
+		copy(tf.InfoHash[:], tf.InfoHashV2[:20])
+	}
+
+	layers, _ := meta["piece layers"].(map[string]any)
+	return tf.readPieceLayers(layers)
+}
+
+// walkFileTree collects the files of a file tree in order, a file being a
+// dictionary with an empty key.
+func walkFileTree(node map[string]any, path []string, files *[]File) error {
+	keys := make([]string, 0, len(node))
+	for key := range node {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		child, ok := node[key].(map[string]any)
+		if !ok {
+			return fmt.Errorf("invalid file tree entry %q", key)
+		}
+		if key != "" {
+			if err := walkFileTree(child, append(path, key), files); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(path) == 0 {
+			return fmt.Errorf("file tree has a file without a name")
+		}
+		length, _ := child["length"].(int64)
+		root, _ := child["pieces root"].(string)
+		if length > 0 && len(root) != 32 {
+			return fmt.Errorf("file %s has no pieces root", strings.Join(path, "/"))
+		}
+		file := File{Path: slices.Clone(path), Length: int(length)}
+		copy(file.PiecesRoot[:], root)
+		*files = append(*files, file)
+	}
+	return nil
+}
+
+// matchV1Files attaches the pieces roots of the v2 file tree to the v1
+// file list of a hybrid torrent.
+func (tf *TorrentFile) matchV1Files(files []File) error {
+	v2Files := make(map[string]File, len(files))
+	for _, file := range files {
+		v2Files[strings.Join(file.Path, "/")] = file
+	}
+	for i := range tf.Files {
+		file := &tf.Files[i]
+		if file.Padding || file.Length == 0 {
+			continue
+		}
+		path := strings.Join(file.Path, "/")
+		v2File, ok := v2Files[path]
+		if !ok || v2File.Length != file.Length {
+			return fmt.Errorf("file %s differs between the v1 and v2 metadata", path)
+		}
+		if file.Offset%tf.PieceLength != 0 {
+			return fmt.Errorf("file %s isn't aligned on a piece", path)
+		}
+		file.PiecesRoot = v2File.PiecesRoot
+	}
+	return nil
+}
+
+// layoutV2Files places every file on a piece boundary
+func (tf *TorrentFile) layoutV2Files(files []File) {
+	tf.Files = files
+	tf.MultiFile = len(files) != 1 || len(files[0].Path) != 1
+	tf.Length = 0
+	offset := 0
+	for i := range tf.Files {
+		tf.Files[i].Offset = offset
+		if tf.Files[i].Length == 0 {
+			continue
+		}
+		tf.Length = offset + tf.Files[i].Length
+		pieces := (tf.Files[i].Length + tf.PieceLength - 1) / tf.PieceLength
+		offset += pieces * tf.PieceLength
+	}
+}
+
+// readPieceLayers builds the merkle root of every piece from the piece
+// layers, checking each layer against the pieces root of its file.
+func (tf *TorrentFile) readPieceLayers(layers map[string]any) error {
+	pieceCount := len(tf.PiecesHash)
+	if pieceCount == 0 {
+		pieceCount = (tf.Length + tf.PieceLength - 1) / tf.PieceLength
+	}
+	tf.PiecesHashV2 = make([]pc.HashV2, pieceCount)
+	leavesPerPiece := tf.PieceLength / merkle.BlockSize
+	for _, file := range tf.Files {
+		if file.Padding || file.Length == 0 {
+			continue
+		}
+		first := file.Offset / tf.PieceLength
+		count := (file.Length + tf.PieceLength - 1) / tf.PieceLength
+		if first+count > pieceCount {
+			return fmt.Errorf("file %s extends past the last piece", strings.Join(file.Path, "/"))
+		}
+		if count == 1 {
+			blocks := (file.Length + merkle.BlockSize - 1) / merkle.BlockSize
+			tf.PiecesHashV2[first] = pc.HashV2{
+				Root:   file.PiecesRoot,
+				Leaves: merkle.NextPowerOfTwo(blocks),
+				Length: file.Length,
+			}
+			continue
+		}
+		layer, ok := layers[string(file.PiecesRoot[:])].(string)
+		if !ok || len(layer) != 32*count {
+			return fmt.Errorf("missing piece layer for file %s", strings.Join(file.Path, "/"))
+		}
+		hashes := make([][32]byte, count)
+		for k := range hashes {
+			copy(hashes[k][:], layer[32*k:32*(k+1)])
+		}
+		root := merkle.Root(hashes, merkle.NextPowerOfTwo(count), merkle.PadHash(leavesPerPiece))
+		if root != file.PiecesRoot {
+			return fmt.Errorf("piece layer of file %s doesn't match its pieces root", strings.Join(file.Path, "/"))
+		}
+		for k, hash := range hashes {
+			tf.PiecesHashV2[first+k] = pc.HashV2{
+				Root:   hash,
+				Leaves: leavesPerPiece,
+				Length: min(tf.PieceLength, file.Length-k*tf.PieceLength),
+			}
+		}
+	}
+	return nil
+}
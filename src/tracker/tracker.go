@@ -1,8 +1,10 @@
 package tracker
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 
@@ -48,6 +50,28 @@ func UrlEncodedInfoHash(tor *tf.TorrentFile) (string, error) {
 // Builds the url to send to the tracker in order to receive peers,
 // the 'peerId' argument corresponds to the the id of our client
 func BuildTrackerRequest(tor *tf.TorrentFile, peerId [20]byte, port int) (string, error) {
+	return BuildAnnounceRequest(tor, peerId, port, AnnounceStats{Left: int64(tor.Length)})
+}
+
+// Events sent to the tracker along with the transfer statistics
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventStopped   = "stopped"
+	EventCompleted = "completed"
+)
+
+type AnnounceStats struct {
+	Event      string
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	IP         net.IP // our external address, the tracker uses the source of the request when nil
+}
+
+// BuildAnnounceRequest is BuildTrackerRequest with the statistics of
+// the transfer
+func BuildAnnounceRequest(tor *tf.TorrentFile, peerId [20]byte, port int, stats AnnounceStats) (string, error) {
 	infoHash, err := UrlEncodedInfoHash(tor) // encode the infohash in UTF-8
 	if err != nil {
 		return "", tracerr.Wrap(err)
@@ -56,11 +80,17 @@ func BuildTrackerRequest(tor *tf.TorrentFile, peerId [20]byte, port int) (string
 		"info_hash":  []string{infoHash}, // URL-encode needed!
 		"peer_id":    []string{string(peerId[:])},
 		"port":       []string{fmt.Sprintf("%d", port)},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"left":       []string{fmt.Sprintf("%d", tor.Length)},
+		"uploaded":   []string{fmt.Sprintf("%d", stats.Uploaded)},
+		"downloaded": []string{fmt.Sprintf("%d", stats.Downloaded)},
+		"left":       []string{fmt.Sprintf("%d", stats.Left)},
 		"compact":    []string{"1"}, // request compact peer list
 	}
+	if stats.Event != EventNone {
+		params.Set("event", stats.Event)
+	}
+	if stats.IP != nil {
+		params.Set("ip", stats.IP.String())
+	}
 	urlStr := tor.Announce + "?" + params.Encode()
 	return urlStr, nil
 }
@@ -98,6 +128,49 @@ func FindPeers(fullURL string, client HttpClient) ([]Peer, error) {
 	return peers, nil
 }
 
+// Announce sends the announce request fullURL and returns the interval
+// and peers the tracker answers
+func Announce(ctx context.Context, fullURL string, client *http.Client) (TrackerResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fullURL, nil)
+	if err != nil {
+		return TrackerResponse{}, tracerr.Wrap(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return TrackerResponse{}, tracerr.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return TrackerResponse{}, fmt.Errorf("tracker answered %s", resp.Status)
+	}
+	var tr_response BencondeTrackerResponse
+	if err := bencode.Unmarshal(resp.Body, &tr_response); err != nil {
+		return TrackerResponse{}, tracerr.Wrap(err)
+	}
+	peers, err := ParsePeers([]byte(tr_response.Peers))
+	if err != nil {
+		return TrackerResponse{}, tracerr.Wrap(err)
+	}
+	return TrackerResponse{Interval: tr_response.Interval, Peers: peers}, nil
+}
+
+// SendEvent notifies the tracker of an event, the response is ignored
+func SendEvent(ctx context.Context, fullURL string, client *http.Client) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fullURL, nil)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tracker answered %s", resp.Status)
+	}
+	return nil
+}
+
 func (peer *Peer) AddressToStr() string {
 	return fmt.Sprintf("%d.%d.%d.%d:%d", peer.IpAdress[0], peer.IpAdress[1], peer.IpAdress[2], peer.IpAdress[3], (int(peer.Port[0])<<8)+int(peer.Port[1]))
 
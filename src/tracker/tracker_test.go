@@ -2,8 +2,10 @@ package tracker
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/samir-adh/bytetorrent/src/torrentfile"
@@ -92,3 +94,17 @@ func TestFindPeers(t *testing.T) {
 		assertEqual(t, string(peer.Port[:]), string(peers[i].Port[:]))
 	}
 }
+
+func TestAnnounce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers6:\xc0\xa8\x01\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+	response, err := Announce(context.Background(), server.URL, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Interval != 900 || len(response.Peers) != 1 || response.Peers[0].AddressToStr() != "192.168.1.1:6881" {
+		t.Errorf("unexpected response %+v", response)
+	}
+}
@@ -0,0 +1,293 @@
+package transmission
+
+import (
+	"encoding/hex"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/samir-adh/bytetorrent/src/picker"
+	"github.com/samir-adh/bytetorrent/src/session"
+)
+
+// view is what the fields of a torrent are computed from, read once per
+// request
+type view struct {
+	*session.Torrent
+	id        int
+	position  int
+	state     session.State
+	err       error
+	completed int64
+	download  int
+	upload    int
+	added     int64 // Unix time
+}
+
+func (h *Handler) view(t *session.Torrent, position int) *view {
+	v := &view{
+		Torrent:   t,
+		id:        h.id(t.Client.InfoHash),
+		position:  position,
+		state:     t.State(),
+		err:       t.Err(),
+		completed: t.Client.Completed(),
+	}
+	v.download, v.upload = h.RPC.Speeds(t)
+	h.mu.Lock()
+	v.added = h.added[t.Client.InfoHash].Unix()
+	h.mu.Unlock()
+	return v
+}
+
+func (v *view) status() int {
+	switch v.state {
+	case session.Queued:
+		return StatusDownloadWait
+	case session.Downloading:
+		return StatusDownload
+	case session.Seeding:
+		return StatusSeed
+	default:
+		return StatusStopped
+	}
+}
+
+// stalled reports whether the torrent runs but transfers nothing
+func (v *view) stalled() bool {
+	running := v.state == session.Downloading || v.state == session.Seeding
+	return running && v.download == 0 && v.upload == 0
+}
+
+// wanted returns the size of the files not skipped and the bytes of them
+// that are verified
+func (v *view) wanted() (int64, int64) {
+	client := v.Client
+	completed := client.FilesCompleted()
+	priorities := client.FilePriorities()
+	var size, have int64
+	for i, file := range client.Torrent.Files {
+		if file.Padding || priorities[i] == picker.Skip {
+			continue
+		}
+		size += int64(file.Length)
+		have += completed[i]
+	}
+	return size, have
+}
+
+func (v *view) left() int64 {
+	size, have := v.wanted()
+	return max(size-have, 0)
+}
+
+func (v *view) eta() int64 {
+	left := v.left()
+	switch {
+	case left == 0:
+		return -1
+	case v.download == 0:
+		return -2 // unknown
+	default:
+		return left / int64(v.download)
+	}
+}
+
+func (v *view) fileName(path []string) string {
+	if v.Client.Torrent.MultiFile {
+		path = append([]string{v.Client.Torrent.Name}, path...)
+	}
+	return strings.Join(path, "/")
+}
+
+func (v *view) files() []map[string]any {
+	completed := v.Client.FilesCompleted()
+	files := []map[string]any{}
+	for i, file := range v.Client.Torrent.Files {
+		if !file.Padding {
+			files = append(files, map[string]any{
+				"name":           v.fileName(file.Path),
+				"length":         file.Length,
+				"bytesCompleted": completed[i],
+			})
+		}
+	}
+	return files
+}
+
+func (v *view) fileStats() []map[string]any {
+	completed := v.Client.FilesCompleted()
+	priorities := v.Client.FilePriorities()
+	stats := []map[string]any{}
+	for i, file := range v.Client.Torrent.Files {
+		if file.Padding {
+			continue
+		}
+		priority := priorities[i]
+		stats = append(stats, map[string]any{
+			"bytesCompleted": completed[i],
+			"wanted":         priority != picker.Skip,
+			"priority":       transmissionPriority(priority),
+		})
+	}
+	return stats
+}
+
+// transmissionPriority maps a priority onto -1 for low, 0 for normal and
+// 1 for high
+func transmissionPriority(priority picker.Priority) int {
+	switch priority {
+	case picker.Low:
+		return -1
+	case picker.High:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (v *view) trackers() []map[string]any {
+	trackers := []map[string]any{}
+	if announce := v.Client.Torrent.Announce; announce != "" {
+		host := announce
+		if u, err := url.Parse(announce); err == nil {
+			host = u.Host
+		}
+		trackers = append(trackers, map[string]any{
+			"id":       0,
+			"announce": announce,
+			"scrape":   "",
+			"host":     host,
+			"tier":     0,
+		})
+	}
+	return trackers
+}
+
+func (v *view) peers() []map[string]any {
+	pieceCount := len(v.Client.Pieces)
+	peers := []map[string]any{}
+	for _, peer := range v.Client.ConnectedPeers() {
+		host, portStr, _ := net.SplitHostPort(peer.Address)
+		port, _ := strconv.Atoi(portStr)
+		progress := 0.0
+		if pieceCount > 0 {
+			progress = float64(peer.Pieces) / float64(pieceCount)
+		}
+		peers = append(peers, map[string]any{
+			"address":            host,
+			"port":               port,
+			"clientName":         peer.Client,
+			"clientIsChoked":     peer.Choked,
+			"clientIsInterested": peer.AmInterested,
+			"peerIsChoked":       peer.AmChoking,
+			"peerIsInterested":   peer.Interested,
+			"isIncoming":         peer.Inbound,
+			"isEncrypted":        false,
+			"progress":           progress,
+			"flagStr":            peer.Flags(),
+			"rateToClient":       peer.DownloadRate,
+			"rateToPeer":         peer.UploadRate,
+		})
+	}
+	return peers
+}
+
+func (v *view) magnetLink() string {
+	link := "magnet:?xt=urn:btih:" + hex.EncodeToString(v.Client.InfoHash[:]) +
+		"&dn=" + url.QueryEscape(v.Client.Torrent.Name)
+	if announce := v.Client.Torrent.Announce; announce != "" {
+		link += "&tr=" + url.QueryEscape(announce)
+	}
+	return link
+}
+
+func errorCode(v *view) any {
+	if v.err != nil {
+		return 3 // local error
+	}
+	return 0
+}
+
+func errorString(v *view) any {
+	if v.err != nil {
+		return v.err.Error()
+	}
+	return ""
+}
+
+// torrentFields computes the fields of torrent-get that bytetorrent has,
+// sizes are in bytes and rates in bytes per second
+var torrentFields = map[string]func(v *view) any{
+	"id":                      func(v *view) any { return v.id },
+	"name":                    func(v *view) any { return v.Client.Torrent.Name },
+	"hashString":              func(v *view) any { return hex.EncodeToString(v.Client.InfoHash[:]) },
+	"status":                  func(v *view) any { return v.status() },
+	"error":                   errorCode,
+	"errorString":             errorString,
+	"totalSize":               func(v *view) any { return v.Client.Torrent.Length },
+	"sizeWhenDone":            func(v *view) any { size, _ := v.wanted(); return size },
+	"leftUntilDone":           func(v *view) any { return v.left() },
+	"haveValid":               func(v *view) any { return v.completed },
+	"haveUnchecked":           func(v *view) any { return 0 },
+	"percentDone":             percentDone,
+	"percentComplete":         percentComplete,
+	"downloadedEver":          func(v *view) any { return v.Client.Downloaded() },
+	"uploadedEver":            func(v *view) any { return v.Client.Uploaded() },
+	"uploadRatio":             uploadRatio,
+	"rateDownload":            func(v *view) any { return v.download },
+	"rateUpload":              func(v *view) any { return v.upload },
+	"eta":                     func(v *view) any { return v.eta() },
+	"peersConnected":          func(v *view) any { return len(v.Client.ConnectedPeers()) },
+	"corruptEver":             func(v *view) any { return v.Client.Stats().Wasted },
+	"downloadDir":             func(v *view) any { return v.Client.Config.DownloadDir },
+	"isFinished":              func(v *view) any { return v.state == session.Finished },
+	"isStalled":               func(v *view) any { return v.stalled() },
+	"isPrivate":               func(v *view) any { return false },
+	"addedDate":               func(v *view) any { return v.added },
+	"queuePosition":           func(v *view) any { return v.position },
+	"files":                   func(v *view) any { return v.files() },
+	"fileStats":               func(v *view) any { return v.fileStats() },
+	"trackers":                func(v *view) any { return v.trackers() },
+	"webseeds":                func(v *view) any { return append([]string{}, v.Client.Torrent.UrlList...) },
+	"peers":                   func(v *view) any { return v.peers() },
+	"pieceCount":              func(v *view) any { return len(v.Client.Pieces) },
+	"pieceSize":               func(v *view) any { return v.Client.PieceLength },
+	"pieces":                  func(v *view) any { return v.Client.Bitfield() }, // base64 in JSON
+	"metadataPercentComplete": func(v *view) any { return 1 },
+	"recheckProgress":         func(v *view) any { return 0 },
+	"magnetLink":              func(v *view) any { return v.magnetLink() },
+	"downloadLimit":           func(v *view) any { return v.Client.Limits.Download.Rate() / kilo },
+	"downloadLimited":         func(v *view) any { return v.Client.Limits.Download.Rate() > 0 },
+	"uploadLimit":             func(v *view) any { return v.Client.Limits.Upload.Rate() / kilo },
+	"uploadLimited":           func(v *view) any { return v.Client.Limits.Upload.Rate() > 0 },
+	"honorsSessionLimits":     func(v *view) any { return true },
+	"seedRatioMode":           func(v *view) any { return 0 }, // the session's
+	"comment":                 func(v *view) any { return "" },
+	"creator":                 func(v *view) any { return "" },
+	"dateCreated":             func(v *view) any { return 0 },
+	"labels":                  func(v *view) any { return []string{} },
+}
+
+func percentDone(v *view) any {
+	size, have := v.wanted()
+	if size == 0 {
+		return 1.0
+	}
+	return float64(have) / float64(size)
+}
+
+func percentComplete(v *view) any {
+	if v.Client.Torrent.Length == 0 {
+		return 1.0
+	}
+	return float64(v.completed) / float64(v.Client.Torrent.Length)
+}
+
+func uploadRatio(v *view) any {
+	if v.completed == 0 {
+		return -1.0 // not available
+	}
+	return float64(v.Client.Uploaded()) / float64(v.completed)
+}
@@ -0,0 +1,504 @@
+package transmission
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/rpc"
+	"github.com/samir-adh/bytetorrent/src/session"
+)
+
+// Path is where Transmission clients send their requests
+const Path = "/transmission/rpc"
+
+// SessionIDHeader carries the token a client must send back with its
+// requests, it is given in the 409 answer to a request without it. This
+// keeps other sites from posting requests through a browser.
+const SessionIDHeader = "X-Transmission-Session-Id"
+
+// Versions reported to clients, the methods implemented are those of
+// Transmission 4.0 that clients need to add and control torrents
+const (
+	RPCVersion        = 17
+	RPCVersionMinimum = 14
+	Version           = "4.0.0 (bytetorrent)"
+)
+
+// Statuses of a torrent
+const (
+	StatusStopped      = 0
+	StatusCheckWait    = 1
+	StatusCheck        = 2
+	StatusDownloadWait = 3
+	StatusDownload     = 4
+	StatusSeedWait     = 5
+	StatusSeed         = 6
+)
+
+// Transmission counts speeds in kB/s of 1000 bytes
+const kilo = 1000
+
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type response struct {
+	Result    string          `json:"result"` // "success" or the error
+	Arguments any             `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+// settings are the session settings of Transmission that bytetorrent
+// has, a limit is kept when disabled like Transmission does
+type settings struct {
+	downloadDir        string
+	speedLimitDown     int // kB/s
+	speedLimitDownOn   bool
+	speedLimitUp       int
+	speedLimitUpOn     bool
+	seedRatioLimit     float64
+	seedRatioLimited   bool
+	idleSeedingLimit   int // minutes
+	idleSeedingLimitOn bool
+}
+
+// Handler answers the requests of Transmission clients with the torrents
+// of an rpc.Server, torrents added through either API are kept the same
+// way.
+type Handler struct {
+	RPC       *rpc.Server
+	sessionID string
+	started   time.Time
+
+	mu       sync.Mutex
+	ids      map[[20]byte]int // Transmission numbers torrents
+	nextID   int
+	added    map[[20]byte]time.Time
+	settings settings
+	methods  map[string]func(ctx context.Context, args json.RawMessage) (any, error)
+}
+
+func New(server *rpc.Server) *Handler {
+	token := make([]byte, 24)
+	rand.Read(token)
+	h := &Handler{
+		RPC:       server,
+		sessionID: hex.EncodeToString(token),
+		started:   time.Now(),
+		ids:       make(map[[20]byte]int),
+		nextID:    1,
+		added:     make(map[[20]byte]time.Time),
+	}
+	download, upload := server.Session.Rates()
+	goals := server.Session.SeedGoals()
+	h.settings = settings{
+		downloadDir:        server.Config.DownloadDir,
+		speedLimitDown:     100,
+		speedLimitDownOn:   download > 0,
+		speedLimitUp:       100,
+		speedLimitUpOn:     upload > 0,
+		seedRatioLimit:     2,
+		seedRatioLimited:   goals.Ratio > 0,
+		idleSeedingLimit:   30,
+		idleSeedingLimitOn: goals.IdleTime > 0,
+	}
+	if download > 0 {
+		h.settings.speedLimitDown = download / kilo
+	}
+	if upload > 0 {
+		h.settings.speedLimitUp = upload / kilo
+	}
+	if goals.Ratio > 0 {
+		h.settings.seedRatioLimit = goals.Ratio
+	}
+	if goals.IdleTime > 0 {
+		h.settings.idleSeedingLimit = int(goals.IdleTime / time.Minute)
+	}
+	h.methods = map[string]func(context.Context, json.RawMessage) (any, error){
+		"torrent-add":       h.torrentAdd,
+		"torrent-get":       h.torrentGet,
+		"torrent-start":     h.torrentStart,
+		"torrent-start-now": h.torrentStart,
+		"torrent-stop":      h.torrentStop,
+		"torrent-remove":    h.torrentRemove,
+		"session-get":       h.sessionGet,
+		"session-set":       h.sessionSet,
+		"session-stats":     h.sessionStats,
+	}
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(SessionIDHeader, h.sessionID)
+	if r.Header.Get(SessionIDHeader) != h.sessionID {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "<h1>409: Conflict</h1><p>Your request had an invalid session-id header.</p>"+
+			"<p><code>%s: %s</code></p>", SessionIDHeader, h.sessionID)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "requests are POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var req request
+	if err := json.NewDecoder(io.LimitReader(r.Body, 32<<20)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := response{Result: "success", Arguments: struct{}{}, Tag: req.Tag}
+	if method, ok := h.methods[req.Method]; !ok {
+		resp.Result = "method name not recognized"
+	} else if result, err := method(r.Context(), req.Arguments); err != nil {
+		resp.Result = err.Error()
+	} else if result != nil {
+		resp.Arguments = result
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// id returns the number of the torrent, numbers are given in the order
+// torrents are first seen and never reused
+func (h *Handler) id(infoHash [20]byte) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id, ok := h.ids[infoHash]
+	if !ok {
+		id = h.nextID
+		h.nextID++
+		h.ids[infoHash] = id
+		h.added[infoHash] = time.Now()
+	}
+	return id
+}
+
+// selectTorrents returns the torrents selected by ids the way
+// Transmission does: all of them when absent, an id, a hash string, a
+// list of both or "recently-active"
+func (h *Handler) selectTorrents(ids json.RawMessage) ([]*session.Torrent, error) {
+	torrents := h.RPC.Session.Torrents()
+	if len(ids) == 0 || string(ids) == "null" {
+		return torrents, nil
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(ids, &list); err != nil {
+		list = []json.RawMessage{ids}
+	}
+	selected := make(map[*session.Torrent]bool)
+	for _, raw := range list {
+		var id int
+		var hash string
+		switch {
+		case json.Unmarshal(raw, &id) == nil:
+			for _, t := range torrents {
+				if h.id(t.Client.InfoHash) == id {
+					selected[t] = true
+				}
+			}
+		case json.Unmarshal(raw, &hash) == nil && hash == "recently-active":
+			for _, t := range torrents {
+				if state := t.State(); state == session.Downloading || state == session.Seeding {
+					selected[t] = true
+				}
+			}
+		case json.Unmarshal(raw, &hash) == nil:
+			for _, t := range torrents {
+				if strings.EqualFold(hex.EncodeToString(t.Client.InfoHash[:]), hash) {
+					selected[t] = true
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid torrent id %s", raw)
+		}
+	}
+	// Keep the queue order
+	var result []*session.Torrent
+	for _, t := range torrents {
+		if selected[t] {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+type torrentArgs struct {
+	IDs             json.RawMessage `json:"ids"`
+	Fields          []string        `json:"fields"`
+	DeleteLocalData bool            `json:"delete-local-data"`
+}
+
+func decode(args json.RawMessage, v any) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
+
+func (h *Handler) torrentAdd(ctx context.Context, args json.RawMessage) (any, error) {
+	var a struct {
+		Filename    string `json:"filename"`
+		Metainfo    []byte `json:"metainfo"` // base64 in JSON
+		Paused      bool   `json:"paused"`
+		DownloadDir string `json:"download-dir"`
+	}
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	params := rpc.AddParams{Data: a.Metainfo, Paused: a.Paused, DownloadDir: h.settings.downloadDir}
+	h.mu.Unlock()
+	if a.DownloadDir != "" {
+		params.DownloadDir = a.DownloadDir
+	}
+	switch {
+	case len(a.Metainfo) > 0:
+	case strings.Contains(a.Filename, "://") || strings.HasPrefix(a.Filename, "magnet:"):
+		params.URL = a.Filename
+	case a.Filename != "":
+		params.Path = a.Filename
+	default:
+		return nil, errors.New("no filename or metainfo specified")
+	}
+	t, err := h.RPC.Add(ctx, params)
+	key := "torrent-added"
+	if errors.Is(err, session.ErrDuplicate) && t != nil {
+		key = "torrent-duplicate"
+	} else if err != nil {
+		return nil, err
+	}
+	return map[string]any{key: map[string]any{
+		"id":         h.id(t.Client.InfoHash),
+		"name":       t.Client.Torrent.Name,
+		"hashString": hex.EncodeToString(t.Client.InfoHash[:]),
+	}}, nil
+}
+
+func (h *Handler) torrentGet(ctx context.Context, args json.RawMessage) (any, error) {
+	var a torrentArgs
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	if len(a.Fields) == 0 {
+		return nil, errors.New("no fields specified")
+	}
+	torrents, err := h.selectTorrents(a.IDs)
+	if err != nil {
+		return nil, err
+	}
+	positions := make(map[*session.Torrent]int)
+	for i, t := range h.RPC.Session.Torrents() {
+		positions[t] = i
+	}
+	result := make([]map[string]any, 0, len(torrents))
+	for _, t := range torrents {
+		view := h.view(t, positions[t])
+		fields := make(map[string]any, len(a.Fields))
+		for _, name := range a.Fields {
+			// Fields bytetorrent doesn't have are left out
+			if field, ok := torrentFields[name]; ok {
+				fields[name] = field(view)
+			}
+		}
+		result = append(result, fields)
+	}
+	return map[string]any{"torrents": result}, nil
+}
+
+func (h *Handler) torrentStart(ctx context.Context, args json.RawMessage) (any, error) {
+	return nil, h.apply(args, h.RPC.Resume)
+}
+
+func (h *Handler) torrentStop(ctx context.Context, args json.RawMessage) (any, error) {
+	return nil, h.apply(args, h.RPC.Pause)
+}
+
+func (h *Handler) torrentRemove(ctx context.Context, args json.RawMessage) (any, error) {
+	var a torrentArgs
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, h.apply(args, func(infoHash [20]byte) error {
+		return h.RPC.Remove(infoHash, a.DeleteLocalData)
+	})
+}
+
+// apply calls action on each torrent selected by the ids of args
+func (h *Handler) apply(args json.RawMessage, action func([20]byte) error) error {
+	var a torrentArgs
+	if err := decode(args, &a); err != nil {
+		return err
+	}
+	torrents, err := h.selectTorrents(a.IDs)
+	if err != nil {
+		return err
+	}
+	for _, t := range torrents {
+		if err := action(t.Client.InfoHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) sessionGet(ctx context.Context, args json.RawMessage) (any, error) {
+	var a struct {
+		Fields []string `json:"fields"`
+	}
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	st := h.settings
+	h.mu.Unlock()
+	s := h.RPC.Session
+	fields := map[string]any{
+		"version":                    Version,
+		"rpc-version":                RPCVersion,
+		"rpc-version-minimum":        RPCVersionMinimum,
+		"session-id":                 h.sessionID,
+		"download-dir":               st.downloadDir,
+		"peer-port":                  s.Port,
+		"port-forwarding-enabled":    s.PortMap != nil,
+		"speed-limit-down":           st.speedLimitDown,
+		"speed-limit-down-enabled":   st.speedLimitDownOn,
+		"speed-limit-up":             st.speedLimitUp,
+		"speed-limit-up-enabled":     st.speedLimitUpOn,
+		"alt-speed-enabled":          s.AltSpeedActive(),
+		"seedRatioLimit":             st.seedRatioLimit,
+		"seedRatioLimited":           st.seedRatioLimited,
+		"idle-seeding-limit":         st.idleSeedingLimit,
+		"idle-seeding-limit-enabled": st.idleSeedingLimitOn,
+		"units": map[string]any{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  kilo,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   kilo,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+	if len(a.Fields) == 0 {
+		return fields, nil
+	}
+	selected := make(map[string]any, len(a.Fields))
+	for _, name := range a.Fields {
+		if value, ok := fields[name]; ok {
+			selected[name] = value
+		}
+	}
+	return selected, nil
+}
+
+// sessionSet changes the settings bytetorrent has, the others are
+// ignored like Transmission ignores unknown keys
+func (h *Handler) sessionSet(ctx context.Context, args json.RawMessage) (any, error) {
+	var a struct {
+		DownloadDir        *string  `json:"download-dir"`
+		SpeedLimitDown     *int     `json:"speed-limit-down"`
+		SpeedLimitDownOn   *bool    `json:"speed-limit-down-enabled"`
+		SpeedLimitUp       *int     `json:"speed-limit-up"`
+		SpeedLimitUpOn     *bool    `json:"speed-limit-up-enabled"`
+		SeedRatioLimit     *float64 `json:"seedRatioLimit"`
+		SeedRatioLimited   *bool    `json:"seedRatioLimited"`
+		IdleSeedingLimit   *int     `json:"idle-seeding-limit"`
+		IdleSeedingLimitOn *bool    `json:"idle-seeding-limit-enabled"`
+	}
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	if a.DownloadDir != nil {
+		if err := h.RPC.CheckDownloadDir(*a.DownloadDir); err != nil {
+			return nil, err
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := &h.settings
+	set(&st.downloadDir, a.DownloadDir)
+	set(&st.speedLimitDown, a.SpeedLimitDown)
+	set(&st.speedLimitDownOn, a.SpeedLimitDownOn)
+	set(&st.speedLimitUp, a.SpeedLimitUp)
+	set(&st.speedLimitUpOn, a.SpeedLimitUpOn)
+	set(&st.seedRatioLimit, a.SeedRatioLimit)
+	set(&st.seedRatioLimited, a.SeedRatioLimited)
+	set(&st.idleSeedingLimit, a.IdleSeedingLimit)
+	set(&st.idleSeedingLimitOn, a.IdleSeedingLimitOn)
+
+	s := h.RPC.Session
+	download, upload := 0, 0
+	if st.speedLimitDownOn {
+		download = st.speedLimitDown * kilo
+	}
+	if st.speedLimitUpOn {
+		upload = st.speedLimitUp * kilo
+	}
+	s.SetRates(download, upload)
+	goals := s.SeedGoals()
+	goals.Ratio, goals.IdleTime = 0, 0
+	if st.seedRatioLimited {
+		goals.Ratio = st.seedRatioLimit
+	}
+	if st.idleSeedingLimitOn {
+		goals.IdleTime = time.Duration(st.idleSeedingLimit) * time.Minute
+	}
+	s.SetSeedGoals(goals)
+	return nil, nil
+}
+
+func set[T any](setting *T, value *T) {
+	if value != nil {
+		*setting = *value
+	}
+}
+
+func (h *Handler) sessionStats(ctx context.Context, args json.RawMessage) (any, error) {
+	var active, paused, download, upload int
+	var downloaded, uploaded int64
+	torrents := h.RPC.Session.Torrents()
+	for _, t := range torrents {
+		switch t.State() {
+		case session.Downloading, session.Seeding:
+			active++
+		case session.Paused:
+			paused++
+		}
+		down, up := h.RPC.Speeds(t)
+		download += down
+		upload += up
+		downloaded += t.Client.Downloaded()
+		uploaded += t.Client.Uploaded()
+	}
+	// Transfers aren't kept across runs, the cumulative stats are those
+	// of the current run
+	stats := map[string]any{
+		"uploadedBytes":   uploaded,
+		"downloadedBytes": downloaded,
+		"filesAdded":      len(torrents),
+		"sessionCount":    1,
+		"secondsActive":   int(time.Since(h.started).Seconds()),
+	}
+	return map[string]any{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(torrents),
+		"downloadSpeed":      download,
+		"uploadSpeed":        upload,
+		"cumulative-stats":   stats,
+		"current-stats":      stats,
+	}, nil
+}
@@ -0,0 +1,235 @@
+package transmission
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/rpc"
+	"github.com/samir-adh/bytetorrent/src/session"
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+)
+
+// albumTorrent is a .torrent file of two files in an album directory,
+// announced to a tracker giving no peer
+func albumTorrent(t *testing.T) []byte {
+	t.Helper()
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bencode.Marshal(w, map[string]any{"interval": 60, "peers": ""})
+	}))
+	t.Cleanup(tracker.Close)
+	data := bytes.Repeat([]byte("transmission"), 100)
+	var pieces []byte
+	for start := 0; start < len(data); start += 256 {
+		hash := sha1.Sum(data[start:min(start+256, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	var buffer bytes.Buffer
+	err := bencode.Marshal(&buffer, map[string]any{
+		"announce": tracker.URL,
+		"info": map[string]any{
+			"name":         "album",
+			"piece length": 256,
+			"pieces":       string(pieces),
+			"files": []map[string]any{
+				{"length": 1000, "path": []string{"a.bin"}},
+				{"length": len(data) - 1000, "path": []string{"b.bin"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// client posts requests like Transmission clients, getting the session
+// id from the first answer
+type client struct {
+	t         *testing.T
+	url       string
+	sessionID string
+}
+
+func (c *client) call(method string, args any, result any) string {
+	c.t.Helper()
+	body, _ := json.Marshal(map[string]any{"method": method, "arguments": args, "tag": 7})
+	for range 2 {
+		req, _ := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+		req.Header.Set(SessionIDHeader, c.sessionID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusConflict {
+			c.sessionID = resp.Header.Get(SessionIDHeader)
+			continue
+		}
+		var decoded struct {
+			Result    string          `json:"result"`
+			Arguments json.RawMessage `json:"arguments"`
+			Tag       int             `json:"tag"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+			c.t.Fatal(err)
+		}
+		if decoded.Tag != 7 {
+			c.t.Errorf("expected the tag to be sent back, got %d", decoded.Tag)
+		}
+		if result != nil {
+			if err := json.Unmarshal(decoded.Arguments, result); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return decoded.Result
+	}
+	c.t.Fatal("the session id was refused")
+	return ""
+}
+
+func newHandler(t *testing.T) (*Handler, *client, string) {
+	t.Helper()
+	s, err := session.New(session.Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	dir := t.TempDir()
+	handler := New(rpc.NewServer(s, torrentclient.Config{DownloadDir: dir}))
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return handler, &client{t: t, url: server.URL + Path}, dir
+}
+
+func TestSessionIDHandshake(t *testing.T) {
+	handler, c, _ := newHandler(t)
+	resp, err := http.Post(c.url, "application/json", bytes.NewReader([]byte(`{"method":"session-get"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get(SessionIDHeader) != handler.sessionID {
+		t.Fatalf("expected a 409 giving the session id, got %s", resp.Status)
+	}
+	var args map[string]any
+	if result := c.call("session-get", map[string]any{"fields": []string{"rpc-version", "session-id"}}, &args); result != "success" {
+		t.Fatal(result)
+	}
+	if args["rpc-version"] != float64(RPCVersion) || args["session-id"] != handler.sessionID || len(args) != 2 {
+		t.Errorf("unexpected session %v", args)
+	}
+	if result := c.call("torrent-reannounce", nil, nil); result != "method name not recognized" {
+		t.Errorf("expected unknown methods to be refused, got %q", result)
+	}
+}
+
+type torrentInfo struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	HashString string `json:"hashString"`
+	Status     int    `json:"status"`
+	TotalSize  int    `json:"totalSize"`
+	Files      []struct {
+		Name   string `json:"name"`
+		Length int    `json:"length"`
+	} `json:"files"`
+	Pieces []byte `json:"pieces"`
+}
+
+func TestControlTorrents(t *testing.T) {
+	handler, c, dir := newHandler(t)
+	metainfo := albumTorrent(t)
+	var added map[string]torrentInfo
+	if result := c.call("torrent-add", map[string]any{"metainfo": metainfo, "paused": true}, &added); result != "success" {
+		t.Fatal(result)
+	}
+	torrent, ok := added["torrent-added"]
+	if !ok || torrent.ID != 1 || torrent.Name != "album" {
+		t.Fatalf("unexpected answer %v", added)
+	}
+	clear(added)
+	c.call("torrent-add", map[string]any{"metainfo": metainfo}, &added)
+	if duplicate, ok := added["torrent-duplicate"]; !ok || duplicate.HashString != torrent.HashString {
+		t.Errorf("expected a duplicate, got %v", added)
+	}
+
+	get := func(ids any) []torrentInfo {
+		t.Helper()
+		var got struct{ Torrents []torrentInfo }
+		fields := []string{"id", "name", "hashString", "status", "totalSize", "files", "pieces", "unknownField"}
+		if result := c.call("torrent-get", map[string]any{"ids": ids, "fields": fields}, &got); result != "success" {
+			t.Fatal(result)
+		}
+		return got.Torrents
+	}
+	torrents := get([]any{1})
+	if len(torrents) != 1 || torrents[0].Status != StatusStopped || torrents[0].TotalSize != 1200 || len(torrents[0].Pieces) != 1 {
+		t.Fatalf("unexpected torrents %+v", torrents)
+	}
+	if files := torrents[0].Files; len(files) != 2 || files[0].Name != "album/a.bin" || files[1].Length != 200 {
+		t.Errorf("unexpected files %+v", files)
+	}
+
+	if result := c.call("torrent-start", map[string]any{"ids": []string{torrent.HashString}}, nil); result != "success" {
+		t.Fatal(result)
+	}
+	if status := get(torrent.HashString)[0].Status; status != StatusDownload && status != StatusDownloadWait {
+		t.Errorf("expected torrent to be downloading, got status %d", status)
+	}
+	c.call("torrent-stop", map[string]any{"ids": 1}, nil)
+	if status := get(nil)[0].Status; status != StatusStopped {
+		t.Errorf("expected torrent to be stopped, got status %d", status)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "album"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "album", "a.bin"), make([]byte, 1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if result := c.call("torrent-remove", map[string]any{"ids": 1, "delete-local-data": true}, nil); result != "success" {
+		t.Fatal(result)
+	}
+	if len(handler.RPC.Session.Torrents()) != 0 {
+		t.Errorf("expected torrent to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "album")); !os.IsNotExist(err) {
+		t.Errorf("expected the downloaded files to be deleted")
+	}
+}
+
+func TestSessionSet(t *testing.T) {
+	handler, c, dir := newHandler(t)
+	args := map[string]any{"speed-limit-down": 50, "speed-limit-down-enabled": true, "speed-limit-up": 20, "seedRatioLimit": 1.5, "seedRatioLimited": true}
+	if result := c.call("session-set", args, nil); result != "success" {
+		t.Fatal(result)
+	}
+	// The upload limit is kept but not enabled
+	if download, upload := handler.RPC.Session.Rates(); download != 50*kilo || upload != 0 {
+		t.Errorf("unexpected rates %d and %d", download, upload)
+	}
+	if goals := handler.RPC.Session.SeedGoals(); goals.Ratio != 1.5 {
+		t.Errorf("expected a seed ratio of 1.5, got %v", goals.Ratio)
+	}
+	var got map[string]any
+	c.call("session-get", nil, &got)
+	if got["speed-limit-up"] != float64(20) || got["speed-limit-up-enabled"] != false || got["speed-limit-down-enabled"] != true {
+		t.Errorf("unexpected session %v", got)
+	}
+
+	handler.RPC.DownloadRoot = dir
+	if result := c.call("session-set", map[string]any{"download-dir": t.TempDir()}, nil); result == "success" {
+		t.Errorf("expected a download directory outside the root to be refused")
+	}
+	if result := c.call("torrent-add", map[string]any{"metainfo": albumTorrent(t), "download-dir": t.TempDir()}, nil); result == "success" {
+		t.Errorf("expected a torrent outside the root to be refused")
+	}
+}
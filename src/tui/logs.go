@@ -0,0 +1,60 @@
+package tui
+
+import (
+	"strings"
+	"sync"
+)
+
+// maxLogLines is the number of lines of the log kept for the log view
+const maxLogLines = 500
+
+// logBuffer keeps the last lines written to the log
+type logBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	max     int
+	partial string // written without its newline yet
+}
+
+func newLogBuffer(max int) *logBuffer {
+	return &logBuffer{max: max}
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	text := b.partial + string(p)
+	lines := strings.Split(text, "\n")
+	b.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		b.lines = append(b.lines, printable(line))
+	}
+	if len(b.lines) > b.max {
+		b.lines = append([]string(nil), b.lines[len(b.lines)-b.max:]...)
+	}
+	return len(p), nil
+}
+
+// tail returns the last n lines
+func (b *logBuffer) tail(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n <= 0 {
+		return nil
+	}
+	return append([]string(nil), b.lines[max(0, len(b.lines)-n):]...)
+}
+
+// printable replaces the tabs of line and drops the other control
+// characters, which would move the cursor around the screen
+func printable(line string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case r < ' ' || r == 0x7f:
+			return -1
+		}
+		return r
+	}, line)
+}
@@ -0,0 +1,320 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/samir-adh/bytetorrent/src/rpc"
+	"github.com/samir-adh/bytetorrent/src/session"
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+)
+
+// Colors and styles of the screen
+const (
+	reset   = "\x1b[0m"
+	bold    = "\x1b[1m"
+	inverse = "\x1b[7m"
+	red     = "\x1b[31m"
+	green   = "\x1b[32m"
+	yellow  = "\x1b[33m"
+	blue    = "\x1b[34m"
+	cyan    = "\x1b[36m"
+	grey    = "\x1b[90m"
+)
+
+const help = "↑↓ select  p pause/resume  d/u limits  v log  q quit"
+
+// render returns the escape sequences drawing the whole screen
+func (t *TUI) render() string {
+	torrents := t.RPC.Session.Torrents()
+	if t.selected >= len(torrents) {
+		t.selected = max(0, len(torrents)-1)
+	}
+	var lines []string
+	lines = append(lines, inverse+bold+fit(t.header(torrents), t.width)+reset)
+	lines = append(lines, t.torrentLines(torrents, max(1, (t.height-4)/3))...)
+	lines = append(lines, "")
+	rest := t.height - len(lines) - 1
+	switch {
+	case t.showLog:
+		lines = append(lines, bold+"Log"+reset)
+		lines = append(lines, t.logs.tail(rest-1)...)
+	case len(torrents) > 0:
+		lines = append(lines, t.details(torrents[t.selected], rest)...)
+	}
+	for len(lines) < t.height-1 {
+		lines = append(lines, "")
+	}
+	lines = lines[:t.height-1]
+	lines = append(lines, t.footer())
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			screen.WriteString("\r\n")
+		}
+		screen.WriteString(fit(line, t.width))
+		screen.WriteString("\x1b[K")
+	}
+	return screen.String()
+}
+
+func (t *TUI) header(torrents []*session.Torrent) string {
+	status := t.RPC.SessionStatus()
+	var download, upload int
+	for _, torrent := range torrents {
+		d, u := t.RPC.Speeds(torrent)
+		download += d
+		upload += u
+	}
+	header := fmt.Sprintf(" bytetorrent  %d torrents  ↓ %s of %s  ↑ %s of %s  port %d",
+		len(torrents), speed(download), limit(status.DownloadRate), speed(upload), limit(status.UploadRate), status.Port)
+	if status.AltSpeed {
+		header += "  alternate limits"
+	}
+	return header + strings.Repeat(" ", max(0, t.width-utf8.RuneCountInString(header)))
+}
+
+// torrentLines lists the torrents, scrolled to show the selected one
+// within at most rows lines
+func (t *TUI) torrentLines(torrents []*session.Torrent, rows int) []string {
+	if len(torrents) == 0 {
+		return []string{"No torrent"}
+	}
+	first := max(0, t.selected-rows+1)
+	var lines []string
+	for i := first; i < len(torrents) && i < first+rows; i++ {
+		status := t.RPC.Status(torrents[i])
+		marker := "  "
+		if i == t.selected {
+			marker = bold + "> "
+		}
+		state := fmt.Sprintf("%-11s", status.State)
+		if status.Error != "" {
+			state = red + state + reset
+		}
+		line := fmt.Sprintf("%s%-*s%s %s %5.1f%% %s ↓ %-10s ↑ %-10s %-8s %d peers",
+			marker, nameWidth(t.width), truncate(status.Name, nameWidth(t.width)), reset,
+			progressBar(status.Progress, 20), status.Progress*100, state,
+			speed(status.DownloadSpeed), speed(status.UploadSpeed), eta(status.ETA), status.Peers)
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// nameWidth gives the names of the torrents what the other columns leave
+func nameWidth(width int) int {
+	return max(10, width-95)
+}
+
+// details shows the tracker, pieces and peers of torrent in rows lines
+func (t *TUI) details(torrent *session.Torrent, rows int) []string {
+	details := t.RPC.Details(torrent)
+	lines := []string{bold + details.Name + reset}
+	if details.Error != "" {
+		lines = append(lines, red+"Error: "+details.Error+reset)
+	}
+	lines = append(lines, "Tracker  "+trackerLine(torrent.Client.Tracker()))
+	lines = append(lines, fmt.Sprintf("Pieces   %d of %d, %s verified of %s   %s█%s verified %s█%s available %s█%s partly verified %s█%s missing",
+		countBits(details.Pieces), details.PieceCount, size(details.Completed), size(details.Size),
+		green, reset, blue, reset, yellow, reset, grey, reset))
+	// The map takes a third of what is left, the peers the rest
+	mapRows := max(1, (rows-len(lines)-2)/3)
+	lines = append(lines, pieceMap(details, t.width, mapRows)...)
+	lines = append(lines, "")
+	lines = append(lines, t.peerLines(details)...)
+	return lines
+}
+
+func trackerLine(tracker torrentclient.TrackerStatus) string {
+	if tracker.URL == "" {
+		return "none"
+	}
+	line := tracker.URL
+	switch {
+	case tracker.Time.IsZero():
+	case tracker.Err != nil:
+		line += fmt.Sprintf("  %serror %s ago: %s%s", red, since(tracker.Time), tracker.Err, reset)
+	case tracker.Event != "":
+		line += fmt.Sprintf("  %s sent %s ago", tracker.Event, since(tracker.Time))
+	default:
+		line += fmt.Sprintf("  %d peers %s ago", tracker.Peers, since(tracker.Time))
+	}
+	return line
+}
+
+func since(at time.Time) string {
+	return eta(int64(time.Since(at).Seconds()))
+}
+
+// pieceMap draws the pieces in rows lines of width cells. A cell stands
+// for several pieces when they don't fit: green when all are verified,
+// yellow when some are, else blue when a peer has one of them.
+func pieceMap(details rpc.TorrentDetails, width int, rows int) []string {
+	count := details.PieceCount
+	if count == 0 || width <= 0 {
+		return nil
+	}
+	cells := min(count, width*rows)
+	type cell struct{ done, total, available int }
+	grid := make([]cell, cells)
+	for i := range count {
+		c := &grid[i*cells/count]
+		c.total++
+		if details.Pieces[i/8]&(0x80>>(i%8)) != 0 {
+			c.done++
+		}
+		if i < len(details.Availability) && details.Availability[i] > 0 {
+			c.available++
+		}
+	}
+	var lines []string
+	for start := 0; start < cells; start += width {
+		var line strings.Builder
+		color := ""
+		for _, c := range grid[start:min(cells, start+width)] {
+			next := grey
+			switch {
+			case c.done == c.total:
+				next = green
+			case c.done > 0:
+				next = yellow
+			case c.available > 0:
+				next = blue
+			}
+			if next != color {
+				line.WriteString(next)
+				color = next
+			}
+			line.WriteString("█")
+		}
+		line.WriteString(reset)
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// peerLines is the table of the peers of a torrent
+func (t *TUI) peerLines(details rpc.TorrentDetails) []string {
+	lines := []string{bold + fmt.Sprintf("%-22s %-20s %-11s %-11s %-6s %s", "Peer", "Client", "Down", "Up", "Flags", "Pieces") + reset}
+	for _, peer := range details.PeerList {
+		pieces := ""
+		if !peer.Inbound && details.PieceCount > 0 {
+			pieces = fmt.Sprintf("%5.1f%%", 100*float64(peer.Pieces)/float64(details.PieceCount))
+		}
+		client := peer.Client
+		if client == "" {
+			client = "?"
+		}
+		lines = append(lines, fmt.Sprintf("%-22s %-20s %-11s %-11s %-6s %s",
+			peer.Address, truncate(client, 20), speed(peer.DownloadRate), speed(peer.UploadRate), torrentclient.PeerInfo(peer).Flags(), pieces))
+	}
+	if len(details.PeerList) == 0 {
+		lines = append(lines, grey+"no peer connected"+reset)
+	}
+	return lines
+}
+
+func (t *TUI) footer() string {
+	if t.prompt != nil {
+		return t.prompt.label + t.prompt.value + "█"
+	}
+	if t.message != "" {
+		return cyan + t.message + reset
+	}
+	return grey + help + reset
+}
+
+func progressBar(progress float64, width int) string {
+	filled := min(width, int(progress*float64(width)))
+	color := yellow
+	if progress >= 1 {
+		color = green
+	}
+	return color + strings.Repeat("█", filled) + grey + strings.Repeat("░", width-filled) + reset
+}
+
+func countBits(bitfield []byte) int {
+	count := 0
+	for _, b := range bitfield {
+		for ; b != 0; b &= b - 1 {
+			count++
+		}
+	}
+	return count
+}
+
+// fit cuts line to width visible characters, escape sequences take no
+// room
+func fit(line string, width int) string {
+	visible := 0
+	for i := 0; i < len(line); {
+		if line[i] == '\x1b' {
+			// Skip to the final byte of the sequence
+			j := i + 1
+			for j < len(line) && (line[j] < '@' || line[j] > '~' || line[j] == '[') {
+				j++
+			}
+			i = j + 1
+			continue
+		}
+		if visible == width {
+			return line[:i] + reset
+		}
+		_, n := utf8.DecodeRuneInString(line[i:])
+		i += n
+		visible++
+	}
+	return line
+}
+
+// truncate cuts s to n characters, ending with an ellipsis when cut
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:n-1]) + "…"
+}
+
+func size(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func speed(n int) string {
+	return size(int64(n)) + "/s"
+}
+
+func limit(n int) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return speed(n)
+}
+
+// eta formats a number of seconds, empty when negative
+func eta(seconds int64) string {
+	if seconds < 0 {
+		return ""
+	}
+	d := time.Duration(seconds) * time.Second
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", seconds)
+	case d < time.Hour:
+		return fmt.Sprintf("%dm %ds", seconds/60, seconds%60)
+	}
+	return fmt.Sprintf("%dh %dm", seconds/3600, seconds/60%60)
+}
@@ -0,0 +1,278 @@
+// Package tui draws a session full screen on a terminal: the torrents with
+// their progress, and for the selected one its tracker, a map of its
+// pieces and its peers. Keys pause torrents, change the rate limits and
+// switch to the log.
+package tui
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/rpc"
+	"github.com/samir-adh/bytetorrent/src/session"
+	"github.com/samir-adh/bytetorrent/src/term"
+)
+
+// DefaultInterval is how often the screen is drawn again when nothing
+// happens
+const DefaultInterval = time.Second
+
+// Escape sequences switching to the alternate screen and hiding the
+// cursor, and back
+const (
+	enterScreen = "\x1b[?1049h\x1b[?25l"
+	leaveScreen = "\x1b[?25h\x1b[?1049l"
+)
+
+// TUI is the full-screen display of a session
+type TUI struct {
+	RPC      *rpc.Server
+	Logger   *log.Logger
+	Interval time.Duration
+	in       *os.File
+	out      io.Writer
+	width    int
+	height   int
+	selected int  // index of the selected torrent
+	showLog  bool // the log replaces the selected torrent
+	prompt   *prompt
+	message  string // shown at the bottom until the next key
+	logs     *logBuffer
+	logOut   io.Writer // the log output while the TUI runs
+	state    *term.State
+	quit     chan struct{} // closed when q is pressed
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// prompt reads the rate limit being typed
+type prompt struct {
+	label    string
+	value    string
+	download bool // the download rate is set, else the upload rate
+}
+
+func New(server *rpc.Server, logger *log.Logger) *TUI {
+	return &TUI{
+		RPC:      server,
+		Logger:   logger,
+		Interval: DefaultInterval,
+		in:       os.Stdin,
+		out:      os.Stdout,
+		width:    80,
+		height:   24,
+		logs:     newLogBuffer(maxLogLines),
+		quit:     make(chan struct{}),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Supported reports whether the standard input and output are terminals
+// the TUI can take
+func Supported() bool {
+	return term.IsTerminal(os.Stdin.Fd()) && term.IsTerminal(os.Stdout.Fd())
+}
+
+// Start takes the terminal: keys are read as they are pressed, the
+// progress bar is hidden and the log kept for the log view until Stop.
+func (t *TUI) Start() error {
+	state, err := term.MakeRaw(t.in.Fd())
+	if err != nil {
+		return err
+	}
+	t.state = state
+	t.Logger.HideProgress(true)
+	t.logOut = stdlog.Writer()
+	stdlog.SetOutput(t.logs)
+	io.WriteString(t.out, enterScreen)
+	keys := make(chan []byte)
+	go t.readKeys(keys)
+	go t.run(keys)
+	return nil
+}
+
+// Stop gives the terminal back, and writes the lines logged meanwhile to
+// the previous log output. It can be called on a nil TUI.
+func (t *TUI) Stop() {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() {
+		close(t.stop)
+		<-t.stopped
+		io.WriteString(t.out, leaveScreen)
+		term.Restore(t.in.Fd(), t.state)
+		stdlog.SetOutput(t.logOut)
+		t.Logger.HideProgress(false)
+		for _, line := range t.logs.tail(maxLogLines) {
+			fmt.Fprintln(t.logOut, line)
+		}
+	})
+}
+
+// Quit is closed when the user asks to quit, nil for a nil TUI
+func (t *TUI) Quit() <-chan struct{} {
+	if t == nil {
+		return nil
+	}
+	return t.quit
+}
+
+// readKeys sends what is typed on the terminal. It stays blocked in a
+// read once the TUI stopped, until the next key or the end of the process.
+func (t *TUI) readKeys(keys chan<- []byte) {
+	buf := make([]byte, 64)
+	for {
+		n, err := t.in.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case keys <- bytes.Clone(buf[:n]):
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// run draws the screen on every key, session event and interval until
+// Stop is called
+func (t *TUI) run(keys <-chan []byte) {
+	defer close(t.stopped)
+	events, unsubscribe := t.RPC.Session.Subscribe()
+	defer unsubscribe()
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	for {
+		t.resize()
+		io.WriteString(t.out, t.render())
+		select {
+		case <-t.stop:
+			return
+		case input := <-keys:
+			t.handleKeys(input)
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+// resize follows the size of the terminal
+func (t *TUI) resize() {
+	out, ok := t.out.(*os.File)
+	if !ok {
+		return
+	}
+	if width, height, err := term.Size(out.Fd()); err == nil && width > 0 && height > 0 {
+		t.width, t.height = width, height
+	}
+}
+
+// handleKeys applies the keys of input, arrows come as escape sequences
+func (t *TUI) handleKeys(input []byte) {
+	for len(input) > 0 {
+		if t.prompt != nil {
+			input = t.handlePrompt(input)
+			continue
+		}
+		key := string(input[:1])
+		input = input[1:]
+		if key == "\x1b" && len(input) >= 2 && input[0] == '[' {
+			key, input = "\x1b["+string(input[1]), input[2:]
+		}
+		t.handleKey(key)
+	}
+}
+
+func (t *TUI) handleKey(key string) {
+	t.message = ""
+	torrents := t.RPC.Session.Torrents()
+	switch key {
+	case "q":
+		select {
+		case <-t.quit:
+		default:
+			close(t.quit)
+		}
+	case "\x1b[A", "k":
+		if t.selected > 0 {
+			t.selected--
+		}
+	case "\x1b[B", "j":
+		if t.selected < len(torrents)-1 {
+			t.selected++
+		}
+	case "p", " ":
+		if t.selected >= len(torrents) {
+			return
+		}
+		torrent := torrents[t.selected]
+		var err error
+		switch torrent.State() {
+		case session.Paused, session.Failed, session.Finished:
+			err = t.RPC.Resume(torrent.Client.InfoHash)
+		default:
+			err = t.RPC.Pause(torrent.Client.InfoHash)
+		}
+		if err != nil {
+			t.message = err.Error()
+		}
+	case "d":
+		t.prompt = &prompt{label: "Download limit in KiB/s, 0 for none: ", download: true}
+	case "u":
+		t.prompt = &prompt{label: "Upload limit in KiB/s, 0 for none: "}
+	case "l", "v":
+		t.showLog = !t.showLog
+	}
+}
+
+// handlePrompt edits the limit being typed with the first key of input
+// and returns the others. Enter applies the limit, Escape cancels.
+func (t *TUI) handlePrompt(input []byte) []byte {
+	key := input[0]
+	input = input[1:]
+	switch {
+	case key == '\r' || key == '\n':
+		t.applyLimit()
+		t.prompt = nil
+	case key == 0x1b:
+		t.prompt = nil
+		// An arrow or other escape sequence cancels as a whole
+		return nil
+	case key == 0x7f || key == '\b':
+		if n := len(t.prompt.value); n > 0 {
+			t.prompt.value = t.prompt.value[:n-1]
+		}
+	case key >= '0' && key <= '9':
+		t.prompt.value += string(key)
+	}
+	return input
+}
+
+func (t *TUI) applyLimit() {
+	if t.prompt.value == "" {
+		return
+	}
+	kib, err := strconv.Atoi(t.prompt.value)
+	if err != nil {
+		t.message = fmt.Sprintf("invalid limit %s", t.prompt.value)
+		return
+	}
+	download, upload := t.RPC.Session.Rates()
+	if t.prompt.download {
+		download = kib * 1024
+	} else {
+		upload = kib * 1024
+	}
+	t.RPC.Session.SetRates(download, upload)
+	t.message = fmt.Sprintf("limits set to %s down, %s up", limit(download), limit(upload))
+}
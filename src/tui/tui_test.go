@@ -0,0 +1,114 @@
+package tui
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/rpc"
+	"github.com/samir-adh/bytetorrent/src/session"
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+)
+
+// newTUI returns a TUI drawing into a buffer, for a session with a paused
+// torrent announced to a tracker giving no peer
+func newTUI(t *testing.T) (*TUI, *session.Torrent) {
+	t.Helper()
+	logger := &log.Logger{Verbose: log.LowVerbose}
+	// Made first, the directory is removed once the session is closed
+	downloadDir := t.TempDir()
+	s, err := session.New(session.Config{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bencode.Marshal(w, map[string]any{"interval": 60, "peers": ""})
+	}))
+	t.Cleanup(tracker.Close)
+	data := []byte("terminal")
+	hash := sha1.Sum(data)
+	var buffer bytes.Buffer
+	bencode.Marshal(&buffer, map[string]any{
+		"announce": tracker.URL,
+		"info": map[string]any{
+			"name":         "data.bin",
+			"length":       len(data),
+			"piece length": 256,
+			"pieces":       string(hash[:]),
+		},
+	})
+	server := rpc.NewServer(s, torrentclient.Config{DownloadDir: downloadDir})
+	torrent, err := server.Add(context.Background(), rpc.AddParams{Data: buffer.Bytes(), Paused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui := New(server, logger)
+	ui.out = &bytes.Buffer{}
+	return ui, torrent
+}
+
+func TestRender(t *testing.T) {
+	ui, _ := newTUI(t)
+	screen := ui.render()
+	for _, expected := range []string{"data.bin", "paused", "1 torrents", "no peer connected", help} {
+		if !strings.Contains(screen, expected) {
+			t.Errorf("expected %q on the screen", expected)
+		}
+	}
+	if lines := strings.Count(screen, "\r\n") + 1; lines != ui.height {
+		t.Errorf("expected %d lines, got %d", ui.height, lines)
+	}
+
+	ui.logs.Write([]byte("first line\nsecond\tline\x1b[2J\n"))
+	ui.handleKeys([]byte("v"))
+	if screen := ui.render(); !strings.Contains(screen, "second line[2J") || strings.Contains(screen, "\x1b[2J") {
+		t.Errorf("expected the log without its control characters, got %q", screen)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	ui, torrent := newTUI(t)
+	ui.handleKeys([]byte("p"))
+	if state := torrent.State(); state == session.Paused {
+		t.Errorf("expected the torrent to resume")
+	}
+	ui.handleKeys([]byte("p"))
+	if state := torrent.State(); state != session.Paused {
+		t.Errorf("expected the torrent to be paused, got %s", state)
+	}
+
+	ui.handleKeys([]byte("d51\x7f2\r"))
+	if download, upload := ui.RPC.Session.Rates(); download != 52*1024 || upload != 0 {
+		t.Errorf("expected a download limit of 52 KiB/s, got %d and %d", download, upload)
+	}
+	ui.handleKeys([]byte("u7\x1b"))
+	if _, upload := ui.RPC.Session.Rates(); upload != 0 || ui.prompt != nil {
+		t.Errorf("expected escape to cancel the limit")
+	}
+
+	ui.handleKeys([]byte("\x1b[Bq"))
+	if ui.selected != 0 {
+		t.Errorf("expected the selection to stay on the only torrent")
+	}
+	select {
+	case <-ui.Quit():
+	default:
+		t.Errorf("expected q to quit")
+	}
+}
+
+func TestFit(t *testing.T) {
+	if line := fit(green+"█████"+reset+"abc", 6); line != green+"█████"+reset+"a"+reset {
+		t.Errorf("unexpected line %q", line)
+	}
+	if line := fit("abc", 6); line != "abc" {
+		t.Errorf("unexpected line %q", line)
+	}
+}
@@ -0,0 +1,517 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPayload keeps datagrams under the usual 1500 bytes MTU
+	maxPayload = 1380
+	// recvWindow is the amount of unread data we accept before the
+	// advertised window drops to zero
+	recvWindow     = 1 << 20
+	reorderLimit   = 1024
+	initialRTO     = time.Second
+	minRTO         = 500 * time.Millisecond
+	maxRTO         = 30 * time.Second
+	maxTimeouts    = 8
+	lingerDuration = 10 * time.Second
+)
+
+var (
+	errConnReset   = errors.New("utp: connection reset by peer")
+	errConnTimeout = errors.New("utp: connection timed out")
+)
+
+type outPacket struct {
+	pkt           *packet
+	size          int
+	sentAt        time.Time
+	transmissions int
+}
+
+// Conn is a uTP connection, it implements net.Conn.
+type Conn struct {
+	socket    *Socket
+	remote    net.Addr
+	recvId    uint16
+	sendId    uint16
+	initiator bool
+
+	mu          sync.Mutex
+	connected   bool
+	established chan struct{} // closed when the handshake completes
+	done        chan struct{} // closed when err is set
+	err         error
+	readNotify  chan struct{}
+	writeNotify chan struct{}
+
+	seqNr      uint16
+	ackNr      uint16
+	inflight   []*outPacket
+	curWindow  int
+	maxWindow  float64
+	peerWindow int
+	replyMicro uint32
+	delays     delayHistory
+	lastAck    uint16
+	dupAcks    int
+	lastLoss   time.Time
+
+	rtt      time.Duration
+	rttVar   time.Duration
+	rto      time.Duration
+	timeouts int
+
+	readBuf []byte
+	reorder map[uint16]*packet
+	eof     bool
+
+	localClosed bool
+	closedAt    time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(socket *Socket, remote net.Addr, recvId, sendId uint16) *Conn {
+	return &Conn{
+		socket:      socket,
+		remote:      remote,
+		recvId:      recvId,
+		sendId:      sendId,
+		established: make(chan struct{}),
+		done:        make(chan struct{}),
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+		maxWindow:   minWindowSize,
+		peerWindow:  recvWindow,
+		rto:         initialRTO,
+		reorder:     make(map[uint16]*packet),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is signalled, the connection fails or the deadline
+// passes. It returns false when the deadline has passed.
+func (c *Conn) wait(ch chan struct{}, deadline time.Time) bool {
+	if deadline.IsZero() {
+		select {
+		case <-ch:
+		case <-c.done:
+		}
+		return true
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-c.done:
+	case <-timer.C:
+		return false
+	}
+	return true
+}
+
+// fail terminates the connection with err, c.mu must be held
+func (c *Conn) fail(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.readBuf) > 0 {
+			wasFull := len(c.readBuf) >= recvWindow/2
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			// Let the sender know our window opened again
+			if wasFull && len(c.readBuf) < recvWindow/2 && c.err == nil {
+				c.sendState()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.eof {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.localClosed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		if !c.wait(c.readNotify, deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.mu.Lock()
+		if c.localClosed {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+		size := min(len(b)-written, maxPayload)
+		if c.canSend(size) {
+			payload := append([]byte(nil), b[written:written+size]...)
+			c.sendData(stData, payload)
+			written += size
+			c.mu.Unlock()
+			continue
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+		if !c.wait(c.writeNotify, deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+	}
+	return written, nil
+}
+
+// Close sends a FIN after the pending data, the socket keeps
+// retransmitting in the background until it is acknowledged.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.localClosed {
+		return nil
+	}
+	c.localClosed = true
+	c.closedAt = time.Now()
+	if c.connected && c.err == nil {
+		c.sendData(stFin, nil)
+	}
+	notify(c.readNotify)
+	notify(c.writeNotify)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readNotify)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writeNotify)
+	return nil
+}
+
+// canSend reports whether size more bytes fit in the send window,
+// a single packet is always allowed when nothing is in flight.
+func (c *Conn) canSend(size int) bool {
+	if len(c.inflight) == 0 {
+		return true
+	}
+	window := min(int(c.maxWindow), c.peerWindow)
+	return c.curWindow+size <= window
+}
+
+// sendData queues a packet consuming a sequence number and transmits it
+func (c *Conn) sendData(typ packetType, payload []byte) {
+	op := &outPacket{
+		pkt: &packet{
+			header:  header{typ: typ, seqNr: c.seqNr},
+			payload: payload,
+		},
+		size: len(payload),
+	}
+	c.seqNr++
+	c.inflight = append(c.inflight, op)
+	c.curWindow += op.size
+	c.transmit(op)
+}
+
+func (c *Conn) transmit(op *outPacket) {
+	op.sentAt = time.Now()
+	op.transmissions++
+	c.send(op.pkt)
+}
+
+func (c *Conn) sendState() {
+	c.send(&packet{
+		header: header{typ: stState, seqNr: c.seqNr},
+		sack:   c.selectiveAck(),
+	})
+}
+
+// send fills in the fields that change on every transmission
+func (c *Conn) send(p *packet) {
+	p.connId = c.sendId
+	if p.typ == stSyn {
+		p.connId = c.recvId
+	}
+	p.ackNr = c.ackNr
+	p.timestamp = nowMicro()
+	p.timestampDiff = c.replyMicro
+	p.wndSize = uint32(max(recvWindow-len(c.readBuf), 0))
+	c.socket.send(p, c.remote)
+}
+
+// selectiveAck builds the bitmask of the packets received past ackNr+1,
+// the first bit stands for ackNr+2.
+func (c *Conn) selectiveAck() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+	maxOffset := 0
+	for seq := range c.reorder {
+		maxOffset = max(maxOffset, int(seq-c.ackNr-2))
+	}
+	mask := make([]byte, (maxOffset/32+1)*4)
+	for seq := range c.reorder {
+		offset := int(seq - c.ackNr - 2)
+		mask[offset>>3] |= 1 << (offset & 7)
+	}
+	return mask
+}
+
+// handlePacket processes a packet routed to this connection by the socket
+func (c *Conn) handlePacket(p *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.replyMicro = nowMicro() - p.timestamp
+	if p.timestampDiff != 0 {
+		c.delays.add(p.timestampDiff, now)
+	}
+	c.peerWindow = int(p.wndSize)
+
+	switch p.typ {
+	case stReset:
+		c.fail(errConnReset)
+		return
+	case stSyn:
+		// The initiator didn't get our state packet, send it again
+		if !c.initiator {
+			c.sendState()
+		}
+		return
+	}
+	if !c.connected {
+		if p.typ == stFin {
+			return
+		}
+		c.connected = true
+		c.ackNr = p.seqNr - 1
+		close(c.established)
+	}
+	c.processAck(p, now)
+	if p.typ == stData || p.typ == stFin {
+		c.processData(p)
+		c.sendState()
+	}
+}
+
+func (c *Conn) processAck(p *packet, now time.Time) {
+	acked := 0
+	for len(c.inflight) > 0 && !seqLess(p.ackNr, c.inflight[0].pkt.seqNr) {
+		acked += c.ackPacket(c.inflight[0], now)
+		c.inflight = c.inflight[1:]
+	}
+
+	sacked := 0
+	var highest uint16
+	for i := range len(p.sack) * 8 {
+		if p.sack[i>>3]&(1<<(i&7)) == 0 {
+			continue
+		}
+		seq := p.ackNr + 2 + uint16(i)
+		sacked++
+		highest = seq
+		for j, op := range c.inflight {
+			if op.pkt.seqNr == seq {
+				acked += c.ackPacket(op, now)
+				c.inflight = append(c.inflight[:j], c.inflight[j+1:]...)
+				break
+			}
+		}
+	}
+
+	if acked > 0 {
+		c.timeouts = 0
+		c.dupAcks = 0
+		c.maxWindow = ledbatWindow(c.maxWindow, acked, c.delays.queuing())
+		notify(c.writeNotify)
+	} else if p.typ == stState && p.ackNr == c.lastAck && len(c.inflight) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			c.onLoss(now)
+			c.transmit(c.inflight[0])
+		}
+	}
+	c.lastAck = p.ackNr
+
+	// Three packets received past a hole mean the hole was lost
+	if sacked >= 3 {
+		lost := false
+		for _, op := range c.inflight {
+			if !seqLess(op.pkt.seqNr, highest) {
+				break
+			}
+			if now.Sub(op.sentAt) > c.rtt {
+				lost = true
+				c.transmit(op)
+			}
+		}
+		if lost {
+			c.onLoss(now)
+		}
+	}
+}
+
+// ackPacket removes op from the send window and returns its size
+func (c *Conn) ackPacket(op *outPacket, now time.Time) int {
+	c.curWindow -= op.size
+	if op.transmissions == 1 {
+		c.updateRTT(now.Sub(op.sentAt))
+	}
+	return op.size
+}
+
+// onLoss halves the window, at most once per round trip
+func (c *Conn) onLoss(now time.Time) {
+	if now.Sub(c.lastLoss) < c.rtt {
+		return
+	}
+	c.lastLoss = now
+	c.maxWindow = max(c.maxWindow/2, minWindowSize)
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = min(max(c.rtt+4*c.rttVar, minRTO), maxRTO)
+}
+
+func (c *Conn) processData(p *packet) {
+	if c.eof {
+		return
+	}
+	switch {
+	case p.seqNr == c.ackNr+1:
+		c.deliver(p)
+		for !c.eof {
+			next, ok := c.reorder[c.ackNr+1]
+			if !ok {
+				break
+			}
+			delete(c.reorder, c.ackNr+1)
+			c.deliver(next)
+		}
+	case seqLess(c.ackNr, p.seqNr):
+		if p.seqNr-c.ackNr < reorderLimit {
+			c.reorder[p.seqNr] = p
+		}
+	}
+}
+
+func (c *Conn) deliver(p *packet) {
+	c.ackNr = p.seqNr
+	if p.typ == stFin {
+		c.eof = true
+		clear(c.reorder)
+	} else {
+		c.readBuf = append(c.readBuf, p.payload...)
+	}
+	notify(c.readNotify)
+}
+
+// tick retransmits timed out packets, it is called periodically by the socket
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || len(c.inflight) == 0 {
+		return
+	}
+	if now.Sub(c.inflight[0].sentAt) < c.rto {
+		return
+	}
+	c.timeouts++
+	if c.timeouts > maxTimeouts {
+		c.fail(errConnTimeout)
+		return
+	}
+	c.maxWindow = minWindowSize
+	c.rto = min(2*c.rto, maxRTO)
+	for _, op := range c.inflight {
+		c.transmit(op)
+	}
+}
+
+// finished reports whether the socket can forget about the connection
+func (c *Conn) finished(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return true
+	}
+	if !c.localClosed {
+		return false
+	}
+	return !c.connected || len(c.inflight) == 0 || now.Sub(c.closedAt) > lingerDuration
+}
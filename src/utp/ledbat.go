@@ -0,0 +1,77 @@
+package utp
+
+import "time"
+
+// LEDBAT congestion control (RFC 6817), as used by BEP 29: the window
+// grows while the measured queuing delay stays under the target and
+// shrinks as soon as we start filling up buffers on the path, which makes
+// uTP yield to interactive traffic sharing the same link.
+const (
+	targetDelay         = 100_000 // microseconds
+	maxCwndIncrease     = 3000    // bytes per round trip
+	minWindowSize       = 2 * maxPayload
+	maxWindowSize       = 1 << 20
+	delayHistoryMinutes = 10
+)
+
+// delayHistory tracks the minimum one-way delay seen over the last minutes,
+// the base delay, and the latest sample.
+type delayHistory struct {
+	minutes     [delayHistoryMinutes]uint32
+	filled      int
+	current     int
+	minuteStart time.Time
+	last        uint32
+}
+
+func delayBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func (h *delayHistory) add(sample uint32, now time.Time) {
+	h.last = sample
+	if h.filled == 0 {
+		h.minutes[0] = sample
+		h.filled = 1
+		h.minuteStart = now
+		return
+	}
+	if now.Sub(h.minuteStart) >= time.Minute {
+		h.current = (h.current + 1) % delayHistoryMinutes
+		h.minutes[h.current] = sample
+		h.filled = min(h.filled+1, delayHistoryMinutes)
+		h.minuteStart = now
+		return
+	}
+	if delayBefore(sample, h.minutes[h.current]) {
+		h.minutes[h.current] = sample
+	}
+}
+
+func (h *delayHistory) base() uint32 {
+	base := h.minutes[h.current]
+	for i := range h.filled {
+		if delayBefore(h.minutes[i], base) {
+			base = h.minutes[i]
+		}
+	}
+	return base
+}
+
+// queuing returns the current queuing delay in microseconds
+func (h *delayHistory) queuing() int64 {
+	if h.filled == 0 {
+		return 0
+	}
+	return int64(h.last - h.base())
+}
+
+// ledbatWindow returns the new congestion window after bytesAcked bytes
+// were acknowledged with the given queuing delay.
+func ledbatWindow(window float64, bytesAcked int, queuingDelay int64) float64 {
+	offTarget := float64(targetDelay-queuingDelay) / targetDelay
+	acked := float64(bytesAcked)
+	windowFactor := min(acked, window) / max(window, acked)
+	window += maxCwndIncrease * offTarget * windowFactor
+	return min(max(window, minWindowSize), maxWindowSize)
+}
@@ -0,0 +1,123 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+type packetType uint8
+
+const (
+	// stData carries a payload
+	stData packetType = 0
+	// stFin closes the connection, its sequence number is the last one
+	stFin packetType = 1
+	// stState acknowledges packets without consuming a sequence number
+	stState packetType = 2
+	// stReset forcefully terminates the connection
+	stReset packetType = 3
+	// stSyn initiates a connection
+	stSyn packetType = 4
+)
+
+const (
+	protocolVersion = 1
+	headerSize      = 20
+	// extSelectiveAck is the extension id of the selective ack bitmask
+	extSelectiveAck = 1
+)
+
+// header is the fixed 20 bytes uTP header as described in BEP 29
+type header struct {
+	typ           packetType
+	connId        uint16
+	timestamp     uint32 // microseconds
+	timestampDiff uint32 // microseconds
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+}
+
+type packet struct {
+	header
+	sack    []byte // selective ack bitmask, nil when the extension is absent
+	payload []byte
+}
+
+func (p *packet) serialize() []byte {
+	size := headerSize + len(p.payload)
+	if p.sack != nil {
+		size += 2 + len(p.sack)
+	}
+	buf := make([]byte, size)
+	buf[0] = byte(p.typ)<<4 | protocolVersion
+	if p.sack != nil {
+		buf[1] = extSelectiveAck
+	}
+	binary.BigEndian.PutUint16(buf[2:4], p.connId)
+	binary.BigEndian.PutUint32(buf[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], p.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], p.wndSize)
+	binary.BigEndian.PutUint16(buf[16:18], p.seqNr)
+	binary.BigEndian.PutUint16(buf[18:20], p.ackNr)
+	offset := headerSize
+	if p.sack != nil {
+		buf[offset] = 0 // no further extension
+		buf[offset+1] = byte(len(p.sack))
+		copy(buf[offset+2:], p.sack)
+		offset += 2 + len(p.sack)
+	}
+	copy(buf[offset:], p.payload)
+	return buf
+}
+
+// parsePacket decodes a datagram, the payload is copied so the
+// caller can reuse its buffer.
+func parsePacket(buf []byte) (*packet, error) {
+	if len(buf) < headerSize {
+		return nil, fmt.Errorf("packet too short: %d bytes", len(buf))
+	}
+	if buf[0]&0x0f != protocolVersion {
+		return nil, fmt.Errorf("unsupported uTP version %d", buf[0]&0x0f)
+	}
+	p := &packet{header: header{
+		typ:           packetType(buf[0] >> 4),
+		connId:        binary.BigEndian.Uint16(buf[2:4]),
+		timestamp:     binary.BigEndian.Uint32(buf[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(buf[8:12]),
+		wndSize:       binary.BigEndian.Uint32(buf[12:16]),
+		seqNr:         binary.BigEndian.Uint16(buf[16:18]),
+		ackNr:         binary.BigEndian.Uint16(buf[18:20]),
+	}}
+	if p.typ > stSyn {
+		return nil, fmt.Errorf("unknown packet type %d", p.typ)
+	}
+	extension := buf[1]
+	offset := headerSize
+	for extension != 0 {
+		if offset+2 > len(buf) {
+			return nil, fmt.Errorf("truncated extension header")
+		}
+		next, length := buf[offset], int(buf[offset+1])
+		if offset+2+length > len(buf) {
+			return nil, fmt.Errorf("truncated extension of length %d", length)
+		}
+		if extension == extSelectiveAck {
+			p.sack = append([]byte(nil), buf[offset+2:offset+2+length]...)
+		}
+		extension = next
+		offset += 2 + length
+	}
+	p.payload = append([]byte(nil), buf[offset:]...)
+	return p, nil
+}
+
+// seqLess compares two sequence numbers taking wrapping into account
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func nowMicro() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
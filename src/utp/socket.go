@@ -0,0 +1,244 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	acceptBacklog = 64
+	tickInterval  = 50 * time.Millisecond
+	// A failed read is retried after readRetry, doubled on every failure
+	// in a row up to maxReadRetry. The socket closes after maxReadErrors.
+	readRetry     = 5 * time.Millisecond
+	maxReadRetry  = time.Second
+	maxReadErrors = 16
+)
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes uTP connections over a single UDP socket. It
+// implements net.Listener so inbound connections can be accepted on the
+// same port that is used for dialing.
+type Socket struct {
+	conn      net.PacketConn
+	mu        sync.Mutex
+	conns     map[connKey]*Conn
+	accepted  chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen opens a UDP socket on address, e.g. ":6881"
+func Listen(network, address string) (*Socket, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(conn), nil
+}
+
+// NewSocket runs the uTP protocol over an existing packet connection
+func NewSocket(conn net.PacketConn) *Socket {
+	s := &Socket{
+		conn:     conn,
+		conns:    make(map[connKey]*Conn),
+		accepted: make(chan *Conn, acceptBacklog),
+		closed:   make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// DialTimeout connects to a uTP peer, failing if the handshake doesn't
+// complete within timeout.
+func (s *Socket) DialTimeout(address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.DialContext(ctx, address)
+}
+
+// DialContext connects to address, giving up when ctx is done
+func (s *Socket) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	var key connKey
+	for {
+		key = connKey{addr.String(), uint16(rand.Uint32())}
+		if _, used := s.conns[key]; !used {
+			break
+		}
+	}
+	conn := newConn(s, addr, key.id, key.id+1)
+	conn.initiator = true
+	s.conns[key] = conn
+	s.mu.Unlock()
+
+	conn.mu.Lock()
+	conn.seqNr = 1
+	conn.sendData(stSyn, nil)
+	conn.mu.Unlock()
+
+	select {
+	case <-conn.established:
+		return conn, nil
+	case <-conn.done:
+		conn.mu.Lock()
+		err = conn.err
+		conn.mu.Unlock()
+	case <-ctx.Done():
+		err = ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = os.ErrDeadlineExceeded
+		}
+	case <-s.closed:
+		err = net.ErrClosed
+	}
+	conn.Close()
+	return nil, &net.OpError{Op: "dial", Net: "utp", Addr: addr, Err: err}
+}
+
+// Accept waits for the next inbound connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.accepted:
+		return conn, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close closes the UDP socket and every connection running over it
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+		s.mu.Lock()
+		conns := s.conns
+		s.conns = make(map[connKey]*Conn)
+		s.mu.Unlock()
+		for _, conn := range conns {
+			conn.mu.Lock()
+			conn.fail(net.ErrClosed)
+			conn.mu.Unlock()
+		}
+	})
+	return err
+}
+
+func (s *Socket) send(p *packet, addr net.Addr) {
+	// Losses are recovered by retransmission, errors can be ignored
+	s.conn.WriteTo(p.serialize(), addr)
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 1<<16)
+	failures := 0
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			failures++
+			if errors.Is(err, net.ErrClosed) || failures >= maxReadErrors {
+				s.Close()
+				return
+			}
+			// Errors such as an ICMP port unreachable pass, others
+			// would make the loop spin
+			select {
+			case <-time.After(min(readRetry<<(failures-1), maxReadRetry)):
+			case <-s.closed:
+				return
+			}
+			continue
+		}
+		failures = 0
+		p, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.dispatch(p, addr)
+	}
+}
+
+func (s *Socket) dispatch(p *packet, addr net.Addr) {
+	key := connKey{addr.String(), p.connId}
+	if p.typ == stSyn {
+		key.id = p.connId + 1
+	}
+	s.mu.Lock()
+	conn, ok := s.conns[key]
+	if !ok && p.typ == stSyn {
+		conn = newConn(s, addr, key.id, p.connId)
+		conn.connected = true
+		conn.ackNr = p.seqNr
+		conn.seqNr = uint16(rand.Uint32())
+		close(conn.established)
+		select {
+		case s.accepted <- conn:
+			s.conns[key] = conn
+			ok = true
+		default:
+			// Backlog is full, let the initiator time out
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		if p.typ != stReset && p.typ != stSyn {
+			s.send(&packet{header: header{
+				typ:       stReset,
+				connId:    p.connId,
+				timestamp: nowMicro(),
+				seqNr:     uint16(rand.Uint32()),
+				ackNr:     p.seqNr,
+			}}, addr)
+		}
+		return
+	}
+	conn.handlePacket(p)
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make(map[connKey]*Conn, len(s.conns))
+			for key, conn := range s.conns {
+				conns[key] = conn
+			}
+			s.mu.Unlock()
+			for key, conn := range conns {
+				conn.tick(now)
+				if conn.finished(now) {
+					s.mu.Lock()
+					delete(s.conns, key)
+					s.mu.Unlock()
+					conn.mu.Lock()
+					conn.fail(net.ErrClosed)
+					conn.mu.Unlock()
+				}
+			}
+		}
+	}
+}
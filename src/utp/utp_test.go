@@ -0,0 +1,195 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPacketSerialize(t *testing.T) {
+	sent := &packet{
+		header: header{
+			typ:           stState,
+			connId:        42,
+			timestamp:     1000,
+			timestampDiff: 20,
+			wndSize:       65536,
+			seqNr:         7,
+			ackNr:         65535,
+		},
+		sack:    []byte{0x05, 0, 0, 0},
+		payload: []byte("hello"),
+	}
+	received, err := parsePacket(sent.serialize())
+	if err != nil {
+		t.Fatalf("failed to parse packet: %s", err)
+	}
+	if received.header != sent.header {
+		t.Errorf("got header %+v, expected %+v", received.header, sent.header)
+	}
+	if !bytes.Equal(received.sack, sent.sack) {
+		t.Errorf("got sack %v, expected %v", received.sack, sent.sack)
+	}
+	if !bytes.Equal(received.payload, sent.payload) {
+		t.Errorf("got payload %q, expected %q", received.payload, sent.payload)
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	if !seqLess(1, 2) || seqLess(2, 1) {
+		t.Errorf("wrong ordering of consecutive sequence numbers")
+	}
+	if !seqLess(65535, 0) {
+		t.Errorf("wrong ordering across wrap around")
+	}
+}
+
+// lossyConn drops every nth outgoing datagram
+type lossyConn struct {
+	net.PacketConn
+	n     int64
+	count atomic.Int64
+}
+
+func (l *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if l.count.Add(1)%l.n == 0 {
+		return len(b), nil
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
+
+func transfer(t *testing.T, server, client *Socket, size int) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		buf, _ := io.ReadAll(conn)
+		received <- buf
+	}()
+
+	conn, err := client.DialTimeout(server.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	conn.Close()
+
+	select {
+	case buf := <-received:
+		if !bytes.Equal(buf, data) {
+			t.Errorf("received %d bytes that differ from the %d bytes sent", len(buf), len(data))
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("transfer timed out")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	server, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	transfer(t, server, client, 1<<20)
+}
+
+func TestTransferWithLoss(t *testing.T) {
+	server, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewSocket(&lossyConn{PacketConn: packetConn, n: 17})
+	defer client.Close()
+	transfer(t, server, client, 256*1024)
+}
+
+func TestReadDeadline(t *testing.T) {
+	server, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := client.DialTimeout(server.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	client, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// Nothing speaks uTP on this port
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	if _, err := client.DialTimeout(silent.LocalAddr().String(), 200*time.Millisecond); err == nil {
+		t.Errorf("expected dial to fail")
+	}
+}
+
+// failingConn fails every read
+type failingConn struct {
+	net.PacketConn
+	reads atomic.Int64
+}
+
+func (f *failingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	f.reads.Add(1)
+	return 0, nil, errors.New("read failed")
+}
+
+func TestReadErrorsBackOff(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &failingConn{PacketConn: packetConn}
+	socket := NewSocket(conn)
+	defer socket.Close()
+	time.Sleep(200 * time.Millisecond)
+	if reads := conn.reads.Load(); reads > 10 {
+		t.Errorf("expected failed reads to be retried slower, got %d reads", reads)
+	}
+}
@@ -0,0 +1,323 @@
+"use strict";
+
+// The dashboard follows the events of /events and acts through the
+// JSON-RPC API of the daemon at /rpc
+
+let requestId = 0;
+let selected = "";
+let source = null;
+let torrents = [];
+
+async function call(method, params) {
+  const response = await fetch("rpc", {
+    method: "POST",
+    headers: {"Content-Type": "application/json"},
+    body: JSON.stringify({jsonrpc: "2.0", method, params, id: ++requestId}),
+  });
+  if (!response.ok) {
+    throw new Error(`daemon answered ${response.status} ${response.statusText}`);
+  }
+  const body = await response.json();
+  if (body.error) {
+    throw new Error(body.error.message);
+  }
+  return body.result;
+}
+
+function showError(err) {
+  const box = document.getElementById("error");
+  box.textContent = err ? err.message : "";
+  box.hidden = !err;
+}
+
+// act runs an action and shows its error, the events bring its result
+async function act(action) {
+  try {
+    await action();
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+}
+
+function size(bytes) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return i === 0 ? `${bytes} B` : `${bytes.toFixed(1)} ${units[i]}`;
+}
+
+function speed(bytes) {
+  return bytes > 0 ? `${size(bytes)}/s` : "";
+}
+
+function limit(bytes) {
+  return bytes > 0 ? `${size(bytes)}/s` : "unlimited";
+}
+
+function eta(seconds) {
+  if (seconds < 0) {
+    return "";
+  }
+  const h = Math.floor(seconds / 3600);
+  const m = Math.floor(seconds / 60) % 60;
+  const s = seconds % 60;
+  return h > 0 ? `${h}h ${m}m` : m > 0 ? `${m}m ${s}s` : `${s}s`;
+}
+
+function element(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  if (className) {
+    e.className = className;
+  }
+  return e;
+}
+
+function progressBar(fraction) {
+  const bar = element("span", undefined, "progress");
+  const fill = element("div");
+  fill.style.width = `${(fraction * 100).toFixed(1)}%`;
+  bar.append(fill);
+  return bar;
+}
+
+function button(label, action) {
+  const b = element("button", label);
+  b.addEventListener("click", (event) => {
+    event.stopPropagation();
+    act(action);
+  });
+  return b;
+}
+
+function renderSession(session) {
+  let down = 0;
+  let up = 0;
+  for (const t of torrents) {
+    down += t.download_speed;
+    up += t.upload_speed;
+  }
+  let text = `${session.torrents} torrents, ↓ ${speed(down) || "0 B/s"} of ${limit(session.download_rate)}, ` +
+    `↑ ${speed(up) || "0 B/s"} of ${limit(session.upload_rate)}, port ${session.port}`;
+  if (session.alt_speed) {
+    text += ", alternate limits";
+  }
+  document.getElementById("session").textContent = text;
+}
+
+function renderTorrents() {
+  const body = document.querySelector("#torrents tbody");
+  body.replaceChildren();
+  for (const t of torrents) {
+    const row = element("tr");
+    if (t.info_hash === selected) {
+      row.className = "selected";
+    }
+    row.addEventListener("click", () => select(t.info_hash === selected ? "" : t.info_hash));
+    const state = element("td", t.state, t.error ? "failed" : "");
+    if (t.error) {
+      state.title = t.error;
+    }
+    const progress = element("td");
+    progress.append(progressBar(t.progress), ` ${(t.progress * 100).toFixed(1)}%`);
+    const actions = element("td");
+    if (t.state === "paused" || t.state === "failed" || t.state === "finished") {
+      actions.append(button("Resume", () => call("resume", {info_hash: t.info_hash})));
+    } else {
+      actions.append(button("Pause", () => call("pause", {info_hash: t.info_hash})));
+    }
+    actions.append(" ", button("Remove", async () => {
+      if (confirm(`Remove ${t.name}? Downloaded files are kept.`)) {
+        await call("remove", {info_hash: t.info_hash});
+      }
+    }));
+    row.append(
+      element("td", t.name, "name"),
+      element("td", size(t.size)),
+      progress,
+      state,
+      element("td", speed(t.download_speed)),
+      element("td", speed(t.upload_speed)),
+      element("td", eta(t.eta)),
+      element("td", t.peers),
+      actions,
+    );
+    body.append(row);
+  }
+  document.getElementById("empty").hidden = torrents.length > 0;
+}
+
+function renderDetails(d) {
+  const section = document.getElementById("details");
+  section.hidden = !d;
+  if (!d) {
+    return;
+  }
+  document.getElementById("details-name").textContent = d.name;
+  const info = document.getElementById("details-info");
+  info.replaceChildren();
+  const rows = [
+    ["Info hash", d.info_hash],
+    ["State", d.error ? `${d.state}: ${d.error}` : d.state],
+    ["Verified", `${size(d.completed)} of ${size(d.size)}`],
+    ["Transferred", `${size(d.downloaded)} down, ${size(d.uploaded)} up`],
+    ["Pieces", `${d.piece_count} of ${size(d.piece_length)}`],
+    ["Limits", `${limit(d.download_rate)} down, ${limit(d.upload_rate)} up`],
+  ];
+  for (const [name, value] of rows) {
+    info.append(element("dt", name), element("dd", value));
+  }
+
+  const trackers = document.getElementById("details-trackers");
+  trackers.replaceChildren(...d.trackers.map((t) => element("li", t)));
+  if (d.trackers.length === 0) {
+    trackers.append(element("li", "none"));
+  }
+
+  const files = document.querySelector("#details-files tbody");
+  files.replaceChildren();
+  for (const f of d.files) {
+    const row = element("tr");
+    row.append(element("td", f.path, "name"), element("td", size(f.length)));
+    files.append(row);
+  }
+
+  const peers = document.querySelector("#details-peers tbody");
+  peers.replaceChildren();
+  for (const p of d.peer_list) {
+    const flags = [
+      p.inbound ? "inbound" : "",
+      p.choked ? "choked" : "",
+      p.interested ? "interested" : "",
+      p.snubbed ? "snubbed" : "",
+    ].filter(Boolean).join(", ");
+    const row = element("tr");
+    row.append(
+      element("td", p.address),
+      element("td", p.client),
+      element("td", p.inbound ? "" : p.pieces),
+      element("td", [size(p.downloaded), speed(p.download_rate)].filter(Boolean).join(", ")),
+      element("td", [size(p.uploaded), speed(p.upload_rate)].filter(Boolean).join(", ")),
+      element("td", flags),
+    );
+    peers.append(row);
+  }
+  drawPieces(d);
+}
+
+// drawPieces draws a cell for each piece: green once verified, else blue
+// getting darker with the number of peers having it, grey if none has
+function drawPieces(d) {
+  const canvas = document.getElementById("piece-map");
+  if (d.piece_count === 0) {
+    return;
+  }
+  const width = canvas.clientWidth || 800;
+  const columns = Math.min(d.piece_count, Math.max(1, Math.floor(width / 8)));
+  const cell = width / columns;
+  const rows = Math.ceil(d.piece_count / columns);
+  canvas.width = width;
+  canvas.height = Math.max(1, Math.ceil(rows * cell));
+  const context = canvas.getContext("2d");
+  const pieces = Uint8Array.from(atob(d.pieces || ""), (c) => c.charCodeAt(0));
+  const maxAvailability = d.availability.reduce((a, b) => Math.max(a, b), 1);
+  for (let i = 0; i < d.piece_count; i++) {
+    const done = (pieces[i >> 3] & (0x80 >> (i & 7))) !== 0;
+    const available = d.availability[i] || 0;
+    if (done) {
+      context.fillStyle = "#3a7";
+    } else if (available > 0) {
+      const lightness = 80 - 45 * (available / maxAvailability);
+      context.fillStyle = `hsl(220, 45%, ${lightness}%)`;
+    } else {
+      context.fillStyle = "#ccc";
+    }
+    const x = (i % columns) * cell;
+    const y = Math.floor(i / columns) * cell;
+    context.fillRect(x, y, Math.max(1, cell - 1), Math.max(1, cell - 1));
+  }
+}
+
+// connect follows the events of the session, and those of the selected
+// torrent details
+function connect() {
+  if (source) {
+    source.close();
+  }
+  source = new EventSource(selected ? `events?torrent=${encodeURIComponent(selected)}` : "events");
+  const status = document.getElementById("connection");
+  source.addEventListener("open", () => {
+    status.textContent = "live";
+    status.className = "online";
+  });
+  source.addEventListener("error", () => {
+    status.textContent = "reconnecting";
+    status.className = "offline";
+  });
+  source.addEventListener("torrents", (event) => {
+    const snapshot = JSON.parse(event.data);
+    torrents = snapshot.torrents;
+    renderSession(snapshot.session);
+    renderTorrents();
+  });
+  source.addEventListener("details", (event) => {
+    const details = JSON.parse(event.data);
+    if (!details) {
+      select("");
+      return;
+    }
+    renderDetails(details);
+  });
+}
+
+function select(infoHash) {
+  selected = infoHash;
+  renderTorrents();
+  if (!selected) {
+    renderDetails(null);
+  }
+  connect();
+}
+
+// readTorrent returns the content of a .torrent file in base64, as the
+// data parameter of the add method
+function readTorrent(file) {
+  return new Promise((resolve, reject) => {
+    const reader = new FileReader();
+    reader.onload = () => resolve(reader.result.slice(reader.result.indexOf(",") + 1));
+    reader.onerror = () => reject(reader.error);
+    reader.readAsDataURL(file);
+  });
+}
+
+document.getElementById("add").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const input = document.getElementById("add-url");
+  const url = input.value.trim();
+  if (!url) {
+    return;
+  }
+  act(async () => {
+    await call("add", {url, paused: document.getElementById("add-paused").checked});
+    input.value = "";
+  });
+});
+
+document.getElementById("add-file").addEventListener("change", (event) => {
+  const files = [...event.target.files];
+  event.target.value = "";
+  act(async () => {
+    for (const file of files) {
+      const data = await readTorrent(file);
+      await call("add", {data, paused: document.getElementById("add-paused").checked});
+    }
+  });
+});
+
+connect();
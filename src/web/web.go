@@ -0,0 +1,120 @@
+package web
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/samir-adh/bytetorrent/src/rpc"
+)
+
+//go:embed static
+var static embed.FS
+
+// DefaultInterval is how often the dashboard is updated when no event
+// comes, for the progress and rates
+const DefaultInterval = time.Second
+
+// Snapshot is the data of an update of the dashboard
+type Snapshot struct {
+	Session  rpc.SessionStatus   `json:"session"`
+	Torrents []rpc.TorrentStatus `json:"torrents"`
+}
+
+// Handler serves the dashboard and the Server-Sent Events it is updated
+// from. Its actions go through the JSON-RPC API, expected at rpc.Path of
+// the same host.
+type Handler struct {
+	RPC      *rpc.Server
+	Interval time.Duration // between updates, DefaultInterval when zero
+	mux      *http.ServeMux
+}
+
+func New(server *rpc.Server) *Handler {
+	h := &Handler{RPC: server, mux: http.NewServeMux()}
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	h.mux.Handle("GET /", http.FileServerFS(files))
+	h.mux.HandleFunc("GET /events", h.events)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// events streams a "torrents" event with a Snapshot each time a torrent
+// is added, removed or changes state, and every Interval. With the
+// torrent query parameter, a "details" event also gives the
+// rpc.TorrentDetails of the torrent, null once it is removed.
+func (h *Handler) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	events, unsubscribe := h.RPC.Session.Subscribe()
+	defer unsubscribe()
+	interval := h.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	selected := r.URL.Query().Get("torrent")
+	for {
+		if err := h.send(w, selected); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		case <-events:
+			// A snapshot covers all the events that came meanwhile
+			for len(events) > 0 {
+				<-events
+			}
+		}
+	}
+}
+
+func (h *Handler) send(w http.ResponseWriter, selected string) error {
+	torrents := h.RPC.Session.Torrents()
+	snapshot := Snapshot{
+		Session:  h.RPC.SessionStatus(),
+		Torrents: make([]rpc.TorrentStatus, 0, len(torrents)),
+	}
+	for _, t := range torrents {
+		snapshot.Torrents = append(snapshot.Torrents, h.RPC.Status(t))
+	}
+	if err := writeEvent(w, "torrents", snapshot); err != nil {
+		return err
+	}
+	if selected == "" {
+		return nil
+	}
+	var details *rpc.TorrentDetails
+	if t, err := h.RPC.Find(selected); err == nil {
+		d := h.RPC.Details(t)
+		details = &d
+	}
+	return writeEvent(w, "details", details)
+}
+
+func writeEvent(w http.ResponseWriter, name string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, encoded)
+	return err
+}
@@ -0,0 +1,143 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/samir-adh/bytetorrent/src/log"
+	"github.com/samir-adh/bytetorrent/src/rpc"
+	"github.com/samir-adh/bytetorrent/src/session"
+	"github.com/samir-adh/bytetorrent/src/torrentclient"
+)
+
+func newHandler(t *testing.T) (*Handler, *httptest.Server) {
+	t.Helper()
+	s, err := session.New(session.Config{}, &log.Logger{Verbose: log.LowVerbose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	handler := New(rpc.NewServer(s, torrentclient.Config{DownloadDir: t.TempDir()}))
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return handler, server
+}
+
+// addTorrent adds a paused torrent of data to the session of h, announced
+// to a tracker giving no peer
+func addTorrent(t *testing.T, h *Handler, data []byte) rpc.TorrentStatus {
+	t.Helper()
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bencode.Marshal(w, map[string]any{"interval": 60, "peers": ""})
+	}))
+	t.Cleanup(tracker.Close)
+	hash := sha1.Sum(data)
+	var buffer bytes.Buffer
+	bencode.Marshal(&buffer, map[string]any{
+		"announce": tracker.URL,
+		"info": map[string]any{
+			"name":         "data.bin",
+			"length":       len(data),
+			"piece length": 256,
+			"pieces":       string(hash[:]),
+		},
+	})
+	torrent, err := h.RPC.Add(context.Background(), rpc.AddParams{Data: buffer.Bytes(), Paused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.RPC.Status(torrent)
+}
+
+func TestDashboard(t *testing.T) {
+	_, server := newHandler(t)
+	for path, contains := range map[string]string{
+		"/":          "<title>bytetorrent</title>",
+		"/app.js":    "EventSource",
+		"/style.css": "#piece-map",
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), contains) {
+			t.Errorf("expected %s to be served, got %s", path, resp.Status)
+		}
+	}
+}
+
+// eventReader reads the Server-Sent Events of a stream
+type eventReader struct {
+	t       *testing.T
+	scanner *bufio.Scanner
+}
+
+func (r *eventReader) next(v any) string {
+	r.t.Helper()
+	var name, data string
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		if line == "" {
+			break
+		}
+		if value, ok := strings.CutPrefix(line, "event: "); ok {
+			name = value
+		} else if value, ok := strings.CutPrefix(line, "data: "); ok {
+			data = value
+		}
+	}
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		r.t.Fatalf("invalid %s event %q: %s", name, data, err)
+	}
+	return name
+}
+
+func TestEvents(t *testing.T) {
+	h, server := newHandler(t)
+	// Only the events of the session bring updates
+	h.Interval = time.Hour
+	added := addTorrent(t, h, []byte("dashboard"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events?torrent="+added.InfoHash[:8], nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	events := &eventReader{t: t, scanner: bufio.NewScanner(resp.Body)}
+
+	var snapshot Snapshot
+	if name := events.next(&snapshot); name != "torrents" || len(snapshot.Torrents) != 1 || snapshot.Torrents[0].State != "paused" {
+		t.Fatalf("unexpected %s event %+v", name, snapshot)
+	}
+	var details *rpc.TorrentDetails
+	if name := events.next(&details); name != "details" || details == nil || details.PieceCount != 1 || len(details.Availability) != 1 {
+		t.Fatalf("unexpected %s event %+v", name, details)
+	}
+
+	torrent, _ := h.RPC.Find(added.InfoHash)
+	h.RPC.Remove(torrent.Client.InfoHash, false)
+	if name := events.next(&snapshot); name != "torrents" || len(snapshot.Torrents) != 0 {
+		t.Fatalf("expected the torrent to be removed, got %s event %+v", name, snapshot)
+	}
+	if name := events.next(&details); name != "details" || details != nil {
+		t.Fatalf("expected no details once removed, got %s event %+v", name, details)
+	}
+}
@@ -0,0 +1,278 @@
+package webseed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	pc "github.com/samir-adh/bytetorrent/src/piece"
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+	"github.com/ztrue/tracerr"
+)
+
+type Kind int
+
+const (
+	// UrlSeed serves the files of the torrent (BEP 19, "url-list")
+	UrlSeed Kind = iota
+	// HttpSeed serves pieces through a script (BEP 17, "httpseeds")
+	HttpSeed
+)
+
+// HttpClient is the part of http.Client used to fetch ranges
+type HttpClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// DefaultTimeout is how long a web seed may take to answer, or send
+// nothing in the middle of a body, before the request is abandoned
+const DefaultTimeout = 30 * time.Second
+
+// ErrTimeout is returned when a web seed stalled for longer than its
+// timeout
+var ErrTimeout = errors.New("web seed timed out")
+
+// BusyError is returned when a BEP 17 seed asks us to come back later
+type BusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("web seed busy, retry in %s", e.RetryAfter)
+}
+
+// WebSeed downloads pieces from an HTTP server
+type WebSeed struct {
+	Url     string
+	Kind    Kind
+	Timeout time.Duration // DefaultTimeout when zero
+	torrent *torrentfile.TorrentFile
+	client  HttpClient
+}
+
+func New(seedUrl string, kind Kind, torrent *torrentfile.TorrentFile, client HttpClient) *WebSeed {
+	return &WebSeed{
+		Url:     seedUrl,
+		Kind:    kind,
+		torrent: torrent,
+		client:  client,
+	}
+}
+
+// FromTorrent returns a web seed for every url-list and httpseeds entry
+func FromTorrent(torrent *torrentfile.TorrentFile, client HttpClient) []*WebSeed {
+	var seeds []*WebSeed
+	for _, seedUrl := range torrent.UrlList {
+		seeds = append(seeds, New(seedUrl, UrlSeed, torrent, client))
+	}
+	for _, seedUrl := range torrent.HttpSeeds {
+		seeds = append(seeds, New(seedUrl, HttpSeed, torrent, client))
+	}
+	return seeds
+}
+
+func (ws *WebSeed) String() string {
+	return ws.Url
+}
+
+// Download fetches the data of piece, checking its hash is left to the caller
+func (ws *WebSeed) Download(piece *pc.Piece) (*pc.PieceResult, error) {
+	return ws.DownloadContext(context.Background(), piece)
+}
+
+// DownloadContext is Download with requests canceled when ctx is done
+func (ws *WebSeed) DownloadContext(ctx context.Context, piece *pc.Piece) (*pc.PieceResult, error) {
+	var payload []byte
+	var err error
+	switch ws.Kind {
+	case HttpSeed:
+		payload, err = ws.downloadFromScript(ctx, piece)
+	default:
+		payload, err = ws.downloadFromFiles(ctx, piece)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) != piece.Length {
+		return nil, tracerr.Errorf("web seed sent %d bytes for piece %d of length %d", len(payload), piece.Index, piece.Length)
+	}
+	return &pc.PieceResult{
+		Index:   piece.Index,
+		Payload: payload,
+		State:   pc.Downloaded,
+	}, nil
+}
+
+// downloadFromFiles requests the byte range of every file the piece spans
+func (ws *WebSeed) downloadFromFiles(ctx context.Context, piece *pc.Piece) ([]byte, error) {
+	payload := make([]byte, 0, piece.Length)
+	for _, fileRange := range ws.torrent.PieceFileRanges(piece.Index) {
+		if ws.torrent.Files[fileRange.Index].Padding {
+			payload = append(payload, make([]byte, fileRange.Length)...)
+			continue
+		}
+		data, err := ws.fetchRange(ctx, ws.fileUrl(ws.torrent.Files[fileRange.Index]), fileRange.Start, fileRange.Length)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, data...)
+	}
+	return payload, nil
+}
+
+// fileUrl follows BEP 19: a seed url ending with a slash is a directory
+// the torrent name is appended to, multi-file torrents always are.
+func (ws *WebSeed) fileUrl(file torrentfile.File) string {
+	if !ws.torrent.MultiFile {
+		if strings.HasSuffix(ws.Url, "/") {
+			return ws.Url + url.PathEscape(ws.torrent.Name)
+		}
+		return ws.Url
+	}
+	fileUrl := ws.Url
+	if !strings.HasSuffix(fileUrl, "/") {
+		fileUrl += "/"
+	}
+	fileUrl += url.PathEscape(ws.torrent.Name)
+	for _, component := range file.Path {
+		fileUrl += "/" + url.PathEscape(component)
+	}
+	return fileUrl
+}
+
+func (ws *WebSeed) fetchRange(ctx context.Context, fileUrl string, start int, length int) ([]byte, error) {
+	resp, err := ws.get(ctx, fileUrl, fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if first, ok := rangeStart(resp.Header.Get("Content-Range")); !ok || first != start {
+			return nil, tracerr.Errorf("web seed %s sent the range %q instead of bytes %d-%d",
+				fileUrl, resp.Header.Get("Content-Range"), start, start+length-1)
+		}
+	case http.StatusOK:
+		// The server ignored the range, skip to the part we want
+		if _, err := io.CopyN(io.Discard, resp.Body, int64(start)); err != nil {
+			return nil, tracerr.Wrap(err)
+		}
+	default:
+		return nil, tracerr.Errorf("web seed %s answered %s", fileUrl, resp.Status)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	return data, nil
+}
+
+// get requests rawUrl, with a Range header unless byteRange is empty.
+// The request fails with ErrTimeout once the seed sent nothing for
+// Timeout, a slow seed still sending keeps going.
+func (ws *WebSeed) get(ctx context.Context, rawUrl string, byteRange string) (*http.Response, error) {
+	timeout := ws.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(timeout, func() { cancel(ErrTimeout) })
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err == nil {
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+		var resp *http.Response
+		if resp, err = ws.client.Do(req); err == nil {
+			resp.Body = &stallBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, timer: timer, timeout: timeout}
+			return resp, nil
+		}
+	}
+	timer.Stop()
+	cancel(nil)
+	if errors.Is(context.Cause(ctx), ErrTimeout) {
+		err = ErrTimeout
+	}
+	return nil, tracerr.Wrap(err)
+}
+
+// stallBody pushes back the timeout of a request on every read
+type stallBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (b *stallBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && errors.Is(context.Cause(b.ctx), ErrTimeout) {
+		err = ErrTimeout
+	}
+	return n, err
+}
+
+func (b *stallBody) Close() error {
+	b.timer.Stop()
+	b.cancel(nil)
+	return b.ReadCloser.Close()
+}
+
+// rangeStart returns the first byte of a Content-Range header, as 100
+// for "bytes 100-199/1000"
+func rangeStart(contentRange string) (int, bool) {
+	byteRange, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	first, _, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		return 0, false
+	}
+	start, err := strconv.Atoi(first)
+	return start, err == nil
+}
+
+// downloadFromScript asks a BEP 17 seed for the whole piece
+func (ws *WebSeed) downloadFromScript(ctx context.Context, piece *pc.Piece) ([]byte, error) {
+	separator := "?"
+	if strings.Contains(ws.Url, "?") {
+		separator = "&"
+	}
+	params := url.Values{
+		"info_hash": []string{string(ws.torrent.InfoHash[:])},
+		"piece":     []string{strconv.Itoa(piece.Index)},
+	}
+	resp, err := ws.get(ctx, ws.Url+separator+params.Encode(), "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(piece.Length)+1))
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusServiceUnavailable:
+		// The body holds the number of seconds to wait
+		seconds, err := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil {
+			seconds = 60
+		}
+		return nil, &BusyError{RetryAfter: time.Duration(seconds) * time.Second}
+	default:
+		return nil, tracerr.Errorf("web seed %s answered %s", ws.Url, resp.Status)
+	}
+}
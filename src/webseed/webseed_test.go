@@ -0,0 +1,161 @@
+package webseed
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pc "github.com/samir-adh/bytetorrent/src/piece"
+	"github.com/samir-adh/bytetorrent/src/torrentfile"
+)
+
+// generateTorrent splits data into two files of a multi-file torrent
+func generateTorrent(data []byte, pieceLength int) *torrentfile.TorrentFile {
+	split := len(data) / 3
+	tor := &torrentfile.TorrentFile{
+		Name:        "my dir",
+		PieceLength: pieceLength,
+		Length:      len(data),
+		MultiFile:   true,
+		Files: []torrentfile.File{
+			{Path: []string{"a.bin"}, Length: split, Offset: 0},
+			{Path: []string{"sub", "b c.bin"}, Length: len(data) - split, Offset: split},
+		},
+	}
+	for start := 0; start < len(data); start += pieceLength {
+		end := min(start+pieceLength, len(data))
+		tor.PiecesHash = append(tor.PiecesHash, sha1.Sum(data[start:end]))
+	}
+	return tor
+}
+
+func pieceOf(tor *torrentfile.TorrentFile, index int) *pc.Piece {
+	return &pc.Piece{
+		Index:  index,
+		Hash:   tor.PiecesHash[index],
+		Length: tor.GetPieceLength(index),
+	}
+}
+
+func TestDownloadFromFiles(t *testing.T) {
+	data := bytes.Repeat([]byte("bytetorrent"), 1000)
+	tor := generateTorrent(data, 4096)
+
+	root := t.TempDir()
+	for _, file := range tor.Files {
+		path := filepath.Join(append([]string{root, tor.Name}, file.Path...)...)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		os.WriteFile(path, data[file.Offset:file.Offset+file.Length], 0o644)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(root)))
+	defer server.Close()
+
+	seed := New(server.URL, UrlSeed, tor, server.Client())
+	for index := range tor.PiecesHash {
+		piece := pieceOf(tor, index)
+		result, err := seed.Download(piece)
+		if err != nil {
+			t.Fatalf("failed to download piece %d: %s", index, err)
+		}
+		if !piece.Verify(result.Payload) {
+			t.Errorf("piece %d doesn't match its hash", index)
+		}
+	}
+}
+
+func TestWrongRange(t *testing.T) {
+	data := bytes.Repeat([]byte("bytetorrent"), 1000)
+	tor := generateTorrent(data, 4096)
+	// The server always sends the start of the file
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-4095/"+strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[:4096])
+	}))
+	defer server.Close()
+
+	seed := New(server.URL, UrlSeed, tor, server.Client())
+	if _, err := seed.Download(pieceOf(tor, 0)); err != nil {
+		t.Errorf("failed to download the first piece: %s", err)
+	}
+	if _, err := seed.Download(pieceOf(tor, 1)); err == nil {
+		t.Errorf("expected a range other than the requested one to be refused")
+	}
+}
+
+func TestDownloadFromScript(t *testing.T) {
+	data := bytes.Repeat([]byte("bytetorrent"), 1000)
+	tor := generateTorrent(data, 4096)
+	busy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if busy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("30"))
+			return
+		}
+		if r.URL.Query().Get("info_hash") != string(tor.InfoHash[:]) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		index, _ := strconv.Atoi(r.URL.Query().Get("piece"))
+		start := index * tor.PieceLength
+		w.Write(data[start : start+tor.GetPieceLength(index)])
+	}))
+	defer server.Close()
+
+	seed := New(server.URL+"/seed.php", HttpSeed, tor, server.Client())
+	piece := pieceOf(tor, 2)
+	_, err := seed.Download(piece)
+	var busyError *BusyError
+	if !errors.As(err, &busyError) || busyError.RetryAfter.Seconds() != 30 {
+		t.Fatalf("expected busy error with a 30s delay, got %v", err)
+	}
+
+	busy = false
+	result, err := seed.Download(piece)
+	if err != nil {
+		t.Fatalf("failed to download piece: %s", err)
+	}
+	if !piece.Verify(result.Payload) {
+		t.Errorf("piece doesn't match its hash")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	data := bytes.Repeat([]byte("bytetorrent"), 1000)
+	tor := generateTorrent(data, 4096)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			// The script seed never answers
+			<-release
+			return
+		}
+		// The file seed stalls in the middle of the range
+		w.Header().Set("Content-Range", strings.Replace(r.Header.Get("Range"), "=", " ", 1)+"/"+strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[:100])
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	for _, seed := range []*WebSeed{
+		New(server.URL+"/seed.php", HttpSeed, tor, server.Client()),
+		New(server.URL, UrlSeed, tor, server.Client()),
+	} {
+		seed.Timeout = 50 * time.Millisecond
+		if _, err := seed.Download(pieceOf(tor, 0)); !errors.Is(err, ErrTimeout) {
+			t.Errorf("expected %s seed to time out, got %v", seed.Url, err)
+		}
+	}
+}